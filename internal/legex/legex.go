@@ -1,19 +1,92 @@
 // This file Contains modified code from the Go standard library
 package legex
 
-func (re *Regexp) Get() *Machine {
-	m, ok := matchPool[re.mpool].Get().(*Machine)
-	if !ok {
+// MachineOption configures the execution of a single Machine, it
+// leaves the shared Regexp untouched.
+type MachineOption func(*Machine)
+
+// Longest makes the machine prefer the leftmost-longest match. That
+// is, the machine returns a match that begins as early as possible
+// in the input (leftmost), and among those it chooses a match that
+// is as long as possible.
+func Longest() MachineOption {
+	return func(m *Machine) {
+		m.longest = true
+	}
+}
+
+// MaxPool keeps at most n free threads in the pool of the machine,
+// the threads freed beyond are left to the GC. It defaults to twice
+// the size of the queues, which is as many threads as can be queued.
+func MaxPool(n int) MachineOption {
+	return func(m *Machine) {
+		m.maxPool = n
+	}
+}
+
+// NoRetention makes [Regexp.Put] leave the machine to the GC instead
+// of keeping it for the next [Regexp.Get], e.g. for a machine which
+// grew large on an adversarial input in a long-lived service.
+func NoRetention() MachineOption {
+	return func(m *Machine) {
+		m.noRetain = true
+	}
+}
+
+// RawBytes makes the machine match the bytes of invalid UTF-8 as the
+// runes of the same value, e.g. `\xff` matches the byte 0xff, instead
+// of as utf8.RuneError. The syntax has no other way to tell a byte,
+// so such a byte and the rune U+0080 to U+00FF of its value are one
+// and the same, `ÿ` and `[À-ÿ]` match the bytes 0xff and 0xc0 too.
+// The candidate phase is skipped, since it looks for the UTF-8
+// encoding of the runes.
+func RawBytes() MachineOption {
+	return func(m *Machine) {
+		m.rawBytes = true
+	}
+}
+
+func (re *Regexp) Get(opts ...MachineOption) *Machine {
+	pool := re.machines()
+	m, ok := pool.pools[re.mpool].Get().(*Machine)
+	stats := &pool.stats[re.mpool]
+	stats.inUse.Add(1)
+	if ok {
+		stats.hits.Add(1)
+		stats.retained.Add(-1)
+		stats.retainedBytes.Add(-int64(m.putBytes))
+	} else {
+		// The machines put are either taken or collected by the GC
 		m = new(Machine)
+		stats.misses.Add(1)
+		stats.retained.Store(0)
+		stats.retainedBytes.Store(0)
+	}
+	// Allocate queues if needed.
+	// Or reallocate, for "large" match pool.
+	n := matchSize[re.mpool]
+	if n == 0 { // large pool
+		n = len(re.prog.Inst)
 	}
+
 	m.re = re
-	m.accum = 0
+	m.longest = re.longest
+	m.maxPool, m.noRetain, m.rawBytes = 2*n, false, false
+	for _, opt := range opts {
+		opt(m)
+	}
+	if len(m.pool) > m.maxPool {
+		clear(m.pool[m.maxPool:])
+		m.pool = m.pool[:m.maxPool]
+	}
+	m.cur = Cursor{}
 	m.matched = false
 	m.p = re.prog
 	if cap(m.matchcap) < re.matchcap {
 		m.matchcap = make([]int, re.matchcap)
+		m.matchpos = make([]int64, re.matchcap)
 		for _, t := range m.pool {
-			t.cap = make([]int, re.matchcap)
+			t.cap = make([]int64, re.matchcap)
 		}
 	}
 
@@ -21,13 +94,8 @@ func (re *Regexp) Get() *Machine {
 		t.cap = t.cap[:m.p.NumCap]
 	}
 	m.matchcap = m.matchcap[:m.p.NumCap]
+	m.matchpos = m.matchpos[:m.p.NumCap]
 
-	// Allocate queues if needed.
-	// Or reallocate, for "large" match pool.
-	n := matchSize[re.mpool]
-	if n == 0 { // large pool
-		n = len(re.prog.Inst)
-	}
 	if len(m.q0.sparse) < n {
 		m.q0 = queue{make([]uint32, n), make([]entry, 0, n)}
 		m.q1 = queue{make([]uint32, n), make([]entry, 0, n)}
@@ -39,6 +107,53 @@ func (re *Regexp) Get() *Machine {
 func (re *Regexp) Put(m *Machine) {
 	m.clear(&m.q0)
 	m.clear(&m.q1)
+	// The threads taken out of pool are still referred beyond it
+	clear(m.pool[len(m.pool):cap(m.pool)])
 	m.re, m.p = nil, nil
-	matchPool[re.mpool].Put(m)
+	pool := re.machines()
+	stats := &pool.stats[re.mpool]
+	stats.inUse.Add(-1)
+	if m.noRetain {
+		return
+	}
+	m.putBytes = m.MemoryFootprint()
+	stats.retained.Add(1)
+	stats.retainedBytes.Add(int64(m.putBytes))
+	pool.pools[re.mpool].Put(m)
+}
+
+// PoolStat describes the machines of a pool, the ones retained are
+// estimated since the GC drops them unnoticed until the pool is found
+// empty.
+type PoolStat struct {
+	QueueSize     int   // size of the queues, 0 for the pool of large programs
+	InUse         int64 // machines taken and not put back
+	Retained      int64 // machines put back for reuse
+	RetainedBytes int64 // footprint of the machines retained, see [Machine.MemoryFootprint]
+	Hits          int64 // machines taken from the pool since the start
+	Misses        int64 // machines allocated since the start as the pool was empty
+}
+
+// PoolStats returns the stats of the shared pools of machines, from
+// the one of the smallest queues to the one of the largest, so that
+// the heap in use can be told per size of program, see
+// [Regexp.NumInst].
+func PoolStats() []PoolStat {
+	return sharedPool.Stats()
+}
+
+// Stats is [PoolStats] for the machines of p.
+func (p *Pool) Stats() []PoolStat {
+	stats := make([]PoolStat, len(matchSize))
+	for i := range stats {
+		stats[i] = PoolStat{
+			QueueSize:     matchSize[i],
+			InUse:         p.stats[i].inUse.Load(),
+			Retained:      p.stats[i].retained.Load(),
+			RetainedBytes: p.stats[i].retainedBytes.Load(),
+			Hits:          p.stats[i].hits.Load(),
+			Misses:        p.stats[i].misses.Load(),
+		}
+	}
+	return stats
 }
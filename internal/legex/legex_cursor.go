@@ -0,0 +1,52 @@
+package legex
+
+// Cursor is the position of a [Machine] in the stream it matches.
+// The stream is fed chunk by chunk, the caller keeps the bytes not
+// yet released in a buffer and hands the whole buffer to every
+// Match. Cursor tells which part of that buffer is out of any match
+// and which part has been scanned already.
+//
+//	stream: | released (Base) | Index | Offset | not scanned |
+//	                          ^ buf[0]
+//
+// Positions kept in the threads of a Machine are relative to the
+// stream, so that they survive the release of the bytes in front of
+// the buffer. [Cursor.Rebase] turns them back into positions in buf.
+type Cursor struct {
+	Index  int   // bytes at the front of buf that are out of any match
+	Offset int   // bytes after Index that are scanned already
+	Base   int64 // bytes released since the last reset
+}
+
+// Pos returns the position in buf where the scan resumes.
+func (c *Cursor) Pos() int {
+	return c.Index + c.Offset
+}
+
+// Advance moves n scanned bytes out of any match, they are released
+// by the next [Cursor.Consume].
+func (c *Cursor) Advance(n int) {
+	n = min(n, c.Offset)
+	c.Index += n
+	c.Offset -= n
+}
+
+// Consume releases the bytes before Index and returns how many of
+// them there are, the caller drops them from the front of buf.
+func (c *Cursor) Consume() int {
+	n := c.Index
+	c.Base += int64(n)
+	c.Index = 0
+	return n
+}
+
+// Rebase turns the stream position pos into a position in buf.
+func (c *Cursor) Rebase(pos int64) int {
+	return int(pos - c.Base)
+}
+
+// Stream turns the position pos in buf into a stream position, it
+// is the inverse of [Cursor.Rebase].
+func (c *Cursor) Stream(pos int) int64 {
+	return c.Base + int64(pos)
+}
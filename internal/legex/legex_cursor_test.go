@@ -0,0 +1,96 @@
+package legex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursor  Cursor
+		advance int
+		pos     int
+		consume int
+		want    Cursor
+	}{
+		{"zero", Cursor{}, 0, 0, 0, Cursor{}},
+		{"advance none", Cursor{0, 5, 0}, 0, 5, 0, Cursor{0, 5, 0}},
+		{"advance part", Cursor{0, 5, 0}, 3, 5, 3, Cursor{0, 2, 3}},
+		{"advance all", Cursor{0, 5, 0}, 5, 5, 5, Cursor{0, 0, 5}},
+		{"advance beyond", Cursor{0, 5, 0}, 8, 5, 5, Cursor{0, 0, 5}},
+		{"index kept", Cursor{2, 3, 7}, 1, 5, 3, Cursor{0, 2, 10}},
+		{"index only", Cursor{4, 0, 1}, 2, 4, 4, Cursor{0, 0, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.cursor
+			c.Advance(tt.advance)
+			require.Equal(t, tt.pos, c.Pos())
+			require.Equal(t, tt.consume, c.Consume())
+			require.Equal(t, tt.want, c)
+			require.Equal(t, tt.want.Pos(), c.Pos())
+		})
+	}
+}
+
+func TestCursor_Rebase(t *testing.T) {
+	c := Cursor{Base: 10}
+	require.Equal(t, 0, c.Rebase(10))
+	require.Equal(t, 5, c.Rebase(15))
+	require.Equal(t, -3, c.Rebase(7))
+
+	// The stream position stays put while buf loses its front
+	c.Offset = 6
+	c.Advance(4)
+	c.Consume()
+	require.Equal(t, 1, c.Rebase(15))
+	require.Equal(t, int64(15), c.Stream(1))
+
+	// Stream positions go beyond the range of a 32-bit int
+	c = Cursor{Base: 1 << 33}
+	require.Equal(t, int64(1<<33+5), c.Stream(5))
+	require.Equal(t, 5, c.Rebase(1<<33+5))
+}
+
+func TestMachine_Cursor(t *testing.T) {
+	re, err := Compile("abc")
+	require.NoError(t, err)
+	machine := re.Get()
+	defer re.Put(machine)
+
+	// Nothing live, everything is released
+	index, offset, ok := machine.Match(0, 0, []byte("xyz"))
+	require.False(t, ok)
+	require.Equal(t, 3, index)
+	require.Equal(t, Cursor{0, offset, 3}, machine.Cursor())
+
+	// The bytes before the live thread are released, the rest is
+	// scanned already
+	index, offset, ok = machine.Match(0, 0, []byte("xxab"))
+	require.False(t, ok)
+	require.Equal(t, 2, index)
+	require.Equal(t, 2, offset)
+	require.Equal(t, Cursor{0, 2, 5}, machine.Cursor())
+
+	snapshot := machine.Snapshot()
+	index, offset, ok = machine.Match(0, offset, []byte("abc"))
+	require.True(t, ok)
+	require.Equal(t, 0, index)
+	require.Equal(t, 3, offset)
+	require.Equal(t, Cursor{}, machine.Cursor())
+
+	// Restore brings the released bytes back along with the threads
+	machine.Restore(snapshot)
+	require.Equal(t, Cursor{0, 2, 5}, machine.Cursor())
+	index, offset, ok = machine.Match(0, 2, []byte("abxabc"))
+	require.True(t, ok)
+	require.Equal(t, 3, index)
+	require.Equal(t, 3, offset)
+
+	machine.Match(0, 0, []byte("zab"))
+	require.Equal(t, int64(1), machine.Cursor().Base)
+	machine.Reset()
+	require.Equal(t, Cursor{}, machine.Cursor())
+}
@@ -4,10 +4,33 @@ import (
 	"bytes"
 	"math"
 	"regexp/syntax"
+	"unsafe"
 )
 
 func (m *Machine) Match(index int, offset int, buf []byte) (int, int, bool) {
-	input := &inputBytes{bytes.NewBuffer(buf)}
+	return m.run(&inputBytes{bytes.NewBuffer(buf), m.rawBytes}, len(buf), index, offset, false)
+}
+
+// MatchEnd is like Match, with buf being the end of the input. A
+// match held back by the threads of higher priority waiting for more
+// input is reported, see Machine.settle.
+func (m *Machine) MatchEnd(index int, offset int, buf []byte) (int, int, bool) {
+	return m.run(&inputBytes{bytes.NewBuffer(buf), m.rawBytes}, len(buf), index, offset, true)
+}
+
+// MatchChunks is like Match on the concatenation of chunks, without
+// copying them into one slice. The positions returned run across the
+// chunks, a stream is expected to stick to either Match or
+// MatchChunks since the candidate phase is skipped by the latter.
+func (m *Machine) MatchChunks(index int, offset int, chunks [][]byte) (int, int, bool) {
+	input := newInputChunks(chunks)
+	input.raw = m.rawBytes
+	return m.run(input, input.len(), index, offset, false)
+}
+
+// run matches input of n bytes, see Match.
+func (m *Machine) run(input input, n int, index int, offset int, end bool) (int, int, bool) {
+	m.stats = Stats{}
 	// Machine will continue to match from index+offset, where the previous match stopped
 	//
 	// INFO: If match the full pattern,
@@ -20,26 +43,139 @@ func (m *Machine) Match(index int, offset int, buf []byte) (int, int, bool) {
 	// - content in buf before index will be the out-of-pattern string.
 	// - machine will remember the new index, if the index changed in the next match, the collected match index will be
 	//   decreased by the difference as well.
-	idx, off, ok := m.match(input, index, offset)
+	m.cur.Index, m.cur.Offset = index, offset
+	idx, off, ok := m.match(input, index, offset, end)
 	if !ok {
+		// The bytes before the earliest start of the live threads
+		// and of the match held back can never be part of a match,
+		// they are released at once.
 		shift := math.MaxInt
+		if m.matched {
+			shift = m.cur.Rebase(m.matchpos[0])
+		}
 		for _, e := range m.q0.dense {
 			if e.t != nil {
-				shift = min(shift, e.t.cap[0]-m.accum)
+				shift = min(shift, m.cur.Rebase(e.t.cap[0]))
 			}
 		}
 		if shift == math.MaxInt {
-			m.accum += idx
-			return idx, off, false
+			m.cur.Index, m.cur.Offset = idx, off
+		} else {
+			m.cur.Index, m.cur.Offset = index, n-index
+			m.cur.Advance(shift)
 		}
-		m.accum += shift
-		return index + shift, len(buf) - (index + shift), false
+		return m.cur.Consume(), m.cur.Offset, false
 	}
-	m.accum = 0
-	m.matched = false
+	for k, at := range m.matchpos {
+		m.matchcap[k] = -1
+		if at >= 0 {
+			m.matchcap[k] = m.cur.Rebase(at)
+		}
+	}
+	// Threads left in the queues started before the end of the
+	// match, they are stale once the caller consumes the match.
+	m.Reset()
 	return m.matchcap[0], m.matchcap[1] - m.matchcap[0], true
 }
 
+// Submatches appends to dst the start and end of the groups of the
+// last match, the whole match first, as offsets from its start, -1
+// for a group not part of the match, see [Regexp.SubexpNames].
+func (m *Machine) Submatches(dst []int) []int {
+	for _, at := range m.matchcap {
+		if at >= 0 {
+			at -= m.matchcap[0]
+		}
+		dst = append(dst, at)
+	}
+	return dst
+}
+
+// Reset drops all the mid-pattern progress of m, so the following
+// Match behaves as if m is freshly taken from [Regexp.Get]. The
+// capture of the last match stays untouched.
+func (m *Machine) Reset() {
+	m.clear(&m.q0)
+	m.clear(&m.q1)
+	m.cur = Cursor{}
+	m.matched = false
+}
+
+// Cursor returns the position of m after the last Match, its Base
+// is the bytes released since the last reset.
+func (m *Machine) Cursor() Cursor {
+	return m.cur
+}
+
+// Snapshot is a copy of the mid-pattern progress of a Machine, it
+// can only be restored to a Machine of the same Regexp.
+type Snapshot struct {
+	re      *Regexp
+	entries []snapshotEntry
+	cur     Cursor
+	match   []int64 // captures of the match held back, nil for none
+}
+
+type snapshotEntry struct {
+	pc  uint32
+	cap []int64 // nil for place holders
+}
+
+// Snapshot saves the mid-pattern progress of m, so that the caller
+// can rewind the stream and resume from here with [Machine.Restore].
+func (m *Machine) Snapshot() *Snapshot {
+	s := &Snapshot{re: m.re, cur: m.cur}
+	if m.matched {
+		s.match = append(make([]int64, 0, len(m.matchpos)), m.matchpos...)
+	}
+	s.entries = make([]snapshotEntry, len(m.q0.dense))
+	for i, d := range m.q0.dense {
+		s.entries[i].pc = d.pc
+		if d.t != nil {
+			s.entries[i].cap = append(make([]int64, 0, len(d.t.cap)), d.t.cap...)
+		}
+	}
+	return s
+}
+
+// Restore discards the progress of m and replaces it with s.
+func (m *Machine) Restore(s *Snapshot) {
+	if s.re != m.re {
+		panic("legex: snapshot restored to machine of another regexp")
+	}
+	m.Reset()
+	m.cur = s.cur
+	if s.match != nil {
+		copy(m.matchpos, s.match)
+		m.matched = true
+	}
+	for _, e := range s.entries {
+		j := len(m.q0.dense)
+		m.q0.dense = m.q0.dense[:j+1]
+		m.q0.sparse[e.pc] = uint32(j)
+		d := &m.q0.dense[j]
+		d.pc, d.t = e.pc, nil
+		if e.cap != nil {
+			d.t = m.alloc(&m.p.Inst[e.pc])
+			copy(d.t.cap, e.cap)
+		}
+	}
+}
+
+// Stats holds the execution counters of the last Match, they help
+// to tell which pattern is pathological in production.
+type Stats struct {
+	Steps       int // runes stepped through by the NFA threads
+	MaxQueue    int // maximum number of entries in the run queue
+	Allocs      int // threads allocated since the pool was empty
+	PrefixSkips int // bytes skipped by the candidate scan
+}
+
+// Stats returns the execution counters of the last Match.
+func (m *Machine) Stats() Stats {
+	return m.stats
+}
+
 // A queue is a 'sparse array' holding pending threads of execution.
 // See https://research.swtch.com/2008/03/using-uninitialized-memory-for-fun-and.html
 type queue struct {
@@ -61,7 +197,7 @@ type entry struct {
 // See https://swtch.com/~rsc/regexp/regexp2.html
 type thread struct {
 	inst *syntax.Inst
-	cap  []int
+	cap  []int64 // positions in the stream, see Cursor
 }
 
 // A Machine holds all the state during an NFA simulation for p.
@@ -71,9 +207,39 @@ type Machine struct {
 	q0, q1   queue        // two queues for runq, nextq
 	pool     []*thread    // pool of available threads
 	matched  bool         // whether a match was found
+	longest  bool         // whether to prefer the leftmost-longest match
 	matchcap []int        // capture information for the match
+	matchpos []int64      // captures of the match held back, see settle
+	startcap []int64      // captures of the threads added at the start
+	stats    Stats        // counters of the last Match
+	maxPool  int          // free threads kept in pool at most
+	noRetain bool         // whether Put leaves m to the GC
+	putBytes int          // footprint when put back into the pool
+	rawBytes bool         // whether invalid UTF-8 is matched as bytes
+	cur      Cursor       // position in the stream after the last Match
+}
 
-	accum int
+// MemoryFootprint returns the bytes held by m, its queues along with
+// the threads on them and in its pool.
+func (m *Machine) MemoryFootprint() int {
+	const (
+		threadSize = int(unsafe.Sizeof(thread{}))
+		entrySize  = int(unsafe.Sizeof(entry{}))
+		ptrSize    = int(unsafe.Sizeof(&thread{}))
+		intSize    = int(unsafe.Sizeof(0))
+		posSize    = int(unsafe.Sizeof(int64(0)))
+	)
+	n := int(unsafe.Sizeof(*m)) + intSize*cap(m.matchcap) + posSize*(cap(m.matchpos)+cap(m.startcap)) + ptrSize*cap(m.pool)
+	threads := len(m.pool)
+	for _, q := range []*queue{&m.q0, &m.q1} {
+		n += 4*cap(q.sparse) + entrySize*cap(q.dense)
+		for _, d := range q.dense {
+			if d.t != nil {
+				threads++
+			}
+		}
+	}
+	return n + threads*(threadSize+posSize*cap(m.matchcap))
 }
 
 // alloc allocates a new thread with the given instruction.
@@ -84,8 +250,9 @@ func (m *Machine) alloc(i *syntax.Inst) *thread {
 		t = m.pool[n-1]
 		m.pool = m.pool[:n-1]
 	} else {
+		m.stats.Allocs++
 		t = new(thread)
-		t.cap = make([]int, len(m.matchcap), cap(m.matchcap))
+		t.cap = make([]int64, len(m.matchcap), cap(m.matchcap))
 	}
 	t.inst = i
 	return t
@@ -94,7 +261,19 @@ func (m *Machine) alloc(i *syntax.Inst) *thread {
 // match runs the machine over the input starting at pos.
 // It reports whether a match was found.
 // If so, m.matchcap holds the submatch information.
-func (m *Machine) match(i input, index int, offset int) (int, int, bool) {
+//
+// INFO: Here will derive a change from the std lib. The loop runs
+// through phases, see phase, instead of jumping around: when no
+// thread is live, the scan phase tries to find a full candidate
+// before any thread is added, see scanner. The prefix phase rewinds
+// to its start, so that the weave phase adds the threads that walk
+// through it and the following content.
+//
+// The threads of higher priority than the one reaching a match go on
+// as with the std lib, even across calls: the match is held until
+// they die or end tells that the input ends with i, see settle. So
+// the match does not depend on how the stream is cut into chunks.
+func (m *Machine) match(i input, index int, offset int, end bool) (int, int, bool) {
 	startCond := m.re.cond
 
 	// Start Op is InstFail startCond is ^EmptyOp(0)
@@ -102,142 +281,228 @@ func (m *Machine) match(i input, index int, offset int) (int, int, bool) {
 		return index, offset, false
 	}
 
-	// State reset is not needed since machine can be reused
-	// m.matched = false
-	// for i := range m.matchcap {
-	// 	m.matchcap[i] = -1
-	// }
-
-	// This block is fine
-	runq, nextq := &m.q0, &m.q1
+	// State reset is not needed since machine can be reused, the
+	// threads on m.q0 resume the match where the last one stopped.
+	w := walk{i: i, index: index, offset: offset, end: end, runq: &m.q0, nextq: &m.q1}
+	w.at(index + offset)
+	if offset == 0 {
+		w.flag = newLazyFlag(-1, w.r)
+	} else {
+		w.flag = i.context(index + offset)
+	}
 
-	r, r1 := endOfText, endOfText // nolint: ineffassign
-	width, width1 := 0, 0
-	r, width = i.step(index + offset)
-	if r != endOfText {
-		r1, width1 = i.step(index + offset + width)
+	next := phaseWeave // Already in the middle of matching.
+	if len(w.runq.dense) == 0 {
+		next = phaseScan
+	}
+	for next != phaseDone {
+		switch next {
+		case phaseScan:
+			next = m.scan(&w)
+		case phasePrefix:
+			next = m.prefix(&w)
+		case phaseWeave:
+			next = m.weave(&w)
+		}
 	}
 
-	// Trying to figure out what flag is
-	var flag lazyFlag
-	if offset == 0 {
-		flag = newLazyFlag(-1, r)
-	} else {
-		flag = i.context(index + offset)
-	}
-
-	for {
-		// If the curr queue has no pending threads, then,
-		//
-		// 1. All thread failed
-		// 2. Just start the first match
-		//
-		// Either way, we need to match from the beginning.
-		//
-		// INFO: Here will derive a change from the std lib. when
-		// matching from the beginning, we always try to match the
-		// full prefix before add any thread. So the logic here is
-		// pretty easy, just record the position of the matching
-		// progress against the prefix. If the prefix can be matched,
-		// thread will be added to the queue so that the following
-		// content can be matched.
-		//
-		// WARN: Currently this if branch wont work because onepass
-		// is disabled. `m.re.prefix` is always empty.
-		if len(runq.dense) == 0 {
-			// What is needed here is a offset, which corresponds to
-			// the one in the outie package los, indicating the matched
-			// length from the match start point.
-			//
-			// E.g. with pattern "abc", if the match is "aab", then the
-			// offset is 2. Since it match the "ab".
-
-			// Have match; finished exploring alternatives.
-			if m.matched {
-				break
-			}
+	m.q0, m.q1 = *w.runq, *w.nextq
+	return w.index, w.offset, m.matched && !live(&m.q0)
+}
 
-			// When prefix is already been matched, just goto weave
-			if len(m.re.prefix) == 0 || offset == len(m.re.prefix) {
-				goto weave // time to add some threads
-			}
-			index, offset := m.matchPrefix(i, index, offset)
-			// TODO: advance r, width and r1, width1
-			if offset == len(m.re.prefix) {
-				goto weave // time to add some threads
-			}
+// phase is a step of the loop of Machine.match, each phase returns
+// the one to run next.
+type phase int
 
-			// Dude you are so fucked, not even finish prefix matching. Maybe next time.
-			return index, offset, false
+const (
+	phaseScan   phase = iota // no thread is live, look for a candidate
+	phasePrefix              // rewind to the start of the candidate
+	phaseWeave               // step the threads over one rune
+	phaseDone                // stop, with or without a match
+)
 
-			// INFO: useless block, we dont focus on pos here
-			//
-			// if startCond&syntax.EmptyBeginText != 0 && pos != 0 {
-			// 	// Anchored match, past beginning of text.
-			// 	break
-			// }
-		}
+// walk is the state of Machine.match over its input. What is needed
+// here is a offset, which corresponds to the one in the outie
+// package los, indicating the matched length from the match start
+// point.
+//
+// E.g. with pattern "abc", if the match is "aab", then the offset is
+// 2. Since it match the "ab".
+type walk struct {
+	i             input
+	index, offset int
+	r, r1         rune // rune at index+offset and the one after
+	width, width1 int
+	flag          lazyFlag // empty-width flags before r
+	end           bool     // whether the input ends with i
+	runq, nextq   *queue
+}
 
-	weave: // Already in the middle of matching.
-		if width == 0 {
-			break
-		}
+// at decodes the runes at pos and after.
+func (w *walk) at(pos int) {
+	w.r, w.width = w.i.step(pos)
+	w.r1, w.width1 = endOfText, 0
+	if w.r != endOfText {
+		w.r1, w.width1 = w.i.step(pos + w.width)
+	}
+}
 
-		if !m.matched {
-			// if len(m.matchcap) > 0 {
-			// 	m.matchcap[0] = index + offset
-			// }
-			m.add(runq, uint32(m.p.Start), index+offset, nil, &flag, nil)
-		}
-		flag = newLazyFlag(r, r1)
+// restart moves w to index, where threads start from scratch.
+func (w *walk) restart(index int) {
+	w.index, w.offset = index, 0
+	w.at(index)
+	w.flag = newLazyFlag(-1, w.r)
+}
 
-		m.step(runq, nextq, index+offset, index+offset+width, r, &flag)
-		offset += width
-		if m.matched {
-			// Found a match and not paying attention to where it is, so any match will do.
-			break
+// scan is the phase where all threads failed, or the first match
+// is just started. Either way, we need to match from the beginning,
+// after the candidate, if any, is found.
+func (m *Machine) scan(w *walk) phase {
+	// Have match; finished exploring alternatives.
+	if m.matched {
+		return phaseDone
+	}
+
+	// Without the input as a whole there is no candidate phase, the
+	// threads walk what it has seen instead.
+	if !w.i.canCheckPrefix() {
+		if w.offset > 0 {
+			return phasePrefix
 		}
-		runq, nextq = nextq, runq
+		return phaseWeave
+	}
+	// When the candidate is already seen, time to add some threads
+	scan := m.re.scan
+	if scan == nil || w.offset == scan.size() {
+		return phaseWeave
+	}
+	skip := w.index
+	w.index, w.offset = scan.next(w.i.inner(), w.index)
+	m.stats.PrefixSkips += w.index - skip
+	if w.offset != scan.size() {
+		// Not even finish the candidate. Maybe next time.
+		return phaseDone
+	}
+	return phasePrefix
+}
+
+// prefix is the phase where the candidate is there, it rewinds to
+// its start so the threads added at weave walk through it as well.
+func (m *Machine) prefix(w *walk) phase {
+	w.restart(w.index)
+	return phaseWeave
+}
+
+// weave is the phase where the threads step over the rune at
+// w.index+w.offset, a new thread starts there unless a match is
+// found already.
+func (m *Machine) weave(w *walk) phase {
+	if w.width == 0 {
+		m.settle(w.runq, w.index+w.offset, w.end)
+		return phaseDone
+	}
+
+	pos := w.index + w.offset
+	if !m.matched {
+		m.add(w.runq, uint32(m.p.Start), pos, m.start(pos), &w.flag, nil)
+	}
+	w.flag = newLazyFlag(w.r, w.r1)
+
+	m.stats.Steps++
+	m.stats.MaxQueue = max(m.stats.MaxQueue, len(w.runq.dense))
+	m.step(w.runq, w.nextq, pos, pos+w.width, w.r, &w.flag)
+	w.offset += w.width
+	w.runq, w.nextq = w.nextq, w.runq
+	if m.matched && !live(w.runq) {
+		// Found a match and no thread is left to override it.
+		return phaseDone
+	}
+
+	if len(w.runq.dense) == 0 {
+		w.restart(w.index + w.offset)
+		return phaseScan
+	}
 
-		if len(runq.dense) == 0 {
-			index, offset = index+offset, 0
-			r, width = i.step(index)
-			if r != endOfText {
-				r1, width1 = i.step(index + width)
+	w.r, w.width = w.r1, w.width1
+	if w.r != endOfText {
+		w.r1, w.width1 = w.i.step(w.index + w.offset + w.width)
+	}
+	return phaseWeave
+}
+
+// settle fires the threads on q reaching InstMatch at pos, the end of
+// the input, as the step over the next rune would. In first-match
+// mode a thread of higher priority still waiting for more input
+// stops it, the threads behind fire once that one dies. When end
+// tells that no more input follows, the threads waiting for it die
+// at once.
+func (m *Machine) settle(q *queue, pos int, end bool) {
+	for j := range q.dense {
+		d := &q.dense[j]
+		switch t := d.t; {
+		case t == nil:
+		case t.inst.Op == syntax.InstMatch:
+			m.record(t.cap, pos)
+			if !m.longest {
+				m.clear(q)
+				return
 			}
-			flag = newLazyFlag(-1, r)
-			// m.add(runq, uint32(m.p.Start), index, m.matchcap, &flag, nil)
-			continue
+			m.free(t)
+			d.t = nil
+		case end:
+			m.free(t)
+			d.t = nil
+		case !m.longest:
+			return
 		}
+	}
+}
+
+// record keeps the captures of a thread reaching InstMatch at pos as
+// the match, unless a longer one is kept in longest mode. They stay
+// stream positions until the match is reported, see Machine.run.
+func (m *Machine) record(cap []int64, pos int) {
+	end := m.cur.Stream(pos)
+	if m.longest && m.matched && m.matchpos[1] >= end {
+		return
+	}
+	copy(m.matchpos, cap)
+	m.matchpos[1] = end
+	m.matched = true
+}
 
-		r, width = r1, width1
-		if r != endOfText {
-			r1, width1 = i.step(index + offset + width)
+// live reports whether a thread is left on q, not only place holders.
+func live(q *queue) bool {
+	for _, d := range q.dense {
+		if d.t != nil {
+			return true
 		}
 	}
+	return false
+}
 
-	m.q0, m.q1 = *runq, *nextq
-	return index, offset, m.matched
+// start returns the captures of a thread starting at pos, where no
+// group is matched yet.
+func (m *Machine) start(pos int) []int64 {
+	m.startcap = append(m.startcap[:0], m.cur.Stream(pos))
+	for range len(m.matchcap) - 1 {
+		m.startcap = append(m.startcap, -1)
+	}
+	return m.startcap
 }
 
-func (m *Machine) matchPrefix(i input, index int, offset int) (int, int) {
-	n0, n1 := len(m.re.prefix), len(i.inner())
-	i0, i1 := offset, index+offset
-	for i0 < n0 && i1 < n1 {
-		if m.re.prefix[i0] != i.inner()[i1] {
-			i0, i1 = 0, i1+1
-			continue
-		}
-		i0, i1 = i0+1, i1+1
+// free puts t back into the pool of m, unless the pool is full.
+func (m *Machine) free(t *thread) {
+	if len(m.pool) < m.maxPool {
+		m.pool = append(m.pool, t)
 	}
-	return i1 - i0, i0
 }
 
 // clear frees all threads on the thread queue.
 func (m *Machine) clear(q *queue) {
 	for _, d := range q.dense {
 		if d.t != nil {
-			m.pool = append(m.pool, d.t)
+			m.free(d.t)
 		}
 	}
 	q.dense = q.dense[:0]
@@ -249,7 +514,7 @@ func (m *Machine) clear(q *queue) {
 // which starts at position pos and ends at nextPos.
 // nextCond gives the setting for the empty-width flags after c.
 func (m *Machine) step(runq, nextq *queue, pos, nextPos int, c rune, nextCond *lazyFlag) {
-	longest := m.re.longest
+	longest := m.longest
 	for j := 0; j < len(runq.dense); j++ {
 		d := &runq.dense[j]
 		t := d.t
@@ -258,8 +523,8 @@ func (m *Machine) step(runq, nextq *queue, pos, nextPos int, c rune, nextCond *l
 		}
 
 		// TODO: Delete this block [Longest Not Planned]
-		if longest && m.matched && len(t.cap) > 0 && m.matchcap[0] < t.cap[0] {
-			m.pool = append(m.pool, t)
+		if longest && m.matched && len(t.cap) > 0 && m.matchpos[0] < t.cap[0] {
+			m.free(t)
 			continue
 		}
 
@@ -269,21 +534,19 @@ func (m *Machine) step(runq, nextq *queue, pos, nextPos int, c rune, nextCond *l
 		default:
 			panic("bad inst")
 
-		// case syntax.InstMatch:
-		// 	if len(t.cap) > 0 && (!longest || !m.matched || m.matchcap[1] < pos) {
-		// 		t.cap[1] = pos
-		// 		copy(m.matchcap, t.cap)
-		// 	}
-		// 	if !longest {
-		// 		// First-match mode: cut off all lower-priority threads.
-		// 		for _, d := range runq.dense[j+1:] {
-		// 			if d.t != nil {
-		// 				m.pool = append(m.pool, d.t)
-		// 			}
-		// 		}
-		// 		runq.dense = runq.dense[:0]
-		// 	}
-		// 	m.matched = true
+		case syntax.InstMatch:
+			// The captures are only trusted from t.cap, which are
+			// positions in the stream.
+			m.record(t.cap, pos)
+			if !longest {
+				// First-match mode: cut off all lower-priority threads.
+				for _, d := range runq.dense[j+1:] {
+					if d.t != nil {
+						m.free(d.t)
+					}
+				}
+				runq.dense = runq.dense[:0]
+			}
 
 		case syntax.InstRune:
 			add = i.MatchRune(c)
@@ -298,7 +561,7 @@ func (m *Machine) step(runq, nextq *queue, pos, nextPos int, c rune, nextCond *l
 			t = m.add(nextq, i.Out, nextPos, t.cap, nextCond, t)
 		}
 		if t != nil {
-			m.pool = append(m.pool, t)
+			m.free(t)
 		}
 	}
 	runq.dense = runq.dense[:0]
@@ -308,7 +571,7 @@ func (m *Machine) step(runq, nextq *queue, pos, nextPos int, c rune, nextCond *l
 // It also recursively adds an entry for all instructions reachable from pc by following
 // empty-width conditions satisfied by cond.  pos gives the current position
 // in the input.
-func (m *Machine) add(q *queue, pc uint32, pos int, cap []int, cond *lazyFlag, t *thread) *thread {
+func (m *Machine) add(q *queue, pc uint32, pos int, cap []int64, cond *lazyFlag, t *thread) *thread {
 again:
 	if pc == 0 {
 		return t
@@ -345,35 +608,18 @@ again:
 	case syntax.InstCapture:
 		if int(i.Arg) < len(cap) {
 			opos := cap[i.Arg]
-			cap[i.Arg] = pos
+			cap[i.Arg] = m.cur.Stream(pos)
 			m.add(q, i.Out, pos, cap, cond, nil)
 			cap[i.Arg] = opos
 		} else {
 			pc = i.Out
 			goto again
 		}
-	case syntax.InstMatch:
-		longest := m.re.longest
-		// TODO: Delete the condition after '&&' since I do not want to support Longest here
-		if len(t.cap) > 0 && (!longest || !m.matched || m.matchcap[1] < pos) {
-			t.cap[0], t.cap[1] = t.cap[0]-m.accum, pos
-			copy(m.matchcap, t.cap)
-		}
-		if !longest {
-			// First-match mode: cut off all lower-priority threads.
-			for _, d := range q.dense[j+1:] {
-				if d.t != nil {
-					m.pool = append(m.pool, d.t)
-				}
-			}
-			q.dense = q.dense[:0]
-		}
-		m.matched = true
-
-	case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+	case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+		// A thread reaching InstMatch is fired by the next step, so
+		// that the threads of higher priority step first, see settle.
 		if t == nil {
 			t = m.alloc(i)
-			t.cap[0] = pos + m.accum
 			copy(t.cap, cap)
 		} else {
 			t.inst = i
@@ -1,7 +1,12 @@
 package legex
 
 import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,6 +62,31 @@ func TestMachine_Match_Base(t *testing.T) {
 				{3, 0, false}, // "def" - no match, adcance all
 			},
 		},
+		{
+			name:   "empty match",
+			expr:   "x*",
+			inputs: []string{"ab"},
+			expected: []struct {
+				index  int
+				offset int
+				ok     bool
+			}{
+				{0, 0, true}, // "ab" - empty match before "a"
+			},
+		},
+		{
+			name:   "match reached after the thread moved on",
+			expr:   "a+",
+			inputs: []string{"x", "aab"},
+			expected: []struct {
+				index  int
+				offset int
+				ok     bool
+			}{
+				{1, 0, false}, // "x" - no match
+				{0, 2, true},  // "aab" - greedy "aa", the "a" thread has priority
+			},
+		},
 		{
 			name: "long stream with multiple keyword matches",
 			expr: "error|warn|info",
@@ -150,8 +180,8 @@ func TestMachine_Match_Wildcard(t *testing.T) {
 				offset int
 				ok     bool
 			}{
-				{0, 3, true},  // "abc" - matches "abc" (.* matches empty)
-				{3, 0, false}, // "xyz" - no match
+				{0, 3, false}, // "abc" - ".*" may still reach a later "c"
+				{0, 3, true},  // "xyz" - it does not, "abc" is the match
 			},
 		},
 		{
@@ -163,8 +193,8 @@ func TestMachine_Match_Wildcard(t *testing.T) {
 				offset int
 				ok     bool
 			}{
-				{0, 6, true},  // "ab123c" - matches "ab.*c"
-				{3, 0, false}, // "def" - no match
+				{0, 6, false}, // "ab123c" - ".*" may still reach a later "c"
+				{0, 6, true},  // "def" - it does not, "ab123c" is the match
 			},
 		},
 		{
@@ -203,7 +233,11 @@ func TestMachine_Match_Wildcard(t *testing.T) {
 			for i, inputStr := range tt.inputs {
 				input = append(input, []byte(inputStr)...)
 
-				idx, off, ok := machine.Match(index, offset, input)
+				match := machine.Match
+				if i == len(tt.inputs)-1 {
+					match = machine.MatchEnd
+				}
+				idx, off, ok := match(index, offset, input)
 				expected := tt.expected[i]
 				assert.Equal(t, expected, struct {
 					index  int
@@ -220,3 +254,629 @@ func TestMachine_Match_Wildcard(t *testing.T) {
 		})
 	}
 }
+
+func TestMachine_PrefixRewind(t *testing.T) {
+	re, err := Compile("^abc")
+	require.NoError(t, err)
+
+	machine := re.Get()
+	defer re.Put(machine)
+
+	// The threads start at the prefix found, not where the scan began
+	idx, off, ok := machine.Match(0, 0, []byte("xxabc"))
+	require.Equal(t, []any{2, 3, true}, []any{idx, off, ok})
+	stats := machine.Stats()
+	assert.Equal(t, 2, stats.PrefixSkips)
+	assert.Equal(t, 3, stats.Steps)
+}
+
+func TestMachine_Stats(t *testing.T) {
+	re, err := Compile("^abc")
+	require.NoError(t, err)
+
+	machine := re.Get()
+	defer re.Put(machine)
+
+	_, _, ok := machine.Match(0, 0, []byte("abc"))
+	require.True(t, ok)
+	stats := machine.Stats()
+	assert.Equal(t, 0, stats.PrefixSkips)
+	assert.Equal(t, 3, stats.Steps)
+	assert.Equal(t, 2, stats.MaxQueue) // "^" placeholder and the thread on "a"
+
+	_, _, ok = machine.Match(0, 0, []byte("zzz"))
+	require.False(t, ok)
+	assert.Equal(t, Stats{PrefixSkips: 3}, machine.Stats())
+}
+
+func TestMachine_Reset(t *testing.T) {
+	re, err := Compile("ab.*c")
+	require.NoError(t, err)
+
+	machine := re.Get()
+	defer re.Put(machine)
+
+	idx, off, ok := machine.Match(0, 0, []byte("xxab"))
+	require.Equal(t, []any{2, 2, false}, []any{idx, off, ok})
+
+	machine.Reset()
+	idx, off, ok = machine.Match(0, 0, []byte("c"))
+	require.Equal(t, []any{1, 0, false}, []any{idx, off, ok})
+}
+
+func TestMachine_SnapshotRestore(t *testing.T) {
+	re, err := Compile("[a-z]+114514")
+	require.NoError(t, err)
+
+	machine := re.Get()
+	defer re.Put(machine)
+
+	idx, off, ok := machine.Match(0, 0, []byte("ABCD abcd1"))
+	require.Equal(t, []any{5, 5, false}, []any{idx, off, ok})
+	snapshot := machine.Snapshot()
+
+	input := []byte("abcd114514")
+	idx, off, ok = machine.Match(0, 5, input)
+	require.Equal(t, []any{0, 10, true}, []any{idx, off, ok})
+
+	// Rewind the stream and replay the very same input
+	machine.Restore(snapshot)
+	idx, off, ok = machine.Match(0, 5, input)
+	require.Equal(t, []any{0, 10, true}, []any{idx, off, ok})
+
+	// Replay with a different continuation
+	machine.Restore(snapshot)
+	idx, off, ok = machine.Match(0, 5, []byte("abcd1!"))
+	require.Equal(t, []any{6, 0, false}, []any{idx, off, ok})
+
+	other := MustCompile("abc").Get()
+	require.Panics(t, func() { other.Restore(snapshot) })
+}
+
+func TestMachine_Longest(t *testing.T) {
+	re := MustCompile("a|ab")
+	posix := MustCompilePOSIX("a|ab")
+
+	var wg sync.WaitGroup
+	for _, tt := range []struct {
+		re   *Regexp
+		opts []MachineOption
+		want bool
+		off  int
+	}{
+		{re, nil, false, 1},
+		{re, []MachineOption{Longest()}, true, 2},
+		{posix, nil, true, 2},
+	} {
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				machine := tt.re.Get(tt.opts...)
+				defer tt.re.Put(machine)
+
+				assert.Equal(t, tt.want, machine.longest)
+				idx, off, ok := machine.Match(0, 0, []byte("xabx"))
+				assert.Equal(t, []any{1, tt.off, true}, []any{idx, off, ok})
+			}()
+		}
+	}
+	wg.Wait()
+	require.False(t, re.longest)
+}
+
+func TestRegexp_Prog(t *testing.T) {
+	re := MustCompile("a+b")
+	require.Equal(t, strings.Count(re.Prog(), "\n"), re.NumInst())
+	require.Contains(t, re.Prog(), "match")
+
+	// The machines of larger programs are taken from larger pools
+	large := MustCompile("(a|b|c|d|e|f|g|h){60}")
+	require.Greater(t, large.NumInst(), matchSize[0])
+	require.Greater(t, large.mpool, re.mpool)
+}
+
+func TestMachine_RequiredPrefix(t *testing.T) {
+	re := MustCompile(`</tool_call\s*>`)
+	prefix, complete := re.LiteralPrefix()
+	require.Equal(t, "</tool_call", prefix)
+	require.False(t, complete)
+
+	machine := re.Get()
+	defer re.Put(machine)
+
+	// The threads only run from the prefix on, a partial prefix at
+	// the end of the input is resumed by the next Match.
+	buf := []byte("some text </tool")
+	index, offset, ok := machine.Match(0, 0, buf)
+	require.False(t, ok)
+	require.Equal(t, 10, index)
+	require.Equal(t, 6, offset)
+	assert.Equal(t, Stats{PrefixSkips: 10}, machine.Stats())
+
+	buf = append(buf[index:], "_call  >"...)
+	index, offset, ok = machine.Match(0, offset, buf)
+	require.True(t, ok)
+	require.Equal(t, 0, index)
+	require.Equal(t, len(buf), offset)
+
+	// Overlapping occurrences of the prefix are not missed
+	re = MustCompile(`aab\d+`)
+	machine2 := re.Get()
+	defer re.Put(machine2)
+	index, offset, ok = machine2.MatchEnd(0, 0, []byte("aaab1"))
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 4, offset)
+}
+
+func TestMachine_CandidateScan(t *testing.T) {
+	scan := prefixScanner("abc")
+	tests := []struct {
+		buf         string
+		pos         int
+		start, seen int
+	}{
+		{"xxabcx", 0, 2, 3},
+		{"abcabc", 1, 3, 3},
+		{"xxxab", 0, 3, 2}, // partial candidate at the end
+		{"xxxab", 4, 5, 0},
+		{"xxx", 0, 3, 0},
+	}
+	for _, tt := range tests {
+		start, seen := scan.next([]byte(tt.buf), tt.pos)
+		assert.Equal(t, tt.start, start, tt.buf)
+		assert.Equal(t, tt.seen, seen, tt.buf)
+	}
+
+	// The candidate phase resumes once the threads of a candidate die
+	re := MustCompile(`ab\d`)
+	machine := re.Get()
+	defer re.Put(machine)
+	index, offset, ok := machine.Match(0, 0, []byte("ab?xxab7"))
+	require.True(t, ok)
+	require.Equal(t, 5, index)
+	require.Equal(t, 3, offset)
+	assert.Equal(t, 2, machine.Stats().PrefixSkips) // "xx"
+}
+
+func TestMachine_ByteClassScan(t *testing.T) {
+	tests := []struct {
+		expr  string
+		bytes string // empty if there is no byte class scan
+	}{
+		{`[<&]\w+;?`, "&<"},
+		{`</(?:a|b)>|\n`, "\n<"},
+		{`(?i)x\d`, "Xx"},
+		{`(?i)k`, ""}, // folds with the Kelvin sign
+		{`x*y`, "xy"},
+		{`x*`, ""},
+		{`.x`, ""},
+		{`é`, ""},
+	}
+	for _, tt := range tests {
+		re := MustCompile(tt.expr)
+		class, ok := re.scan.(*byteClassScanner)
+		if tt.bytes == "" {
+			assert.False(t, ok, tt.expr)
+			continue
+		}
+		require.True(t, ok, tt.expr)
+		var bytes []byte
+		for b, in := range class.table {
+			if in {
+				bytes = append(bytes, byte(b))
+			}
+		}
+		assert.Equal(t, tt.bytes, string(bytes), tt.expr)
+	}
+
+	re := MustCompile(`[<&]\w+;`)
+	machine := re.Get()
+	defer re.Put(machine)
+	index, offset, ok := machine.Match(0, 0, []byte("a < b &amp; c"))
+	require.True(t, ok)
+	require.Equal(t, 6, index)
+	require.Equal(t, 5, offset)
+	assert.Positive(t, machine.Stats().PrefixSkips)
+}
+
+func TestMachine_MaxPool(t *testing.T) {
+	re := MustCompile(`(a|b)*c`)
+
+	machine := re.Get(MaxPool(2))
+	_, _, ok := machine.Match(0, 0, []byte("ababababc"))
+	require.True(t, ok)
+	machine.Reset()
+	require.LessOrEqual(t, len(machine.pool), 2)
+	re.Put(machine)
+
+	// A machine left to the GC is never taken again
+	machine = re.Get(NoRetention())
+	re.Put(machine)
+	for range 4 {
+		other := re.Get()
+		require.NotSame(t, machine, other)
+		require.Equal(t, 2*matchSize[re.mpool], other.maxPool)
+		defer re.Put(other)
+	}
+}
+
+func TestMachine_MemoryFootprint(t *testing.T) {
+	re := MustCompile(`(a|b|c|d|e|f|g|h){400}`)
+	before := PoolStats()[re.mpool]
+
+	machine := re.Get(MaxPool(0))
+	empty := machine.MemoryFootprint()
+	require.Positive(t, empty)
+	_, _, ok := machine.Match(0, 0, []byte(strings.Repeat("abc", 50)))
+	require.False(t, ok)
+	require.Greater(t, machine.MemoryFootprint(), empty) // threads allocated
+	require.Equal(t, before.InUse+1, PoolStats()[re.mpool].InUse)
+
+	re.Put(machine)
+	after := PoolStats()[re.mpool]
+	require.Equal(t, before.InUse, after.InUse)
+	require.Equal(t, int64(1), after.Retained)
+	require.Equal(t, int64(machine.putBytes), after.RetainedBytes)
+}
+
+func TestMachine_MatchChunks(t *testing.T) {
+	// Every chunk boundary of the input is tried, including the ones
+	// splitting a rune and the ones between the bytes of \b.
+	input := "x </tool_call  > &amp; héé; foo; été! <tool> &lt ÉTÉ!"
+	exprs := []string{`</tool_call\s*>`, `é+;`, `\bfoo\b;`, `[<&]\w+;`, `(?i)été!`}
+
+	// drop releases n bytes from the front of chunks
+	drop := func(chunks [][]byte, n int) [][]byte {
+		for n > 0 && len(chunks) > 0 {
+			k := min(n, len(chunks[0]))
+			chunks[0], n = chunks[0][k:], n-k
+			if len(chunks[0]) == 0 {
+				chunks = chunks[1:]
+			}
+		}
+		return chunks
+	}
+	type found struct{ at, size int }
+
+	for _, expr := range exprs {
+		re := MustCompile(expr)
+		var want []found
+		for _, loc := range regexp.MustCompile(expr).FindAllStringIndex(input, -1) {
+			want = append(want, found{loc[0], loc[1] - loc[0]})
+		}
+		require.NotEmpty(t, want, expr)
+
+		// All the chunks at once, boundaries within a rune are stepped
+		// across by the threads.
+		for size := 1; size <= 4; size++ {
+			var chunks [][]byte
+			for i := 0; i < len(input); i += size {
+				chunks = append(chunks, []byte(input[i:min(i+size, len(input))]))
+			}
+			machine := re.Get()
+			var got []found
+			base := 0
+			for {
+				index, n, ok := machine.MatchChunks(0, 0, chunks)
+				if !ok {
+					break
+				}
+				got = append(got, found{base + index, n})
+				chunks, base = drop(chunks, index+n), base+index+n
+			}
+			re.Put(machine)
+			require.Equal(t, want, got, "%s in chunks of %d", expr, size)
+		}
+
+		// One rune a time, the bytes not released are kept as chunks
+		machine := re.Get()
+		var chunks [][]byte
+		var got []found
+		base, offset := 0, 0
+		for _, r := range input {
+			chunks = append(chunks, utf8.AppendRune(nil, r))
+			for {
+				index, n, ok := machine.MatchChunks(0, offset, chunks)
+				if !ok {
+					chunks, base, offset = drop(chunks, index), base+index, n
+					break
+				}
+				got = append(got, found{base + index, n})
+				chunks, base, offset = drop(chunks, index+n), base+index+n, 0
+			}
+		}
+		re.Put(machine)
+		require.Equal(t, want, got, "%s rune by rune", expr)
+	}
+}
+
+func TestMachine_InputChunks(t *testing.T) {
+	input := newInputChunks([][]byte{[]byte("a\xc3"), nil, []byte("\xa9"), []byte("b")})
+	require.Equal(t, 4, input.len())
+
+	r, width := input.step(1)
+	require.Equal(t, 'é', r)
+	require.Equal(t, 2, width)
+	r, width = input.step(3)
+	require.Equal(t, 'b', r)
+	require.Equal(t, 1, width)
+	r, width = input.step(0)
+	require.Equal(t, 'a', r)
+	require.Equal(t, 1, width)
+	r, width = input.step(4)
+	require.Equal(t, endOfText, r)
+	require.Equal(t, 0, width)
+
+	require.Equal(t, newLazyFlag('é', 'b'), input.context(3))
+	require.Equal(t, newLazyFlag(-1, 'a'), input.context(0))
+	require.Equal(t, newLazyFlag('b', -1), input.context(4))
+}
+
+func TestMachine_RawBytes(t *testing.T) {
+	re := MustCompile(`\xff+;`)
+	input := []byte("a\xff\xff;b")
+
+	machine := re.Get()
+	_, _, ok := machine.Match(0, 0, input)
+	require.False(t, ok) // utf8.RuneError is not 'ÿ'
+	re.Put(machine)
+
+	machine = re.Get(RawBytes())
+	index, offset, ok := machine.Match(0, 0, input)
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 3, offset)
+	index, offset, ok = machine.MatchChunks(0, 0, [][]byte{input[:2], input[2:]})
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 3, offset)
+	re.Put(machine)
+
+	// The option does not outlive the machine taken
+	machine = re.Get()
+	defer re.Put(machine)
+	_, _, ok = machine.Match(0, 0, input)
+	require.False(t, ok)
+
+	// Valid runes, U+FFFD included, are decoded as usual
+	re = MustCompile(`ÿ\x{fffd}`)
+	raw := re.Get(RawBytes())
+	defer re.Put(raw)
+	index, offset, ok = raw.Match(0, 0, []byte("\xffÿ\xef\xbf\xbd"))
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 5, offset)
+
+	// A byte is the Latin-1 rune of its value, the syntax tells no
+	// other way to match it
+	re = MustCompile(`[À-ÿ]+;`)
+	raw = re.Get(RawBytes())
+	defer re.Put(raw)
+	index, offset, ok = raw.Match(0, 0, []byte("a\xc0é\xff;"))
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 5, offset)
+	index, offset, ok = raw.MatchChunks(0, 0, [][]byte{[]byte("a\xc0\xc3"), []byte("\xa9\xff;")})
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 5, offset)
+}
+
+func TestRegexp_Limits(t *testing.T) {
+	limits := Limits{MaxInst: 64, MaxRepeat: 10}
+	_, err := limits.Compile(`</tool_call\s*>`)
+	require.NoError(t, err)
+	_, err = limits.CompilePOSIX(`a{2,10}`)
+	require.NoError(t, err)
+
+	_, err = limits.Compile(`a{2,11}`)
+	require.ErrorIs(t, err, ErrPatternTooComplex)
+	_, err = limits.Compile(`a{11,}`)
+	require.ErrorIs(t, err, ErrPatternTooComplex)
+	_, err = limits.Compile(`(a{10}){10}`)
+	require.ErrorIs(t, err, ErrPatternTooComplex)
+
+	// A zero field leaves its bound out
+	_, err = Limits{}.Compile(`(a{10}){10}`)
+	require.NoError(t, err)
+}
+
+func TestRegexp_WithPool(t *testing.T) {
+	shared := MustCompile(`a+b`)
+	pool := NewPool()
+	re := shared.WithPool(pool)
+	require.Equal(t, shared.String(), re.String())
+	before := PoolStats()[re.mpool]
+
+	machine := re.Get()
+	index, offset, ok := machine.Match(0, 0, []byte("xaab"))
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+	require.Equal(t, 3, offset)
+	require.Equal(t, int64(1), pool.Stats()[re.mpool].InUse)
+	re.Put(machine)
+
+	stats := pool.Stats()[re.mpool]
+	require.Equal(t, int64(0), stats.InUse)
+	require.Equal(t, int64(1), stats.Retained)
+	require.Equal(t, int64(1), stats.Misses)
+	require.Equal(t, before, PoolStats()[re.mpool]) // the shared pool is untouched
+
+	// The copy left with the shared pool keeps using it
+	machine = shared.Get()
+	require.Equal(t, before.InUse+1, PoolStats()[re.mpool].InUse)
+	shared.Put(machine)
+}
+
+func TestMachine_Submatches(t *testing.T) {
+	re := MustCompile(`<(?P<tag>\w+)(?: (\w+))?(x)?>`)
+	machine := re.Get()
+	defer re.Put(machine)
+
+	index, offset, ok := machine.Match(0, 0, []byte("ab<code go>"))
+	require.True(t, ok)
+	require.Equal(t, 2, index)
+	require.Equal(t, 9, offset)
+	require.Equal(t, []int{0, 9, 1, 5, 6, 8, -1, -1}, machine.Submatches(nil))
+	require.Equal(t, []string{"", "tag", "", ""}, re.SubexpNames())
+
+	// The groups are kept across the chunks and the bytes released
+	buf := []byte("xx<co")
+	index, offset, ok = machine.Match(0, 0, buf)
+	require.False(t, ok)
+	buf = append(buf[index:], "de>"...)
+	index, offset, ok = machine.Match(0, offset, buf)
+	require.True(t, ok)
+	require.Equal(t, 0, index)
+	require.Equal(t, 6, offset)
+	require.Equal(t, []int{0, 6, 1, 5, -1, -1, -1, -1}, machine.Submatches(nil))
+}
+
+func TestMachine_Priority(t *testing.T) {
+	tests := []struct {
+		expr, buf     string
+		index, offset int
+	}{
+		{`(a|ab)(c|bcd)`, "xabcd", 1, 4}, // not "abc" of the lower branch
+		{`<k*`, "<kkk>", 0, 4},
+		{`<k*?`, "<kkk>", 0, 1},
+		{`a+`, "aab", 0, 2},
+		{`a|ab`, "abx", 0, 1},
+	}
+	for _, tt := range tests {
+		re := MustCompile(tt.expr)
+		machine := re.Get()
+		index, offset, ok := machine.Match(0, 0, []byte(tt.buf))
+		require.True(t, ok, tt.expr)
+		require.Equal(t, [2]int{tt.index, tt.offset}, [2]int{index, offset}, tt.expr)
+		re.Put(machine)
+	}
+
+	// The match is held while the threads of higher priority wait for
+	// more input, however the input is cut into chunks
+	for _, tt := range []struct {
+		expr          string
+		chunks        []string
+		index, offset int
+	}{
+		{`<k*`, []string{"x<k", "kk>y</z"}, 0, 4},
+		{`<k*`, []string{"x<", "k", "k", "k>"}, 0, 4},
+		{`(a|ab)(c|bcd)`, []string{"xabc", "d"}, 0, 4},
+		{`(a|ab)(c|bcd)`, []string{"xab", "cx"}, 0, 3},
+	} {
+		re := MustCompile(tt.expr)
+		machine := re.Get()
+		var buf []byte
+		var index, offset int
+		var ok bool
+		for _, chunk := range tt.chunks {
+			require.False(t, ok, tt.expr)
+			buf = append(buf[index:], chunk...)
+			index, offset, ok = machine.Match(0, offset, buf)
+		}
+		require.True(t, ok, tt.expr)
+		require.Equal(t, [2]int{tt.index, tt.offset}, [2]int{index, offset}, tt.expr)
+		re.Put(machine)
+	}
+
+	// The end of the input settles the match at once
+	re := MustCompile(`<k*`)
+	machine := re.Get()
+	defer re.Put(machine)
+	index, offset, ok := machine.Match(0, 0, []byte("x<kk"))
+	require.False(t, ok)
+	require.Equal(t, [2]int{1, 3}, [2]int{index, offset})
+	index, offset, ok = machine.MatchEnd(0, offset, []byte("<kk"))
+	require.True(t, ok)
+	require.Equal(t, [2]int{0, 3}, [2]int{index, offset})
+}
+
+func TestMachine_Phases(t *testing.T) {
+	re := MustCompile(`ab\d`)
+	machine := re.Get()
+	defer re.Put(machine)
+	start := func(buf string, index, offset int, raw bool) *walk {
+		machine.Reset()
+		w := &walk{i: &inputBytes{bytes.NewBuffer([]byte(buf)), raw}, index: index, offset: offset,
+			runq: &machine.q0, nextq: &machine.q1}
+		w.at(index + offset)
+		w.flag = newLazyFlag(-1, w.r)
+		return w
+	}
+
+	t.Run("scan", func(t *testing.T) {
+		// The candidate is found, its start is rewound to
+		w := start("xxab7", 0, 0, false)
+		require.Equal(t, phasePrefix, machine.scan(w))
+		require.Equal(t, [2]int{2, 2}, [2]int{w.index, w.offset})
+		// Part of the candidate ends the input
+		w = start("xxxa", 0, 0, false)
+		require.Equal(t, phaseDone, machine.scan(w))
+		require.Equal(t, [2]int{3, 1}, [2]int{w.index, w.offset})
+		// The candidate is already seen
+		w = start("ab7", 0, 2, false)
+		require.Equal(t, phaseWeave, machine.scan(w))
+		require.Equal(t, [2]int{0, 2}, [2]int{w.index, w.offset})
+		// No candidate phase without the input as a whole
+		require.Equal(t, phaseWeave, machine.scan(start("xab7", 0, 0, true)))
+		require.Equal(t, phasePrefix, machine.scan(start("xab7", 1, 1, true)))
+		// A match ends the loop
+		w = start("ab7", 0, 0, false)
+		machine.matched = true
+		require.Equal(t, phaseDone, machine.scan(w))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		w := start("xab7", 1, 2, false)
+		require.Equal(t, phaseWeave, machine.prefix(w))
+		require.Equal(t, [2]int{1, 0}, [2]int{w.index, w.offset})
+		require.Equal(t, [2]rune{'a', 'b'}, [2]rune{w.r, w.r1})
+	})
+
+	t.Run("weave", func(t *testing.T) {
+		w := start("ab7", 0, 0, false)
+		for _, offset := range []int{1, 2, 3} {
+			require.Equal(t, phaseWeave, machine.weave(w))
+			require.Equal(t, offset, w.offset)
+			require.NotEmpty(t, w.runq.dense)
+		}
+		// The thread reaching the match is settled at the end
+		require.False(t, machine.matched)
+		require.Equal(t, phaseDone, machine.weave(w))
+		require.True(t, machine.matched)
+		require.Equal(t, []int64{0, 3}, machine.matchpos[:2])
+
+		// The threads die, the scan resumes after what they walked
+		w = start("ax", 0, 0, false)
+		require.Equal(t, phaseWeave, machine.weave(w))
+		require.Equal(t, phaseScan, machine.weave(w))
+		require.Equal(t, [2]int{2, 0}, [2]int{w.index, w.offset})
+		require.Empty(t, w.runq.dense)
+
+		// The end of the input ends the loop
+		w = start("a", 0, 1, false)
+		steps := machine.Stats().Steps
+		require.Equal(t, phaseDone, machine.weave(w))
+		require.Equal(t, steps, machine.Stats().Steps)
+	})
+}
+
+func BenchmarkMachine_Match(b *testing.B) {
+	text := []byte(strings.Repeat("lorem ipsum <x> dolor sit amet ", 64) + "<code go>")
+	for _, expr := range []string{`<code \w+>`, `[<&]\w+ \w+>`, `\w+ \w+>`} {
+		b.Run(expr, func(b *testing.B) {
+			re := MustCompile(expr)
+			machine := re.Get()
+			defer re.Put(machine)
+			b.SetBytes(int64(len(text)))
+			for b.Loop() {
+				// Split the text in two chunks to resume mid-pattern
+				index, offset, _ := machine.Match(0, 0, text[:len(text)-4])
+				machine.Match(index, offset, text)
+				machine.Reset()
+			}
+		})
+	}
+}
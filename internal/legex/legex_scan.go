@@ -0,0 +1,145 @@
+package legex
+
+import (
+	"bytes"
+	"regexp/syntax"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Machine runs in two phases, the candidate phase skips the input
+// where no match can start without running any thread, the threads
+// are only added from a candidate on, to verify it. Once the threads
+// of a candidate all die, the candidate phase resumes from there.
+//
+// A scanner implements the candidate phase of a Regexp.
+type scanner interface {
+	// next looks for the first candidate in buf from pos. It returns
+	// the start of the candidate and the bytes of it that are seen,
+	// which is size if found, or the part of the candidate buf ends
+	// with. The part is scanned again by the next call, so that the
+	// state of the phase is resumed across chunks by the offset of
+	// the caller.
+	next(buf []byte, pos int) (start, seen int)
+	// size returns the bytes a candidate is made of.
+	size() int
+}
+
+// newScanner picks the scanner of re, if any.
+func newScanner(re *Regexp) scanner {
+	if len(re.prefixBytes) > 0 {
+		return prefixScanner(re.prefixBytes)
+	}
+	if class, ok := firstBytes(re.prog); ok {
+		return class
+	}
+	return nil
+}
+
+// prefixScanner finds the literal prefix every match starts with.
+type prefixScanner []byte
+
+func (p prefixScanner) next(buf []byte, pos int) (int, int) {
+	buf = buf[pos:]
+	if i := bytes.Index(buf, p); i >= 0 {
+		return pos + i, len(p)
+	}
+	for k := min(len(p)-1, len(buf)); k > 0; k-- {
+		if bytes.HasPrefix(p, buf[len(buf)-k:]) {
+			return pos + len(buf) - k, k
+		}
+	}
+	return pos + len(buf), 0
+}
+
+func (p prefixScanner) size() int {
+	return len(p)
+}
+
+// byteClassScanner finds the bytes a match may start with, e.g. the
+// '<' and '&' of "[<&]\w+;?", over the whole input at once instead of
+// stepping the threads rune by rune.
+type byteClassScanner struct {
+	table [256]bool
+	n     int  // bytes in table
+	only  byte // the byte of table if n is 1, for bytes.IndexByte
+}
+
+func (c *byteClassScanner) next(buf []byte, pos int) (int, int) {
+	if c.n == 1 {
+		if i := bytes.IndexByte(buf[pos:], c.only); i >= 0 {
+			return pos + i, 1
+		}
+		return len(buf), 0
+	}
+	for i := pos; i < len(buf); i++ {
+		if c.table[buf[i]] {
+			return i, 1
+		}
+	}
+	return len(buf), 0
+}
+
+func (c *byteClassScanner) size() int {
+	return 1
+}
+
+// firstBytes collects the bytes the matches of prog may start with,
+// it reports false if any byte may, or if a match may be empty.
+func firstBytes(prog *syntax.Prog) (*byteClassScanner, bool) {
+	class := &byteClassScanner{}
+	seen := make([]bool, len(prog.Inst))
+	var walk func(pc uint32) bool
+	walk = func(pc uint32) bool {
+		if seen[pc] {
+			return true
+		}
+		seen[pc] = true
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			return walk(inst.Out) && walk(inst.Arg)
+		case syntax.InstCapture, syntax.InstNop, syntax.InstEmptyWidth:
+			return walk(inst.Out)
+		case syntax.InstFail:
+			return true
+		case syntax.InstRune, syntax.InstRune1:
+			return class.add(inst.Rune, syntax.Flags(inst.Arg)&syntax.FoldCase != 0)
+		default: // InstMatch, InstRuneAny, InstRuneAnyNotNL
+			return false
+		}
+	}
+	if !walk(uint32(prog.Start)) {
+		return nil, false
+	}
+	for b, ok := range class.table {
+		if ok {
+			class.n, class.only = class.n+1, byte(b)
+		}
+	}
+	return class, true
+}
+
+// add adds the runes of ranges to the class, along with their case
+// variants if fold is set. It reports false for the runes encoded in
+// more than a byte, which are not taken so far.
+func (c *byteClassScanner) add(ranges []rune, fold bool) bool {
+	if len(ranges) == 1 {
+		ranges = []rune{ranges[0], ranges[0]}
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i+1] >= utf8.RuneSelf {
+			return false
+		}
+		for r := ranges[i]; r <= ranges[i+1]; r++ {
+			c.table[r] = true
+			for f := unicode.SimpleFold(r); fold && f != r; f = unicode.SimpleFold(f) {
+				if f >= utf8.RuneSelf {
+					return false
+				}
+				c.table[f] = true
+			}
+		}
+	}
+	return true
+}
@@ -2,16 +2,19 @@ package legex
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"regexp/syntax"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"unicode/utf8"
 )
 
 // Regexp is the representation of a compiled regular expression.
-// A Regexp is safe for concurrent use by multiple goroutines,
-// except for configuration methods, such as [Regexp.Longest].
+// A Regexp is safe for concurrent use by multiple goroutines, the
+// execution options such as [Longest] are given to each [Machine].
 type Regexp struct {
 	expr           string       // as passed to Compile
 	prog           *syntax.Prog // compiled program
@@ -24,14 +27,13 @@ type Regexp struct {
 	prefixRune     rune           // first rune in prefix
 	prefixEnd      uint32         // pc for last rune in prefix
 	mpool          int            // pool for machines
+	pool           *Pool          // see WithPool, nil for the shared one
 	matchcap       int            // size of recorded match lengths
 	prefixComplete bool           // prefix is the entire regexp
 	cond           syntax.EmptyOp // empty-width conditions required at start of match
 	minInputLen    int            // minimum length of the input in bytes
-
-	// This field can be modified by the Longest method,
-	// but it is otherwise read-only.
-	longest bool // whether regexp prefers leftmost-longest match
+	longest        bool           // default of the machines, set by CompilePOSIX
+	scan           scanner        // candidate phase of the machines, or nil
 }
 
 // String returns the source text used to compile the regular expression.
@@ -40,13 +42,10 @@ func (re *Regexp) String() string {
 }
 
 // Copy returns a new [Regexp] object copied from re.
-// Calling [Regexp.Longest] on one copy does not affect another.
 //
 // Deprecated: In earlier releases, when using a [Regexp] in multiple goroutines,
 // giving each goroutine its own copy helped to avoid lock contention.
 // As of Go 1.12, using Copy is no longer necessary to avoid lock contention.
-// Copy may still be appropriate if the reason for its use is to make
-// two copies with different [Regexp.Longest] settings.
 func (re *Regexp) Copy() *Regexp {
 	re2 := *re
 	return &re2
@@ -63,7 +62,7 @@ func (re *Regexp) Copy() *Regexp {
 // package implements it without the expense of backtracking.
 // For POSIX leftmost-longest matching, see [CompilePOSIX].
 func Compile(expr string) (*Regexp, error) {
-	return compile(expr, syntax.Perl, false)
+	return compile(expr, syntax.Perl, false, Limits{})
 }
 
 // CompilePOSIX is like [Compile] but restricts the regular expression
@@ -86,24 +85,55 @@ func Compile(expr string) (*Regexp, error) {
 // The POSIX rule is computationally prohibitive and not even well-defined.
 // See https://swtch.com/~rsc/regexp/regexp2.html#posix for details.
 func CompilePOSIX(expr string) (*Regexp, error) {
-	return compile(expr, syntax.POSIX, true)
+	return compile(expr, syntax.POSIX, true, Limits{})
 }
 
-// Longest makes future searches prefer the leftmost-longest match.
-// That is, when matching against text, the regexp returns a match that
-// begins as early as possible in the input (leftmost), and among those
-// it chooses a match that is as long as possible.
-// This method modifies the [Regexp] and may not be called concurrently
-// with any other methods.
-func (re *Regexp) Longest() {
-	re.longest = true
+// ErrPatternTooComplex is matched by the errors of the expressions
+// too large or nested too deeply to be compiled.
+var ErrPatternTooComplex = errors.New("legex: pattern too complex")
+
+// Limits bounds the program compiled from an expression, e.g. one
+// supplied by an untrusted user. A zero field leaves its bound out,
+// an expression beyond the bounds fails with ErrPatternTooComplex.
+type Limits struct {
+	MaxInst   int // instructions of the compiled program
+	MaxRepeat int // count of a repetition, e.g. 100 of a{2,100}
 }
 
-func compile(expr string, mode syntax.Flags, longest bool) (*Regexp, error) {
+// Compile is like [Compile] within the limits l.
+func (l Limits) Compile(expr string) (*Regexp, error) {
+	return compile(expr, syntax.Perl, false, l)
+}
+
+// CompilePOSIX is like [CompilePOSIX] within the limits l.
+func (l Limits) CompilePOSIX(expr string) (*Regexp, error) {
+	return compile(expr, syntax.POSIX, true, l)
+}
+
+// repeat returns the largest count of the repetitions of re.
+func repeat(re *syntax.Regexp) int {
+	n := 0
+	if re.Op == syntax.OpRepeat {
+		n = max(re.Min, re.Max)
+	}
+	for _, sub := range re.Sub {
+		n = max(n, repeat(sub))
+	}
+	return n
+}
+
+func compile(expr string, mode syntax.Flags, longest bool, limits Limits) (*Regexp, error) {
 	re, err := syntax.Parse(expr, mode)
+	if err, ok := err.(*syntax.Error); ok &&
+		(err.Code == syntax.ErrLarge || err.Code == syntax.ErrNestingDepth) {
+		return nil, fmt.Errorf("%w: %w", ErrPatternTooComplex, err)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if n := repeat(re); limits.MaxRepeat > 0 && n > limits.MaxRepeat {
+		return nil, fmt.Errorf("%w: repeat count %d exceeds %d", ErrPatternTooComplex, n, limits.MaxRepeat)
+	}
 	maxCap := re.MaxCap()
 	capNames := re.CapNames()
 
@@ -112,6 +142,9 @@ func compile(expr string, mode syntax.Flags, longest bool) (*Regexp, error) {
 	if err != nil {
 		return nil, err
 	}
+	if n := len(prog.Inst); limits.MaxInst > 0 && n > limits.MaxInst {
+		return nil, fmt.Errorf("%w: program of %d instructions exceeds %d", ErrPatternTooComplex, n, limits.MaxInst)
+	}
 	matchcap := prog.NumCap
 	if matchcap < 2 {
 		matchcap = 2
@@ -128,7 +161,9 @@ func compile(expr string, mode syntax.Flags, longest bool) (*Regexp, error) {
 		minInputLen: minInputLen(re),
 	}
 	if regexp.onepass == nil {
-		// 	regexp.prefix, regexp.prefixComplete = prog.Prefix()
+		// The literal every match starts with, e.g. "</tool_call" of
+		// "</tool_call\s*>", is scanned for before the threads run.
+		regexp.prefix, regexp.prefixComplete = prog.Prefix()
 		// 	regexp.maxBitStateLen = maxBitStateLen(prog)
 	} else {
 		regexp.prefix, regexp.prefixComplete, regexp.prefixEnd = onePassPrefix(prog)
@@ -139,6 +174,7 @@ func compile(expr string, mode syntax.Flags, longest bool) (*Regexp, error) {
 		regexp.prefixBytes = []byte(regexp.prefix)
 		regexp.prefixRune, _ = utf8.DecodeRuneInString(regexp.prefix)
 	}
+	regexp.scan = newScanner(regexp)
 
 	n := len(prog.Inst)
 	i := 0
@@ -152,14 +188,45 @@ func compile(expr string, mode syntax.Flags, longest bool) (*Regexp, error) {
 
 // Pools of *machine for use during (*Regexp).doExecute,
 // split up by the size of the execution queues.
-// matchPool[i] machines have queue size matchSize[i].
+// Pool.pools[i] machines have queue size matchSize[i].
 // On a 64-bit system each queue entry is 16 bytes,
-// so matchPool[0] has 16*2*128 = 4kB queues, etc.
-// The final matchPool is a catch-all for very large queues.
-var (
-	matchSize = [...]int{128, 512, 2048, 16384, 0}
-	matchPool [len(matchSize)]sync.Pool
-)
+// so Pool.pools[0] has 16*2*128 = 4kB queues, etc.
+// The final pool is a catch-all for very large queues.
+var matchSize = [...]int{128, 512, 2048, 16384, 0}
+
+// Pool keeps the machines put back by the regexps it is given to,
+// apart from those of the other pools, see [Regexp.WithPool]. The
+// regexps given none share a package-wide pool.
+type Pool struct {
+	pools [len(matchSize)]sync.Pool
+	stats [len(matchSize)]struct {
+		inUse, retained, retainedBytes atomic.Int64
+		hits, misses                   atomic.Int64
+	}
+}
+
+var sharedPool Pool
+
+func NewPool() *Pool {
+	return new(Pool)
+}
+
+// WithPool returns a copy of re whose machines are taken from and
+// put back into p, e.g. so that the machines of the patterns of one
+// tenant neither evict nor grow the ones of the others.
+func (re *Regexp) WithPool(p *Pool) *Regexp {
+	re = re.Copy()
+	re.pool = p
+	return re
+}
+
+// machines returns the pool of the machines of re.
+func (re *Regexp) machines() *Pool {
+	if re.pool != nil {
+		return re.pool
+	}
+	return &sharedPool
+}
 
 // minInputLen walks the regexp to find the minimum length of any matchable input.
 func minInputLen(re *syntax.Regexp) int {
@@ -230,6 +297,19 @@ func quote(s string) string {
 	return strconv.Quote(s)
 }
 
+// Prog returns a dump of the instructions of the compiled program,
+// one per line, with the start instruction marked by a '*'.
+func (re *Regexp) Prog() string {
+	return re.prog.String()
+}
+
+// NumInst returns the number of instructions of the compiled program,
+// which decides the size of the queues of its machines and so the
+// pool they are taken from, see [Regexp.Get].
+func (re *Regexp) NumInst() int {
+	return len(re.prog.Inst)
+}
+
 // NumSubexp returns the number of parenthesized subexpressions in this [Regexp].
 func (re *Regexp) NumSubexp() int {
 	return re.numSubexp
@@ -283,6 +363,7 @@ type input interface {
 // inputBytes scans a byte slice.
 type inputBytes struct {
 	str *bytes.Buffer
+	raw bool // see RawBytes
 }
 
 func (i *inputBytes) step(pos int) (rune, int) {
@@ -291,7 +372,7 @@ func (i *inputBytes) step(pos int) (rune, int) {
 		if c < utf8.RuneSelf {
 			return rune(c), 1
 		}
-		return utf8.DecodeRune(i.str.Bytes()[pos:])
+		return decodeRune(i.str.Bytes()[pos:], i.raw)
 	}
 	return endOfText, 0
 }
@@ -301,7 +382,7 @@ func (i *inputBytes) inner() []byte {
 }
 
 func (i *inputBytes) canCheckPrefix() bool {
-	return true
+	return !i.raw
 }
 
 func (i *inputBytes) hasPrefix(re *Regexp) bool {
@@ -319,19 +400,131 @@ func (i *inputBytes) context(pos int) lazyFlag {
 	if uint(pos-1) < uint(i.str.Len()) {
 		r1 = rune(i.str.Bytes()[pos-1])
 		if r1 >= utf8.RuneSelf {
-			r1, _ = utf8.DecodeLastRune(i.str.Bytes()[:pos])
+			r1 = decodeLastRune(i.str.Bytes()[:pos], i.raw)
 		}
 	}
 	// 0 <= pos && pos < len(i.str)
 	if uint(pos) < uint(i.str.Len()) {
 		r2 = rune(i.str.Bytes()[pos])
 		if r2 >= utf8.RuneSelf {
-			r2, _ = utf8.DecodeRune(i.str.Bytes()[pos:])
+			r2, _ = decodeRune(i.str.Bytes()[pos:], i.raw)
 		}
 	}
 	return newLazyFlag(r1, r2)
 }
 
+// inputChunks scans chained chunks as if they were one byte slice,
+// a rune may straddle two chunks.
+type inputChunks struct {
+	chunks [][]byte
+	starts []int // position of each chunk, and the length at last
+	last   int   // chunk of the last lookup, positions mostly go forward
+	raw    bool  // see RawBytes
+}
+
+func newInputChunks(chunks [][]byte) *inputChunks {
+	starts := make([]int, len(chunks)+1)
+	for j, c := range chunks {
+		starts[j+1] = starts[j] + len(c)
+	}
+	return &inputChunks{chunks: chunks, starts: starts}
+}
+
+func (i *inputChunks) len() int {
+	return i.starts[len(i.chunks)]
+}
+
+// locate returns the chunk holding the byte at pos, which must be
+// in range.
+func (i *inputChunks) locate(pos int) int {
+	j := i.last
+	for pos < i.starts[j] {
+		j--
+	}
+	for pos >= i.starts[j+1] {
+		j++
+	}
+	i.last = j
+	return j
+}
+
+// gather copies up to len(dst) bytes from pos into dst.
+func (i *inputChunks) gather(dst []byte, pos int) []byte {
+	n := 0
+	for n < len(dst) && pos+n < i.len() {
+		j := i.locate(pos + n)
+		n += copy(dst[n:], i.chunks[j][pos+n-i.starts[j]:])
+	}
+	return dst[:n]
+}
+
+func (i *inputChunks) step(pos int) (rune, int) {
+	if uint(pos) >= uint(i.len()) {
+		return endOfText, 0
+	}
+	j := i.locate(pos)
+	chunk := i.chunks[j][pos-i.starts[j]:]
+	if c := chunk[0]; c < utf8.RuneSelf {
+		return rune(c), 1
+	}
+	if utf8.FullRune(chunk) {
+		return decodeRune(chunk, i.raw)
+	}
+	var buf [utf8.UTFMax]byte
+	return decodeRune(i.gather(buf[:], pos), i.raw)
+}
+
+func (i *inputChunks) inner() []byte {
+	return nil
+}
+
+// The candidate phase needs the input as a whole, the threads walk
+// the chunks instead.
+func (i *inputChunks) canCheckPrefix() bool {
+	return false
+}
+
+func (i *inputChunks) hasPrefix(re *Regexp) bool {
+	return false
+}
+
+func (i *inputChunks) index(re *Regexp, pos int) int {
+	return -1
+}
+
+func (i *inputChunks) context(pos int) lazyFlag {
+	r1, r2 := endOfText, endOfText
+	if uint(pos-1) < uint(i.len()) {
+		var buf [utf8.UTFMax]byte
+		start := max(pos-utf8.UTFMax, 0)
+		r1 = decodeLastRune(i.gather(buf[:pos-start], start), i.raw)
+	}
+	if uint(pos) < uint(i.len()) {
+		r2, _ = i.step(pos)
+	}
+	return newLazyFlag(r1, r2)
+}
+
+// decodeRune is utf8.DecodeRune, the invalid byte is decoded as the
+// rune of its value if raw is set, which is the Latin-1 rune of the
+// same value, see RawBytes.
+func decodeRune(p []byte, raw bool) (rune, int) {
+	r, width := utf8.DecodeRune(p)
+	if raw && r == utf8.RuneError && width == 1 {
+		return rune(p[0]), 1
+	}
+	return r, width
+}
+
+// decodeLastRune is decodeRune for the last rune of p.
+func decodeLastRune(p []byte, raw bool) rune {
+	r, width := utf8.DecodeLastRune(p)
+	if raw && r == utf8.RuneError && width == 1 {
+		return rune(p[len(p)-1])
+	}
+	return r
+}
+
 // inputReader scans a RuneReader.
 type inputReader struct {
 	r     io.RuneReader
@@ -443,8 +636,7 @@ const startSize = 10 // The size at which to start a slice in the 'All' routines
 // matches that of calling the [Regexp.String] method.
 //
 // Note that the output is lossy in some cases: This method does not indicate
-// POSIX regular expressions (i.e. those compiled by calling [CompilePOSIX]), or
-// those for which the [Regexp.Longest] method has been called.
+// POSIX regular expressions (i.e. those compiled by calling [CompilePOSIX]).
 func (re *Regexp) AppendText(b []byte) ([]byte, error) {
 	return append(b, re.String()...), nil
 }
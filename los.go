@@ -1,19 +1,42 @@
-// WARN: This package is not thread safe
+// The Results of a stream do not depend on how it is chunked, a
+// block is made of the leftmost head and the leftmost tail after it,
+// as found by the regexp package over the whole stream. This holds
+// for literal delimiters and for regex ones, leftmost-first or POSIX,
+// without empty-width assertions: "^", "$", "\b", "\B" and the like
+// only see the bytes from where a match is tried on, so they may
+// differ from the regexp package. lostest.Differential checks a pair
+// against it.
+//
+// WARN: Matcher is not thread safe, while a Pair can be shared by
+// the matchers of many goroutines.
 package los
 
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"iter"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/humbornjo/los/internal/legex"
 )
 
 var (
 	ErrBufferNotDrained = errors.New("matcher closed without drained")
+	ErrRewindTooFar     = errors.New("rewind beyond retained bytes")
+	ErrStreamTooLong    = errors.New("stream beyond the maximum length")
+	ErrEditDistance     = errors.New("edit distance out of range")
 )
 
-type State = int
+// State is the part of a block a Result belongs to, STATE_NONE for
+// the content out of any block.
+type State int
 
 const (
 	STATE_NONE State = iota
@@ -22,11 +45,63 @@ const (
 	STATE_TAIL
 )
 
+var stateNames = [...]string{"NONE", "HEAD", "BODY", "TAIL"}
+
+// String returns the name of s, e.g. "HEAD", or "State(n)" for a
+// value out of the constants.
+func (s State) String() string {
+	if s < STATE_NONE || s > STATE_TAIL {
+		return "State(" + strconv.Itoa(int(s)) + ")"
+	}
+	return stateNames[s]
+}
+
+// ParseState returns the State named name, as told by String, the
+// case and the prefix "STATE_" are ignored, e.g. "head" and
+// "STATE_HEAD" are STATE_HEAD.
+func ParseState(name string) (State, error) {
+	upper := strings.ToUpper(name)
+	for s, n := range stateNames {
+		if upper == n || upper == "STATE_"+n {
+			return State(s), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown state %q", name)
+}
+
 type Pair struct {
 	head      string
 	headRegex regexMode
 	tail      string
 	tailRegex regexMode
+	maxEdit   int
+	noLiteral bool
+	priority  int
+	headGuard func(Result) bool
+	headLine  bool
+	name      string
+	escape    byte
+	limits    CompileLimits
+	pool      *MachinePool
+
+	// newHead builds a head pattern that is not a delimiter, e.g.
+	// the records of CSVPair
+	newHead func() pattern
+	// newTail is newHead for the tail, e.g. the line break before
+	// the next header of DiffFilePair
+	newTail func() pattern
+
+	// compiled once by NewPair, never mutated afterwards
+	headProg compiled
+	tailProg compiled
+}
+
+// compiled is the part of a regex delimiter shared by all matchers
+// of a pair, each matcher takes its own machine from the regexp.
+type compiled struct {
+	literals []string
+	trie     *literalPattern
+	re       *legex.Regexp
 }
 
 type pairOption func(*Pair) *Pair
@@ -61,28 +136,195 @@ func WithRegexTail(mode ...regexMode) pairOption {
 	}
 }
 
+// WithMaxEditDistance allows the literal head and tail to be
+// matched approximately, tolerating up to k insertions, deletions
+// or substitutions, e.g. "BEGIN" arriving as "BEG1N" in OCR output.
+// It has no effect on delimiters matched as regex. k is to be less
+// than the length of the literal delimiters, NewPair panics with
+// ErrEditDistance otherwise, see ValidatePair.
+func WithMaxEditDistance(k int) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.maxEdit = k
+		return pair
+	}
+}
+
+// WithoutLiteralFastPath keeps regex delimiters on the regex VM
+// even when they are only an alternation of literals, which would
+// otherwise be matched by the literal engine.
+func WithoutLiteralFastPath() pairOption {
+	return func(pair *Pair) *Pair {
+		pair.noLiteral = true
+		return pair
+	}
+}
+
+// WithHeadGuard lets guard veto a matched head before the block is
+// entered, e.g. to only treat "```" as a fence at line start. A
+// vetoed head is emitted as STATE_NONE and the head is looked for
+// again right after it.
+func WithHeadGuard(guard func(Result) bool) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.headGuard = guard
+		return pair
+	}
+}
+
+// WithLineAnchoredHead only matches the literal head at the start
+// of a line, i.e. right after a '\n' or at the start of the stream,
+// which saves turning a literal into a regex just for "(?m)^". It
+// has no effect on heads matched by the regex VM.
+func WithLineAnchoredHead() pairOption {
+	return func(pair *Pair) *Pair {
+		pair.headLine = true
+		return pair
+	}
+}
+
+// WithEscape makes the delimiters preceded by an odd number of c
+// part of the content, e.g. the `\"` in a quoted string of a pair of
+// `"`, so that the identical head and tail keep alternating. An
+// escaped delimiter is looked for again right after its first byte.
+func WithEscape(c byte) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.escape = c
+		return pair
+	}
+}
+
+// WithName tags the pair with name, e.g. to tell the blocks of a
+// multi-pair matcher apart with PairResult.
+func WithName(name string) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.name = name
+		return pair
+	}
+}
+
 func NewPair(head, tail string, opts ...pairOption) *Pair {
 	pair := &Pair{head: head, tail: tail}
 	for _, opt := range opts {
 		pair = opt(pair)
 	}
+	return pair.build()
+}
+
+// build compiles the delimiters once the pair is configured.
+func (pair *Pair) build() *Pair {
+	if err := pair.checkEdit(); err != nil {
+		panic(err.Error())
+	}
+	pair.headProg = pair.compile(pair.head, pair.headRegex)
+	pair.tailProg = pair.compile(pair.tail, pair.tailRegex)
 	return pair
 }
 
-func NewMatcher(pair *Pair) Matcher {
-	var patHead, parTail pattern
-	if pair.headRegex == 0 {
-		patHead = newKmpPattern(pair.head)
-	} else {
-		patHead = newRegexPattern(pair.head, pair.headRegex)
+// checkEdit reports the edit distance of WithMaxEditDistance out of
+// the range of the literal delimiters, as an ErrEditDistance.
+func (pair *Pair) checkEdit() error {
+	if pair.maxEdit < 0 {
+		return fmt.Errorf("%w: %d is negative", ErrEditDistance, pair.maxEdit)
 	}
+	for _, d := range []struct {
+		field, source string
+		mode          regexMode
+	}{{"head", pair.head, pair.headRegex}, {"tail", pair.tail, pair.tailRegex}} {
+		if d.mode == _REGEX_MODE_NONE && pair.maxEdit > 0 && pair.maxEdit >= len(d.source) {
+			return fmt.Errorf("%s: %w: %d is not less than the length of %q", d.field, ErrEditDistance, pair.maxEdit, d.source)
+		}
+	}
+	return nil
+}
 
-	if pair.tailRegex == 0 {
-		parTail = newKmpPattern(pair.tail)
-	} else {
-		parTail = newRegexPattern(pair.tail, pair.tailRegex)
+// compile analyses a regex delimiter, regex that turns out to be a
+// set of literals skips the regex VM.
+func (pair *Pair) compile(source string, mode regexMode) compiled {
+	if mode == _REGEX_MODE_NONE {
+		return compiled{}
+	}
+	if pair.limits != (CompileLimits{}) {
+		// The limits hold for the delimiters matched as literals alike
+		pair.mustCompile(source, mode)
+	}
+	if !pair.noLiteral {
+		if literals, ok := literalAlternation(source, mode); ok {
+			c := compiled{literals: literals}
+			if len(literals) > 1 {
+				c.trie = newLiteralPattern(literals, mode)
+			}
+			return c
+		}
+	}
+
+	return compiled{re: pair.mustCompile(source, mode)}
+}
+
+// mustCompile is compileRegex within the limits of the pair, it
+// panics with the error.
+func (pair *Pair) mustCompile(source string, mode regexMode) *legex.Regexp {
+	re, err := compileRegex(source, mode, pair.limits)
+	if err != nil {
+		panic(fmt.Sprintf("regexp: Compile(%q): %v", source, err))
+	}
+	if pair.pool != nil {
+		re = re.WithPool(pair.pool)
+	}
+	return re
+}
+
+type matcherOption func(*matcher) *matcher
+
+func NewMatcher(pair *Pair, opts ...matcherOption) Matcher {
+	patHead := pair.newHeadPattern()
+	parTail := pair.newTailPattern()
+	m := &matcher{
+		state:    STATE_NONE,
+		buffer:   bytes.NewBuffer(nil),
+		patterns: [2]pattern{patHead, parTail},
+		pair:     pair,
+		opts:     opts,
+	}
+	for _, opt := range opts {
+		m = opt(m)
 	}
-	return &matcher{STATE_NONE, 0, 0, bytes.NewBuffer(nil), [2]pattern{patHead, parTail}}
+	return m
+}
+
+func (pair *Pair) newHeadPattern() pattern {
+	if pair.newHead != nil {
+		return pair.newHead()
+	}
+	pat := pair.newPattern(pair.head, pair.headRegex, pair.headProg)
+	if kmp, ok := pat.(*kmpPattern); ok {
+		kmp.anchored = pair.headLine
+	}
+	return pat
+}
+
+func (pair *Pair) newTailPattern() pattern {
+	if pair.newTail != nil {
+		return pair.newTail()
+	}
+	return pair.newPattern(pair.tail, pair.tailRegex, pair.tailProg)
+}
+
+// newPattern picks the cheapest engine able to match source, the
+// compiled parts are shared while the match states are not.
+func (pair *Pair) newPattern(source string, mode regexMode, c compiled) pattern {
+	if mode == _REGEX_MODE_NONE {
+		if pair.maxEdit > 0 {
+			return newFuzzyPattern(source, pair.maxEdit)
+		}
+		return newKmpPattern(source)
+	}
+
+	switch {
+	case c.trie != nil:
+		return c.trie
+	case len(c.literals) == 1:
+		return newKmpPattern(c.literals[0])
+	}
+	return newRegexPattern(c.re)
 }
 
 type Matcher interface {
@@ -93,14 +335,95 @@ type Matcher interface {
 	// Match takes a string as input and return a sequence of
 	// Result against the input. There could be 0 or more Result.
 	Match(string) Results
+	// Peek returns the bytes received and not classified yet, e.g. a
+	// partial delimiter, without consuming them, so that a UI can
+	// render them speculatively. They stay valid until the next
+	// Match.
+	Peek() []byte
+	// Flush yields the blocks held back for a later tail which can
+	// no longer come, see WithGreedyTail, and matches the content
+	// following them along with the input postponed by
+	// WithMinScanSize. A regex delimiter held back while a preferred
+	// match may still follow, e.g. "<k*" on "<kk", is settled too.
+	// It is to be called once the input is over, before Drain.
+	Flush() Results
+	// Stats returns the counters collected by the regex machines
+	// during the last Match, along with the bytes of the stream.
+	Stats() Stats
+	// Rewind pushes the last n emitted bytes back in front of the
+	// buffer and rolls the state back to where they were first
+	// seen, so the next Match reparses them. It needs the bytes to
+	// be retained with WithRewind, and must not be called while
+	// iterating Results.
+	Rewind(n int) error
+	// Remaining reports whether more blocks are to be matched, it
+	// only turns false once the limit of WithMaxBlocks is reached.
+	Remaining() bool
+	// Go matches the chunks received from in on a dedicated goroutine,
+	// the Results are sent in order to the returned channel and stay
+	// valid after the next chunk. The caller must receive the Results
+	// until the channel is closed, the error channel then yields
+	// the error of Err, or an error matching ErrBufferNotDrained if
+	// Drain has content left.
+	Go(in <-chan []byte) (<-chan Result, <-chan error)
+	// Bodies matches the content read from in and yields a reader of
+	// the body of every block, which streams it as it is read, so
+	// that a huge body is piped with constant memory. A reader is a
+	// BodyReader, only valid until the next one is yielded, the rest
+	// of its body is then skipped. The body of a chain is made of
+	// the Results of its inner matchers. The reader of a body cut by
+	// the end of in fails with io.ErrUnexpectedEOF, and the error of
+	// reading in or of the matcher is returned by the reader of the
+	// body it cuts, or else by a last reader. The content left is to
+	// be drained.
+	Bodies(in io.Reader) iter.Seq[io.Reader]
+	// MatchIndex matches as Match does and yields where the Results
+	// are in the stream instead of their content, for an index over
+	// a stream stored elsewhere. The options building Results of
+	// their own, WithCoalesce and WithGraphemeSafety, and the routes
+	// are left out.
+	MatchIndex(string) iter.Seq[IndexSpan]
+	// Err returns the error that stopped matching, the following
+	// input is only buffered until Drain is called.
+	Err() error
+	// Clone returns a new matcher of the same pairs and options, the
+	// compiled patterns are shared while the buffer and state start
+	// afresh. The writers given as options are shared as well.
+	Clone() Matcher
+	// Route writes the content of the Results of a state to a writer
+	// instead of yielding them, see Write.
+	Route(state State, w io.Writer)
+	// Write matches its input for the Results to flow into the
+	// writers given by Route, the others are dropped.
+	io.Writer
 
 	// Close must be called for each matcher. It act as nop for
 	// kmpPattern. For regexPattern, however, Close will restore
 	// machine in regexPattern, thus to reduce the memory alloc
-	// pressure. It throws error if there is still data in buffer.
+	// pressure. It throws error if there is still data in buffer,
+	// ErrUnterminatedBlock if it is within a block or else
+	// ErrBufferNotDrained.
+	// Close is safe to call many times, even concurrently, the
+	// following calls return the error of the first one.
 	//
 	// WARN: Matcher should never be further used after Close.
 	Close() error
+	// CloseAndDrain closes the matcher along with returning what
+	// Drain would, so that the content left is not lost.
+	CloseAndDrain() (string, error)
+}
+
+// MachineStats holds the execution counters of a regex machine.
+type MachineStats = legex.Stats
+
+// Stats holds the execution counters of the regex machines added
+// up, they stay zero for delimiters matched without the regex VM.
+// Bytes is counted over the whole stream instead, and Buffered is
+// told as of the end of the last Match.
+type Stats struct {
+	MachineStats
+	Bytes    int64 // bytes received since the stream started
+	Buffered int   // bytes held back for a later Match
 }
 
 // Results is a iterator of Result
@@ -124,6 +447,23 @@ type Result interface {
 	// For regex pair matches, the returned iterator will yield all
 	// the submatch in the compiled regular expression.
 	Matches() iter.Seq[string]
+	// Submatches returns the groups of a HEAD or TAIL matched as a
+	// regex, the whole delimiter first, or the content as a whole
+	// for the other Results.
+	Submatches() []Submatch
+	// Before returns up to the configured bytes of content right
+	// before a HEAD or TAIL Result, see WithContextBytes.
+	Before() []byte
+	// After returns up to the configured bytes of content right
+	// after a HEAD or TAIL Result that are already received when
+	// the Result is emitted, see WithContextBytes.
+	After() []byte
+	// Value returns the value attached to the block of a HEAD, BODY
+	// or TAIL Result, see WithOnHead.
+	Value() any
+	// Highlights returns the ranges of the BODY Result matched by
+	// the regex of WithBodyHighlighter.
+	Highlights() [][2]int
 }
 
 var _ Result = textResult{}
@@ -133,6 +473,24 @@ type textResult struct {
 	raw   []byte
 }
 
+// resultSlabSize is the number of textResults allocated at once.
+const resultSlabSize = 32
+
+// resultSlab hands out the textResults of a matcher from slices of
+// resultSlabSize, so that a yield does not allocate one Result each.
+// A slab is never reused, the Results handed out stay valid.
+type resultSlab struct {
+	results []textResult
+}
+
+func (s *resultSlab) next(state State, raw []byte) *textResult {
+	if len(s.results) == cap(s.results) {
+		s.results = make([]textResult, 0, resultSlabSize)
+	}
+	s.results = append(s.results, textResult{state, raw})
+	return &s.results[len(s.results)-1]
+}
+
 func (r textResult) Raw() []byte {
 	return r.raw
 }
@@ -151,6 +509,54 @@ func (r textResult) Matches() iter.Seq[string] {
 	}
 }
 
+func (r textResult) Before() []byte {
+	return nil
+}
+
+func (r textResult) After() []byte {
+	return nil
+}
+
+func (r textResult) Value() any {
+	return nil
+}
+
+func (r textResult) Highlights() [][2]int {
+	return nil
+}
+
+// blockResult is a textResult carrying what is known about the block
+// it belongs to, it is only used when any of the fields is wanted.
+type blockResult struct {
+	textResult
+	pair          *Pair
+	before, after []byte
+	sum           []byte
+	duration      time.Duration
+	value         any
+	highlights    [][2]int
+	text          string
+	spans         []Submatch
+	extent        Extent
+	span          IndexSpan
+}
+
+func (r blockResult) Before() []byte {
+	return r.before
+}
+
+func (r blockResult) After() []byte {
+	return r.after
+}
+
+func (r blockResult) Value() any {
+	return r.value
+}
+
+func (r blockResult) Highlights() [][2]int {
+	return r.highlights
+}
+
 // Default Implementation ---------------------------------------
 
 var _ Matcher = (*matcher)(nil)
@@ -161,48 +567,524 @@ type matcher struct {
 	offset   int
 	buffer   *bytes.Buffer
 	patterns [2]pattern
+	stats    Stats
+	rewind   *rewinder
+	block    *heldBlock
+	fallback *Pair
+	greedy   *greedyTail
+	restarts map[*Pair]pattern // head patterns of WithRestartOnHead
+	alt      Matcher
+	heads    *headSet
+	pair     *Pair // pair of the current block in multi-pair mode
+	context  *contextWindow
+
+	blocks    int // blocks completed since the stream started
+	maxBlocks int
+	received  int64 // bytes received since the stream started
+	maxStream int64
+	minScan   int
+	unscanned int        // bytes buffered by WithMinScanSize
+	ending    bool       // whether Flush matches the end of the stream
+	utf8      *utf8Check // see WithInvalidUTF8
+	decoder   *decoder   // see WithEncoding
+	steps     int        // runes stepped since the stream started
+	maxSteps  int        // see WithStepLimit
+	isolated  bool       // see WithPoolIsolation
+
+	discardNone bool
+	discardBody bool
+	bodyAt      [2]int64 // offsets of the head and the body, see WithDiscardBody
+	pooled      bool     // see WithPooledResults
+	slab        resultSlab
+	chunk       string        // of the last Match, see WithPooledResults
+	feedChunk   Results       // matches chunk, bound once
+	text        *textCount    // see WithTextOffsets
+	skipping    bool          // the rest of the body is skipped, see Bodies
+	strict      *strictPrefix // see WithStrictPrefix
+	invariant   *invariant    // see WithInvariantChecks
+	coalesce    *coalescer
+	grapheme    *graphemeHold
+	highlight   *highlighter
+	groups      [2]groups // of the last head and tail matched
+	template    *blockTemplate
+	autoDrain   func(Result)
+	onHead      func(Result) any
+	value       any // value of the current block
+	tracer      Tracer
+	span        Span  // span of the current block
+	spanAt      int64 // offset of the head of the current block
+
+	lookback [2]int  // per pattern
+	trail    byteRun // run of bytes the emitted content ends with
+	opts     []matcherOption
+	spec     *speculation
+	hash     hash.Hash
+	journal  *journal
+	recorder *recorder
+	onTrans  func(from, to State, offset int64)
+	routes   routes
+	clock    func() time.Time
+	headAt   time.Time // when the head of the block was matched
+	emitted  State     // state of the last Result
+	pos      int64     // offset in the stream of the next Result
+	headPos  int64     // offset in the stream of the head of the block
+
+	emptyMatch emptyMatchPolicy
+	logger     *slog.Logger
+	logLevel   slog.Level
+	afterTail  bool  // the last Result emitted is a TAIL
+	err        error // error that stopped matching
+
+	closed   sync.Once
+	closeErr error // error of the first Close
+}
+
+// headPair returns the pair of the head just matched.
+func (m *matcher) headPair() *Pair {
+	if m.heads != nil {
+		return m.heads.pairs[m.heads.winner]
+	}
+	return m.pair
 }
 
 func (m *matcher) Drain() string {
 	defer m.buffer.Reset()
+	m.record(recordDrain, "")
+	if m.span != nil {
+		m.span.End(nil, m.pos, m.pos-m.spanAt)
+		m.span = nil
+	}
+	if m.rewind != nil {
+		m.rewind.reset()
+	}
+	if m.context != nil {
+		m.context.last = m.context.last[:0]
+	}
+	if m.highlight != nil {
+		m.highlight.reset()
+	}
+	if m.template != nil {
+		m.template.reset()
+	}
+	if m.strict != nil {
+		m.strict.headed = false
+	}
+	if m.invariant != nil {
+		m.invariant.last = STATE_NONE
+	}
+	m.skipping = false
+	m.patterns[0].Reset()
+	m.patterns[1].Reset()
+	if f, ok := m.patterns[0].(follower); ok {
+		f.follow(lineStart)
+	}
 	m.index, m.offset, m.state = 0, 0, STATE_NONE
-	return m.buffer.String()
+	m.blocks, m.received, m.steps = 0, 0, 0
+	m.trail = byteRun{}
+	if m.greedy != nil {
+		m.greedy.at = -1
+	}
+	if m.spec != nil {
+		m.spec.active = false
+	}
+	var pending, held string
+	if m.coalesce != nil {
+		pending = string(m.coalesce.pending)
+		m.coalesce.reset()
+	}
+	if m.grapheme != nil {
+		pending += string(m.grapheme.pending)
+		m.grapheme.reset()
+	}
+	if m.block != nil && m.block.buf.Len() > 0 {
+		defer m.block.buf.Reset()
+		held = m.block.buf.String()
+	}
+	m.advance(STATE_NONE, len(held)+m.buffer.Len())
+	if m.text != nil {
+		m.text.add(STATE_NONE, []byte(held), m.pos)
+		m.text.add(STATE_NONE, m.buffer.Bytes(), m.pos)
+	}
+	m.afterTail, m.err = false, nil
+	m.unscanned = 0
+	m.resetDecoder()
+	return pending + held + m.buffer.String() + m.drainUTF8()
 }
 
 func (m *matcher) Match(s string) Results {
+	if m.pooled {
+		// The sequence is bound once to take no allocation either
+		if m.feedChunk == nil {
+			m.feedChunk = func(yield func(Result) bool) {
+				m.feed(m.wrap(yield), m.chunk)
+			}
+		}
+		m.chunk = s
+		return m.feedChunk
+	}
 	return func(yield func(Result) bool) {
+		m.feed(m.wrap(yield), s)
+	}
+}
+
+// feed matches the chunk s, the Results are yielded as they are sent.
+func (m *matcher) feed(yield func(Result) bool, s string) {
+	m.stats = Stats{}
+	m.record(recordChunk, s)
+	s, invalid, err := m.checkUTF8(m.decode(s, false))
+	s, over := m.limit(s)
+	if !m.postpone(s) {
+		m.match(yield, s)
+	}
+	if len(over) > 0 {
+		if m.err == nil {
+			m.fail(ErrStreamLimit{Limit: m.maxStream, Have: m.received})
+		}
+		m.buffer.WriteString(over)
+	}
+	if err != nil {
+		if m.err == nil {
+			m.fail(err)
+		}
+		m.buffer.WriteString(invalid)
+	}
+}
+
+// wrap wraps yield with the options acting on the Results emitted.
+func (m *matcher) wrap(yield func(Result) bool) func(Result) bool {
+	if m.invariant != nil {
+		yield = m.checkOrder(yield)
+	}
+	if m.routes.any() {
+		yield = m.routes.wrap(yield, &m.err)
+	}
+	if m.coalesce != nil {
+		yield = m.coalesce.wrap(yield, m.now)
+	}
+	if m.grapheme != nil {
+		yield = m.grapheme.wrap(yield)
+	}
+	return yield
+}
+
+func (m *matcher) match(yield func(Result) bool, s string) {
+	if m.err != nil {
 		m.buffer.WriteString(s)
-	encore:
-		pattern, buffer := m.patterns[m.state>>1], m.buffer.Bytes()
-		index, offset, ok := pattern.Match(m.index, m.offset, buffer)
-		if ok {
-			m.index, m.offset = 0, offset
-			if index > 0 &&
-				!yield(textResult{m.state, m.buffer.Next(index)}) {
+		return
+	}
+	if m.discardNone && m.state == STATE_NONE && m.buffer.Len() == 0 {
+		s = m.skipNone(s)
+	}
+	if (m.skipping || m.discardBody) && m.state == STATE_BODY && m.buffer.Len() == 0 && m.block == nil {
+		s = m.skip(STATE_BODY, s)
+	}
+	m.buffer.WriteString(s)
+encore:
+	if m.state == STATE_NONE && !m.Remaining() {
+		if m.buffer.Len() > 0 {
+			m.emit(yield, STATE_NONE, m.buffer.Next(m.buffer.Len()))
+		}
+		return
+	}
+	pattern, buffer := m.patterns[m.state>>1], m.buffer.Bytes()
+	var index, offset int
+	var ok bool
+	if m.spec != nil && m.spec.active {
+		if !m.speculate(buffer) {
+			return
+		}
+		index, offset, ok = 0, m.heads.lengths[m.heads.winner], true
+	} else {
+		index, offset, ok = matchAt(pattern, m.ending, m.index, m.offset, buffer)
+		m.collect(pattern)
+		if m.overstep() {
+			return
+		}
+	}
+	if m.block != nil && m.state == STATE_BODY && m.block.exceeds(index) {
+		if m.greedy != nil && m.greedy.at >= 0 {
+			if !m.settle(yield) {
 				return
 			}
-			m.offset = 0
-			if !yield(textResult{m.state + 1, m.buffer.Next(offset)}) {
-				return
+			goto encore
+		}
+		// Cut where the body outgrows the limit, not where the
+		// pattern happens to release the buffer
+		if !m.reject(yield, m.buffer.Next(m.block.overflow())) {
+			return
+		}
+		goto encore
+	}
+	if ok && offset == 0 && (index == len(buffer) || m.refuseEmpty(index)) {
+		pattern.Reset()
+		m.index, m.offset = 0, 0
+		// Like the regex VM, an empty match at the end of buffer
+		// is left to be found again along with more bytes.
+		if index == len(buffer) {
+			if index > 0 {
+				m.emit(yield, m.state, m.buffer.Next(index))
 			}
-			m.state = m.state ^ 0b10 // transfer state
+			return
+		}
+		if m.emptyMatch == EMPTY_MATCH_ERROR {
+			m.fail(ErrEmptyMatch)
+			return
+		}
+		// Step over one byte so that the match moves on
+		m.warn("empty delimiter stepped over", "state", m.state, "offset", m.pos+int64(index))
+		if !m.emit(yield, m.state, m.buffer.Next(index+1)) {
+			return
+		}
+		goto encore
+	}
+	if ok && m.greedy != nil && m.state == STATE_BODY {
+		// Hold the tail as body until a later one may come
+		pattern.Reset()
+		m.index, m.offset = 0, 0
+		m.emit(yield, STATE_BODY, m.buffer.Next(index))
+		m.greedy.at = m.block.buf.Len()
+		m.greedy.end = m.greedy.at + offset
+		m.emit(yield, STATE_BODY, m.buffer.Next(offset))
+		goto encore
+	}
+	if ok && m.escaped(index) {
+		pattern.Reset()
+		m.index, m.offset = 0, 0
+		if !m.emit(yield, m.state, m.buffer.Next(index+1)) {
+			return
+		}
+		goto encore
+	}
+	if ok {
+		m.index, m.offset = 0, offset
+		if index > 0 && !m.emit(yield, m.state, m.buffer.Next(index)) {
+			return
+		}
+		m.offset = 0
+		state := m.state + 1
+		if state == STATE_HEAD && m.spec != nil && len(m.heads.candidates()) > 1 {
+			// Leave the head in buffer until the pair is decided
+			m.spec.active = true
 			goto encore
 		}
-		m.index, m.offset = index, offset
-		if m.index == 0 {
+		if state == STATE_HEAD {
+			pair := m.headPair()
+			if pair.headGuard != nil &&
+				!pair.headGuard(textResult{state, m.buffer.Bytes()[:offset]}) {
+				if !m.emit(yield, m.state, m.buffer.Next(offset)) {
+					return
+				}
+				goto encore
+			}
+			if m.heads != nil {
+				m.pair = pair
+				m.patterns[1] = m.heads.tails[m.heads.winner]
+			}
+		}
+		m.capture(state, pattern)
+		m.state = m.state ^ 0b10 // transfer state
+		if !m.emit(yield, state, m.buffer.Next(offset)) {
 			return
 		}
-		yield(textResult{m.state, m.buffer.Next(m.index)})
-		m.index = 0
+		goto encore
+	}
+	m.index, m.offset = index, offset
+	m.index = m.bound(pattern, index, offset)
+	if m.index == 0 {
+		return
+	}
+	m.emit(yield, m.state, m.buffer.Next(m.index))
+	m.index = 0
+}
+
+// emit is the only way out of Match for a Result, it reports
+// whether the consumer asks for more.
+func (m *matcher) emit(yield func(Result) bool, state State, raw []byte) bool {
+	if f, ok := m.patterns[0].(follower); ok {
+		f.follow(raw)
+	}
+	m.trail.follow(raw)
+	if state == STATE_HEAD {
+		m.headPos = m.pos
+	}
+	if m.clock != nil && state == STATE_HEAD {
+		m.headAt = m.clock()
+	}
+	if m.block != nil && state != STATE_NONE {
+		return m.hold(yield, state, raw)
 	}
+	return m.send(yield, state, raw)
+}
+
+func (m *matcher) send(yield func(Result) bool, state State, raw []byte) bool {
+	return m.sendAfter(yield, state, raw, m.buffer.Bytes())
+}
+
+// sendAfter is send with the content following raw told explicitly,
+// for when it is not the buffer, e.g. a held block.
+func (m *matcher) sendAfter(yield func(Result) bool, state State, raw, after []byte) bool {
+	m.afterTail = state == STATE_TAIL
+	m.advance(state, len(raw))
+	var span IndexSpan
+	if m.text != nil {
+		span = m.text.add(state, raw, m.pos)
+	}
+	if m.strict != nil && m.strict.refuses(state) {
+		return m.refuse(raw)
+	}
+	if state == STATE_NONE && m.discardNone {
+		return true
+	}
+	if m.discardBody {
+		switch state {
+		case STATE_HEAD:
+			m.bodyAt = [2]int64{m.pos - int64(len(raw)), m.pos}
+		case STATE_BODY:
+			return true
+		}
+	}
+	if m.rewind != nil {
+		m.rewind.record(state, raw)
+	}
+	if state == STATE_TAIL {
+		m.blocks++
+		m.skipping = false
+	}
+	if m.heads == nil && m.context == nil && m.hash == nil && m.clock == nil && m.onHead == nil && m.tracer == nil &&
+		m.highlight == nil && m.template == nil && (state&1 == 0 || m.groups[state>>1].names == nil) &&
+		(state != STATE_TAIL || !m.discardBody) && m.text == nil {
+		if m.pooled {
+			return yield(pooled(blockResult{textResult: textResult{state, raw}}))
+		}
+		return yield(m.slab.next(state, raw))
+	}
+
+	result := blockResult{textResult: textResult{state, raw}, span: span}
+	if m.hash != nil {
+		result.sum = m.digest(state, raw)
+	}
+	if m.clock != nil && state == STATE_TAIL {
+		result.duration = m.clock().Sub(m.headAt)
+	}
+	if state != STATE_NONE {
+		result.pair = m.pair
+	}
+	if state&1 == 1 {
+		result.spans = m.groups[state>>1].spans(raw, m.pos-int64(len(raw)))
+	}
+	if m.discardBody && state == STATE_TAIL {
+		result.extent = m.extent(len(raw))
+	}
+	if m.context != nil {
+		result.before, result.after = m.context.around(state, raw, after)
+	}
+	if m.highlight != nil {
+		result.highlights = m.highlight.highlight(state, raw)
+	}
+	var failed bool // the Result is the last one once matching stops
+	if m.template != nil {
+		var err error
+		if result.text, err = m.template.feed(result, m.pos); err != nil && m.err == nil {
+			m.fail(err)
+			failed = true
+		}
+	}
+	if m.onHead != nil && state == STATE_HEAD {
+		m.value = m.onHead(result)
+	}
+	if state != STATE_NONE {
+		result.value = m.value
+	}
+	if m.tracer != nil {
+		m.trace(state, result)
+	}
+	if m.pooled {
+		return yield(pooled(result)) && !failed
+	}
+	return yield(result) && !failed
+}
+
+// collect adds up the counters of the pattern just run.
+func (m *matcher) collect(pattern pattern) {
+	if pat, isRegex := pattern.(*regexPattern); isRegex {
+		stats := pat.Stats()
+		m.steps += stats.Steps
+		m.stats.add(Stats{MachineStats: stats})
+	}
+}
+
+// add adds up the counters of the regex machines of other.
+func (s *Stats) add(other Stats) {
+	s.Steps += other.Steps
+	s.MaxQueue = max(s.MaxQueue, other.MaxQueue)
+	s.Allocs += other.Allocs
+	s.PrefixSkips += other.PrefixSkips
+}
+
+func (m *matcher) Peek() []byte {
+	return m.buffer.Bytes()
+}
+
+func (m *matcher) Stats() Stats {
+	stats := m.stats
+	stats.Bytes = m.received
+	stats.Buffered = m.buffer.Len()
+	if m.block != nil {
+		stats.Buffered += m.block.buf.Len()
+	}
+	return stats
+}
+
+// drainErr returns the error of closing the matcher with content
+// left, it tells the head of the block left unterminated if any.
+func (m *matcher) drainErr() error {
+	switch {
+	case !m.undrained():
+		return nil
+	case m.state != STATE_NONE:
+		return ErrUnterminatedBlock{StartOffset: m.headPos}
+	}
+	return ErrBufferNotDrained
+}
+
+// undrained reports whether Drain would return any content.
+func (m *matcher) undrained() bool {
+	return m.buffer.Len() > 0 ||
+		(m.block != nil && m.block.buf.Len() > 0) ||
+		(m.coalesce != nil && m.coalesce.first != nil) ||
+		(m.grapheme != nil && m.grapheme.first != nil) ||
+		(m.utf8 != nil && m.utf8.pending != "")
+}
+
+func (m *matcher) Clone() Matcher {
+	if m.heads != nil {
+		return NewMultiMatcher(m.heads.pairs, m.opts...)
+	}
+	return NewMatcher(m.pair, m.opts...)
 }
 
 func (m *matcher) Close() error {
+	m.closed.Do(func() { m.closeErr = m.close() })
+	return m.closeErr
+}
+
+func (m *matcher) close() error {
 	m.patterns[0].Clear()
-	m.patterns[1].Clear()
+	if m.heads == nil {
+		m.patterns[1].Clear()
+	}
+	if m.alt != nil {
+		m.alt.Close() // nolint: errcheck
+	}
+	for _, pat := range m.restarts {
+		pat.Clear()
+	}
+	if m.highlight != nil {
+		m.highlight.pat.Clear()
+	}
 
-	if m.buffer.Len() > 0 {
-		return ErrBufferNotDrained
+	if !m.drainOnClose() {
+		return m.drainErr()
 	}
 	return nil
 }
@@ -214,16 +1096,47 @@ type pattern interface {
 	// unmatched string in buffer ASAP.
 	Match(index int, offset int, s []byte) (newIndex int, newOffset int, ok bool)
 
+	// Reset drops the progress of a partially matched pattern
+	Reset()
+
 	// Clear clean up the inner state of pattern
 	Clear()
 }
 
+// follower is implemented by patterns looking behind the buffer,
+// they are told about the bytes consumed right before it.
+type follower interface {
+	follow(raw []byte)
+}
+
+// ender is implemented by patterns holding a match back while a
+// longer or preferred one may follow, see legex.Machine.MatchEnd.
+type ender interface {
+	MatchEnd(index int, offset int, s []byte) (int, int, bool)
+}
+
+// matchAt runs pattern over s, as the end of the stream if end is set.
+func matchAt(pattern pattern, end bool, index int, offset int, s []byte) (int, int, bool) {
+	if e, ok := pattern.(ender); ok && end {
+		return e.MatchEnd(index, offset, s)
+	}
+	return pattern.Match(index, offset, s)
+}
+
+// lineStart is followed at the start of a stream.
+var lineStart = []byte{'\n'}
+
 // Implemented with Knuth-Morris-Pratt algorithm for forward
 // search.
 type kmpPattern struct {
 	lps    []int
 	length int
 	source string
+
+	// anchored only accepts the occurrences at line start, prev is
+	// the byte right before the buffer.
+	anchored bool
+	prev     byte
 }
 
 var _ pattern = (*kmpPattern)(nil)
@@ -246,9 +1159,13 @@ func newKmpPattern(source string) *kmpPattern {
 		}
 		return array
 	}
-	return &kmpPattern{computeLpsArray(source), len(source), source}
+	return &kmpPattern{lps: computeLpsArray(source), length: len(source), source: source, prev: '\n'}
 }
 
+// Match returns, short of a match, the longest suffix of buffer which
+// is a proper prefix of the source, the KMP state at the end of the
+// scan. Only these bytes may still begin a match, so that all the
+// bytes before them are emitted at once.
 func (pat *kmpPattern) Match(index int, offset int, buffer []byte) (int, int, bool) {
 	if offset == pat.length {
 		return index, offset, true
@@ -259,7 +1176,10 @@ func (pat *kmpPattern) Match(index int, offset int, buffer []byte) (int, int, bo
 		if buffer[i] == pat.source[j] {
 			i, j = i+1, j+1
 			if j == m {
-				return i - j, j, true
+				if pat.atLineStart(buffer, i-j) {
+					return i - j, j, true
+				}
+				j = pat.lps[j-1]
 			}
 		} else {
 			if j != 0 {
@@ -269,9 +1189,31 @@ func (pat *kmpPattern) Match(index int, offset int, buffer []byte) (int, int, bo
 			}
 		}
 	}
+	for j > 0 && !pat.atLineStart(buffer, i-j) {
+		j = pat.lps[j-1]
+	}
 	return i - j, j, false
 }
 
+func (pat *kmpPattern) atLineStart(buffer []byte, start int) bool {
+	switch {
+	case !pat.anchored:
+		return true
+	case start > 0:
+		return buffer[start-1] == '\n'
+	default:
+		return pat.prev == '\n'
+	}
+}
+
+func (pat *kmpPattern) follow(raw []byte) {
+	if len(raw) > 0 {
+		pat.prev = raw[len(raw)-1]
+	}
+}
+
+func (pat *kmpPattern) Reset() {}
+
 func (pat *kmpPattern) Clear() {}
 
 // Implemented with regular expression VM for forward search.
@@ -279,25 +1221,21 @@ func (pat *kmpPattern) Clear() {}
 // - https://swtch.com/~rsc/regexp/regexp2.html
 type regexPattern struct {
 	*legex.Machine
+	names     []string // of the groups, see Result.Submatches
 	clearFunc func()
+	cleared   sync.Once
 }
 
 // legex.Machine implement pattern
 var _ pattern = (*regexPattern)(nil)
 
-func newRegexPattern(pattern string, mode regexMode) *regexPattern {
-	var re *legex.Regexp
-	switch mode {
-	case REGEX_MODE_PERL:
-		re = legex.MustCompile(pattern)
-	case REGEX_MODE_POSIX:
-		re = legex.MustCompilePOSIX(pattern)
-	default:
-		panic("unreachable")
-	}
-	return &regexPattern{re.Get(), func() { re.Put(re.Get()) }}
+func newRegexPattern(re *legex.Regexp) *regexPattern {
+	m := re.Get()
+	return &regexPattern{Machine: m, names: re.SubexpNames(), clearFunc: func() { re.Put(m) }}
 }
 
+// Clear puts the machine back into the pool only once, a machine put
+// twice would be handed to two patterns.
 func (pat *regexPattern) Clear() {
-	pat.clearFunc()
+	pat.cleared.Do(pat.clearFunc)
 }
@@ -0,0 +1,138 @@
+package los
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// largeProgram is the number of instructions beyond which the machines
+// of a regex are taken from a pool of larger queues.
+const largeProgram = 128
+
+// warningPenalty is added to the score of a delimiter per warning.
+const warningPenalty = 100
+
+type warningCode int
+
+const (
+	// WARN_UNBOUNDED: the delimiter may match strings of any length,
+	// a partial match may hold back the stream without limit, see
+	// WithLookbackLimit.
+	WARN_UNBOUNDED warningCode = iota
+	// WARN_NESTED_QUANTIFIER: a repetition is repeated, e.g. "(a+)*",
+	// which multiplies the threads of the regex VM.
+	WARN_NESTED_QUANTIFIER
+	// WARN_EMPTY_MATCH: the delimiter may match zero bytes, see
+	// WithEmptyMatchPolicy.
+	WARN_EMPTY_MATCH
+	// WARN_LARGE_PROGRAM: the regex compiles into a program whose
+	// machines are costly to allocate and to step through.
+	WARN_LARGE_PROGRAM
+)
+
+// Warning is a streaming pitfall found in a delimiter.
+type Warning struct {
+	Code      warningCode
+	Delimiter string // "head" or "tail"
+	Message   string
+}
+
+// DelimiterReport describes how a delimiter is matched.
+type DelimiterReport struct {
+	Regex   bool // matched by the regex VM, not by a literal engine
+	NumInst int  // instructions of the regex program, if Regex
+	MaxLen  int  // see Pair.MaxHeadLen, -1 if unbounded
+	Score   int
+}
+
+// Report is the outcome of AnalyzePair, the higher the score the more
+// costly or risky the pair is to stream.
+type Report struct {
+	Head, Tail DelimiterReport
+	Score      int
+	Warnings   []Warning
+}
+
+// AnalyzePair scores the delimiters of pair and warns about the
+// pitfalls of streaming them, e.g. to vet the pairs of a config
+// before deployment. The score of a delimiter is the number of
+// instructions of its regex program, plus a penalty per warning.
+func AnalyzePair(pair *Pair) Report {
+	var report Report
+	report.Head = analyzeDelimiter(&report, "head", pair.head, pair.headRegex, pair.headProg, pair.MaxHeadLen)
+	report.Tail = analyzeDelimiter(&report, "tail", pair.tail, pair.tailRegex, pair.tailProg, pair.MaxTailLen)
+	report.Score = report.Head.Score + report.Tail.Score
+	return report
+}
+
+func analyzeDelimiter(report *Report, name, source string, mode regexMode, c compiled,
+	maxLen func() (int, bool)) DelimiterReport {
+	warnings := len(report.Warnings)
+	warn := func(code warningCode, message string) {
+		report.Warnings = append(report.Warnings, Warning{code, name, message})
+	}
+
+	var d DelimiterReport
+	n, bounded := maxLen()
+	d.MaxLen = n
+	if !bounded {
+		d.MaxLen = -1
+		warn(WARN_UNBOUNDED, "the "+name+" may match strings of any length")
+	}
+	if matchesEmpty(source, mode) {
+		warn(WARN_EMPTY_MATCH, "the "+name+" may match zero bytes")
+	}
+
+	if c.re != nil {
+		d.Regex, d.NumInst = true, c.re.NumInst()
+		if d.NumInst > largeProgram {
+			warn(WARN_LARGE_PROGRAM, "the "+name+" compiles into a large program")
+		}
+		flags := syntax.Perl
+		if mode == REGEX_MODE_POSIX {
+			flags = syntax.POSIX
+		}
+		if re, err := syntax.Parse(source, flags); err == nil && nestedQuantifier(re, false) {
+			warn(WARN_NESTED_QUANTIFIER, "the "+name+" repeats a repetition")
+		}
+	}
+
+	d.Score = d.NumInst + warningPenalty*(len(report.Warnings)-warnings)
+	return d
+}
+
+// matchesEmpty reports whether the delimiter matches the empty string.
+func matchesEmpty(source string, mode regexMode) bool {
+	var re *regexp.Regexp
+	var err error
+	switch mode {
+	case _REGEX_MODE_NONE:
+		return source == ""
+	case REGEX_MODE_POSIX:
+		re, err = regexp.CompilePOSIX(source)
+	default:
+		re, err = regexp.Compile(source)
+	}
+	return err == nil && re.MatchString("")
+}
+
+// nestedQuantifier reports whether re has a repetition within another
+// one, inner tells whether re is already within one.
+func nestedQuantifier(re *syntax.Regexp, inner bool) bool {
+	repeats := false
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		repeats = true
+	case syntax.OpRepeat:
+		repeats = re.Max < 0 || re.Max > 1
+	}
+	if repeats && inner {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if nestedQuantifier(sub, inner || repeats) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package los
+
+import "slices"
+
+// goQueueSize bounds the Results sent by Matcher.Go ahead of the
+// receiver, the matching goroutine blocks once it is full.
+const goQueueSize = 16
+
+func (m *matcher) Go(in <-chan []byte) (<-chan Result, <-chan error) {
+	return goMatch(m, in)
+}
+
+func goMatch(m Matcher, in <-chan []byte) (<-chan Result, <-chan error) {
+	out, errc := make(chan Result, goQueueSize), make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(out)
+		for chunk := range in {
+			for result := range m.Match(string(chunk)) {
+				out <- detach(result)
+			}
+		}
+		if err := m.Err(); err != nil {
+			errc <- err
+		} else if err := drainErr(m); err != nil {
+			errc <- err
+		}
+	}()
+	return out, errc
+}
+
+// undrained reports whether Drain of m would return any content.
+func undrained(m Matcher) bool {
+	d, ok := m.(interface{ undrained() bool })
+	return ok && d.undrained()
+}
+
+// drainErr returns the error of closing m with content left.
+func drainErr(m Matcher) error {
+	if d, ok := m.(interface{ drainErr() error }); ok {
+		return d.drainErr()
+	}
+	return nil
+}
+
+// detach copies the content of result out of the matcher buffer.
+func detach(result Result) Result {
+	switch r := result.(type) {
+	case textResult:
+		r.raw = slices.Clone(r.raw)
+		return r
+	case *textResult:
+		return textResult{r.state, slices.Clone(r.raw)}
+	case blockResult:
+		r.raw = slices.Clone(r.raw)
+		return r
+	case chainResult:
+		r.Result = detach(r.Result)
+		return r
+	case *pooledResult:
+		return detach(r.blockResult)
+	default:
+		return textResult{result.State(), slices.Clone(result.Raw())}
+	}
+}
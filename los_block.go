@@ -0,0 +1,175 @@
+package los
+
+import (
+	"bytes"
+	"math"
+	"slices"
+)
+
+// WithMaxBodyBytes rejects the blocks whose body grows beyond n
+// bytes. Head and body are then held back until the tail shows up.
+// The head of a rejected block is emitted as STATE_NONE and the
+// matcher looks for a head again right after it, or the block is
+// re-scanned with the pair given by WithFallbackPair.
+func WithMaxBodyBytes(n int) matcherOption {
+	return func(m *matcher) *matcher {
+		m.holdBlocks().maxBody = n
+		return m
+	}
+}
+
+// WithBodyLen rejects the blocks whose body is shorter than min or
+// longer than max bytes, e.g. to filter out delimiters colliding by
+// accident in noisy data. A max of zero or less lifts the maximum.
+// The rejected blocks are handled as with WithMaxBodyBytes.
+func WithBodyLen(min, max int) matcherOption {
+	return func(m *matcher) *matcher {
+		block := m.holdBlocks()
+		block.minBody = min
+		if max > 0 {
+			block.maxBody = max
+		}
+		return m
+	}
+}
+
+// WithBodyValidator rejects the blocks whose body fails valid, it is
+// called once the tail is found, e.g. to tell a "```" within prose
+// from a real code fence. The rejected blocks are handled as with
+// WithMaxBodyBytes.
+func WithBodyValidator(valid func(body []byte) bool) matcherOption {
+	return func(m *matcher) *matcher {
+		m.holdBlocks().valid = valid
+		return m
+	}
+}
+
+// WithFallbackPair re-scans the region of a rejected block with alt
+// before it falls back to STATE_NONE. The Results yielded for the
+// region are the ones of alt. The region is the whole block, or its
+// head and body up to the byte outgrowing WithMaxBodyBytes, the
+// matcher goes on after it.
+func WithFallbackPair(alt *Pair) matcherOption {
+	return func(m *matcher) *matcher {
+		m.fallback = alt
+		return m
+	}
+}
+
+// heldBlock keeps head and body of the block being matched, until
+// the tail is found and the block can be judged as a whole.
+type heldBlock struct {
+	buf     bytes.Buffer
+	head    int
+	minBody int
+	maxBody int
+	valid   func([]byte) bool
+}
+
+// holdBlocks makes m hold every block until its tail.
+func (m *matcher) holdBlocks() *heldBlock {
+	if m.block == nil {
+		m.block = &heldBlock{maxBody: math.MaxInt}
+	}
+	return m.block
+}
+
+// exceeds reports whether n more bytes of body are too many.
+func (b *heldBlock) exceeds(n int) bool {
+	return b.buf.Len()-b.head+n > b.maxBody
+}
+
+// overflow returns the bytes that make the body outgrow maxBody by
+// one, where an oversized block is cut whatever the chunks.
+func (b *heldBlock) overflow() int {
+	return b.head + b.maxBody + 1 - b.buf.Len()
+}
+
+// accepts reports whether the block held is to be emitted once its
+// tail is found.
+func (b *heldBlock) accepts() bool {
+	return b.acceptsBody(b.buf.Bytes()[b.head:])
+}
+
+// acceptsBody reports whether body passes the constraints set on
+// the blocks.
+func (b *heldBlock) acceptsBody(body []byte) bool {
+	return len(body) >= b.minBody && len(body) <= b.maxBody &&
+		(b.valid == nil || b.valid(body))
+}
+
+// hold keeps head and body in the block, the whole block is only
+// emitted once the tail settles it.
+func (m *matcher) hold(yield func(Result) bool, state State, raw []byte) bool {
+	switch state {
+	case STATE_HEAD:
+		m.block.head = len(raw)
+		m.block.buf.Write(raw)
+	case STATE_BODY:
+		m.block.buf.Write(raw)
+	case STATE_TAIL:
+		if m.restarts != nil && !m.restart(yield) {
+			return false
+		}
+		if !m.block.accepts() {
+			return m.reject(yield, raw)
+		}
+		held := m.block.buf.Bytes()
+		defer m.block.buf.Reset()
+		var after []byte
+		if m.context != nil {
+			after = slices.Concat(held[m.block.head:], raw)
+		}
+		if !m.sendAfter(yield, STATE_HEAD, held[:m.block.head], after) {
+			return false
+		}
+		if len(held) > m.block.head &&
+			!m.send(yield, STATE_BODY, held[m.block.head:]) {
+			return false
+		}
+		return m.send(yield, STATE_TAIL, raw)
+	}
+	return true
+}
+
+// reject gives up the block held so far along with raw. Its head is
+// emitted as STATE_NONE and the rest is pushed back in front of the
+// buffer, so that no head within the block is missed. With a
+// fallback pair the region is re-scanned by it instead, the matcher
+// then looks for a head right after the region.
+func (m *matcher) reject(yield func(Result) bool, raw []byte) bool {
+	m.block.buf.Write(raw)
+	region := m.block.buf.Bytes()
+	defer m.block.buf.Reset()
+
+	m.patterns[0].Reset()
+	m.patterns[1].Reset()
+	m.index, m.offset, m.state = 0, 0, STATE_NONE
+	m.warn("block rejected", "bytes", len(region), "offset", m.pos)
+
+	if m.fallback == nil {
+		head := region[:m.block.head]
+		m.buffer = bytes.NewBuffer(slices.Concat(region[m.block.head:], m.buffer.Bytes()))
+		if f, ok := m.patterns[0].(follower); ok {
+			f.follow(head)
+		}
+		m.trail = byteRun{}
+		m.trail.follow(head)
+		return m.send(yield, STATE_NONE, head)
+	}
+	if m.alt == nil {
+		// A block of alt left open at the end of the region is held
+		// back, to be drained as STATE_NONE with the rest
+		m.alt = NewMatcher(m.fallback, WithMaxBodyBytes(math.MaxInt))
+	}
+	for result := range m.alt.Match(string(region)) {
+		if !m.send(yield, result.State(), result.Raw()) {
+			m.alt.Drain()
+			return false
+		}
+	}
+	if rest := m.alt.Drain(); len(rest) > 0 {
+		return m.send(yield, STATE_NONE, []byte(rest))
+	}
+	return true
+}
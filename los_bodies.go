@@ -0,0 +1,168 @@
+package los
+
+import (
+	"errors"
+	"io"
+	"iter"
+)
+
+// BodyReader is the reader of a body yielded by Matcher.Bodies.
+type BodyReader interface {
+	io.ReadCloser
+	// CloseWithError abandons the body, the following Reads return
+	// err, or io.ErrClosedPipe if it is nil. The rest of the body is
+	// then skipped by scanning the input for the tail, it is neither
+	// copied into the buffer of the matcher nor seen by the options
+	// acting on the Results, e.g. WithBodyHash, unless
+	// WithMaxBodyBytes holds the block.
+	CloseWithError(err error) error
+}
+
+func (m *matcher) Bodies(in io.Reader) iter.Seq[io.Reader] {
+	return bodies(m, in)
+}
+
+// skipBody makes the rest of the current body be skipped.
+func (m *matcher) skipBody() {
+	if m.state == STATE_BODY {
+		m.skipping = true
+	}
+}
+
+func bodies(m Matcher, in io.Reader) iter.Seq[io.Reader] {
+	return func(yield func(io.Reader) bool) {
+		var err error
+		next, stop := iter.Pull(iter.Seq[Result](readResults(m, in, &err)))
+		defer stop()
+
+		for {
+			result, ok := next()
+			if !ok {
+				if err != nil {
+					yield(&bodyReader{err: err})
+				}
+				return
+			}
+			if result.State() != STATE_HEAD || depth(result) > 0 {
+				continue
+			}
+			body := &bodyReader{m: m, next: next, fail: &err}
+			if !yield(body) || !body.skip() {
+				return
+			}
+		}
+	}
+}
+
+// readResults yields the Results of m over the chunks read from in,
+// followed by those of Flush once in is over. The error of reading in
+// or of m stops the sequence and is stored in err.
+func readResults(m Matcher, in io.Reader, err *error) Results {
+	return func(yield func(Result) bool) {
+		buf := make([]byte, scanChunkSize)
+		for {
+			n, rerr := in.Read(buf)
+			for result := range m.Match(string(buf[:n])) {
+				if !yield(result) {
+					return
+				}
+			}
+			if *err = m.Err(); *err != nil {
+				return
+			}
+			if errors.Is(rerr, io.EOF) {
+				for result := range m.Flush() {
+					if !yield(result) {
+						return
+					}
+				}
+				*err = m.Err()
+				return
+			}
+			if rerr != nil {
+				*err = rerr
+				return
+			}
+		}
+	}
+}
+
+// bodyReader reads the body of a block out of the Results pulled by
+// Bodies, up to its tail.
+type bodyReader struct {
+	m       Matcher
+	next    func() (Result, bool)
+	fail    *error // error that ended the Results
+	pending []byte // content of the last BODY Result not read yet
+	err     error  // io.EOF once the tail is reached
+	closed  error  // error of CloseWithError
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	if r.closed != nil {
+		return 0, r.closed
+	}
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pull()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *bodyReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+func (r *bodyReader) CloseWithError(err error) error {
+	if r.closed != nil {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	r.pending, r.closed = nil, err
+	if s, ok := r.m.(interface{ skipBody() }); ok && r.err == nil {
+		s.skipBody()
+	}
+	return nil
+}
+
+// pull takes the next Result of the body, the tail ends it and so
+// does the end of the Results, with their error or
+// io.ErrUnexpectedEOF.
+func (r *bodyReader) pull() {
+	result, ok := r.next()
+	switch {
+	case !ok && *r.fail != nil:
+		r.err = *r.fail
+	case !ok:
+		r.err = io.ErrUnexpectedEOF
+	case result.State() == STATE_BODY || depth(result) > 0:
+		r.pending = result.Raw()
+	case result.State() == STATE_TAIL:
+		r.err = io.EOF
+	}
+}
+
+// depth returns the depth of result in a chain, the body of a block
+// of the outer matcher is made of the Results of the inner ones.
+func depth(result Result) int {
+	if r, ok := result.(ChainResult); ok {
+		return r.Depth()
+	}
+	return 0
+}
+
+// skip drops the rest of the body, so that the Results pulled next
+// follow the tail. It reports whether the tail is reached.
+func (r *bodyReader) skip() bool {
+	r.pending = nil
+	for r.err == nil {
+		r.pull()
+	}
+	return r.err == io.EOF
+}
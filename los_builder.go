@@ -0,0 +1,69 @@
+package los
+
+// Head returns the head as given to NewPair.
+func (pair *Pair) Head() string {
+	return pair.head
+}
+
+// Tail returns the tail as given to NewPair.
+func (pair *Pair) Tail() string {
+	return pair.tail
+}
+
+// Name returns the name given by WithName.
+func (pair *Pair) Name() string {
+	return pair.name
+}
+
+// Modes returns the regex modes of head and tail, a literal
+// delimiter has neither REGEX_MODE_PERL nor REGEX_MODE_POSIX.
+func (pair *Pair) Modes() (head, tail regexMode) {
+	return pair.headRegex, pair.tailRegex
+}
+
+// Builder returns a PairBuilder starting from the settings of the
+// pair, the pair itself is left untouched.
+func (pair *Pair) Builder() *PairBuilder {
+	return &PairBuilder{pair: *pair}
+}
+
+// PairBuilder configures a Pair step by step, e.g.
+//
+//	pair := los.NewPairBuilder("<think>", "</think>").
+//		With(los.WithLineAnchoredHead()).
+//		Build()
+type PairBuilder struct {
+	pair Pair
+}
+
+func NewPairBuilder(head, tail string) *PairBuilder {
+	return &PairBuilder{pair: Pair{head: head, tail: tail}}
+}
+
+// Head replaces the head, with the regex mode given if any.
+func (b *PairBuilder) Head(head string, mode ...regexMode) *PairBuilder {
+	b.pair.head = head
+	b.pair = *WithRegexHead(mode...)(&b.pair)
+	return b
+}
+
+// Tail replaces the tail, with the regex mode given if any.
+func (b *PairBuilder) Tail(tail string, mode ...regexMode) *PairBuilder {
+	b.pair.tail = tail
+	b.pair = *WithRegexTail(mode...)(&b.pair)
+	return b
+}
+
+// With applies the options of NewPair.
+func (b *PairBuilder) With(opts ...pairOption) *PairBuilder {
+	for _, opt := range opts {
+		b.pair = *opt(&b.pair)
+	}
+	return b
+}
+
+// Build returns a new Pair, the builder can be used to build more.
+func (b *PairBuilder) Build() *Pair {
+	pair := b.pair
+	return pair.build()
+}
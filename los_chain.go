@@ -0,0 +1,245 @@
+package los
+
+import (
+	"io"
+	"iter"
+	"slices"
+	"sync"
+)
+
+// Chain feeds the body of the blocks of outer into inner, e.g. to
+// extract the code fences and then split their body by lines. The
+// Results of both are yielded in stream order, the HEAD, NONE and
+// TAIL of outer along with the Results of inner in place of the
+// BODY, they implement ChainResult. Inner is drained at every TAIL
+// of outer, its rest is yielded as STATE_NONE, so that a block of
+// inner never spans two blocks of outer. Chains nest as inner, e.g.
+// Chain(sections, Chain(fences, lines)).
+//
+// The chain owns both matchers, Drain and Close propagate to them.
+// It cannot be rewound.
+func Chain(outer, inner Matcher) Matcher {
+	return &chain{outer: outer, inner: inner}
+}
+
+// ChainResult is implemented by the Results of Chain.
+type ChainResult interface {
+	Result
+	// Depth returns 0 for the Results of the outer matcher, 1 for
+	// those of the inner one, and so on for the nested chains.
+	Depth() int
+	// Unwrap returns the Result as yielded by its own matcher, e.g.
+	// to tell its PairResult.
+	Unwrap() Result
+}
+
+type chainResult struct {
+	Result
+	depth int
+}
+
+var _ ChainResult = chainResult{}
+
+func (r chainResult) Depth() int {
+	return r.depth
+}
+
+func (r chainResult) Unwrap() Result {
+	return r.Result
+}
+
+// nest puts result depth levels deeper.
+func nest(result Result, depth int) chainResult {
+	if r, ok := result.(chainResult); ok {
+		r.depth += depth
+		return r
+	}
+	return chainResult{result, depth}
+}
+
+var _ Matcher = (*chain)(nil)
+
+type chain struct {
+	outer, inner Matcher
+	stats        Stats
+	routes       routes
+	err          error  // write error of the routes
+	rest         []byte // input received after err
+	pos          int64  // offset in the stream of the next Result
+
+	closed   sync.Once
+	closeErr error // error of the first Close
+}
+
+func (c *chain) Match(s string) Results {
+	return func(yield func(Result) bool) {
+		c.stats = Stats{}
+		if c.err != nil {
+			c.rest = append(c.rest, s...)
+			return
+		}
+		if c.routes.any() {
+			yield = c.routes.wrap(yield, &c.err)
+		}
+		yield = c.count(yield)
+		defer func() { c.stats.add(c.outer.Stats()) }()
+		for result := range c.outer.Match(s) {
+			if !c.pass(yield, result) {
+				return
+			}
+		}
+	}
+}
+
+// pass yields a Result of outer, the body is matched by inner.
+func (c *chain) pass(yield func(Result) bool, result Result) bool {
+	switch result.State() {
+	case STATE_BODY:
+		defer func() { c.stats.add(c.inner.Stats()) }()
+		for r := range c.inner.Match(result.String()) {
+			if !yield(nest(r, 1)) {
+				return false
+			}
+		}
+		return true
+	case STATE_TAIL:
+		for r := range c.inner.Flush() {
+			if !yield(nest(r, 1)) {
+				return false
+			}
+		}
+		rest := c.inner.Drain()
+		if len(rest) > 0 && !yield(chainResult{textResult{STATE_NONE, []byte(rest)}, 1}) {
+			return false
+		}
+	}
+	return yield(chainResult{result, 0})
+}
+
+// Flush flushes outer, then inner in case outer is left in a block.
+func (c *chain) Flush() Results {
+	return func(yield func(Result) bool) {
+		if c.routes.any() {
+			yield = c.routes.wrap(yield, &c.err)
+		}
+		yield = c.count(yield)
+		for result := range c.outer.Flush() {
+			if !c.pass(yield, result) {
+				return
+			}
+		}
+		for r := range c.inner.Flush() {
+			if !yield(nest(r, 1)) {
+				return
+			}
+		}
+	}
+}
+
+// count wraps yield to count the offset of the Results.
+func (c *chain) count(yield func(Result) bool) func(Result) bool {
+	return func(result Result) bool {
+		c.pos += int64(len(result.Raw()))
+		return yield(result)
+	}
+}
+
+// Drain returns the rest of inner followed by the rest of outer.
+func (c *chain) Drain() string {
+	defer func() { c.rest, c.err = c.rest[:0], nil }()
+	rest := c.inner.Drain() + c.outer.Drain() + string(c.rest)
+	c.pos += int64(len(rest))
+	return rest
+}
+
+func (c *chain) Stats() Stats {
+	stats := c.stats
+	stats.Bytes = c.outer.Stats().Bytes
+	stats.Buffered = c.outer.Stats().Buffered + c.inner.Stats().Buffered
+	return stats
+}
+
+func (c *chain) Rewind(n int) error {
+	return ErrRewindTooFar
+}
+
+// Peek returns the bytes buffered by inner followed by the ones
+// buffered by outer, as they come in the stream.
+func (c *chain) Peek() []byte {
+	inner, outer := c.inner.Peek(), c.outer.Peek()
+	if len(inner) == 0 {
+		return outer
+	}
+	return append(slices.Clip(inner), outer...)
+}
+
+func (c *chain) Remaining() bool {
+	return c.outer.Remaining()
+}
+
+func (c *chain) Go(in <-chan []byte) (<-chan Result, <-chan error) {
+	return goMatch(c, in)
+}
+
+func (c *chain) Bodies(in io.Reader) iter.Seq[io.Reader] {
+	return bodies(c, in)
+}
+
+func (c *chain) Err() error {
+	switch {
+	case c.err != nil:
+		return c.err
+	case c.outer.Err() != nil:
+		return c.outer.Err()
+	}
+	return c.inner.Err()
+}
+
+func (c *chain) Clone() Matcher {
+	return Chain(c.outer.Clone(), c.inner.Clone())
+}
+
+func (c *chain) Route(state State, w io.Writer) {
+	c.routes[state] = w
+}
+
+func (c *chain) Write(p []byte) (int, error) {
+	return write(c, p)
+}
+
+func (c *chain) CloseAndDrain() (string, error) {
+	return closeAndDrain(c)
+}
+
+func (c *chain) undrained() bool {
+	return len(c.rest) > 0 || undrained(c.outer) || undrained(c.inner)
+}
+
+func (c *chain) Close() error {
+	c.closed.Do(func() { c.closeErr = c.close() })
+	return c.closeErr
+}
+
+func (c *chain) close() error {
+	err := c.outer.Close()
+	if innerErr := c.inner.Close(); err == nil {
+		err = innerErr
+	}
+	if err == nil && len(c.rest) > 0 {
+		err = ErrBufferNotDrained
+	}
+	return err
+}
+
+func (c *chain) drainErr() error {
+	if err := drainErr(c.outer); err != nil {
+		return err
+	}
+	if err := drainErr(c.inner); err != nil {
+		return err
+	}
+	if len(c.rest) > 0 {
+		return ErrBufferNotDrained
+	}
+	return nil
+}
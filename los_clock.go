@@ -0,0 +1,22 @@
+package los
+
+import "time"
+
+// WithClock times the blocks with now, e.g. time.Now, the time from
+// the head to the tail is told by the TAIL Result, see Block. The
+// head is timed when it is matched, even if the block is held. The
+// clock also drives WithCoalesce.
+func WithClock(now func() time.Time) matcherOption {
+	return func(m *matcher) *matcher {
+		m.clock = now
+		return m
+	}
+}
+
+// now reads the clock of WithClock, or the wall clock.
+func (m *matcher) now() time.Time {
+	if m.clock != nil {
+		return m.clock()
+	}
+	return time.Now()
+}
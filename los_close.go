@@ -0,0 +1,31 @@
+package los
+
+// WithAutoDrainOnClose makes Close hand the content left in the
+// matcher to fn as a STATE_NONE Result, instead of reporting
+// ErrBufferNotDrained, so that a deferred Close does not lose the
+// tail of a stream.
+func WithAutoDrainOnClose(fn func(Result)) matcherOption {
+	return func(m *matcher) *matcher {
+		m.autoDrain = fn
+		return m
+	}
+}
+
+func (m *matcher) CloseAndDrain() (string, error) {
+	return closeAndDrain(m)
+}
+
+func closeAndDrain(m Matcher) (string, error) {
+	rest := m.Drain()
+	return rest, m.Close()
+}
+
+// drainOnClose hands the content left to the function given by
+// WithAutoDrainOnClose, it reports whether there was any.
+func (m *matcher) drainOnClose() bool {
+	if m.autoDrain == nil || !m.undrained() {
+		return false
+	}
+	m.autoDrain(textResult{STATE_NONE, []byte(m.Drain())})
+	return true
+}
@@ -0,0 +1,77 @@
+package los
+
+import (
+	"slices"
+	"time"
+)
+
+// WithCoalesce merges consecutive Results of the same state, a merged
+// Result is emitted once it reaches n bytes or once every has passed
+// since the last emission. A zero n or every lifts that limit. HEAD
+// and TAIL are emitted right away, the content pending before them is
+// emitted first. The pending content is kept across Match calls and
+// returned by Drain.
+func WithCoalesce(n int, every time.Duration) matcherOption {
+	return func(m *matcher) *matcher {
+		m.coalesce = &coalescer{size: n, every: every}
+		return m
+	}
+}
+
+// coalescer keeps a copy of the content not emitted yet, along with
+// the first Result it was merged into.
+type coalescer struct {
+	size  int
+	every time.Duration
+	last  time.Time
+
+	first   Result
+	pending []byte
+}
+
+func (c *coalescer) wrap(yield func(Result) bool, now func() time.Time) func(Result) bool {
+	return func(result Result) bool {
+		state := result.State()
+		if c.first != nil && c.first.State() != state && !c.flush(yield, now) {
+			return false
+		}
+		if state&1 == 1 {
+			c.last = now()
+			return yield(result)
+		}
+
+		if c.first == nil {
+			c.first = result
+		}
+		c.pending = append(c.pending, result.Raw()...)
+		if (c.size > 0 && len(c.pending) >= c.size) ||
+			(c.every > 0 && now().Sub(c.last) >= c.every) {
+			return c.flush(yield, now)
+		}
+		return true
+	}
+}
+
+// flush emits the pending content as a single Result.
+func (c *coalescer) flush(yield func(Result) bool, now func() time.Time) bool {
+	raw := slices.Clone(c.pending)
+	var result Result
+	switch first := c.first.(type) {
+	case blockResult:
+		first.raw = raw
+		result = first
+	case *pooledResult:
+		block := first.blockResult
+		block.raw = raw
+		result = pooled(block)
+	default:
+		result = textResult{c.first.State(), raw}
+	}
+	c.reset()
+	c.last = now()
+	return yield(result)
+}
+
+func (c *coalescer) reset() {
+	c.first, c.pending = nil, c.pending[:0]
+}
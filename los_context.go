@@ -0,0 +1,32 @@
+package los
+
+// WithContextBytes makes every HEAD and TAIL Result expose up to
+// before bytes of content preceding it with Result.Before, and up to
+// after bytes following it with Result.After. The bytes following a
+// delimiter are never waited for, only the received ones are there.
+func WithContextBytes(before, after int) matcherOption {
+	return func(m *matcher) *matcher {
+		m.context = &contextWindow{before: before, after: after}
+		return m
+	}
+}
+
+// contextWindow remembers the tail of the emitted content.
+type contextWindow struct {
+	before, after int
+	last          []byte
+}
+
+// around returns the context of a Result about to be emitted, the
+// returned slices are copies since the window keeps sliding.
+func (w *contextWindow) around(state State, raw, next []byte) ([]byte, []byte) {
+	var before, after []byte
+	if state&1 == 1 {
+		before = append([]byte(nil), w.last...)
+		after = append([]byte(nil), next[:min(w.after, len(next))]...)
+	}
+
+	w.last = append(w.last, raw[max(0, len(raw)-w.before):]...)
+	w.last = w.last[:copy(w.last, w.last[max(0, len(w.last)-w.before):])]
+	return before, after
+}
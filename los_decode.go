@@ -0,0 +1,32 @@
+package los
+
+import "iter"
+
+// DecodeBlocks matches the chunks of in with m and decodes the body
+// of each block with decode, e.g. a json.Unmarshal into T. A block
+// failing to decode yields its error and the blocks after it are
+// decoded still, the error stopping m is yielded last if any. The
+// content left in m is not drained.
+func DecodeBlocks[T any](m Matcher, in iter.Seq[string], decode func([]byte) (T, error)) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var body []byte
+		for chunk := range in {
+			for result := range m.Match(chunk) {
+				switch result.State() {
+				case STATE_HEAD:
+					body = body[:0]
+				case STATE_BODY:
+					body = append(body, result.Raw()...)
+				case STATE_TAIL:
+					if !yield(decode(body)) {
+						return
+					}
+				}
+			}
+		}
+		if err := m.Err(); err != nil {
+			var zero T
+			yield(zero, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package los
+
+import "unsafe"
+
+// WithDiscardNone drops the content out of blocks, STATE_NONE is
+// neither yielded nor copied into the buffer of matcher. Only the
+// bytes that may open a block are kept across Match calls.
+func WithDiscardNone() matcherOption {
+	return func(m *matcher) *matcher {
+		m.discardNone = true
+		return m
+	}
+}
+
+// WithDiscardBody drops the body of the blocks, STATE_BODY is neither
+// yielded nor copied into the buffer of matcher once the chunk the
+// body starts in is matched, the input is only scanned for the tail.
+// The TAIL Result tells where the block is, see ExtentResult, e.g. to
+// index the delimited regions of a huge file. The options acting on
+// the body, e.g. WithBodyHash, do not see it.
+func WithDiscardBody() matcherOption {
+	return func(m *matcher) *matcher {
+		m.discardBody = true
+		return m
+	}
+}
+
+// Extent is the place of a block in the stream.
+type Extent struct {
+	Offset, Size         int64 // of the whole block
+	BodyOffset, BodySize int64
+}
+
+// ExtentResult is implemented by the Results of a matcher given
+// WithDiscardBody.
+type ExtentResult interface {
+	Result
+	// Extent returns the place of the block for the TAIL Result, and
+	// a zero Extent for the others.
+	Extent() Extent
+}
+
+var _ ExtentResult = blockResult{}
+
+func (r blockResult) Extent() Extent {
+	return r.extent
+}
+
+// extent returns the Extent of the block whose tail of n bytes ends
+// right before m.pos.
+func (m *matcher) extent(n int) Extent {
+	head, body := m.bodyAt[0], m.bodyAt[1]
+	return Extent{
+		Offset:     head,
+		Size:       m.pos - head,
+		BodyOffset: body,
+		BodySize:   m.pos - int64(n) - body,
+	}
+}
+
+// skipNone scans s for a head right from the input, it returns the
+// part of s starting at the first head candidate which needs to be
+// buffered. The head found is scanned again from the buffer.
+func (m *matcher) skipNone(s string) string {
+	if !m.Remaining() {
+		return ""
+	}
+	return m.skip(STATE_NONE, s)
+}
+
+// skip is skipNone for the delimiter that ends state, the tail for
+// STATE_BODY.
+func (m *matcher) skip(state State, s string) string {
+	pattern := m.patterns[state>>1]
+	view := unsafe.Slice(unsafe.StringData(s), len(s))
+	index, offset, ok := pattern.Match(0, 0, view)
+	m.collect(pattern)
+	if f, isFollower := m.patterns[0].(follower); isFollower {
+		f.follow(view[:index])
+	}
+	m.trail.follow(view[:index])
+	m.advance(state, index)
+	if m.text != nil {
+		m.text.add(state, view[:index], m.pos)
+	}
+	if ok {
+		pattern.Reset()
+	} else {
+		m.offset = offset
+	}
+	return s[index:]
+}
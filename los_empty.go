@@ -0,0 +1,44 @@
+package los
+
+import "errors"
+
+var ErrEmptyMatch = errors.New("delimiter matched empty")
+
+type emptyMatchPolicy int
+
+const (
+	// EMPTY_MATCH_SKIP ignores the empty delimiters, the byte at the
+	// empty match is emitted in the current state instead.
+	EMPTY_MATCH_SKIP emptyMatchPolicy = iota
+	// EMPTY_MATCH_ERROR stops matching at the first empty delimiter,
+	// see Matcher.Err.
+	EMPTY_MATCH_ERROR
+	// EMPTY_MATCH_EMIT_BLOCK emits the empty delimiters, except for
+	// an empty head right where the last tail ended, which is skipped
+	// like with EMPTY_MATCH_SKIP. So a pair of empty delimiters yields
+	// one empty block before every byte, whatever the chunking is.
+	EMPTY_MATCH_EMIT_BLOCK
+)
+
+// WithEmptyMatchPolicy decides what happens when the head or tail
+// matches zero bytes, e.g. an empty literal or a regex like "x*".
+// It defaults to EMPTY_MATCH_SKIP.
+func WithEmptyMatchPolicy(policy emptyMatchPolicy) matcherOption {
+	return func(m *matcher) *matcher {
+		m.emptyMatch = policy
+		return m
+	}
+}
+
+// refuseEmpty reports whether the empty delimiter matched at index
+// is not to be taken.
+func (m *matcher) refuseEmpty(index int) bool {
+	if m.emptyMatch != EMPTY_MATCH_EMIT_BLOCK {
+		return true
+	}
+	return m.state == STATE_NONE && index == 0 && m.afterTail
+}
+
+func (m *matcher) Err() error {
+	return m.err
+}
@@ -0,0 +1,84 @@
+package los
+
+import "unicode/utf8"
+
+// maxUndecoded is the bytes a Decoder may leave undecoded before its
+// error is taken for a real one, see WithEncoding.
+const maxUndecoded = 16
+
+// Decoder transcodes a stream into UTF-8 chunk by chunk. It is the
+// transform.Transformer of golang.org/x/text, so that the Decoder of
+// any encoding.Encoding there, e.g. of UTF-16 or of a legacy code
+// page, is a Decoder.
+type Decoder interface {
+	// Transform writes to dst the transcoding of src, it returns the
+	// bytes written and read. The bytes of a unit split across chunks
+	// are left unread with an error, until the next src holds the
+	// whole unit or atEOF is set.
+	Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error)
+	// Reset starts the stream afresh.
+	Reset()
+}
+
+// WithEncoding transcodes the stream with d before matching it. For
+// UTF-16, d is the NewDecoder of unicode.UTF16 in golang.org/x/text,
+// e.g. unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).
+// The delimiters are matched against the UTF-8 transcoding and the
+// Results hold it. A unit split across chunks waits for the next
+// one, or for Flush. Drain drops it. An error of d stops matching,
+// see Matcher.Err.
+func WithEncoding(d Decoder) matcherOption {
+	return func(m *matcher) *matcher {
+		m.decoder = &decoder{d: d}
+		return m
+	}
+}
+
+type decoder struct {
+	d       Decoder
+	pending []byte // bytes of a unit split across chunks
+	dst     []byte
+}
+
+// decode transcodes s with the decoder of WithEncoding, the last
+// bytes of s are kept until their unit is whole unless atEOF is set.
+func (m *matcher) decode(s string, atEOF bool) string {
+	dec := m.decoder
+	if dec == nil || m.err != nil {
+		return s
+	}
+	src := append(dec.pending, s...)
+	var out []byte
+	for {
+		// A unit never takes more room in UTF-8 than utf8.UTFMax
+		// bytes per byte it is made of
+		dst := dec.dst[:cap(dec.dst)]
+		if len(dst) < utf8.UTFMax*len(src)+utf8.UTFMax {
+			dst = make([]byte, utf8.UTFMax*len(src)+utf8.UTFMax)
+			dec.dst = dst
+		}
+		nDst, nSrc, err := dec.d.Transform(dst, src, atEOF)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+		if err == nil || len(src) == 0 {
+			break
+		}
+		if nSrc == 0 && nDst == 0 {
+			if atEOF || len(src) > maxUndecoded {
+				m.fail(err)
+				src = nil
+			}
+			break
+		}
+	}
+	dec.pending = append(dec.pending[:0], src...)
+	return string(out)
+}
+
+// resetDecoder starts the transcoding of a new stream.
+func (m *matcher) resetDecoder() {
+	if m.decoder != nil {
+		m.decoder.d.Reset()
+		m.decoder.pending = m.decoder.pending[:0]
+	}
+}
@@ -0,0 +1,91 @@
+package los
+
+import (
+	"fmt"
+
+	"github.com/humbornjo/los/internal/legex"
+)
+
+// ErrPatternTooComplex is matched by the errors of the regex
+// delimiters too large or nested too deeply to be compiled, see
+// ValidatePair.
+var ErrPatternTooComplex = legex.ErrPatternTooComplex
+
+// CompileLimits bounds the regex delimiters of a pair, MaxInst the
+// instructions of their programs and MaxRepeat the counts of their
+// repetitions, a zero field leaves its bound out.
+type CompileLimits = legex.Limits
+
+// WithCompileLimits makes the regex delimiters beyond limits fail to
+// compile with ErrPatternTooComplex, e.g. the delimiters supplied by
+// the users of a service, which NewPair would otherwise compile into
+// programs of any size. See ValidatePair.
+func WithCompileLimits(limits CompileLimits) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.limits = limits
+		return pair
+	}
+}
+
+// ErrStreamLimit is the ErrStreamTooLong of WithMaxStreamBytes along
+// with its numbers: matching stopped once Have bytes were received
+// beyond Limit. It matches ErrStreamTooLong.
+type ErrStreamLimit struct {
+	Limit int64
+	Have  int64
+}
+
+func (e ErrStreamLimit) Error() string {
+	return fmt.Sprintf("%v: %d bytes received, limit %d", ErrStreamTooLong, e.Have, e.Limit)
+}
+
+func (e ErrStreamLimit) Is(target error) bool {
+	return target == ErrStreamTooLong
+}
+
+// ErrUnterminatedBlock is returned by Close for a matcher left
+// within the block whose head starts at StartOffset in the stream,
+// it matches ErrBufferNotDrained.
+type ErrUnterminatedBlock struct {
+	StartOffset int64
+}
+
+func (e ErrUnterminatedBlock) Error() string {
+	return fmt.Sprintf("%v: block started at offset %d", ErrBufferNotDrained, e.StartOffset)
+}
+
+func (e ErrUnterminatedBlock) Is(target error) bool {
+	return target == ErrBufferNotDrained
+}
+
+// ValidatePair returns the error NewPair would panic with for the
+// same arguments, e.g. one matching ErrPatternTooComplex or
+// ErrEditDistance.
+func ValidatePair(head, tail string, opts ...pairOption) error {
+	pair := &Pair{head: head, tail: tail}
+	for _, opt := range opts {
+		pair = opt(pair)
+	}
+	if err := pair.checkEdit(); err != nil {
+		return err
+	}
+	if _, err := compileRegex(pair.head, pair.headRegex, pair.limits); err != nil {
+		return fmt.Errorf("head: %w", err)
+	}
+	if _, err := compileRegex(pair.tail, pair.tailRegex, pair.limits); err != nil {
+		return fmt.Errorf("tail: %w", err)
+	}
+	return nil
+}
+
+// compileRegex compiles the regex delimiter source within limits, a
+// literal delimiter is left nil.
+func compileRegex(source string, mode regexMode, limits CompileLimits) (*legex.Regexp, error) {
+	switch mode {
+	case REGEX_MODE_PERL:
+		return limits.Compile(source)
+	case REGEX_MODE_POSIX:
+		return limits.CompilePOSIX(source)
+	}
+	return nil, nil
+}
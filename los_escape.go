@@ -0,0 +1,44 @@
+package los
+
+// byteRun is a run of the same byte.
+type byteRun struct {
+	c byte
+	n int
+}
+
+// follow extends the run with raw, the run of raw replaces it unless
+// raw is made of the same byte.
+func (r *byteRun) follow(raw []byte) {
+	if len(raw) == 0 {
+		return
+	}
+	c, n := raw[len(raw)-1], 0
+	for n < len(raw) && raw[len(raw)-1-n] == c {
+		n++
+	}
+	if n == len(raw) && r.c == c {
+		n += r.n
+	}
+	r.c, r.n = c, n
+}
+
+// escaped reports whether the delimiter matched at index of the
+// buffer is escaped, see WithEscape.
+func (m *matcher) escaped(index int) bool {
+	pair := m.pair
+	if m.state == STATE_NONE {
+		pair = m.headPair()
+	}
+	if pair == nil || pair.escape == 0 {
+		return false
+	}
+
+	buffer, n := m.buffer.Bytes(), 0
+	for n < index && buffer[index-1-n] == pair.escape {
+		n++
+	}
+	if n == index && m.trail.c == pair.escape {
+		n += m.trail.n
+	}
+	return n%2 == 1
+}
@@ -0,0 +1,110 @@
+package los
+
+import (
+	"errors"
+	"io"
+	"iter"
+	"os"
+	"unsafe"
+)
+
+// fileWindow is the size of the windows of a file fed to the matcher
+// by MatchFile.
+const fileWindow = 1 << 20
+
+// MatchFile segments the file at path with a matcher of pair and
+// opts. The file is memory-mapped where the platform allows it, and
+// read window by window otherwise, so that only the bytes not
+// classified yet are held on the heap however large the file is.
+// Once the file is over, the blocks held by the matcher are flushed
+// and the content left is yielded as a last STATE_NONE Result, like
+// Scanner does. An error of opening or reading the file stops the
+// sequence, as does an error of the matcher, the last Result is then
+// an ErrorResult.
+func MatchFile(path string, pair *Pair, opts ...matcherOption) iter.Seq[Result] {
+	return func(yield func(Result) bool) {
+		f, err := os.Open(path)
+		if err != nil {
+			yield(errorResult{err: err})
+			return
+		}
+		defer f.Close() // nolint: errcheck
+		info, err := f.Stat()
+		if err != nil {
+			yield(errorResult{err: err})
+			return
+		}
+		m := NewMatcher(pair, opts...)
+		defer m.Close() // nolint: errcheck
+
+		size := info.Size()
+		data, unmap, err := mapFile(f, size)
+		if err == nil {
+			defer unmap()
+		}
+		var buf []byte
+		if data == nil {
+			buf = make([]byte, min(size, fileWindow))
+		}
+		for at := int64(0); at < size; {
+			var window []byte
+			if data != nil {
+				window = data[at:min(at+fileWindow, size)]
+			} else if n, err := f.ReadAt(buf, at); n > 0 {
+				window = buf[:n]
+			} else {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF // the file shrank
+				}
+				yield(errorResult{err: err})
+				return
+			}
+			// The matcher copies what it holds on to, the window is
+			// not retained past Match.
+			if !yieldAll(yield, m.Match(unsafe.String(unsafe.SliceData(window), len(window)))) {
+				return
+			}
+			at += int64(len(window))
+			if err := m.Err(); err != nil {
+				yield(errorResult{err: err})
+				return
+			}
+		}
+		if !yieldAll(yield, m.Flush()) {
+			return
+		}
+		if rest := m.Drain(); len(rest) > 0 {
+			yield(textResult{STATE_NONE, []byte(rest)})
+		}
+	}
+}
+
+// ErrorResult is the last Result of MatchFile and MatchFileParallel
+// when an error stops them, it holds no content.
+type ErrorResult interface {
+	Result
+	// Err returns the error that stopped the sequence.
+	Err() error
+}
+
+type errorResult struct {
+	textResult
+	err error
+}
+
+var _ ErrorResult = errorResult{}
+
+func (r errorResult) Err() error {
+	return r.err
+}
+
+// yieldAll passes the Results of rs on to yield, it reports whether
+// yield asks for more.
+func yieldAll(yield func(Result) bool, rs Results) bool {
+	for result := range rs {
+		if !yield(result) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,14 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package los
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is not supported on this platform, MatchFile reads the
+// file window by window instead.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.ErrUnsupported
+}
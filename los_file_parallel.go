@@ -0,0 +1,297 @@
+package los
+
+import (
+	"iter"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// minSegment is the smallest segment of a file scanned on its own by
+// MatchFileParallel.
+const minSegment = 1 << 20
+
+// MatchFileParallel is MatchFile scanning segments of the file on up
+// to workers goroutines. A file is split at positions no head or tail
+// may straddle, found by matching the delimiters around them within
+// their maximum length, see Pair.MaxHeadLen. Since whether a segment
+// starts within a block is only known once the previous one is
+// scanned, the segments but the first are scanned both from outside
+// and from within a block, the Results are then merged in order.
+//
+// The Results are split differently but hold the same content in the
+// same states as those of MatchFile, they reference the mapped file
+// and stay valid until the sequence is over. The file is scanned by
+// MatchFile at once if it is not mapped, or if the pair can not be
+// split safely: a delimiter which is unbounded, may match zero bytes
+// or depends on the bytes around it, e.g. "\b", WithEscape and
+// WithLineAnchoredHead, a fuzzy head and the CSV records.
+func MatchFileParallel(path string, pair *Pair, workers int) iter.Seq[Result] {
+	return func(yield func(Result) bool) {
+		splitter, ok := newSplitter(pair)
+		if !ok || workers < 2 {
+			MatchFile(path, pair)(yield)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			yield(errorResult{err: err})
+			return
+		}
+		defer f.Close() // nolint: errcheck
+		info, err := f.Stat()
+		if err != nil {
+			yield(errorResult{err: err})
+			return
+		}
+		data, unmap, err := mapFile(f, info.Size())
+		if err != nil || data == nil {
+			if err == nil {
+				unmap()
+			}
+			MatchFile(path, pair)(yield)
+			return
+		}
+		defer unmap()
+
+		segments := splitter.split(data, max(len(data)/(4*workers), minSegment))
+		runs := scanSegments(data, pair, segments, workers)
+		defer runs.stop()
+
+		start, state := 0, STATE_NONE
+		for i := range segments {
+			<-runs.done[i]
+			r := runs.runs[i][state>>1]
+			for _, s := range r.spans {
+				if !yield(textResult{s.state, data[start:s.end]}) {
+					return
+				}
+				start = s.end
+			}
+			if r.err != nil {
+				yield(errorResult{err: r.err})
+				return
+			}
+			state = r.state
+		}
+	}
+}
+
+// splitter finds the positions of a stream no delimiter of a pair
+// straddles.
+type splitter struct {
+	delimiters []*regexp.Regexp // the delimiters anchored at both ends
+	maxLen     int
+}
+
+// newSplitter reports false if the delimiters of pair may straddle
+// any position, or depend on the bytes around them.
+func newSplitter(pair *Pair) (*splitter, bool) {
+	if pair.newHead != nil || pair.newTail != nil || pair.maxEdit > 0 || pair.escape != 0 || pair.headLine {
+		return nil, false
+	}
+	s := &splitter{}
+	for _, d := range []struct {
+		source string
+		mode   regexMode
+		maxLen func() (int, bool)
+	}{{pair.head, pair.headRegex, pair.MaxHeadLen}, {pair.tail, pair.tailRegex, pair.MaxTailLen}} {
+		n, bounded := d.maxLen()
+		if !bounded || matchesEmpty(d.source, d.mode) {
+			return nil, false
+		}
+		source, flags := regexp.QuoteMeta(d.source), syntax.Perl
+		if d.mode != _REGEX_MODE_NONE {
+			source = d.source
+			if d.mode == REGEX_MODE_POSIX {
+				flags = syntax.POSIX
+			}
+			re, err := syntax.Parse(source, flags)
+			if err != nil || hasAssertion(re) {
+				return nil, false
+			}
+		}
+		compile := regexp.Compile
+		if d.mode == REGEX_MODE_POSIX {
+			compile = regexp.CompilePOSIX
+		}
+		re, err := compile(`^(` + source + `)$`)
+		if err != nil {
+			return nil, false
+		}
+		s.delimiters = append(s.delimiters, re)
+		s.maxLen = max(s.maxLen, n)
+	}
+	return s, true
+}
+
+// hasAssertion reports whether re looks at the bytes around a match.
+func hasAssertion(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasAssertion(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// safe reports whether no delimiter may straddle the position at of
+// data, which must start a rune.
+func (s *splitter) safe(data []byte, at int) bool {
+	if at < len(data) && !utf8.RuneStart(data[at]) {
+		return false
+	}
+	for start := max(at-s.maxLen+1, 0); start < at; start++ {
+		for end := at + 1; end <= min(start+s.maxLen, len(data)); end++ {
+			for _, re := range s.delimiters {
+				if re.Match(data[start:end]) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// split returns the ends of the segments of data, of about size
+// bytes each. A segment grows until its end is safe.
+func (s *splitter) split(data []byte, size int) []int {
+	var ends []int
+	for at := size; at < len(data); at += size {
+		for at < len(data) && !s.safe(data, at) {
+			at++
+		}
+		if at < len(data) {
+			ends = append(ends, at)
+		}
+	}
+	return append(ends, len(data))
+}
+
+// segmentRun is the outcome of scanning a segment from a state.
+type segmentRun struct {
+	spans []segmentSpan
+	state State // the state at the end of the segment
+	err   error // of the matcher
+}
+
+// segmentSpan is a Result as the position of its end in the file.
+type segmentSpan struct {
+	state State
+	end   int
+}
+
+// segmentRuns holds the runs of the segments of a file, by the state
+// they start from, the runs of a segment are complete once its done
+// channel is closed.
+type segmentRuns struct {
+	runs    [][2]segmentRun
+	done    []chan struct{}
+	stopped atomic.Bool
+	wg      sync.WaitGroup
+}
+
+// stop abandons the segments not scanned yet and waits for the ones
+// being scanned, they read the mapped file.
+func (r *segmentRuns) stop() {
+	r.stopped.Store(true)
+	r.wg.Wait()
+}
+
+// scanSegments scans the segments of data ending at ends on workers
+// goroutines, in order.
+func scanSegments(data []byte, pair *Pair, ends []int, workers int) *segmentRuns {
+	r := &segmentRuns{runs: make([][2]segmentRun, len(ends)), done: make([]chan struct{}, len(ends))}
+	type job struct {
+		segment int
+		from    State
+	}
+	jobs := make(chan job)
+	pending := make([]atomic.Int32, len(ends))
+	for i := range ends {
+		r.done[i] = make(chan struct{})
+		pending[i].Store(2)
+	}
+	pending[0].Store(1)
+
+	r.wg.Add(workers + 1)
+	go func() {
+		defer r.wg.Done()
+		defer close(jobs)
+		for i := range ends {
+			for _, state := range []State{STATE_NONE, STATE_BODY} {
+				if i == 0 && state == STATE_BODY {
+					continue
+				}
+				if r.stopped.Load() {
+					return
+				}
+				jobs <- job{i, state}
+			}
+		}
+	}()
+	for range workers {
+		go func() {
+			defer r.wg.Done()
+			for j := range jobs {
+				if r.stopped.Load() {
+					continue
+				}
+				start := 0
+				if j.segment > 0 {
+					start = ends[j.segment-1]
+				}
+				last := j.segment == len(ends)-1
+				r.runs[j.segment][j.from>>1] = scanSegment(data[start:ends[j.segment]], start, pair, j.from, last)
+				if pending[j.segment].Add(-1) == 0 {
+					close(r.done[j.segment])
+				}
+			}
+		}()
+	}
+	return r
+}
+
+// scanSegment matches segment, found at start of the file, from the
+// state from. The content left at the end is in the state the
+// segment ends with, or in STATE_NONE for the last segment as for
+// MatchFile.
+func scanSegment(segment []byte, start int, pair *Pair, from State, last bool) segmentRun {
+	m := NewMatcher(pair).(*matcher)
+	defer m.Close() // nolint: errcheck
+	m.state = from
+
+	var run segmentRun
+	end := start
+	add := func(state State, n int) {
+		end += n
+		run.spans = append(run.spans, segmentSpan{state, end})
+	}
+	for at := 0; at < len(segment); at += fileWindow {
+		window := segment[at:min(at+fileWindow, len(segment))]
+		for result := range m.Match(unsafe.String(unsafe.SliceData(window), len(window))) {
+			add(result.State(), len(result.Raw()))
+		}
+	}
+	for result := range m.Flush() {
+		add(result.State(), len(result.Raw()))
+	}
+	run.state, run.err = m.state, m.Err()
+	rest, state := m.Drain(), run.state
+	if last {
+		state = STATE_NONE
+	}
+	if len(rest) > 0 {
+		add(state, len(rest))
+	}
+	return run
+}
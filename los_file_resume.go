@@ -0,0 +1,111 @@
+package los
+
+import (
+	"encoding/binary"
+	"iter"
+	"os"
+)
+
+// checkpointVersion leads the state of a checkpoint, so that a state
+// saved by an older release is told apart.
+const checkpointVersion = 1
+
+// CheckpointResult is implemented by the Results of MatchFileFrom.
+type CheckpointResult interface {
+	Result
+	// Checkpoint returns the offset of the file right after the
+	// Result and the state of the matcher there, MatchFileFrom
+	// resumes from them as if it never stopped.
+	Checkpoint() (offset int64, state []byte)
+}
+
+type checkpointResult struct {
+	Result
+	offset int64
+	state  State // the state resumed from
+	trail  byteRun
+}
+
+var _ CheckpointResult = checkpointResult{}
+
+func (r checkpointResult) Checkpoint() (int64, []byte) {
+	state := []byte{checkpointVersion, byte(r.state), r.trail.c}
+	return r.offset, binary.AppendUvarint(state, uint64(r.trail.n))
+}
+
+// MatchFileFrom segments the file at path from offset on, in the
+// manner of tail -f: the Results implement CheckpointResult, and the
+// checkpoint of the last Result handled is where a log shipper
+// resumes after a restart. With a nil state, the file is matched from
+// offset on as if it started there. Unlike MatchFile, the content not
+// classified at the end of the file is not yielded, it is read again
+// from the last checkpoint once the file has grown. A state which is
+// not of a checkpoint, or an error of opening or reading the file,
+// stops the sequence.
+func MatchFileFrom(path string, offset int64, state []byte, pair *Pair, opts ...matcherOption) iter.Seq[Result] {
+	return func(yield func(Result) bool) {
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		m := NewMatcher(pair, opts...).(*matcher)
+		defer m.Close()
+		if !m.resume(offset, state) {
+			return
+		}
+
+		checkpoint := func(result Result) bool {
+			resumed := STATE_NONE
+			if s := result.State(); s == STATE_HEAD || s == STATE_BODY {
+				resumed = STATE_BODY
+			}
+			return yield(checkpointResult{result, m.pos, resumed, m.trail})
+		}
+		buf := make([]byte, fileWindow)
+		for at := offset; ; {
+			n, _ := f.ReadAt(buf, at)
+			if n == 0 {
+				m.Drain()
+				return
+			}
+			for result := range m.Match(string(buf[:n])) {
+				if !checkpoint(result) {
+					m.Drain()
+					return
+				}
+			}
+			if m.Err() != nil {
+				return
+			}
+			at += int64(n)
+		}
+	}
+}
+
+// resume sets m up to match from the checkpoint at offset, it reports
+// false if state is not of a checkpoint.
+func (m *matcher) resume(offset int64, state []byte) bool {
+	m.pos = offset
+	if len(state) == 0 {
+		return true
+	}
+	if len(state) < 3 || state[0] != checkpointVersion {
+		return false
+	}
+	s := State(state[1])
+	n, k := binary.Uvarint(state[3:])
+	if (s != STATE_NONE && s != STATE_BODY) || k <= 0 || 3+k != len(state) {
+		return false
+	}
+
+	m.state, m.emitted = s, s
+	if m.invariant != nil {
+		m.invariant.last = s
+	}
+	m.trail = byteRun{state[2], int(n)}
+	if f, ok := m.patterns[0].(follower); ok && n > 0 {
+		f.follow([]byte{state[2]})
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package los
+
+// Implemented with Sellers' dynamic programming for approximate
+// forward search. Each cell of the column also tracks where its
+// cheapest alignment started, so the matched region can be cut
+// out of the buffer once the distance drops below the threshold.
+type fuzzyPattern struct {
+	k      int
+	source string
+	dist   []int // dist[i] is the edit distance of source[:i]
+	start  []int // start[i] is where the alignment of dist[i] began
+}
+
+var _ pattern = (*fuzzyPattern)(nil)
+
+func newFuzzyPattern(source string, k int) *fuzzyPattern {
+	if k >= len(source) {
+		panic("los: edit distance must be less than the delimiter length")
+	}
+	n := len(source) + 1
+	return &fuzzyPattern{k, source, make([]int, n), make([]int, n)}
+}
+
+// Match rescans from index on every call, the held back region is
+// bounded by len(source)+k so this stays cheap. offset is ignored
+// since the alignment state can not be resumed from a length.
+//
+// A hit is not accepted right away unless it is exact, the next
+// byte may still keep or lower the distance (e.g. "BEGI" is 1 edit
+// away from "BEGIN", but the following "N" makes it 0).
+func (pat *fuzzyPattern) Match(index int, _ int, buffer []byte) (int, int, bool) {
+	m, k := len(pat.source), pat.k
+	for i := range pat.dist {
+		pat.dist[i], pat.start[i] = i, index
+	}
+
+	hit, hitStart, hitEnd := -1, 0, 0
+	for j := index; j < len(buffer); j++ {
+		diag, diagStart := pat.dist[0], pat.start[0]
+		pat.dist[0], pat.start[0] = 0, j+1
+		for i := 1; i <= m; i++ {
+			d, s := diag, diagStart
+			if buffer[j] != pat.source[i-1] {
+				d++
+			}
+			if pat.dist[i]+1 < d { // extra byte in buffer
+				d, s = pat.dist[i]+1, pat.start[i]
+			}
+			if pat.dist[i-1]+1 < d { // byte missing from buffer
+				d, s = pat.dist[i-1]+1, pat.start[i-1]
+			}
+			diag, diagStart = pat.dist[i], pat.start[i]
+			pat.dist[i], pat.start[i] = d, s
+		}
+
+		d := pat.dist[m]
+		switch {
+		case hit >= 0 && d > hit:
+			return hitStart, hitEnd - hitStart, true
+		case d <= k:
+			hit, hitStart, hitEnd = d, pat.start[m], j+1
+			if hit == 0 {
+				return hitStart, hitEnd - hitStart, true
+			}
+		}
+	}
+
+	// Hold back the earliest alignment that may still turn into a
+	// match with the upcoming bytes.
+	hold := len(buffer)
+	if hit >= 0 {
+		hold = hitStart
+	}
+	for i := 1; i <= m; i++ {
+		if pat.dist[i] <= k {
+			hold = min(hold, pat.start[i])
+		}
+	}
+	return hold, len(buffer) - hold, false
+}
+
+func (pat *fuzzyPattern) Reset() {}
+
+func (pat *fuzzyPattern) Clear() {}
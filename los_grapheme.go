@@ -0,0 +1,146 @@
+package los
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// WithGraphemeSafety holds back the end of the BODY Results until
+// the grapheme cluster it belongs to is known to be over, so that a
+// renderer consuming the Results never draws half an emoji ZWJ
+// sequence, a letter without its combining marks, or half a flag.
+// The clusters follow the rules of UAX #29 for CR LF, the extending
+// and spacing marks, ZWJ sequences, emoji modifiers and regional
+// indicator pairs, the Hangul and Indic rules are left out. The held
+// content is emitted before the TAIL Result, and returned by Drain.
+func WithGraphemeSafety() matcherOption {
+	return func(m *matcher) *matcher {
+		m.grapheme = &graphemeHold{}
+		return m
+	}
+}
+
+// graphemeHold keeps a copy of the last grapheme cluster of the BODY
+// emitted, along with the Result it was cut from.
+type graphemeHold struct {
+	first   Result
+	pending []byte
+}
+
+func (g *graphemeHold) wrap(yield func(Result) bool) func(Result) bool {
+	return func(result Result) bool {
+		if result.State() != STATE_BODY {
+			if g.first != nil && !g.flush(yield) {
+				return false
+			}
+			return yield(result)
+		}
+
+		raw := result.Raw()
+		if g.first != nil {
+			raw = append(g.pending, raw...)
+		}
+		cut := lastCluster(raw)
+		if cut > 0 && !yield(withRaw(result, raw[:cut:cut])) {
+			return false
+		}
+		g.reset()
+		if cut < len(raw) {
+			g.first, g.pending = result, append([]byte(nil), raw[cut:]...)
+		}
+		return true
+	}
+}
+
+// flush emits the content held as a BODY Result.
+func (g *graphemeHold) flush(yield func(Result) bool) bool {
+	result := withRaw(g.first, g.pending)
+	g.reset()
+	return yield(result)
+}
+
+func (g *graphemeHold) reset() {
+	g.first, g.pending = nil, nil
+}
+
+// withRaw returns result with its content replaced by raw.
+func withRaw(result Result, raw []byte) Result {
+	switch r := result.(type) {
+	case blockResult:
+		r.raw = raw
+		return r
+	case *pooledResult:
+		block := r.blockResult
+		block.raw = raw
+		return pooled(block)
+	}
+	return textResult{result.State(), raw}
+}
+
+// lastCluster returns where the last grapheme cluster of raw starts,
+// along with the first bytes of a rune split at its end.
+func lastCluster(raw []byte) int {
+	end := len(raw)
+	for i := len(raw) - 1; i >= max(len(raw)-utf8.UTFMax+1, 0); i-- {
+		if utf8.RuneStart(raw[i]) {
+			if !utf8.FullRune(raw[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if end == 0 {
+		return 0
+	}
+
+	next, at := utf8.DecodeLastRune(raw[:end])
+	at = end - at
+	for at > 0 {
+		prev, width := utf8.DecodeLastRune(raw[:at])
+		if graphemeBreak(raw[:at-width], prev, next) {
+			break
+		}
+		next, at = prev, at-width
+	}
+	return at
+}
+
+// graphemeBreak reports whether a grapheme cluster boundary lies
+// between prev and next, before is the content preceding prev.
+func graphemeBreak(before []byte, prev, next rune) bool {
+	switch {
+	case prev == '\r' && next == '\n':
+		return false
+	case unicode.IsControl(prev) || unicode.IsControl(next):
+		return true
+	case extends(next):
+		return false
+	case prev == zwj && unicode.Is(unicode.So, next):
+		return false
+	case isRegionalIndicator(prev) && isRegionalIndicator(next):
+		// Regional indicators pair up from the start of their run
+		n := 1
+		for len(before) > 0 {
+			r, width := utf8.DecodeLastRune(before)
+			if !isRegionalIndicator(r) {
+				break
+			}
+			n, before = n+1, before[:len(before)-width]
+		}
+		return n%2 == 0
+	}
+	return true
+}
+
+const zwj = '\u200d'
+
+// extends reports whether r never starts a grapheme cluster: the
+// marks, ZWJ, the variation selectors and the emoji modifiers.
+func extends(r rune) bool {
+	return r == zwj || unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc, unicode.Variation_Selector) ||
+		(r >= 0x1f3fb && r <= 0x1f3ff) || (r >= 0xe0020 && r <= 0xe007f)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
@@ -0,0 +1,84 @@
+package los
+
+import (
+	"bytes"
+	"slices"
+)
+
+// WithLazyTail closes a block at the first tail following its head,
+// which is the default.
+func WithLazyTail() matcherOption {
+	return func(m *matcher) *matcher {
+		m.greedy = nil
+		return m
+	}
+}
+
+// WithGreedyTail closes a block at the last tail following its head
+// instead of the first, for when the tail may be part of the body,
+// e.g. a "}" closing a JSON object. The tails found are held as body
+// until the block outgrows the limit of WithMaxBodyBytes or the input
+// is over, see Matcher.Flush, the block is then closed at the last
+// one and the content after it is matched again.
+func WithGreedyTail() matcherOption {
+	return func(m *matcher) *matcher {
+		m.holdBlocks()
+		m.greedy = &greedyTail{at: -1}
+		return m
+	}
+}
+
+// greedyTail locates the last tail found in the block held, at is
+// negative when there is none.
+type greedyTail struct {
+	at, end int
+}
+
+// settle closes the block held at the last tail found, the content
+// held after it is pushed back in front of the buffer.
+func (m *matcher) settle(yield func(Result) bool) bool {
+	g := m.greedy
+	held := m.block.buf.Bytes()
+	tail, rest := slices.Clone(held[g.at:g.end]), slices.Clone(held[g.end:])
+	m.block.buf.Truncate(g.at)
+	g.at = -1
+
+	m.buffer = bytes.NewBuffer(slices.Concat(rest, m.buffer.Bytes()))
+	m.patterns[0].Reset()
+	m.patterns[1].Reset()
+	m.index, m.offset, m.state = 0, 0, STATE_NONE
+	if f, ok := m.patterns[0].(follower); ok {
+		f.follow(tail)
+	}
+	m.trail = byteRun{}
+	m.trail.follow(tail)
+	return m.hold(yield, STATE_TAIL, tail)
+}
+
+func (m *matcher) Flush() Results {
+	return func(y func(Result) bool) {
+		m.stats = Stats{}
+		m.record(recordFlush, "")
+		m.ending = true
+		defer func() { m.ending = false }()
+		rest := m.decode("", true)
+		m.endUTF8()
+		if m.err != nil {
+			return
+		}
+		more := true
+		yield := m.wrap(func(r Result) bool {
+			more = y(r)
+			return more
+		})
+		// The patterns holding a match back for more input report it
+		_, holds := m.patterns[m.state>>1].(ender)
+		if len(rest) > 0 || m.unscanned > 0 || (holds && m.buffer.Len() > 0) {
+			m.unscanned = 0
+			m.match(yield, rest)
+		}
+		if more && m.greedy != nil && m.greedy.at >= 0 && m.settle(yield) {
+			m.match(yield, "")
+		}
+	}
+}
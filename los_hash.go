@@ -0,0 +1,54 @@
+package los
+
+import (
+	"hash"
+	"time"
+)
+
+// WithBodyHash hashes the body of each block as it streams through,
+// e.g. with sha256.New, so that verifying the content does not need
+// to buffer the body again. The sum is told by the TAIL Result, see
+// Block. The hash is not rewound by Matcher.Rewind, a body rewound
+// into is hashed twice.
+func WithBodyHash(h func() hash.Hash) matcherOption {
+	return func(m *matcher) *matcher {
+		m.hash = h()
+		return m
+	}
+}
+
+// Block is implemented by the Results of a matcher configured with
+// WithBodyHash or WithClock.
+type Block interface {
+	Result
+	// Sum returns the hash of the whole body for the TAIL Result, and
+	// nil for the others.
+	Sum() []byte
+	// Duration returns the time from the head to the tail for the
+	// TAIL Result, and 0 for the others.
+	Duration() time.Duration
+}
+
+var _ Block = blockResult{}
+
+func (r blockResult) Sum() []byte {
+	return r.sum
+}
+
+func (r blockResult) Duration() time.Duration {
+	return r.duration
+}
+
+// digest feeds the hash with the Result about to be sent, it returns
+// the sum once the block is complete.
+func (m *matcher) digest(state State, raw []byte) []byte {
+	switch state {
+	case STATE_HEAD:
+		m.hash.Reset()
+	case STATE_BODY:
+		m.hash.Write(raw) // nolint: errcheck
+	case STATE_TAIL:
+		return m.hash.Sum(nil)
+	}
+	return nil
+}
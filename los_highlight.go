@@ -0,0 +1,66 @@
+package los
+
+import "github.com/humbornjo/los/internal/legex"
+
+// WithBodyHighlighter matches re within the BODY of the blocks, the
+// ranges matched are returned by Highlights of the BODY Results, so
+// that e.g. the keywords of a code block are found without scanning
+// the Results again. The ranges are relative to Raw of the Result the
+// match ends in, a match started in an earlier BODY Result of the
+// same block has a negative start. A match never runs across blocks,
+// the empty matches are left out. The ranges are not adjusted by
+// WithCoalesce nor WithGraphemeSafety.
+func WithBodyHighlighter(re string) matcherOption {
+	regex := legex.MustCompile(re)
+	return func(m *matcher) *matcher {
+		m.highlight = &highlighter{pat: newRegexPattern(regex)}
+		m.tune(m.highlight.pat)
+		return m
+	}
+}
+
+// highlighter runs the regex of WithBodyHighlighter over the BODY,
+// it keeps the content in which a match may still start.
+type highlighter struct {
+	pat    *regexPattern
+	held   []byte
+	offset int // bytes of held already scanned
+}
+
+// highlight returns the ranges matched up to the end of raw, the
+// block is over once state is not STATE_BODY.
+func (h *highlighter) highlight(state State, raw []byte) [][2]int {
+	if state != STATE_BODY {
+		h.reset()
+		return nil
+	}
+
+	var ranges [][2]int
+	prior := len(h.held) // bytes of held before raw
+	h.held = append(h.held, raw...)
+	cut := 0
+	for cut < len(h.held) {
+		index, offset, ok := h.pat.Match(0, h.offset, h.held[cut:])
+		if !ok {
+			cut, h.offset = cut+index, offset
+			break
+		}
+		h.offset = 0
+		if offset == 0 {
+			// Step over one byte so that the match moves on
+			h.pat.Reset()
+			cut += index + 1
+			continue
+		}
+		start := cut + index - prior
+		ranges = append(ranges, [2]int{start, start + offset})
+		cut += index + offset
+	}
+	h.held = append(h.held[:0], h.held[min(cut, len(h.held)):]...)
+	return ranges
+}
+
+func (h *highlighter) reset() {
+	h.pat.Reset()
+	h.held, h.offset = h.held[:0], 0
+}
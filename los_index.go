@@ -0,0 +1,48 @@
+package los
+
+import "iter"
+
+// IndexSpan is where a Result is in the stream, see
+// Matcher.MatchIndex. The offsets are counted across Drain, as those
+// of Submatch, in bytes, and in runes and UTF-16 code units given
+// WithTextOffsets.
+type IndexSpan struct {
+	State      State
+	Start, End int64
+
+	counted      bool
+	runes, units [2]int64
+}
+
+func (m *matcher) MatchIndex(s string) iter.Seq[IndexSpan] {
+	return func(yield func(IndexSpan) bool) {
+		m.feed(func(result Result) bool {
+			// The Result is yielded right after it is sent
+			if r, ok := result.(SpanResult); ok && m.text != nil {
+				return yield(r.Span())
+			}
+			return yield(IndexSpan{State: result.State(), Start: m.pos - int64(len(result.Raw())), End: m.pos})
+		}, s)
+	}
+}
+
+// MatchIndex counts the offsets over the Results of the chain, which
+// add up to the stream, see count.
+func (c *chain) MatchIndex(s string) iter.Seq[IndexSpan] {
+	return func(yield func(IndexSpan) bool) {
+		c.stats = Stats{}
+		if c.err != nil {
+			c.rest = append(c.rest, s...)
+			return
+		}
+		defer func() { c.stats.add(c.outer.Stats()) }()
+		span := c.count(func(result Result) bool {
+			return yield(IndexSpan{State: result.State(), Start: c.pos - int64(len(result.Raw())), End: c.pos})
+		})
+		for result := range c.outer.Match(s) {
+			if !c.pass(span, result) {
+				return
+			}
+		}
+	}
+}
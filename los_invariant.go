@@ -0,0 +1,51 @@
+package los
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvariant = errors.New("states out of order")
+
+// WithInvariantChecks checks that the Results follow the grammar
+// NONE* (HEAD BODY* TAIL NONE*)*, the last block being possibly left
+// open, whatever the other options are. A Result out of order stops
+// matching before it is emitted, Matcher.Err then reports
+// ErrInvariant. It guards the code downstream relying on the order
+// against a regression of the matcher, at the cost of a check per
+// Result.
+func WithInvariantChecks() matcherOption {
+	return func(m *matcher) *matcher {
+		m.invariant = &invariant{last: STATE_NONE}
+		return m
+	}
+}
+
+// invariant keeps the state of the last Result checked.
+type invariant struct {
+	last State
+}
+
+// follows tells the states that may come after each state.
+var follows = [4][2]State{
+	STATE_NONE: {STATE_NONE, STATE_HEAD},
+	STATE_HEAD: {STATE_BODY, STATE_TAIL},
+	STATE_BODY: {STATE_BODY, STATE_TAIL},
+	STATE_TAIL: {STATE_NONE, STATE_HEAD},
+}
+
+// checkOrder wraps yield to check the order of the Results, the
+// first one out of order stops matching.
+func (m *matcher) checkOrder(yield func(Result) bool) func(Result) bool {
+	v := m.invariant
+	return func(result Result) bool {
+		state := result.State()
+		if state < STATE_NONE || state > STATE_TAIL ||
+			(state != follows[v.last][0] && state != follows[v.last][1]) {
+			m.fail(fmt.Errorf("%w: %s after %s", ErrInvariant, state, v.last))
+			return false
+		}
+		v.last = state
+		return yield(result)
+	}
+}
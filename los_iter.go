@@ -0,0 +1,94 @@
+package los
+
+import "iter"
+
+// FilterState yields the Results of rs in any of states.
+func FilterState(rs Results, states ...State) Results {
+	return func(yield func(Result) bool) {
+		for result := range rs {
+			for _, state := range states {
+				if result.State() == state && !yield(result) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// MapString yields the content of the Results of rs.
+func MapString(rs Results) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for result := range rs {
+			if !yield(result.String()) {
+				return
+			}
+		}
+	}
+}
+
+// Tee splits rs into two sequences yielding the same Results, the
+// ones not yet seen by the other sequence are copied out of the
+// matcher buffer and kept until it gets them. The sequences are not
+// to be iterated concurrently, and rs is stopped once both of them
+// are done with.
+func Tee(rs Results) (Results, Results) {
+	t := &tee{}
+	return t.side(rs, 0), t.side(rs, 1)
+}
+
+type tee struct {
+	next    func() (Result, bool)
+	stop    func()
+	queues  [2][]Result
+	stopped [2]bool
+	done    bool
+}
+
+func (t *tee) side(rs Results, i int) Results {
+	return func(yield func(Result) bool) {
+		for {
+			var result Result
+			if len(t.queues[i]) > 0 {
+				result, t.queues[i] = t.queues[i][0], t.queues[i][1:]
+			} else if !t.pull(rs, i, &result) {
+				return
+			}
+			if !yield(result) {
+				t.quit(i)
+				return
+			}
+		}
+	}
+}
+
+// pull takes the next Result of rs for the sequence i, it is queued
+// for the other one.
+func (t *tee) pull(rs Results, i int, result *Result) bool {
+	if t.done {
+		return false
+	}
+	if t.next == nil {
+		t.next, t.stop = iter.Pull(iter.Seq[Result](rs))
+	}
+	r, ok := t.next()
+	if !ok {
+		t.done = true
+		return false
+	}
+	*result = detach(r)
+	if other := 1 - i; !t.stopped[other] {
+		t.queues[other] = append(t.queues[other], *result)
+	}
+	return true
+}
+
+// quit marks the sequence i as done with, rs is stopped along with
+// the last one.
+func (t *tee) quit(i int) {
+	t.stopped[i] = true
+	t.queues[i] = nil
+	if t.stopped[0] && t.stopped[1] && t.stop != nil {
+		t.stop()
+		t.done = true
+	}
+}
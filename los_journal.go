@@ -0,0 +1,51 @@
+package los
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// WithJournal appends a record to w at every state transition, so
+// that the Results can be rebuilt from the journal and the original
+// stream without matching again, see Replay. A record is made of
+//
+//   - the varint distance from the offset of the previous record to
+//     the offset in the stream the new state starts at, negative
+//     after a Matcher.Rewind;
+//   - the new state as a single byte;
+//   - the uvarint index of the pair in NewMultiMatcher, 0 otherwise.
+//
+// The content returned by Drain is journaled as STATE_NONE. A write
+// error stops matching, see Matcher.Err.
+func WithJournal(w io.Writer) matcherOption {
+	return func(m *matcher) *matcher {
+		m.journal = &journal{w: w, state: -1}
+		return m
+	}
+}
+
+type journal struct {
+	w      io.Writer
+	last   int64 // offset of the last record
+	state  State // state of the last record
+	record []byte
+}
+
+// journalize records the transition to state if any.
+func (m *matcher) journalize(state State) {
+	j := m.journal
+	if state == j.state || m.err != nil {
+		return
+	}
+	pair := 0
+	if m.heads != nil && state != STATE_NONE {
+		pair = m.heads.winner
+	}
+	j.record = binary.AppendVarint(j.record[:0], m.pos-j.last)
+	j.record = append(j.record, byte(state))
+	j.record = binary.AppendUvarint(j.record, uint64(pair))
+	if _, err := j.w.Write(j.record); err != nil {
+		m.fail(err)
+	}
+	j.last, j.state = m.pos, state
+}
@@ -0,0 +1,259 @@
+package los
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type keyedOption func(*KeyedMatcher) *KeyedMatcher
+
+// KeyedMatcher matches many independent streams, e.g. the sessions
+// of a server, each key having a matcher of its own which is created
+// by the first Match of the key. It is safe for concurrent use, the
+// Matches of distinct keys run concurrently while those of the same
+// key wait for each other, so a Match of a key is not to be called
+// while iterating over the Results of the same key.
+type KeyedMatcher struct {
+	pair    *Pair
+	opts    []matcherOption
+	maxKeys int
+	ttl     time.Duration
+	onEvict func(key, drained string)
+	now     func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	lru      list.List // of *session, the most recently used first
+}
+
+// session is the stream of a key.
+type session struct {
+	key     string
+	mu      sync.Mutex
+	m       Matcher
+	used    time.Time   // last Match, guarded by the KeyedMatcher
+	stale   atomic.Bool // removed from the sessions, to be ended
+	evicted bool        // m is drained, the key starts a new session
+}
+
+func NewKeyedMatcher(pair *Pair, opts ...keyedOption) *KeyedMatcher {
+	k := &KeyedMatcher{pair: pair, sessions: map[string]*list.Element{}, now: time.Now}
+	for _, opt := range opts {
+		k = opt(k)
+	}
+	return k
+}
+
+// WithMaxKeys bounds the sessions of a KeyedMatcher to n, the least
+// recently matched one is evicted to make room for a new key, see
+// WithOnEvict.
+func WithMaxKeys(n int) keyedOption {
+	return func(k *KeyedMatcher) *KeyedMatcher {
+		k.maxKeys = n
+		return k
+	}
+}
+
+// WithSessionTTL evicts the sessions not matched for longer than
+// ttl, so that the abandoned ones release their buffers. They are
+// evicted by the Matches of the other keys, and by
+// KeyedMatcher.Expire, e.g. called by a time.Ticker.
+func WithSessionTTL(ttl time.Duration) keyedOption {
+	return func(k *KeyedMatcher) *KeyedMatcher {
+		k.ttl = ttl
+		return k
+	}
+}
+
+// WithOnEvict calls fn with the key of every session evicted by
+// WithMaxKeys or WithSessionTTL and the content it had left, as
+// Matcher.Drain returns it, which is dropped otherwise. A session
+// evicted while its Results are iterated over is told once the
+// iteration is done. fn is not called for KeyedMatcher.Drain, nor
+// with the locks of the KeyedMatcher held.
+func WithOnEvict(fn func(key, drained string)) keyedOption {
+	return func(k *KeyedMatcher) *KeyedMatcher {
+		k.onEvict = fn
+		return k
+	}
+}
+
+// WithSessionOptions gives opts to the matcher of every key.
+func WithSessionOptions(opts ...matcherOption) keyedOption {
+	return func(k *KeyedMatcher) *KeyedMatcher {
+		k.opts = opts
+		return k
+	}
+}
+
+// Match matches chunk in the stream of key, as Matcher.Match does.
+func (k *KeyedMatcher) Match(key string, chunk string) Results {
+	return func(yield func(Result) bool) {
+		s := k.lock(key)
+		defer k.release(s)
+		for result := range s.m.Match(chunk) {
+			if !yield(result) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error that stopped matching the stream of key, if
+// any, see Matcher.Err.
+func (k *KeyedMatcher) Err(key string) error {
+	s := k.find(key)
+	if s == nil {
+		return nil
+	}
+	defer s.mu.Unlock()
+	return s.m.Err()
+}
+
+// Drain ends the session of key, it returns the content left as
+// Matcher.Drain does. The next Match of key starts a new session.
+func (k *KeyedMatcher) Drain(key string) string {
+	s := k.find(key)
+	if s == nil {
+		return ""
+	}
+	defer s.mu.Unlock()
+	k.mu.Lock()
+	k.remove(s)
+	k.mu.Unlock()
+	return k.end(s)
+}
+
+// Expire evicts the sessions idle beyond WithSessionTTL.
+func (k *KeyedMatcher) Expire() {
+	k.mu.Lock()
+	evicted := k.expired(nil)
+	k.mu.Unlock()
+	for _, e := range evicted {
+		k.sweep(e)
+	}
+}
+
+// Len returns the number of sessions.
+func (k *KeyedMatcher) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.sessions)
+}
+
+// lock returns the session of key locked, it starts one if there is
+// none, evicting the least recently used ones beyond WithMaxKeys.
+func (k *KeyedMatcher) lock(key string) *session {
+	for {
+		k.mu.Lock()
+		var s *session
+		if e, ok := k.sessions[key]; ok {
+			s = e.Value.(*session)
+			k.lru.MoveToFront(e)
+		} else {
+			s = &session{key: key, m: NewMatcher(k.pair, k.opts...)}
+			k.sessions[key] = k.lru.PushFront(s)
+		}
+		evicted := k.expired(s)
+		s.used = k.now()
+		for k.maxKeys > 0 && len(k.sessions) > k.maxKeys {
+			last := k.lru.Back().Value.(*session)
+			k.remove(last)
+			evicted = append(evicted, last)
+		}
+		k.mu.Unlock()
+
+		for _, e := range evicted {
+			k.sweep(e)
+		}
+		s.mu.Lock()
+		if !s.evicted {
+			return s
+		}
+		s.mu.Unlock() // ended meanwhile, start over
+	}
+}
+
+// find returns the session of key locked, or nil if there is none.
+func (k *KeyedMatcher) find(key string) *session {
+	k.mu.Lock()
+	e, ok := k.sessions[key]
+	k.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	s := e.Value.(*session)
+	s.mu.Lock()
+	if s.evicted {
+		s.mu.Unlock()
+		return nil
+	}
+	return s
+}
+
+// expired removes the sessions idle beyond WithSessionTTL but keep,
+// k.mu is held.
+func (k *KeyedMatcher) expired(keep *session) []*session {
+	if k.ttl <= 0 {
+		return nil
+	}
+	var evicted []*session
+	now := k.now()
+	for e := k.lru.Back(); e != nil; {
+		s, prev := e.Value.(*session), e.Prev()
+		if s != keep {
+			if now.Sub(s.used) <= k.ttl {
+				break
+			}
+			k.remove(s)
+			evicted = append(evicted, s)
+		}
+		e = prev
+	}
+	return evicted
+}
+
+// remove takes s out of the sessions, k.mu is held. It is ended by
+// the goroutine holding it, see unlock.
+func (k *KeyedMatcher) remove(s *session) {
+	if e, ok := k.sessions[s.key]; ok && e.Value == s {
+		delete(k.sessions, s.key)
+		k.lru.Remove(e)
+	}
+	s.stale.Store(true)
+}
+
+// release unlocks s, it ends s if it was evicted meanwhile.
+func (k *KeyedMatcher) release(s *session) {
+	s.mu.Unlock()
+	k.sweep(s)
+}
+
+// sweep ends s once it is removed from the sessions, unless a Match
+// holds it, which is then to end it, see release. So a session is
+// never waited for by another key, e.g. one evicted while its Results
+// are iterated over.
+func (k *KeyedMatcher) sweep(s *session) {
+	if !s.stale.Load() || !s.mu.TryLock() {
+		return
+	}
+	ended := !s.evicted
+	rest := k.end(s)
+	s.mu.Unlock()
+	if ended && k.onEvict != nil {
+		k.onEvict(s.key, rest)
+	}
+}
+
+// end drains and closes the matcher of s, s.mu is held.
+func (k *KeyedMatcher) end(s *session) string {
+	if s.evicted {
+		return ""
+	}
+	s.evicted = true
+	rest := s.m.Drain()
+	s.m.Close() // nolint: errcheck
+	return rest
+}
@@ -0,0 +1,122 @@
+package los
+
+import (
+	"regexp/syntax"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxHeadLen returns the length of the longest head the pair may
+// match, a partial head never holds back more than that minus one
+// byte. It reports false if the head is an unbounded regex.
+func (pair *Pair) MaxHeadLen() (int, bool) {
+	if pair.newHead != nil {
+		return 0, false
+	}
+	return pair.maxLen(pair.head, pair.headRegex, pair.headProg)
+}
+
+// MaxTailLen is the MaxHeadLen of the tail.
+func (pair *Pair) MaxTailLen() (int, bool) {
+	if pair.newTail != nil {
+		return 0, false
+	}
+	return pair.maxLen(pair.tail, pair.tailRegex, pair.tailProg)
+}
+
+func (pair *Pair) maxLen(source string, mode regexMode, c compiled) (int, bool) {
+	switch {
+	case mode == _REGEX_MODE_NONE:
+		return len(source) + pair.maxEdit, true
+	case c.literals != nil:
+		n := 0
+		for _, literal := range c.literals {
+			n = max(n, len(literal))
+		}
+		return n, true
+	}
+
+	flags := syntax.Perl
+	if mode == REGEX_MODE_POSIX {
+		flags = syntax.POSIX
+	}
+	re, err := syntax.Parse(source, flags)
+	if err != nil {
+		return 0, false
+	}
+	n := regexMaxLen(re.Simplify())
+	return n, n >= 0
+}
+
+// regexMaxLen returns the length in bytes of the longest string re
+// may match, or -1 if there is none.
+func regexMaxLen(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		n := 0
+		for _, r := range re.Rune {
+			n += runeMaxLen(r, re.Flags&syntax.FoldCase != 0)
+		}
+		return n
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return 0
+		}
+		return runeMaxLen(re.Rune[len(re.Rune)-1], false)
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return utf8.UTFMax
+	case syntax.OpStar, syntax.OpPlus:
+		return -1
+	case syntax.OpQuest, syntax.OpCapture:
+		return regexMaxLen(re.Sub[0])
+	case syntax.OpRepeat:
+		n := regexMaxLen(re.Sub[0])
+		if re.Max < 0 || n < 0 {
+			return -1
+		}
+		return n * re.Max
+	case syntax.OpConcat:
+		total := 0
+		for _, sub := range re.Sub {
+			n := regexMaxLen(sub)
+			if n < 0 {
+				return -1
+			}
+			total += n
+		}
+		return total
+	case syntax.OpAlternate:
+		longest := 0
+		for _, sub := range re.Sub {
+			n := regexMaxLen(sub)
+			if n < 0 {
+				return -1
+			}
+			longest = max(longest, n)
+		}
+		return longest
+	default: // empty width operators
+		return 0
+	}
+}
+
+// runeMaxLen returns the length in bytes of the longest encoding of
+// r, along with its case variants if fold is set.
+func runeMaxLen(r rune, fold bool) int {
+	n := runeLen(r)
+	if fold {
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			n = max(n, runeLen(f))
+		}
+	}
+	return n
+}
+
+// runeLen is utf8.RuneLen, except that the runes which can not be
+// encoded count as the utf8.RuneError they are decoded into.
+func runeLen(r rune) int {
+	if n := utf8.RuneLen(r); n > 0 {
+		return n
+	}
+	return utf8.RuneLen(utf8.RuneError)
+}
@@ -0,0 +1,37 @@
+package los
+
+// WithMaxBlocks stops matching once n blocks are completed, the rest
+// of the stream is passed through as STATE_NONE without being held
+// back. See Matcher.Remaining.
+func WithMaxBlocks(n int) matcherOption {
+	return func(m *matcher) *matcher {
+		m.maxBlocks = n
+		return m
+	}
+}
+
+func (m *matcher) Remaining() bool {
+	return m.maxBlocks <= 0 || m.blocks < m.maxBlocks
+}
+
+// WithMaxStreamBytes stops matching once n bytes are received, the
+// first n bytes are matched and Matcher.Err then reports an
+// ErrStreamLimit, the bytes beyond are only buffered until Drain.
+// The bytes received are counted by Stats.
+func WithMaxStreamBytes(n int64) matcherOption {
+	return func(m *matcher) *matcher {
+		m.maxStream = n
+		return m
+	}
+}
+
+// limit counts the bytes of s, it cuts the bytes beyond the limit
+// of WithMaxStreamBytes.
+func (m *matcher) limit(s string) (string, string) {
+	keep := len(s)
+	if m.maxStream > 0 {
+		keep = int(min(int64(keep), max(0, m.maxStream-m.received)))
+	}
+	m.received += int64(len(s))
+	return s[:keep], s[keep:]
+}
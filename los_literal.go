@@ -0,0 +1,184 @@
+package los
+
+import (
+	"regexp/syntax"
+	"slices"
+)
+
+// maxLiteralAlternation bounds the number of literals a regex may
+// expand into before it is left to the regex VM.
+const maxLiteralAlternation = 64
+
+// literalAlternation reports whether expr only ever matches one of
+// a finite set of literals, e.g. "error|warn|info" or "ab[cd]". The
+// literals are returned in priority order of the alternation.
+func literalAlternation(expr string, mode regexMode) ([]string, bool) {
+	flags := syntax.Perl
+	if mode == REGEX_MODE_POSIX {
+		flags = syntax.POSIX
+	}
+	re, err := syntax.Parse(expr, flags)
+	if err != nil {
+		return nil, false
+	}
+
+	var expand func(re *syntax.Regexp) ([]string, bool)
+	expand = func(re *syntax.Regexp) ([]string, bool) {
+		switch re.Op {
+		case syntax.OpLiteral:
+			if re.Flags&syntax.FoldCase != 0 {
+				return nil, false
+			}
+			return []string{string(re.Rune)}, true
+		case syntax.OpEmptyMatch:
+			return []string{""}, true
+		case syntax.OpQuest:
+			subs, ok := expand(re.Sub[0])
+			if !ok || len(subs) == maxLiteralAlternation {
+				return nil, false
+			}
+			if re.Flags&syntax.NonGreedy != 0 {
+				return append([]string{""}, subs...), true
+			}
+			return append(subs, ""), true
+		case syntax.OpCharClass:
+			var literals []string
+			for i := 0; i < len(re.Rune); i += 2 {
+				for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+					if len(literals) == maxLiteralAlternation {
+						return nil, false
+					}
+					literals = append(literals, string(r))
+				}
+			}
+			return literals, true
+		case syntax.OpAlternate:
+			var literals []string
+			for _, sub := range re.Sub {
+				subs, ok := expand(sub)
+				if !ok || len(literals)+len(subs) > maxLiteralAlternation {
+					return nil, false
+				}
+				literals = append(literals, subs...)
+			}
+			return literals, true
+		case syntax.OpConcat:
+			literals := []string{""}
+			for _, sub := range re.Sub {
+				subs, ok := expand(sub)
+				if !ok || len(literals)*len(subs) > maxLiteralAlternation {
+					return nil, false
+				}
+				product := make([]string, 0, len(literals)*len(subs))
+				for _, prefix := range literals {
+					for _, suffix := range subs {
+						product = append(product, prefix+suffix)
+					}
+				}
+				literals = product
+			}
+			return literals, true
+		default:
+			return nil, false
+		}
+	}
+
+	literals, ok := expand(re.Simplify())
+	if !ok || slices.Contains(literals, "") {
+		return nil, false
+	}
+	return literals, true
+}
+
+// Implemented with a byte trie of the alternatives, anchored at
+// each position whose first byte can open one of them. Only the
+// priority among literals starting at the same position follows
+// the regex mode: the first alternative for REGEX_MODE_PERL and
+// the longest one for REGEX_MODE_POSIX. The trie is read only once
+// built, so one literalPattern serves all the matchers of a pair.
+type literalPattern struct {
+	longest bool
+	nodes   []literalNode
+	first   [256]bool
+}
+
+type literalNode struct {
+	next     map[byte]int
+	priority int // priority of the literal ending here, -1 if none
+	minBelow int // best priority among strict descendants
+}
+
+var _ pattern = (*literalPattern)(nil)
+
+func newLiteralPattern(literals []string, mode regexMode) *literalPattern {
+	pat := &literalPattern{longest: mode == REGEX_MODE_POSIX}
+	pat.nodes = append(pat.nodes, literalNode{map[byte]int{}, -1, len(literals)})
+	for priority, literal := range literals {
+		pat.first[literal[0]] = true
+		n := 0
+		for i := 0; i < len(literal); i++ {
+			node := &pat.nodes[n]
+			node.minBelow = min(node.minBelow, priority)
+			next, ok := node.next[literal[i]]
+			if !ok {
+				next = len(pat.nodes)
+				node.next[literal[i]] = next
+				pat.nodes = append(pat.nodes, literalNode{map[byte]int{}, -1, len(literals)})
+			}
+			n = next
+		}
+		if pat.nodes[n].priority < 0 {
+			pat.nodes[n].priority = priority
+		}
+	}
+	return pat
+}
+
+// Match rescans from index on every call since the held back
+// region is never longer than the longest literal.
+func (pat *literalPattern) Match(index int, _ int, buffer []byte) (int, int, bool) {
+	n := len(buffer)
+	for p := index; p < n; p++ {
+		if !pat.first[buffer[p]] {
+			continue
+		}
+
+		best, bestLen, node := -1, 0, 0
+		for i := p; ; i++ {
+			if i == n {
+				// Running out of buffer in the middle of the trie, a
+				// better literal may still show up with more bytes.
+				if best < 0 || pat.prefersBelow(node, best) {
+					return p, n - p, false
+				}
+				break
+			}
+			next, ok := pat.nodes[node].next[buffer[i]]
+			if !ok {
+				break
+			}
+			node = next
+			if priority := pat.nodes[node].priority; priority >= 0 &&
+				(best < 0 || pat.longest || priority < best) {
+				best, bestLen = priority, i+1-p
+			}
+		}
+		if best >= 0 {
+			return p, bestLen, true
+		}
+	}
+	return n, 0, false
+}
+
+// prefersBelow reports whether a literal under node would take
+// precedence over the one already found with priority best.
+func (pat *literalPattern) prefersBelow(node int, best int) bool {
+	if pat.longest {
+		return len(pat.nodes[node].next) > 0
+	}
+	return pat.nodes[node].minBelow < best
+}
+
+func (pat *literalPattern) Reset() {}
+
+func (pat *literalPattern) Clear() {}
@@ -0,0 +1,35 @@
+package los
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger tells logger about what changes the matching silently,
+// i.e. an empty delimiter stepped over, a block rejected or a
+// partial delimiter cut by WithLookbackLimit, and about the errors
+// stopping it. The records are logged at level, slog.LevelWarn by
+// default.
+func WithLogger(logger *slog.Logger, level ...slog.Level) matcherOption {
+	l := slog.LevelWarn
+	if len(level) > 0 {
+		l = level[0]
+	}
+	return func(m *matcher) *matcher {
+		m.logger, m.logLevel = logger, l
+		return m
+	}
+}
+
+// warn logs msg along with the key-value pairs of args.
+func (m *matcher) warn(msg string, args ...any) {
+	if m.logger != nil {
+		m.logger.Log(context.Background(), m.logLevel, msg, args...)
+	}
+}
+
+// fail stops the matching with err, see Matcher.Err.
+func (m *matcher) fail(err error) {
+	m.err = err
+	m.warn("matching stopped", "err", err, "offset", m.pos)
+}
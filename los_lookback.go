@@ -0,0 +1,39 @@
+package los
+
+// WithLookbackLimit never holds back more than n bytes for a partial
+// delimiter, the bytes beyond are emitted in the current state and
+// the delimiter is looked for again in the last n bytes. It bounds
+// the memory of the matcher for infinite streams when a regex such
+// as "<[^>]*>" may go on forever. The limit is raised for bounded
+// delimiters so that they are never cut, see Pair.MaxHeadLen.
+func WithLookbackLimit(n int) matcherOption {
+	return func(m *matcher) *matcher {
+		pairs := []*Pair{m.pair}
+		if m.heads != nil {
+			pairs = m.heads.pairs
+		}
+		m.lookback = [2]int{n, n}
+		for _, pair := range pairs {
+			if l, ok := pair.MaxHeadLen(); ok {
+				m.lookback[0] = max(m.lookback[0], l-1)
+			}
+			if l, ok := pair.MaxTailLen(); ok {
+				m.lookback[1] = max(m.lookback[1], l-1)
+			}
+		}
+		return m
+	}
+}
+
+// bound gives up the partial delimiter beyond the lookback limit,
+// it returns the index the buffer is released up to.
+func (m *matcher) bound(pattern pattern, index, offset int) int {
+	limit := m.lookback[m.state>>1]
+	if limit <= 0 || offset <= limit {
+		return index
+	}
+	pattern.Reset()
+	m.offset = 0
+	m.warn("partial delimiter cut", "state", m.state, "bytes", offset-limit)
+	return index + offset - limit
+}
@@ -0,0 +1,25 @@
+package los
+
+// WithMinScanSize leaves the input of Match to a later Match until n
+// bytes are received, so that the tiny chunks of a model streaming
+// tokens run the regex machines far less often, at the cost of the
+// Results coming up to n bytes later. Flush scans the input postponed
+// right away, though it also settles the blocks of WithGreedyTail.
+func WithMinScanSize(n int) matcherOption {
+	return func(m *matcher) *matcher {
+		m.minScan = n
+		return m
+	}
+}
+
+// postpone reports whether s is buffered for a later scan, the bytes
+// postponed are scanned along with the ones reaching the minimum.
+func (m *matcher) postpone(s string) bool {
+	if m.err != nil || m.unscanned+len(s) >= m.minScan {
+		m.unscanned = 0
+		return false
+	}
+	m.buffer.WriteString(s)
+	m.unscanned += len(s)
+	return true
+}
@@ -0,0 +1,231 @@
+package los
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// WithPriority ranks the pair among the other pairs of a multi-pair
+// matcher, the higher one wins when two heads start at the same
+// offset. It has no effect on a single-pair matcher.
+func WithPriority(n int) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.priority = n
+		return pair
+	}
+}
+
+// NewMultiMatcher matches several pairs against the same stream, a
+// block opened by the head of one pair is only closed by the tail
+// of the same pair. The heads compete as follows:
+//
+//  1. the head starting earliest in the stream wins;
+//  2. among heads starting at the same offset, the pair with the
+//     highest priority (see WithPriority) wins;
+//  3. among equal priorities, the pair registered first wins.
+//
+// A head is only committed once no other head can start before it
+// or at the same offset with a higher rank, which may hold back a
+// complete head until more bytes arrive. The Results are thus yielded
+// strictly in stream order whatever the pairs are, and the same
+// Results are yielded whatever the chunking of the stream is, except
+// for how the content is split between Results of the same state.
+// The HEAD, BODY and TAIL Results implement PairResult.
+func NewMultiMatcher(pairs []*Pair, opts ...matcherOption) Matcher {
+	if len(pairs) == 0 {
+		panic("los: multi-pair matcher needs at least one pair")
+	}
+	heads := &headSet{
+		pairs:   pairs,
+		heads:   make([]pattern, len(pairs)),
+		tails:   make([]pattern, len(pairs)),
+		bases:   make([]int, len(pairs)),
+		offsets: make([]int, len(pairs)),
+		indexes: make([]int, len(pairs)),
+		partial: make([]bool, len(pairs)),
+		found:   make([]bool, len(pairs)),
+		lengths: make([]int, len(pairs)),
+	}
+	heads.order.hs = heads
+	for i, pair := range pairs {
+		heads.heads[i] = pair.newHeadPattern()
+		heads.tails[i] = pair.newTailPattern()
+	}
+
+	m := &matcher{
+		state:    STATE_NONE,
+		buffer:   bytes.NewBuffer(nil),
+		patterns: [2]pattern{heads, heads.tails[0]},
+		heads:    heads,
+		opts:     opts,
+	}
+	for _, opt := range opts {
+		m = opt(m)
+	}
+	return m
+}
+
+// PairResult is implemented by the HEAD, BODY and TAIL Results of a
+// multi-pair matcher.
+type PairResult interface {
+	Result
+	// Pair returns the pair whose head opened the block
+	Pair() *Pair
+}
+
+var _ PairResult = blockResult{}
+
+func (r blockResult) Pair() *Pair {
+	return r.pair
+}
+
+// headSet matches the heads of all pairs as a single pattern. Each
+// head sees the buffer from its own base, so that it is resumed as
+// if the buffer was consumed up to the index it returned last.
+type headSet struct {
+	pairs   []*Pair
+	heads   []pattern
+	tails   []pattern
+	bases   []int
+	offsets []int
+	winner  int
+
+	// scratch of Match
+	indexes []int
+	partial []bool
+	found   []bool
+	lengths []int
+	order   headOrder
+
+	// wait for all the heads starting at the same offset, whatever
+	// their rank is, see WithSpeculation
+	waitAll bool
+	end     bool // see MatchEnd
+}
+
+// headOrder is a heap of the heads found by the last Match, the
+// first one starts the earliest in the stream, the ties are broken
+// by rank, see outranks.
+type headOrder struct {
+	hs  *headSet
+	ids []int
+}
+
+func (o *headOrder) Len() int { return len(o.ids) }
+
+func (o *headOrder) Less(a, b int) bool {
+	i, j := o.ids[a], o.ids[b]
+	indexes := o.hs.indexes
+	return indexes[i] < indexes[j] || (indexes[i] == indexes[j] && o.hs.outranks(i, j))
+}
+
+func (o *headOrder) Swap(a, b int) { o.ids[a], o.ids[b] = o.ids[b], o.ids[a] }
+
+func (o *headOrder) Push(x any) { o.ids = append(o.ids, x.(int)) }
+
+func (o *headOrder) Pop() any {
+	x := o.ids[len(o.ids)-1]
+	o.ids = o.ids[:len(o.ids)-1]
+	return x
+}
+
+var _ pattern = (*headSet)(nil)
+
+// outranks reports whether head i wins over head j at the same offset.
+func (hs *headSet) outranks(i, j int) bool {
+	pi, pj := hs.pairs[i].priority, hs.pairs[j].priority
+	return pi > pj || (pi == pj && i < j)
+}
+
+// MatchEnd is Match with buffer being the end of the stream, see ender.
+func (hs *headSet) MatchEnd(index int, offset int, buffer []byte) (int, int, bool) {
+	hs.end = true
+	defer func() { hs.end = false }()
+	return hs.Match(index, offset, buffer)
+}
+
+func (hs *headSet) Match(_ int, _ int, buffer []byte) (int, int, bool) {
+	n := len(buffer)
+	indexes, partial := hs.indexes, hs.partial
+	hs.order.ids = hs.order.ids[:0]
+	for i, head := range hs.heads {
+		base := hs.bases[i]
+		if f, ok := head.(follower); ok && base > 0 {
+			f.follow(buffer[:base])
+		}
+		index, offset, ok := matchAt(head, hs.end, 0, hs.offsets[i], buffer[base:])
+		index += base
+		indexes[i], partial[i], hs.found[i], hs.lengths[i] = index, false, ok, offset
+		if !ok {
+			hs.bases[i], hs.offsets[i] = index, offset
+			partial[i] = offset > 0
+			continue
+		}
+		// Found heads are rescanned from scratch if not committed
+		hs.offsets[i] = 0
+		heap.Push(&hs.order, i)
+	}
+
+	best, bestIndex, bestOffset := -1, 0, 0
+	if hs.order.Len() > 0 {
+		best = hs.order.ids[0]
+		bestIndex, bestOffset = indexes[best], hs.lengths[best]
+	}
+
+	hold := n
+	for i := range hs.heads {
+		if partial[i] && (best < 0 || indexes[i] < bestIndex ||
+			(indexes[i] == bestIndex && (hs.waitAll || hs.outranks(i, best)))) {
+			hold = min(hold, indexes[i])
+		}
+	}
+	if best >= 0 && hold == n {
+		hs.Reset()
+		hs.winner = best
+		return bestIndex, bestOffset, true
+	}
+
+	// Wait for the heads that may still beat the best one, or for
+	// the partial heads if there is none.
+	if best >= 0 {
+		hold = min(hold, bestIndex)
+	}
+	for i := range hs.bases {
+		hs.bases[i] -= min(hold, hs.bases[i])
+	}
+	return hold, n - hold, false
+}
+
+// candidates returns the heads found at the offset of the winner by
+// the last Match.
+func (hs *headSet) candidates() []int {
+	var candidates []int
+	for i := range hs.heads {
+		if hs.found[i] && hs.indexes[i] == hs.indexes[hs.winner] {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+func (hs *headSet) follow(raw []byte) {
+	for _, head := range hs.heads {
+		if f, ok := head.(follower); ok {
+			f.follow(raw)
+		}
+	}
+}
+
+func (hs *headSet) Reset() {
+	for i, head := range hs.heads {
+		head.Reset()
+		hs.bases[i], hs.offsets[i] = 0, 0
+	}
+}
+
+func (hs *headSet) Clear() {
+	for i := range hs.heads {
+		hs.heads[i].Clear()
+		hs.tails[i].Clear()
+	}
+}
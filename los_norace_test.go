@@ -0,0 +1,5 @@
+//go:build !race
+
+package los
+
+const raceEnabled = false
@@ -0,0 +1,301 @@
+package los
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrSpec is returned by BuildPipeline for a spec it cannot build,
+// Path tells where in the spec, e.g. "stages[0].pairs[1].head".
+type ErrSpec struct {
+	Path string
+	Err  error
+}
+
+func (e ErrSpec) Error() string {
+	if e.Path == "" {
+		return "spec: " + e.Err.Error()
+	}
+	return fmt.Sprintf("spec: %s: %v", e.Path, e.Err)
+}
+
+func (e ErrSpec) Unwrap() error {
+	return e.Err
+}
+
+// Pipeline is a chain of matchers described by a spec, see
+// BuildPipeline. It is safe for concurrent use, each NewMatcher
+// starts a stream of its own.
+type Pipeline struct {
+	stages []stage
+	routes map[string]string // sink by state name
+}
+
+type stage struct {
+	pairs []*Pair
+	opts  []matcherOption
+}
+
+// pipelineSpec is the spec of BuildPipeline.
+type pipelineSpec struct {
+	Stages []stageSpec       `json:"stages"`
+	Routes map[string]string `json:"routes"`
+}
+
+type stageSpec struct {
+	Pairs      []pairSpec      `json:"pairs"`
+	Transforms []transformSpec `json:"transforms"`
+}
+
+type pairSpec struct {
+	Name             string `json:"name"`
+	Head             string `json:"head"`
+	Tail             string `json:"tail"`
+	HeadRegex        string `json:"head_regex"`
+	TailRegex        string `json:"tail_regex"`
+	LineAnchoredHead bool   `json:"line_anchored_head"`
+	Escape           string `json:"escape"`
+	Priority         int    `json:"priority"`
+	MaxEditDistance  int    `json:"max_edit_distance"`
+}
+
+// transformSpec is a matcher option acting on the Results of a stage,
+// Type tells which one and the other fields are its arguments.
+type transformSpec struct {
+	Type  string `json:"type"`
+	N     int    `json:"n"`
+	Every string `json:"every"`
+	Regex string `json:"regex"`
+}
+
+var regexModes = map[string]regexMode{"": _REGEX_MODE_NONE, "perl": REGEX_MODE_PERL, "posix": REGEX_MODE_POSIX}
+
+// BuildPipeline builds a pipeline from its JSON or YAML spec, so that
+// the blocks to extract are configured without recompiling, e.g.
+//
+//	{
+//	  "stages": [
+//	    {"pairs": [{"head": "```", "tail": "```", "line_anchored_head": true}]},
+//	    {"pairs": [{"head": "TODO", "tail": "\n"}], "transforms": [{"type": "discard_none"}]}
+//	  ],
+//	  "routes": {"body": "todos"}
+//	}
+//
+// The stages are chained from the first, the outer one, to the last,
+// see Chain, a stage of many pairs is a multi-pair matcher. A pair
+// takes the options of NewPair, "head_regex" and "tail_regex" being
+// "perl" or "posix". The transforms are the matcher options
+// "discard_none", "grapheme_safety", "greedy_tail", "coalesce" of
+// "n" bytes and "every" duration, "max_body_bytes", "lookback_limit"
+// and "max_blocks" of "n", and "highlight" of "regex". The routes
+// name the sink of the Results of a state, see Pipeline.NewMatcher.
+// A spec not starting with "{" is taken as YAML, with the same fields.
+// The errors are ErrSpec.
+func BuildPipeline(spec []byte) (Pipeline, error) {
+	if trimmed := bytes.TrimSpace(spec); len(trimmed) > 0 && trimmed[0] != '{' {
+		var err error
+		if spec, err = yamlToJSON(spec); err != nil {
+			return Pipeline{}, ErrSpec{Err: err}
+		}
+	}
+	var s pipelineSpec
+	dec := json.NewDecoder(bytes.NewReader(spec))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return Pipeline{}, ErrSpec{Path: specPath(typeErr.Field), Err: err}
+		}
+		return Pipeline{}, ErrSpec{Err: err}
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return Pipeline{}, ErrSpec{Err: errors.New("data after the spec")}
+	}
+	if len(s.Stages) == 0 {
+		return Pipeline{}, ErrSpec{Path: "stages", Err: errors.New("no stage")}
+	}
+
+	var p Pipeline
+	for i, st := range s.Stages {
+		stage, err := buildStage(fmt.Sprintf("stages[%d]", i), st)
+		if err != nil {
+			return Pipeline{}, err
+		}
+		p.stages = append(p.stages, stage)
+	}
+	for name := range s.Routes {
+		if _, err := ParseState(name); err != nil {
+			return Pipeline{}, ErrSpec{Path: "routes." + name, Err: err}
+		}
+	}
+	p.routes = s.Routes
+	return p, nil
+}
+
+// yamlToJSON converts a YAML spec to JSON, so that it is decoded and
+// checked as one.
+func yamlToJSON(spec []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(spec, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// specPath turns the path of a field told by encoding/json, e.g.
+// "stages.0.pairs", into the form of ErrSpec, "stages[0].pairs".
+func specPath(field string) string {
+	var b strings.Builder
+	for i, name := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(name); err == nil {
+			fmt.Fprintf(&b, "[%s]", name)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(name)
+	}
+	return b.String()
+}
+
+func buildStage(path string, s stageSpec) (stage, error) {
+	if len(s.Pairs) == 0 {
+		return stage{}, ErrSpec{Path: path + ".pairs", Err: errors.New("no pair")}
+	}
+	var st stage
+	for i, ps := range s.Pairs {
+		pair, err := buildPair(fmt.Sprintf("%s.pairs[%d]", path, i), ps)
+		if err != nil {
+			return stage{}, err
+		}
+		st.pairs = append(st.pairs, pair)
+	}
+	for i, ts := range s.Transforms {
+		opt, err := buildTransform(fmt.Sprintf("%s.transforms[%d]", path, i), ts)
+		if err != nil {
+			return stage{}, err
+		}
+		st.opts = append(st.opts, opt)
+	}
+	return st, nil
+}
+
+func buildPair(path string, s pairSpec) (*Pair, error) {
+	headMode, ok := regexModes[s.HeadRegex]
+	if !ok {
+		return nil, ErrSpec{Path: path + ".head_regex", Err: fmt.Errorf("unknown regex mode %q", s.HeadRegex)}
+	}
+	tailMode, ok := regexModes[s.TailRegex]
+	if !ok {
+		return nil, ErrSpec{Path: path + ".tail_regex", Err: fmt.Errorf("unknown regex mode %q", s.TailRegex)}
+	}
+	for _, d := range []struct {
+		field, source string
+		mode          regexMode
+	}{{"head", s.Head, headMode}, {"tail", s.Tail, tailMode}} {
+		if d.source == "" {
+			return nil, ErrSpec{Path: path + "." + d.field, Err: errors.New("empty delimiter")}
+		}
+		if _, err := compileRegex(d.source, d.mode, CompileLimits{}); err != nil {
+			return nil, ErrSpec{Path: path + "." + d.field, Err: err}
+		}
+	}
+
+	opts := []pairOption{
+		WithRegexHead(headMode),
+		WithRegexTail(tailMode),
+		WithName(s.Name),
+		WithPriority(s.Priority),
+		WithMaxEditDistance(s.MaxEditDistance),
+	}
+	if err := ValidatePair(s.Head, s.Tail, opts...); errors.Is(err, ErrEditDistance) {
+		return nil, ErrSpec{Path: path + ".max_edit_distance", Err: err}
+	}
+	if s.LineAnchoredHead {
+		opts = append(opts, WithLineAnchoredHead())
+	}
+	switch len(s.Escape) {
+	case 0:
+	case 1:
+		opts = append(opts, WithEscape(s.Escape[0]))
+	default:
+		return nil, ErrSpec{Path: path + ".escape", Err: fmt.Errorf("escape %q is not a single byte", s.Escape)}
+	}
+	return NewPair(s.Head, s.Tail, opts...), nil
+}
+
+func buildTransform(path string, s transformSpec) (matcherOption, error) {
+	if s.N < 0 {
+		return nil, ErrSpec{Path: path + ".n", Err: fmt.Errorf("negative n %d", s.N)}
+	}
+	switch s.Type {
+	case "discard_none":
+		return WithDiscardNone(), nil
+	case "grapheme_safety":
+		return WithGraphemeSafety(), nil
+	case "greedy_tail":
+		return WithGreedyTail(), nil
+	case "max_body_bytes":
+		return WithMaxBodyBytes(s.N), nil
+	case "lookback_limit":
+		return WithLookbackLimit(s.N), nil
+	case "max_blocks":
+		return WithMaxBlocks(s.N), nil
+	case "coalesce":
+		var every time.Duration
+		if s.Every != "" {
+			var err error
+			if every, err = time.ParseDuration(s.Every); err != nil {
+				return nil, ErrSpec{Path: path + ".every", Err: err}
+			}
+		}
+		return WithCoalesce(s.N, every), nil
+	case "highlight":
+		if _, err := compileRegex(s.Regex, REGEX_MODE_PERL, CompileLimits{}); err != nil {
+			return nil, ErrSpec{Path: path + ".regex", Err: err}
+		}
+		return WithBodyHighlighter(s.Regex), nil
+	}
+	return nil, ErrSpec{Path: path + ".type", Err: fmt.Errorf("unknown transform %q", s.Type)}
+}
+
+// NewMatcher returns a matcher running the stages of the pipeline,
+// the Results of the states routed by the spec are written to the
+// sinks of the same name, see Matcher.Route. A sink missing from
+// sinks is an ErrSpec.
+func (p Pipeline) NewMatcher(sinks map[string]io.Writer) (Matcher, error) {
+	for name, sink := range p.routes {
+		if _, ok := sinks[sink]; !ok {
+			return nil, ErrSpec{Path: "routes." + name, Err: fmt.Errorf("no sink %q", sink)}
+		}
+	}
+
+	var m Matcher
+	for _, st := range slices.Backward(p.stages) {
+		var sm Matcher
+		if len(st.pairs) == 1 {
+			sm = NewMatcher(st.pairs[0], st.opts...)
+		} else {
+			sm = NewMultiMatcher(st.pairs, st.opts...)
+		}
+		if m != nil {
+			sm = Chain(sm, m)
+		}
+		m = sm
+	}
+	for name, sink := range p.routes {
+		state, _ := ParseState(name)
+		m.Route(state, sinks[sink])
+	}
+	return m, nil
+}
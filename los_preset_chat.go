@@ -0,0 +1,37 @@
+package los
+
+import "fmt"
+
+// ChatEnd is the marker closing a turn in the transcripts matched by
+// NewChatMatcher.
+const ChatEnd = "<|end|>"
+
+// ChatRoles are the roles matched by NewChatMatcher.
+var ChatRoles = []string{"system", "user", "assistant"}
+
+// ChatPairs returns a pair for each role, opened by the "<|role|>"
+// marker and closed by end. The pairs are named after their role,
+// see ChatRole.
+func ChatPairs(end string, roles ...string) []*Pair {
+	pairs := make([]*Pair, len(roles))
+	for i, role := range roles {
+		pairs[i] = NewPair(fmt.Sprintf("<|%s|>", role), end, WithName(role))
+	}
+	return pairs
+}
+
+// NewChatMatcher segments a chat transcript such as
+// "<|user|>hi<|end|><|assistant|>hello<|end|>" into the turns of
+// ChatRoles, each turn is a block.
+func NewChatMatcher(opts ...matcherOption) Matcher {
+	return NewMultiMatcher(ChatPairs(ChatEnd, ChatRoles...), opts...)
+}
+
+// ChatRole returns the role of the turn result belongs to, or "" out
+// of the turns.
+func ChatRole(result Result) string {
+	if r, ok := result.(PairResult); ok && r.Pair() != nil {
+		return r.Pair().Name()
+	}
+	return ""
+}
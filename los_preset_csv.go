@@ -0,0 +1,53 @@
+package los
+
+// CSVPair matches the records of a CSV stream, the head is a whole
+// record and the tail its line break, "\n" or "\r\n". The line
+// breaks within a quoted field belong to the record, however the
+// stream is chunked. The separator of the fields does not matter to
+// the records, so that CSVPair serves TSV as well.
+var CSVPair = newCSVPair()
+
+func newCSVPair() *Pair {
+	pair := NewPair("", "\r?\n", WithRegexTail(REGEX_MODE_PERL), WithName("csv"))
+	pair.newHead = func() pattern { return &csvPattern{} }
+	return pair
+}
+
+// NewCSVMatcher splits a CSV or TSV stream into records, each record
+// is the HEAD of a block which can be parsed on its own, e.g. with
+// encoding/csv. Blank lines are emitted as STATE_NONE, and the last
+// record is left to Drain unless it ends with a line break.
+func NewCSVMatcher(opts ...matcherOption) Matcher {
+	return NewMatcher(CSVPair, opts...)
+}
+
+// csvPattern matches a record up to its line break, a partial match
+// is the record received so far. quoted tells whether the bytes
+// scanned end within a quoted field, an escaped quote "" toggles it
+// twice.
+type csvPattern struct {
+	quoted bool
+}
+
+var _ pattern = (*csvPattern)(nil)
+
+func (pat *csvPattern) Match(index int, offset int, buffer []byte) (int, int, bool) {
+	for i := index + offset; i < len(buffer); i++ {
+		switch {
+		case buffer[i] == '"':
+			pat.quoted = !pat.quoted
+		case buffer[i] == '\n' && !pat.quoted:
+			if i > index && buffer[i-1] == '\r' {
+				i--
+			}
+			return index, i - index, true
+		}
+	}
+	return index, len(buffer) - index, false
+}
+
+func (pat *csvPattern) Reset() {
+	pat.quoted = false
+}
+
+func (pat *csvPattern) Clear() {}
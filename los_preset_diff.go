@@ -0,0 +1,111 @@
+package los
+
+import "bytes"
+
+var (
+	// DiffFilePair matches the diff of a file, the head is its
+	// "diff --git a/x b/x" line, the body the extended header lines
+	// following it, e.g. "index" and "---", up to the first hunk.
+	DiffFilePair = newDiffPair("diff --git ")
+	// DiffHunkPair matches a hunk, the head is its "@@ -1,3 +1,4 @@"
+	// line and the body the lines of the hunk.
+	DiffHunkPair = newDiffPair("@@ ")
+)
+
+// diffHeaders are the prefixes of the header lines opening a block.
+var diffHeaders = [...][]byte{[]byte("diff --git "), []byte("@@ ")}
+
+func newDiffPair(header string) *Pair {
+	pair := NewPair(header, "\n", WithLineAnchoredHead())
+	pair.newHead = func() pattern {
+		// newHeadPattern leaves the custom heads as they are built
+		kmp := newKmpPattern(header)
+		kmp.anchored = true
+		return &diffHeadPattern{kmpPattern: kmp}
+	}
+	pair.newTail = func() pattern { return diffTailPattern{} }
+	return pair
+}
+
+// NewDiffMatcher splits a unified diff, e.g. from "git diff", into
+// files and hunks, told apart by PairResult. The head of a block is
+// its header line without the line break, the tail is the line break
+// ending the block right before the next header or at the end of the
+// stream, so that the lines in between are its body. A hunk ends the
+// file block, the hunks of a file follow it.
+func NewDiffMatcher(opts ...matcherOption) Matcher {
+	return NewMultiMatcher([]*Pair{DiffFilePair, DiffHunkPair}, opts...)
+}
+
+// diffHeadPattern matches a header line starting with the source of
+// kmpPattern up to its line break, a partial match is the header
+// received so far.
+type diffHeadPattern struct {
+	*kmpPattern
+}
+
+var _ pattern = (*diffHeadPattern)(nil)
+
+func (pat *diffHeadPattern) Match(index int, offset int, buffer []byte) (int, int, bool) {
+	return pat.match(index, offset, buffer, false)
+}
+
+// MatchEnd takes the header ending the stream without a line break.
+func (pat *diffHeadPattern) MatchEnd(index int, offset int, buffer []byte) (int, int, bool) {
+	return pat.match(index, offset, buffer, true)
+}
+
+func (pat *diffHeadPattern) match(index int, offset int, buffer []byte, end bool) (int, int, bool) {
+	if offset < pat.length {
+		var ok bool
+		if index, offset, ok = pat.kmpPattern.Match(index, offset, buffer); !ok {
+			return index, offset, false
+		}
+	}
+	if n := bytes.IndexByte(buffer[index+offset:], '\n'); n >= 0 {
+		return index, offset + n, true
+	}
+	return index, len(buffer) - index, end
+}
+
+// diffTailPattern matches the line break followed by a header line,
+// or ending the stream.
+type diffTailPattern struct{}
+
+var _ pattern = diffTailPattern{}
+
+func (pat diffTailPattern) Match(index int, _ int, buffer []byte) (int, int, bool) {
+	return pat.match(index, buffer, false)
+}
+
+// MatchEnd takes the last byte of the stream if it is a line break.
+func (pat diffTailPattern) MatchEnd(index int, _ int, buffer []byte) (int, int, bool) {
+	return pat.match(index, buffer, true)
+}
+
+// match looks for the line break from index, the header after it
+// may be partial, then the line break is held back for more bytes.
+func (diffTailPattern) match(index int, buffer []byte, end bool) (int, int, bool) {
+	for i := index; i < len(buffer); i++ {
+		if buffer[i] != '\n' {
+			continue
+		}
+		next := buffer[i+1:]
+		if len(next) == 0 {
+			return i, 1, end
+		}
+		for _, header := range diffHeaders {
+			switch {
+			case bytes.HasPrefix(next, header):
+				return i, 1, true
+			case !end && bytes.HasPrefix(header, next):
+				return i, len(buffer) - i, false
+			}
+		}
+	}
+	return len(buffer), 0, false
+}
+
+func (diffTailPattern) Reset() {}
+
+func (diffTailPattern) Clear() {}
@@ -0,0 +1,37 @@
+package los
+
+import "time"
+
+// The settings of WithHighThroughput.
+const (
+	ThroughputScanSize     = 512
+	ThroughputCoalesceSize = 4096
+	ThroughputCoalesceTime = 100 * time.Millisecond
+)
+
+// WithLowLatency emits every Result as soon as it is matched: the
+// input is scanned chunk by chunk and the Results are not merged,
+// undoing WithMinScanSize and WithCoalesce given before. It is the
+// default behavior of a matcher. Only these two knobs are tuned, the
+// machine pool and the Results are left as the other options set
+// them, see WithPoolIsolation and WithPooledResults.
+func WithLowLatency() matcherOption {
+	return func(m *matcher) *matcher {
+		m.minScan, m.coalesce = 0, nil
+		return m
+	}
+}
+
+// WithHighThroughput trades latency for fewer runs of the regex
+// machines and fewer Results: the input is scanned once
+// ThroughputScanSize bytes are received, see WithMinScanSize, and the
+// Results of a state are merged up to ThroughputCoalesceSize bytes or
+// ThroughputCoalesceTime, see WithCoalesce. The options given after
+// it tune these knobs further. As with WithLowLatency, no other knob
+// is tuned.
+func WithHighThroughput() matcherOption {
+	return func(m *matcher) *matcher {
+		m = WithMinScanSize(ThroughputScanSize)(m)
+		return WithCoalesce(ThroughputCoalesceSize, ThroughputCoalesceTime)(m)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package los
+
+// raceEnabled tells that the race detector, which allocates on its
+// own, is on.
+const raceEnabled = true
@@ -0,0 +1,95 @@
+package los
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// The kinds of the records of WithRecorder.
+const (
+	recordChunk byte = iota
+	recordFlush
+	recordDrain
+)
+
+// WithRecorder archives the input of the matcher to w, so that a
+// stream met in production can be fed again by ReplayRecording with
+// the same chunking. A record is made of
+//
+//   - the kind as a single byte, 0 for Match, 1 for Flush and 2 for
+//     Drain;
+//   - for Match, the uvarint length of the chunk followed by it.
+//
+// A write error stops matching, see Matcher.Err.
+func WithRecorder(w io.Writer) matcherOption {
+	return func(m *matcher) *matcher {
+		m.recorder = &recorder{w: w}
+		return m
+	}
+}
+
+type recorder struct {
+	w      io.Writer
+	record []byte
+}
+
+// record archives a call of kind with the chunk of Match if any.
+func (m *matcher) record(kind byte, chunk string) {
+	if m.recorder == nil {
+		return
+	}
+	r := m.recorder
+	r.record = append(r.record[:0], kind)
+	if kind == recordChunk {
+		r.record = binary.AppendUvarint(r.record, uint64(len(chunk)))
+		r.record = append(r.record, chunk...)
+	}
+	if _, err := r.w.Write(r.record); err != nil && m.err == nil {
+		m.fail(err)
+	}
+}
+
+// ReplayRecording feeds the stream archived by WithRecorder to m as
+// it was fed at the time, the Results of Match and Flush are yielded
+// in turn while the content of Drain is yielded as a STATE_NONE
+// Result. It stops at the first malformed record or error of reading.
+func ReplayRecording(r io.Reader, m Matcher) Results {
+	return func(yield func(Result) bool) {
+		br := bufio.NewReader(r)
+		for {
+			kind, err := br.ReadByte()
+			if err != nil {
+				return
+			}
+			var results Results
+			switch kind {
+			case recordChunk:
+				n, err := binary.ReadUvarint(br)
+				if err != nil {
+					return
+				}
+				chunk := make([]byte, n)
+				if _, err := io.ReadFull(br, chunk); err != nil {
+					return
+				}
+				results = m.Match(string(chunk))
+			case recordFlush:
+				results = m.Flush()
+			case recordDrain:
+				rest := m.Drain()
+				if len(rest) > 0 && !yield(textResult{STATE_NONE, []byte(rest)}) {
+					return
+				}
+				continue
+			default:
+				return
+			}
+			for result := range results {
+				if !yield(result) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package los
+
+import "sync"
+
+// PooledResult is implemented by the Results of a matcher given
+// WithPooledResults.
+type PooledResult interface {
+	Result
+	// Release hands the Result back to the pool, it is not to be used
+	// anymore, nor its content.
+	Release()
+}
+
+// WithPooledResults takes the Results from a pool instead of
+// allocating one per Result, so that a pipeline matching at a high
+// rate makes no garbage of its own. Every Result is a PooledResult
+// to be released by the consumer once done with it, see Release, a
+// Result not released is left to the GC. A Result is detached, e.g.
+// by Matcher.Go, into one out of the pool. The Results of a Match are
+// to be ranged over before the next Match, the sequence is reused.
+func WithPooledResults() matcherOption {
+	return func(m *matcher) *matcher {
+		m.pooled = true
+		return m
+	}
+}
+
+// Release releases result if it is a PooledResult, the ones wrapped
+// by Chain included, it does nothing otherwise.
+func Release(result Result) {
+	for {
+		switch r := result.(type) {
+		case PooledResult:
+			r.Release()
+			return
+		case ChainResult:
+			result = r.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+var resultPool = sync.Pool{New: func() any { return new(pooledResult) }}
+
+type pooledResult struct {
+	blockResult
+}
+
+// pooled returns result in a pooledResult out of the pool.
+func pooled(result blockResult) *pooledResult {
+	r := resultPool.Get().(*pooledResult)
+	r.blockResult = result
+	return r
+}
+
+func (r *pooledResult) Release() {
+	r.blockResult = blockResult{}
+	resultPool.Put(r)
+}
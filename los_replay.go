@@ -0,0 +1,103 @@
+package los
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"iter"
+)
+
+// replayChunk bounds the bytes of source held by a replayed Result.
+const replayChunk = 32 << 10
+
+// Replay rebuilds the Results of a matcher from the journal written
+// by WithJournal and the original stream, read at random from source.
+// Long segments are split into Results of the same state, the last
+// one runs up to the end of source. The Results implement
+// ReplayResult. Replay stops at the first malformed record or error
+// of reading, the content rewound by Matcher.Rewind is only replayed
+// up to the rewind point.
+func Replay(journal io.Reader, source io.ReaderAt) iter.Seq[Result] {
+	return func(yield func(Result) bool) {
+		r := bufio.NewReader(journal)
+		buf := make([]byte, replayChunk)
+
+		cur, ok := readRecord(r, 0)
+		for ok {
+			next, more := readRecord(r, cur.at)
+			end := next.at
+			if !more {
+				end = -1 // up to the end of source
+			}
+			if !replaySegment(yield, source, buf, cur, end) {
+				return
+			}
+			cur, ok = next, more
+		}
+	}
+}
+
+// ReplayResult is implemented by the Results of Replay.
+type ReplayResult interface {
+	Result
+	// PairIndex returns the index of the pair in NewMultiMatcher, it
+	// is 0 for a single-pair matcher and for STATE_NONE.
+	PairIndex() int
+}
+
+type replayResult struct {
+	textResult
+	pair int
+}
+
+var _ ReplayResult = replayResult{}
+
+func (r replayResult) PairIndex() int {
+	return r.pair
+}
+
+type journalRecord struct {
+	at    int64
+	state State
+	pair  int
+}
+
+func readRecord(r *bufio.Reader, last int64) (journalRecord, bool) {
+	delta, err := binary.ReadVarint(r)
+	if err != nil {
+		return journalRecord{}, false
+	}
+	state, err := r.ReadByte()
+	if err != nil || State(state) > STATE_TAIL {
+		return journalRecord{}, false
+	}
+	pair, err := binary.ReadUvarint(r)
+	if err != nil {
+		return journalRecord{}, false
+	}
+	return journalRecord{last + delta, State(state), int(pair)}, true
+}
+
+// replaySegment yields the content of source from rec up to end, or
+// up to the end of source if end is negative.
+func replaySegment(yield func(Result) bool, source io.ReaderAt, buf []byte, rec journalRecord, end int64) bool {
+	for at := rec.at; end < 0 || at < end; {
+		n := len(buf)
+		if end >= 0 {
+			n = int(min(int64(n), end-at))
+		}
+		n, err := source.ReadAt(buf[:n], at)
+		if n > 0 && !yield(replayResult{textResult{rec.state, buf[:n]}, rec.pair}) {
+			return false
+		}
+		at += int64(n)
+		if errors.Is(err, io.EOF) && end < 0 {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package los
+
+// WithRestartOnHead gives up the block when its head shows up again
+// in the body, the way editors recover from an unterminated fence.
+// The block is emitted as STATE_NONE up to the last head found in
+// its body, where it restarts, e.g. "<x>a<x>b</x>" yields "<x>a" and
+// then the block "<x>b</x>". The blocks are held back until their
+// tail as with WithMaxBodyBytes, and only the head of the pair of
+// the block restarts it.
+func WithRestartOnHead() matcherOption {
+	return func(m *matcher) *matcher {
+		m.holdBlocks()
+		m.restarts = map[*Pair]pattern{}
+		return m
+	}
+}
+
+// restart looks for the last head in the body held, the block held
+// is made to start there and the content before it is emitted.
+func (m *matcher) restart(yield func(Result) bool) bool {
+	pat, ok := m.restarts[m.pair]
+	if !ok {
+		pat = m.pair.newHeadPattern()
+		m.tune(pat)
+		m.restarts[m.pair] = pat
+	}
+
+	held, head := m.block.buf.Bytes(), m.block.head
+	at, length := -1, 0
+	for i := head; i < len(held); {
+		pat.Reset()
+		if f, isFollower := pat.(follower); isFollower {
+			f.follow(held[:i])
+		}
+		index, offset, found := pat.Match(0, 0, held[i:])
+		m.collect(pat)
+		if !found {
+			break
+		}
+		at, length = i+index, offset
+		i = at + max(offset, 1)
+	}
+	pat.Reset()
+	if at < 0 {
+		return true
+	}
+
+	m.block.head = length
+	return m.send(yield, STATE_NONE, m.block.buf.Next(at))
+}
@@ -0,0 +1,124 @@
+package los
+
+import (
+	"bytes"
+	"slices"
+)
+
+// WithRewind retains up to n bytes of the emitted Results so that
+// they can be pushed back into the matcher with [Matcher.Rewind].
+func WithRewind(n int) matcherOption {
+	return func(m *matcher) *matcher {
+		m.rewind = &rewinder{limit: n}
+		return m
+	}
+}
+
+// rewinder keeps the tail of the emitted bytes along with a mark
+// at the start of every Result carrying the state before it.
+type rewinder struct {
+	limit int
+	raw   []byte
+	marks []rewindMark
+}
+
+type rewindMark struct {
+	at    int   // start of the Result in raw, negative once trimmed
+	state State // state of the Result
+}
+
+func (r *rewinder) record(state State, raw []byte) {
+	r.marks = append(r.marks, rewindMark{len(r.raw), state})
+	r.raw = append(r.raw, raw...)
+
+	if drop := len(r.raw) - r.limit; drop > 0 {
+		r.raw = r.raw[:copy(r.raw, r.raw[drop:])]
+		k := 0
+		for i := range r.marks {
+			r.marks[i].at -= drop
+			if r.marks[i].at <= 0 {
+				k = i
+			}
+		}
+		r.marks = r.marks[:copy(r.marks, r.marks[k:])]
+	}
+}
+
+func (r *rewinder) reset() {
+	r.raw, r.marks = r.raw[:0], r.marks[:0]
+}
+
+// Rewind restarts both patterns from the rewind point instead of
+// restoring their snapshots. Bytes are only emitted once no pattern
+// can start before them, so nothing before the point matters.
+func (m *matcher) Rewind(n int) error {
+	if m.rewind == nil || n < 0 || n > len(m.rewind.raw) {
+		return ErrRewindTooFar
+	}
+	if n == 0 {
+		return nil
+	}
+
+	r := m.rewind
+	point := len(r.raw) - n
+	k := len(r.marks) - 1
+	for r.marks[k].at > point {
+		k--
+	}
+	// A delimiter moves the state forward, rewinding into it means
+	// the delimiter has not been seen yet.
+	m.state = r.marks[k].state &^ 1
+	if m.invariant != nil {
+		m.invariant.last = m.state
+	}
+	m.afterTail = false
+	if r.marks[k].at == point {
+		k--
+		m.afterTail = k >= 0 && r.marks[k].state == STATE_TAIL
+	}
+	for _, mark := range r.marks[k+1:] {
+		if mark.state == STATE_TAIL {
+			m.blocks--
+		}
+	}
+
+	// The pending content was emitted as far as the rewinder knows
+	if c := m.coalesce; c != nil && c.first != nil {
+		c.pending = c.pending[:max(0, len(c.pending)-n)]
+		if len(c.pending) == 0 {
+			c.reset()
+		}
+	}
+
+	var held []byte
+	if m.block != nil {
+		held = m.block.buf.Bytes()
+		defer m.block.buf.Reset()
+	}
+	m.pos -= int64(n)
+	if m.text != nil {
+		m.text.sub(r.raw[point:])
+	}
+	if m.journal != nil {
+		m.journal.state = -1 // journal the rewind point
+	}
+	pushed := slices.Concat(r.raw[point:], held, m.buffer.Bytes())
+	m.buffer = bytes.NewBuffer(pushed)
+	r.raw, r.marks = r.raw[:point], r.marks[:k+1]
+
+	m.patterns[0].Reset()
+	m.patterns[1].Reset()
+	if f, ok := m.patterns[0].(follower); ok && point > 0 {
+		f.follow(r.raw[:point])
+	}
+	m.trail = byteRun{}
+	m.trail.follow(r.raw[:point])
+	m.index, m.offset = 0, 0
+	if m.spec != nil {
+		m.spec.active = false
+	}
+	if m.greedy != nil {
+		m.greedy.at = -1
+	}
+	return nil
+}
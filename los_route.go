@@ -0,0 +1,58 @@
+package los
+
+import "io"
+
+// Route writes the content of the Results of state to w instead of
+// yielding them, e.g. the body to a file and the rest to stdout. A
+// nil w yields them again. The writes are made as the Results are
+// emitted, so a slow writer holds back the matching, and a write
+// error stops matching, see Matcher.Err. The routes are not carried
+// over by Clone.
+func (m *matcher) Route(state State, w io.Writer) {
+	m.routes[state] = w
+}
+
+// Write matches p as Match does, so that a stream can be copied into
+// the writers given by Route, e.g. with io.Copy. The Results of the
+// states not routed are dropped.
+func (m *matcher) Write(p []byte) (int, error) {
+	return write(m, p)
+}
+
+func write(m Matcher, p []byte) (int, error) {
+	for range m.Match(string(p)) {
+	}
+	if err := m.Err(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// routes holds the writer of each state, if any.
+type routes [4]io.Writer
+
+// wrap wraps yield to write the Results of the routed states, the
+// first write error is stored in err.
+func (r *routes) wrap(yield func(Result) bool, err *error) func(Result) bool {
+	return func(result Result) bool {
+		w := r[result.State()]
+		if w == nil {
+			return yield(result)
+		}
+		if _, e := w.Write(result.Raw()); e != nil {
+			*err = e
+			return false
+		}
+		return true
+	}
+}
+
+// any reports whether any state is routed.
+func (r *routes) any() bool {
+	for _, w := range r {
+		if w != nil {
+			return true
+		}
+	}
+	return false
+}
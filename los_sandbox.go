@@ -0,0 +1,136 @@
+package los
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/humbornjo/los/internal/legex"
+)
+
+var ErrStepLimit = errors.New("regex steps beyond the limit")
+
+// The settings of SandboxProfile.
+const (
+	SandboxMaxInst   = 1000
+	SandboxMaxRepeat = 100
+	SandboxMaxSteps  = 1 << 26
+	SandboxLookback  = 4096
+)
+
+// Profile is a set of options given at once, those of Pair to NewPair
+// and those of Matcher to NewMatcher.
+type Profile struct {
+	Pair    []pairOption
+	Matcher []matcherOption
+}
+
+// SandboxProfile bounds what the delimiters supplied by the users of
+// a service may cost, e.g.
+//
+//	sandbox := los.SandboxProfile()
+//	pair := los.NewPair(head, tail, append(opts, sandbox.Pair...)...)
+//	m := los.NewMatcher(pair, sandbox.Matcher...)
+//
+// The programs of the regex delimiters are bounded to SandboxMaxInst
+// instructions and repetitions of SandboxMaxRepeat, see
+// WithCompileLimits, the steps of their machines over a stream to
+// SandboxMaxSteps, see WithStepLimit, and the bytes held for a
+// partial delimiter to SandboxLookback, see WithLookbackLimit. The
+// machines of the pairs are kept in a pool of their own, see
+// WithMachinePool, a profile is meant to be taken once per tenant.
+func SandboxProfile() Profile {
+	return Profile{
+		Pair: []pairOption{
+			WithCompileLimits(CompileLimits{MaxInst: SandboxMaxInst, MaxRepeat: SandboxMaxRepeat}),
+			WithMachinePool(NewMachinePool()),
+		},
+		Matcher: []matcherOption{
+			WithStepLimit(SandboxMaxSteps),
+			WithLookbackLimit(SandboxLookback),
+		},
+	}
+}
+
+// WithStepLimit stops matching once the regex machines have stepped
+// through more than n runes since the stream started, see
+// Stats.Steps, Matcher.Err then reports ErrStepLimit and the bytes
+// left are only buffered until Drain. Along with WithCompileLimits,
+// which bounds the cost of a step, it bounds the time a stream may
+// take, the content held back being scanned again included.
+func WithStepLimit(n int) matcherOption {
+	return func(m *matcher) *matcher {
+		m.maxSteps = n
+		return m
+	}
+}
+
+// overstep stops matching once the steps of the stream are beyond
+// the limit of WithStepLimit.
+func (m *matcher) overstep() bool {
+	if m.maxSteps <= 0 || m.steps <= m.maxSteps {
+		return false
+	}
+	m.fail(fmt.Errorf("%w: %d steps, limit %d", ErrStepLimit, m.steps, m.maxSteps))
+	return true
+}
+
+// WithPoolIsolation leaves the regex machines of the matcher to the GC
+// once it is closed, instead of putting them back into the pools the
+// matchers of all the pairs take theirs from, so that a machine grown
+// large on a hostile input is never handed to another matcher.
+func WithPoolIsolation() matcherOption {
+	return func(m *matcher) *matcher {
+		m.isolated = true
+		m.tuneAll()
+		return m
+	}
+}
+
+// MachinePool keeps the regex machines of the pairs it is given to,
+// apart from the pool shared by the other pairs, see
+// WithMachinePool. Its Stats tell the machines in use and retained.
+type MachinePool = legex.Pool
+
+func NewMachinePool() *MachinePool {
+	return legex.NewPool()
+}
+
+// WithMachinePool takes the regex machines of the pair from pool and
+// puts them back there, e.g. one pool per tenant of a service, so that
+// the machines grown by the delimiters of a tenant neither evict nor
+// bloat the ones of the others.
+func WithMachinePool(pool *MachinePool) pairOption {
+	return func(pair *Pair) *Pair {
+		pair.pool = pool
+		return pair
+	}
+}
+
+// tune sets up the regex machine of pat for the options of m.
+func (m *matcher) tune(pat pattern) {
+	re, isRegex := pat.(*regexPattern)
+	if !isRegex {
+		return
+	}
+	if m.utf8 != nil && m.utf8.policy == INVALID_UTF8_BYTE {
+		legex.RawBytes()(re.Machine)
+	}
+	if m.isolated {
+		legex.NoRetention()(re.Machine)
+	}
+}
+
+// tuneAll is tune for all the patterns of m.
+func (m *matcher) tuneAll() {
+	m.tune(m.patterns[0])
+	m.tune(m.patterns[1])
+	if m.heads != nil {
+		for i := range m.heads.heads {
+			m.tune(m.heads.heads[i])
+			m.tune(m.heads.tails[i])
+		}
+	}
+	if m.highlight != nil {
+		m.tune(m.highlight.pat)
+	}
+}
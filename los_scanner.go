@@ -0,0 +1,90 @@
+package los
+
+import (
+	"errors"
+	"io"
+)
+
+// scanChunkSize is the size of the reads of a Scanner.
+const scanChunkSize = 4096
+
+// Scanner reads the Results of a matcher over an io.Reader one at a
+// time, in the manner of bufio.Scanner:
+//
+//	s := los.NewScanner(r, m)
+//	for s.Scan() {
+//		fmt.Println(s.Result().State(), s.Result())
+//	}
+//	if err := s.Err(); err != nil { ... }
+//
+// Once the reader is over, the blocks held by the matcher are
+// flushed and the content left is drained as a last STATE_NONE
+// Result.
+type Scanner struct {
+	r       io.Reader
+	m       Matcher
+	buf     []byte
+	results []Result
+	result  Result
+	err     error
+	eof     bool
+}
+
+func NewScanner(r io.Reader, m Matcher) *Scanner {
+	return &Scanner{r: r, m: m, buf: make([]byte, scanChunkSize)}
+}
+
+// Scan advances to the next Result, it returns false once the input
+// is over or an error stopped the scan, see Err.
+func (s *Scanner) Scan() bool {
+	for len(s.results) == 0 {
+		if s.eof || s.err != nil {
+			s.result = nil
+			return false
+		}
+		s.fill()
+	}
+	s.result, s.results = s.results[0], s.results[1:]
+	return true
+}
+
+// fill matches the next chunk read, or flushes and drains the
+// matcher once the reader is over.
+func (s *Scanner) fill() {
+	s.results = s.results[:0]
+	n, err := s.r.Read(s.buf)
+	if n > 0 {
+		s.collect(s.m.Match(string(s.buf[:n])))
+	}
+	switch {
+	case errors.Is(err, io.EOF):
+		s.eof = true
+		s.collect(s.m.Flush())
+		if rest := s.m.Drain(); len(rest) > 0 {
+			s.results = append(s.results, textResult{STATE_NONE, []byte(rest)})
+		}
+	case err != nil:
+		s.err = err
+	}
+	if s.err == nil {
+		s.err = s.m.Err()
+	}
+}
+
+func (s *Scanner) collect(rs Results) {
+	for result := range rs {
+		s.results = append(s.results, result)
+	}
+}
+
+// Result returns the Result of the last Scan, it stays valid until
+// the next Scan.
+func (s *Scanner) Result() Result {
+	return s.result
+}
+
+// Err returns the first error of the reader or the matcher, io.EOF
+// is not an error.
+func (s *Scanner) Err() error {
+	return s.err
+}
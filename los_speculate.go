@@ -0,0 +1,72 @@
+package los
+
+// WithSpeculation lets a multi-pair matcher decide between the pairs
+// whose heads match at the same offset, e.g. "---" opening either a
+// front matter or a horizontal rule. The block is held back and the
+// tail of every candidate is looked for, the pair whose block is the
+// first to complete wins, a block rejected by WithBodyLen or
+// WithBodyValidator is out of the race. Once more than budget bytes
+// follow the head with no winner, the pair ranked first by
+// NewMultiMatcher wins. It has no effect on a single-pair matcher.
+func WithSpeculation(budget int) matcherOption {
+	return func(m *matcher) *matcher {
+		if m.heads != nil {
+			m.heads.waitAll = true
+			m.spec = &speculation{budget: budget}
+		}
+		return m
+	}
+}
+
+type speculation struct {
+	budget int
+	active bool // a head is held until its pair is decided
+}
+
+// speculate looks for the tails of the candidates in buffer, which
+// starts with the head. It reports whether the pair is decided, the
+// decided one is then the winner of the head set. The tails are only
+// looked for within the budget, so that the winner does not depend
+// on how much of the stream the buffer holds.
+func (m *matcher) speculate(buffer []byte) bool {
+	hs := m.heads
+	candidates := hs.candidates()
+	shortest := len(buffer)
+	for _, i := range candidates {
+		shortest = min(shortest, hs.lengths[i])
+	}
+	window := buffer[:min(len(buffer), shortest+m.spec.budget)]
+
+	best, bestEnd := -1, 0
+	for _, i := range candidates {
+		n := hs.lengths[i]
+		if n > len(window) {
+			continue
+		}
+
+		tail := hs.tails[i]
+		tail.Reset()
+		index, offset, ok := matchAt(tail, m.ending && len(window) == len(buffer), 0, 0, window[n:])
+		m.collect(tail)
+		tail.Reset()
+		if !ok || (m.block != nil && !m.block.acceptsBody(window[n:n+index])) {
+			continue
+		}
+		end := n + index + offset
+		if best < 0 || end < bestEnd || (end == bestEnd && hs.outranks(i, best)) {
+			best, bestEnd = i, end
+		}
+	}
+
+	switch {
+	case best >= 0:
+		hs.winner = best
+	case len(buffer)-shortest <= m.spec.budget:
+		return false
+	}
+	m.spec.active = false
+	for _, i := range candidates {
+		hs.found[i] = i == hs.winner
+	}
+	return true
+}
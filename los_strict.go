@@ -0,0 +1,62 @@
+package los
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrStrictPrefix = errors.New("content before the first head")
+
+// WithStrictPrefix refuses any STATE_NONE content before the first
+// head of the stream, for the protocols where leading garbage tells
+// that the stream is corrupt. Matching stops at the first such
+// content instead of emitting it, Matcher.Err then reports
+// ErrStrictPrefix, unless WithRejectWriter is given. The content
+// between the blocks is left alone.
+func WithStrictPrefix() matcherOption {
+	return func(m *matcher) *matcher {
+		if m.strict == nil {
+			m.strict = &strictPrefix{}
+		}
+		return m
+	}
+}
+
+// WithRejectWriter writes the content refused by WithStrictPrefix to
+// w instead of stopping matching, it implies WithStrictPrefix. An
+// error of w stops matching, see Matcher.Err.
+func WithRejectWriter(w io.Writer) matcherOption {
+	return func(m *matcher) *matcher {
+		m.strict = &strictPrefix{reject: w}
+		return m
+	}
+}
+
+type strictPrefix struct {
+	reject io.Writer
+	headed bool // a head is matched since the stream started
+}
+
+// refuses reports whether the Result of state is content before the
+// first head.
+func (s *strictPrefix) refuses(state State) bool {
+	if state == STATE_HEAD {
+		s.headed = true
+	}
+	return state == STATE_NONE && !s.headed
+}
+
+// refuse handles raw refused by WithStrictPrefix, it returns false
+// once matching stops.
+func (m *matcher) refuse(raw []byte) bool {
+	if w := m.strict.reject; w != nil {
+		if _, err := w.Write(raw); err != nil {
+			m.fail(err)
+			return false
+		}
+		return true
+	}
+	m.fail(fmt.Errorf("%w: %d bytes at offset %d", ErrStrictPrefix, len(raw), m.pos-int64(len(raw))))
+	return false
+}
@@ -0,0 +1,79 @@
+package los
+
+import "iter"
+
+// Submatch is a group of a delimiter matched as a regex, see
+// Result.Submatches.
+type Submatch struct {
+	Index int    // of the group, 0 for the whole delimiter
+	Name  string // of the group, "" if it has none
+	Text  string
+	// Start and End are the offsets of the group in Raw of the
+	// Result, both -1 if the group is not part of the match.
+	Start, End int
+	// StreamStart and StreamEnd are the offsets of the group in the
+	// stream, counted across Drain as the file or connection the
+	// stream is read from. They are only known for the groups of a
+	// regex delimiter, both are -1 otherwise.
+	StreamStart, StreamEnd int64
+}
+
+// groups holds the groups of the last delimiter matched as a regex
+// for a state, names is nil for a literal delimiter.
+type groups struct {
+	pos   []int
+	names []string
+}
+
+// capture keeps the groups of the delimiter of state just matched
+// by pat.
+func (m *matcher) capture(state State, pat pattern) {
+	g := &m.groups[state>>1]
+	re, isRegex := pat.(*regexPattern)
+	if !isRegex {
+		g.pos, g.names = g.pos[:0], nil
+		return
+	}
+	g.pos, g.names = re.Submatches(g.pos[:0]), re.names
+}
+
+// spans returns the groups of raw, which starts at offset at of the
+// stream, or nil if raw is not the delimiter they were captured from.
+func (g *groups) spans(raw []byte, at int64) []Submatch {
+	if g.names == nil || len(g.pos) < 2 || g.pos[1] != len(raw) {
+		return nil
+	}
+	spans := make([]Submatch, len(g.pos)/2)
+	for i := range spans {
+		start, end := g.pos[2*i], g.pos[2*i+1]
+		spans[i] = Submatch{Index: i, Name: g.names[i], Start: -1, End: -1, StreamStart: -1, StreamEnd: -1}
+		if start >= 0 && end >= start {
+			spans[i].Text = string(raw[start:end])
+			spans[i].Start, spans[i].End = start, end
+			spans[i].StreamStart, spans[i].StreamEnd = at+int64(start), at+int64(end)
+		}
+	}
+	return spans
+}
+
+func (r textResult) Submatches() []Submatch {
+	return []Submatch{{Text: r.String(), End: len(r.raw), StreamStart: -1, StreamEnd: -1}}
+}
+
+func (r blockResult) Submatches() []Submatch {
+	if r.spans == nil {
+		return r.textResult.Submatches()
+	}
+	return r.spans
+}
+
+// Matches yields the Text of the Submatches.
+func (r blockResult) Matches() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for _, span := range r.Submatches() {
+			if !yield(span.Text) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package los
+
+import (
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// TemplateResult is implemented by the Results of a matcher given
+// WithTemplate.
+type TemplateResult interface {
+	Result
+	// Text returns the output of the template for the TAIL Result,
+	// and "" for the others.
+	Text() string
+}
+
+// TemplateBlock is the data of the template of WithTemplate.
+type TemplateBlock struct {
+	Head, Body, Tail string
+	// Submatches holds the Matches of the head followed by those of
+	// the tail.
+	Submatches []string
+	// Offsets holds the offsets in the stream of the start of the
+	// head and of the end of the tail.
+	Offsets [2]int64
+}
+
+// WithTemplate executes the text/template tmpl for every block once
+// its tail is matched, with a TemplateBlock as data, e.g.
+// "{{.Offsets}} {{.Body}}\n" for a log shipper. The output is
+// returned by Text of the TAIL Result, see TemplateResult. A tmpl
+// that does not parse panics, an error of executing it stops
+// matching, see Matcher.Err.
+func WithTemplate(tmpl string) matcherOption {
+	t := template.Must(template.New("block").Parse(tmpl))
+	return func(m *matcher) *matcher {
+		m.template = &blockTemplate{tmpl: t}
+		return m
+	}
+}
+
+// blockTemplate gathers the block being matched for the template.
+type blockTemplate struct {
+	tmpl  *template.Template
+	block TemplateBlock
+	body  []byte
+	out   strings.Builder
+}
+
+// feed adds result to the block, at STATE_TAIL it returns the output
+// of the template, end being the offset of the end of result.
+func (t *blockTemplate) feed(result Result, end int64) (string, error) {
+	raw := result.Raw()
+	switch result.State() {
+	case STATE_HEAD:
+		t.reset()
+		t.block.Head = string(raw)
+		t.block.Submatches = slices.Collect(result.Matches())
+		t.block.Offsets[0] = end - int64(len(raw))
+	case STATE_BODY:
+		t.body = append(t.body, raw...)
+	case STATE_TAIL:
+		t.block.Body, t.block.Tail = string(t.body), string(raw)
+		t.block.Submatches = slices.AppendSeq(t.block.Submatches, result.Matches())
+		t.block.Offsets[1] = end
+		t.out.Reset()
+		err := t.tmpl.Execute(&t.out, t.block)
+		t.reset()
+		return t.out.String(), err
+	}
+	return "", nil
+}
+
+func (t *blockTemplate) reset() {
+	t.block = TemplateBlock{}
+	t.body = t.body[:0]
+}
+
+var _ TemplateResult = blockResult{}
+
+func (r blockResult) Text() string {
+	return r.text
+}
@@ -1,11 +1,35 @@
 package los
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"iter"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/humbornjo/los/internal/legex"
 )
 
 func TestLos_Matcher_Kmp(t *testing.T) {
@@ -21,7 +45,7 @@ func TestLos_Matcher_Kmp(t *testing.T) {
 		{
 			name:            "pass through empty content",
 			contents:        []string{"test"},
-			expectedResults: [][]Result{{textResult{STATE_NONE, []byte("test")}}},
+			expectedResults: [][]Result{{&textResult{STATE_NONE, []byte("test")}}},
 			drainedContent:  "", // Remaining unmatched content
 		},
 		{
@@ -33,18 +57,18 @@ func TestLos_Matcher_Kmp(t *testing.T) {
 		{
 			name:            "single complete prologue",
 			contents:        []string{"prologue"},
-			expectedResults: [][]Result{{textResult{STATE_HEAD, []byte("prologue")}}},
+			expectedResults: [][]Result{{&textResult{STATE_HEAD, []byte("prologue")}}},
 			drainedContent:  "", // All content matched
 		},
 		{
 			name:     "multiple contents with complete matches",
 			contents: []string{"prologue", "content", "epilogue"},
 			expectedResults: [][]Result{{
-				textResult{STATE_HEAD, []byte("prologue")},
+				&textResult{STATE_HEAD, []byte("prologue")},
 			}, {
-				textResult{STATE_BODY, []byte("content")},
+				&textResult{STATE_BODY, []byte("content")},
 			}, {
-				textResult{STATE_TAIL, []byte("epilogue")},
+				&textResult{STATE_TAIL, []byte("epilogue")},
 			}},
 			drainedContent: "", // All content matched across calls
 		},
@@ -52,9 +76,9 @@ func TestLos_Matcher_Kmp(t *testing.T) {
 			name:     "combined content with both prologue and epilogue",
 			contents: []string{"prologue middle content epilogue"},
 			expectedResults: [][]Result{{
-				textResult{STATE_HEAD, []byte("prologue")},
-				textResult{STATE_BODY, []byte(" middle content ")},
-				textResult{STATE_TAIL, []byte("epilogue")},
+				&textResult{STATE_HEAD, []byte("prologue")},
+				&textResult{STATE_BODY, []byte(" middle content ")},
+				&textResult{STATE_TAIL, []byte("epilogue")},
 			}},
 			drainedContent: "", // All content matched
 		},
@@ -62,8 +86,8 @@ func TestLos_Matcher_Kmp(t *testing.T) {
 			name:     "complete prologue and partial epilogue",
 			contents: []string{"prologuedata", "epilo"},
 			expectedResults: [][]Result{{
-				textResult{STATE_HEAD, []byte("prologue")},
-				textResult{STATE_BODY, []byte("data")},
+				&textResult{STATE_HEAD, []byte("prologue")},
+				&textResult{STATE_BODY, []byte("data")},
 			}, nil},
 			drainedContent: "epilo", // All content matched
 		},
@@ -82,3 +106,3257 @@ func TestLos_Matcher_Kmp(t *testing.T) {
 		})
 	}
 }
+
+func TestLos_Matcher_Fuzzy(t *testing.T) {
+	tests := []struct {
+		name            string
+		contents        []string
+		expectedResults [][]Result
+		drainedContent  string
+	}{
+		{
+			name:     "exact delimiters",
+			contents: []string{"a BEGIN b END c"},
+			expectedResults: [][]Result{{
+				&textResult{STATE_NONE, []byte("a ")},
+				&textResult{STATE_HEAD, []byte("BEGIN")},
+				&textResult{STATE_BODY, []byte(" b ")},
+				&textResult{STATE_TAIL, []byte("END")},
+				&textResult{STATE_NONE, []byte(" ")},
+			}},
+			drainedContent: "c", // May still become "cEGIN", 1 edit away from "BEGIN"
+		},
+		{
+			name:     "substituted delimiters",
+			contents: []string{"a BEG1N b EN0 c"},
+			expectedResults: [][]Result{{
+				&textResult{STATE_NONE, []byte("a ")},
+				&textResult{STATE_HEAD, []byte("BEG1N")},
+				&textResult{STATE_BODY, []byte(" b ")},
+				&textResult{STATE_TAIL, []byte("EN0")},
+				&textResult{STATE_NONE, []byte(" ")},
+			}},
+			drainedContent: "c", // May still become "cEGIN", 1 edit away from "BEGIN"
+		},
+		{
+			name:     "substituted head split across chunks",
+			contents: []string{"a BE", "G1", "N b"},
+			expectedResults: [][]Result{{
+				&textResult{STATE_NONE, []byte("a ")},
+			}, nil, {
+				&textResult{STATE_HEAD, []byte("BEG1N")},
+				&textResult{STATE_BODY, []byte(" ")},
+			}},
+			drainedContent: "b", // May still become "bND", 1 edit away from "END"
+		},
+		{
+			name:     "inexact hit held until next byte",
+			contents: []string{"BEGI", "N"},
+			expectedResults: [][]Result{nil, {
+				&textResult{STATE_HEAD, []byte("BEGIN")},
+			}},
+			drainedContent: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher := NewMatcher(NewPair("BEGIN", "END", WithMaxEditDistance(1)))
+			for i, content := range tt.contents {
+				expected := tt.expectedResults[i]
+				got := slices.Collect(iter.Seq[Result](matcher.Match(content)))
+				require.Equal(t, expected, got)
+			}
+
+			drainedContent := matcher.Drain()
+			require.Equal(t, tt.drainedContent, drainedContent)
+			require.NoError(t, matcher.Close())
+		})
+	}
+
+	// The edit distance is less than the length of the literals, the
+	// regex delimiters are left out
+	err := ValidatePair("BEGIN", "END", WithMaxEditDistance(3))
+	require.ErrorIs(t, err, ErrEditDistance)
+	require.ErrorContains(t, err, "tail: ")
+	require.ErrorIs(t, ValidatePair("BEGIN", "END", WithMaxEditDistance(-1)), ErrEditDistance)
+	require.NoError(t, ValidatePair("BEGIN", "E", WithMaxEditDistance(2), WithRegexTail(REGEX_MODE_PERL)))
+	require.Panics(t, func() { NewPair("BEGIN", "END", WithMaxEditDistance(3)) })
+}
+
+func TestLos_LiteralAlternation(t *testing.T) {
+	tests := []struct {
+		expr     string
+		mode     regexMode
+		literals []string
+		ok       bool
+	}{
+		{"error|warn|info", REGEX_MODE_PERL, []string{"error", "warn", "info"}, true},
+		{"ab[cd]|x", REGEX_MODE_PERL, []string{"abc", "abd", "x"}, true},
+		{"abc", REGEX_MODE_POSIX, []string{"abc"}, true},
+		{"(abc)|x", REGEX_MODE_PERL, nil, false},
+		{"(?i)abc", REGEX_MODE_PERL, nil, false},
+		{"ab.*c", REGEX_MODE_PERL, nil, false},
+		{"a|", REGEX_MODE_PERL, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			literals, ok := literalAlternation(tt.expr, tt.mode)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.literals, literals)
+		})
+	}
+}
+
+func TestLos_Matcher_LiteralFastPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     string
+		mode     regexMode
+		contents []string
+		expected []string
+	}{
+		{
+			name: "keywords in stream",
+			head: "error|warn|info",
+			mode: REGEX_MODE_PERL,
+			contents: []string{
+				"where there is a info\n",
+				"there is a warn", "ing\n",
+				"and suddenly an err", "or come up\n",
+			},
+			expected: []string{
+				"where there is a ", "info", "\n", "there is a ",
+				"warn", "ing", "\n", "and suddenly an ", "error", " come up",
+				"\n", "",
+			},
+		},
+		{
+			name:     "leftmost first prefers earlier alternative",
+			head:     "ab|abc",
+			mode:     REGEX_MODE_PERL,
+			contents: []string{"xa", "b", "c\n", "abc\n"},
+			expected: []string{"x", "ab", "c", "\n", "ab", "c", "\n", ""},
+		},
+		{
+			name:     "leftmost longest prefers longer alternative",
+			head:     "ab|abc",
+			mode:     REGEX_MODE_POSIX,
+			contents: []string{"xa", "b", "c\n", "abc\n"},
+			expected: []string{"x", "abc", "\n", "abc", "\n", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMatcher(NewPair(tt.head, "\n", WithRegexHead(tt.mode)))
+			defer m.Close() // nolint: errcheck
+			require.IsType(t, &literalPattern{}, m.(*matcher).patterns[0])
+
+			var got []string
+			for _, content := range tt.contents {
+				for result := range m.Match(content) {
+					got = append(got, result.String())
+				}
+			}
+			require.Equal(t, tt.expected, append(got, m.Drain()))
+		})
+	}
+
+	m := NewMatcher(NewPair("error|warn", "\n", WithRegexHead(REGEX_MODE_PERL), WithoutLiteralFastPath()))
+	defer m.Close() // nolint: errcheck
+	require.IsType(t, &regexPattern{}, m.(*matcher).patterns[0])
+}
+
+func TestLos_Matcher_Stats(t *testing.T) {
+	matcher := NewMatcher(NewPair("<think>", "</think\\s*>", WithRegexTail(REGEX_MODE_PERL)))
+	defer matcher.Close() // nolint: errcheck
+
+	for range matcher.Match("<think>hmm</think >") {
+	}
+	stats := matcher.Stats()
+	require.Positive(t, stats.Steps)
+	require.Positive(t, stats.MaxQueue)
+
+	for range matcher.Match("plain") {
+	}
+	require.Equal(t, Stats{Bytes: 24}, matcher.Stats()) // literal head only
+}
+
+func TestLos_Matcher_Rewind(t *testing.T) {
+	collect := func(results Results) []Result {
+		return slices.Collect(iter.Seq[Result](results))
+	}
+
+	matcher := NewMatcher(NewPair("<a>", "</a>"), WithRewind(16))
+	defer matcher.Close() // nolint: errcheck
+
+	require.Equal(t, []Result{
+		&textResult{STATE_NONE, []byte("x")},
+		&textResult{STATE_HEAD, []byte("<a>")},
+		&textResult{STATE_BODY, []byte("body")},
+		&textResult{STATE_TAIL, []byte("</a>")},
+		&textResult{STATE_NONE, []byte("y")},
+	}, collect(matcher.Match("x<a>body</a>y")))
+
+	// Back to the start of the body
+	require.NoError(t, matcher.Rewind(len("body</a>y")))
+	require.Equal(t, []Result{
+		&textResult{STATE_BODY, []byte("body")},
+		&textResult{STATE_TAIL, []byte("</a>")},
+		&textResult{STATE_NONE, []byte("y")},
+	}, collect(matcher.Match("")))
+
+	// Into the middle of the head, which is then never seen
+	require.NoError(t, matcher.Rewind(len("a>body</a>y")))
+	require.Equal(t, []Result{
+		&textResult{STATE_NONE, []byte("a>body</a>y")},
+	}, collect(matcher.Match("")))
+
+	// Only the retained bytes can be pushed back
+	require.ErrorIs(t, matcher.Rewind(14), ErrRewindTooFar)
+	require.NoError(t, matcher.Rewind(13))
+	require.Equal(t, "x<a>body</a>y", matcher.Drain())
+	require.ErrorIs(t, matcher.Rewind(1), ErrRewindTooFar)
+
+	// Older bytes are trimmed past the limit
+	matcher = NewMatcher(NewPair("<a>", "</a>"), WithRewind(4))
+	collect(matcher.Match("x<a>body"))
+	require.ErrorIs(t, matcher.Rewind(5), ErrRewindTooFar)
+	require.NoError(t, matcher.Rewind(2))
+	require.Equal(t, []Result{
+		&textResult{STATE_BODY, []byte("dy")},
+	}, collect(matcher.Match("")))
+
+	// Reparse the pushed back bytes with another pair
+	matcher = NewMatcher(NewPair("<a>", "</a>"), WithRewind(16))
+	collect(matcher.Match("<a>b<a>c"))
+	require.NoError(t, matcher.Rewind(len("<a>b<a>c")))
+	other := NewMatcher(NewPair("<a>", "<a>"))
+	require.Equal(t, []Result{
+		&textResult{STATE_HEAD, []byte("<a>")},
+		&textResult{STATE_BODY, []byte("b")},
+		&textResult{STATE_TAIL, []byte("<a>")},
+		&textResult{STATE_NONE, []byte("c")},
+	}, collect(other.Match(matcher.Drain())))
+}
+
+func TestLos_Matcher_FallbackPair(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []matcherOption
+		contents []string
+		expected []Result
+		drained  string
+	}{
+		{
+			name:     "block within limit",
+			opts:     []matcherOption{WithMaxBodyBytes(4)},
+			contents: []string{"a<<b", "ody>>c"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("a")},
+				textResult{STATE_HEAD, []byte("<<")},
+				textResult{STATE_BODY, []byte("body")},
+				textResult{STATE_TAIL, []byte(">>")},
+				textResult{STATE_NONE, []byte("c")},
+			},
+		},
+		{
+			name:     "oversized block emitted as raw text",
+			opts:     []matcherOption{WithMaxBodyBytes(3)},
+			contents: []string{"a<<b", "ody>>c<<d>>"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("a")},
+				textResult{STATE_NONE, []byte("<<")},
+				textResult{STATE_NONE, []byte("body>>c")},
+				textResult{STATE_HEAD, []byte("<<")},
+				textResult{STATE_BODY, []byte("d")},
+				textResult{STATE_TAIL, []byte(">>")},
+			},
+		},
+		{
+			name:     "body length out of range",
+			opts:     []matcherOption{WithBodyLen(2, 3)},
+			contents: []string{"<<a>>c<<b", "o>><<long>>"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("<<")},
+				textResult{STATE_NONE, []byte("a>>c")},
+				textResult{STATE_HEAD, []byte("<<")},
+				textResult{STATE_BODY, []byte("bo")},
+				textResult{STATE_TAIL, []byte(">>")},
+				textResult{STATE_NONE, []byte("<<")},
+				textResult{STATE_NONE, []byte("long>>")},
+			},
+		},
+		{
+			name: "body rejected by validator",
+			opts: []matcherOption{WithBodyValidator(func(body []byte) bool {
+				return !bytes.ContainsRune(body, ' ')
+			})},
+			contents: []string{"<<a b>>c<<d", ">>"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("<<")},
+				textResult{STATE_NONE, []byte("a b>>c")},
+				textResult{STATE_HEAD, []byte("<<")},
+				textResult{STATE_BODY, []byte("d")},
+				textResult{STATE_TAIL, []byte(">>")},
+			},
+		},
+		{
+			name:     "unterminated block rejected mid stream",
+			opts:     []matcherOption{WithMaxBodyBytes(3)},
+			contents: []string{"<<long", " body>"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("<<")},
+				textResult{STATE_NONE, []byte("long")},
+				textResult{STATE_NONE, []byte(" body>")},
+			},
+		},
+		{
+			name: "oversized block re-scanned with fallback",
+			opts: []matcherOption{
+				WithMaxBodyBytes(3),
+				WithFallbackPair(NewPair("[", "]")),
+			},
+			contents: []string{"<<x[b]ody", ">>"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("<<x")},
+				textResult{STATE_HEAD, []byte("[")},
+				textResult{STATE_BODY, []byte("b")},
+				textResult{STATE_TAIL, []byte("]")},
+				textResult{STATE_NONE, []byte("ody")},
+				textResult{STATE_NONE, []byte(">>")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher := NewMatcher(NewPair("<<", ">>"), tt.opts...)
+			defer matcher.Close() // nolint: errcheck
+
+			var got []Result
+			for _, content := range tt.contents {
+				for result := range matcher.Match(content) {
+					got = append(got, textResult{result.State(), slices.Clone(result.Raw())})
+				}
+			}
+			require.Equal(t, tt.expected, got)
+			require.Equal(t, tt.drained, matcher.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_RejectChunking(t *testing.T) {
+	tests := []struct {
+		pair  *Pair
+		opts  []matcherOption
+		input string
+		runs  []string // the last one is drained
+	}{
+		{
+			NewPair("<<", ">>"), []matcherOption{WithMaxBodyBytes(3)}, "a<<bo<<dy>>c<<d>><<long body>",
+			// The head within the rejected block is not missed
+			[]string{"a<<bo", "<<", "dy", ">>", "c", "<<", "d", ">>", "<<long body>", ""},
+		},
+		{
+			NewPair("<<", ">>"), []matcherOption{WithBodyLen(2, 3)}, "<<a>>c<<bo>><<x<<long>>",
+			[]string{"<<a>>c", "<<", "bo", ">>", "<<x<<long>>", ""},
+		},
+		{
+			NewPair("\"", "\""), []matcherOption{WithBodyLen(2, 4)}, "<a>\"</a>\"\"x\"",
+			[]string{"<a>", "\"", "</a>", "\"", "\"x", "\""},
+		},
+		{
+			NewPair("<<", ">>"), []matcherOption{WithMaxBodyBytes(3), WithFallbackPair(NewPair("[", "]"))},
+			"<<x[b]ody>>[c]<<[long]",
+			// The region is cut at the byte outgrowing the limit
+			[]string{"<<x", "[", "b", "]", "ody>>[c]<<[long]", ""},
+		},
+	}
+	for _, tt := range tests {
+		for size := len(tt.input); size > 0; size-- {
+			m := NewMatcher(tt.pair, tt.opts...)
+			got := mergeRuns(func(yield func(Result) bool) {
+				for chunk := range slices.Chunk([]byte(tt.input), size) {
+					for result := range m.Match(string(chunk)) {
+						if !yield(textResult{result.State(), slices.Clone(result.Raw())}) {
+							return
+						}
+					}
+				}
+			})
+			got = append(got, m.Drain())
+			require.Equal(t, tt.runs, got, "%q in chunks of %d", tt.input, size)
+		}
+	}
+}
+
+func TestLos_MultiMatcher_Priority(t *testing.T) {
+	type pairState struct {
+		state State
+		raw   string
+		pair  int // index of pair, -1 for STATE_NONE
+	}
+
+	tests := []struct {
+		name     string
+		pairs    func() []*Pair
+		contents []string
+		expected []pairState
+	}{
+		{
+			name: "same offset resolved by registration order",
+			pairs: func() []*Pair {
+				return []*Pair{NewPair("<a>", "</a>"), NewPair("<", ">")}
+			},
+			contents: []string{"<", "a>x</a>"},
+			expected: []pairState{
+				{STATE_HEAD, "<a>", 0},
+				{STATE_BODY, "x", 0},
+				{STATE_TAIL, "</a>", 0},
+			},
+		},
+		{
+			name: "same offset resolved by priority",
+			pairs: func() []*Pair {
+				return []*Pair{NewPair("<a>", "</a>"), NewPair("<", ">", WithPriority(1))}
+			},
+			contents: []string{"<", "a>x</a>"},
+			expected: []pairState{
+				{STATE_HEAD, "<", 1},
+				{STATE_BODY, "a", 1},
+				{STATE_TAIL, ">", 1},
+				{STATE_NONE, "x", -1},
+				{STATE_HEAD, "<", 1},
+				{STATE_BODY, "/a", 1},
+				{STATE_TAIL, ">", 1},
+			},
+		},
+		{
+			name: "earliest head wins over priority",
+			pairs: func() []*Pair {
+				return []*Pair{NewPair("<b>", "</b>", WithPriority(9)), NewPair("x<", ">")}
+			},
+			contents: []string{"ax<b>c</b>"},
+			expected: []pairState{
+				{STATE_NONE, "a", -1},
+				{STATE_HEAD, "x<", 1},
+				{STATE_BODY, "b", 1},
+				{STATE_TAIL, ">", 1},
+				{STATE_NONE, "c</b>", -1},
+			},
+		},
+		{
+			name: "regex and literal heads",
+			pairs: func() []*Pair {
+				return []*Pair{
+					NewPair("<tool_call\\s*>", "</tool_call>", WithRegexHead(REGEX_MODE_PERL)),
+					NewPair("<think>", "</think>"),
+				}
+			},
+			contents: []string{"a<th", "ink>b</think><tool_call ", ">c</tool_call>"},
+			expected: []pairState{
+				{STATE_NONE, "a", -1},
+				{STATE_HEAD, "<think>", 1},
+				{STATE_BODY, "b", 1},
+				{STATE_TAIL, "</think>", 1},
+				{STATE_HEAD, "<tool_call >", 0},
+				{STATE_BODY, "c", 0},
+				{STATE_TAIL, "</tool_call>", 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs := tt.pairs()
+			matcher := NewMultiMatcher(pairs)
+			defer matcher.Close() // nolint: errcheck
+
+			var got []pairState
+			for _, content := range tt.contents {
+				for result := range matcher.Match(content) {
+					ps := pairState{result.State(), result.String(), -1}
+					if pr, ok := result.(PairResult); ok {
+						ps.pair = slices.Index(pairs, pr.Pair())
+					}
+					got = append(got, ps)
+				}
+			}
+			require.Equal(t, tt.expected, got)
+			require.Empty(t, matcher.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_HeadGuard(t *testing.T) {
+	pair := NewPair("<keep>|<skip>", "</>",
+		WithRegexHead(REGEX_MODE_PERL),
+		WithHeadGuard(func(head Result) bool { return head.String() == "<keep>" }),
+	)
+	matcher := NewMatcher(pair)
+	defer matcher.Close() // nolint: errcheck
+
+	var got []Result
+	for _, content := range []string{"a<sk", "ip>b</>c<keep>d</>"} {
+		for result := range matcher.Match(content) {
+			got = append(got, textResult{result.State(), slices.Clone(result.Raw())})
+		}
+	}
+	require.Equal(t, []Result{
+		textResult{STATE_NONE, []byte("a")},
+		textResult{STATE_NONE, []byte("<skip>")},
+		textResult{STATE_NONE, []byte("b</>c")},
+		textResult{STATE_HEAD, []byte("<keep>")},
+		textResult{STATE_BODY, []byte("d")},
+		textResult{STATE_TAIL, []byte("</>")},
+	}, got)
+	require.Empty(t, matcher.Drain())
+}
+
+func TestLos_Matcher_LineAnchoredHead(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []string
+		expected []Result
+	}{
+		{
+			name:     "head at stream start",
+			contents: []string{"```go```"},
+			expected: []Result{
+				textResult{STATE_HEAD, []byte("```")},
+				textResult{STATE_BODY, []byte("go")},
+				textResult{STATE_TAIL, []byte("```")},
+			},
+		},
+		{
+			name:     "head inside a line",
+			contents: []string{"run `", "``go``` now"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("run `")}, // Never held back
+				textResult{STATE_NONE, []byte("``go``` now")},
+			},
+		},
+		{
+			name:     "line start tracked across chunks",
+			contents: []string{"prose\n", "```go", "```"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("prose\n")},
+				textResult{STATE_HEAD, []byte("```")},
+				textResult{STATE_BODY, []byte("go")},
+				textResult{STATE_TAIL, []byte("```")},
+			},
+		},
+		{
+			name:     "overlapping occurrence at line start",
+			contents: []string{"x````\n```a```"},
+			expected: []Result{
+				textResult{STATE_NONE, []byte("x````\n")},
+				textResult{STATE_HEAD, []byte("```")},
+				textResult{STATE_BODY, []byte("a")},
+				textResult{STATE_TAIL, []byte("```")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher := NewMatcher(NewPair("```", "```", WithLineAnchoredHead()))
+			defer matcher.Close() // nolint: errcheck
+
+			var got []Result
+			for _, content := range tt.contents {
+				for result := range matcher.Match(content) {
+					got = append(got, textResult{result.State(), slices.Clone(result.Raw())})
+				}
+			}
+			require.Equal(t, tt.expected, got)
+			require.Empty(t, matcher.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_ContextBytes(t *testing.T) {
+	type context struct {
+		state         State
+		before, after string
+	}
+
+	tests := []struct {
+		name     string
+		opts     []matcherOption
+		contents []string
+		expected []context
+	}{
+		{
+			name:     "context around delimiters",
+			opts:     []matcherOption{WithContextBytes(3, 2)},
+			contents: []string{"abcd<x>ef", "gh</x>ij"},
+			expected: []context{
+				{STATE_HEAD, "bcd", "ef"},
+				{STATE_TAIL, "fgh", "ij"},
+			},
+		},
+		{
+			name:     "after is limited to received bytes",
+			opts:     []matcherOption{WithContextBytes(8, 8)},
+			contents: []string{"a<x>", "b</x>"},
+			expected: []context{
+				{STATE_HEAD, "a", ""},
+				{STATE_TAIL, "a<x>b", ""},
+			},
+		},
+		{
+			name:     "context of held blocks",
+			opts:     []matcherOption{WithContextBytes(2, 2), WithMaxBodyBytes(8)},
+			contents: []string{"ab<x>c", "d</x>e"},
+			expected: []context{
+				{STATE_HEAD, "ab", "cd"},
+				{STATE_TAIL, "cd", "e"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher := NewMatcher(NewPair("<x>", "</x>"), tt.opts...)
+			defer matcher.Close() // nolint: errcheck
+
+			var got []context
+			for _, content := range tt.contents {
+				for result := range matcher.Match(content) {
+					if result.State() == STATE_HEAD || result.State() == STATE_TAIL {
+						got = append(got, context{result.State(), string(result.Before()), string(result.After())})
+					} else {
+						require.Nil(t, result.Before())
+						require.Nil(t, result.After())
+					}
+				}
+			}
+			require.Equal(t, tt.expected, got)
+			matcher.Drain()
+		})
+	}
+}
+
+func TestLos_Matcher_MaxBlocks(t *testing.T) {
+	matcher := NewMatcher(NewPair("<", ">"), WithMaxBlocks(2))
+	defer matcher.Close() // nolint: errcheck
+
+	var got []Result
+	for _, content := range []string{"<a>b<c", ">d<e>f<"} {
+		require.True(t, matcher.Remaining())
+		for result := range matcher.Match(content) {
+			got = append(got, textResult{result.State(), slices.Clone(result.Raw())})
+		}
+	}
+	require.False(t, matcher.Remaining())
+	require.Equal(t, []Result{
+		textResult{STATE_HEAD, []byte("<")},
+		textResult{STATE_BODY, []byte("a")},
+		textResult{STATE_TAIL, []byte(">")},
+		textResult{STATE_NONE, []byte("b")},
+		textResult{STATE_HEAD, []byte("<")},
+		textResult{STATE_BODY, []byte("c")},
+		textResult{STATE_TAIL, []byte(">")},
+		textResult{STATE_NONE, []byte("d<e>f<")},
+	}, got)
+
+	// A new stream starts over after Drain
+	require.Empty(t, matcher.Drain())
+	require.True(t, matcher.Remaining())
+}
+
+func TestLos_Matcher_DiscardNone(t *testing.T) {
+	tests := []struct {
+		name     string
+		pair     *Pair
+		contents []string
+	}{
+		{
+			name:     "literal pair",
+			pair:     NewPair("<x>", "</x>"),
+			contents: []string{"noise<x>a</x>noise <", "x>b</", "x> <x", "!"},
+		},
+		{
+			name:     "regex pair",
+			pair:     NewPair("<x\\s*>", "</x>", WithRegexHead(REGEX_MODE_PERL)),
+			contents: []string{"noise<x>a</x>noise <", "x >b</", "x> <x", "!"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMatcher(tt.pair, WithDiscardNone())
+			defer m.Close() // nolint: errcheck
+
+			var got []State
+			var body string
+			for _, content := range tt.contents {
+				for result := range m.Match(content) {
+					got = append(got, result.State())
+					if result.State() == STATE_BODY {
+						body += result.String()
+					}
+				}
+				require.LessOrEqual(t, m.(*matcher).buffer.Len(), 5)
+			}
+			require.Equal(t, []State{
+				STATE_HEAD, STATE_BODY, STATE_TAIL,
+				STATE_HEAD, STATE_BODY, STATE_TAIL,
+			}, got)
+			require.Equal(t, "ab", body)
+			require.Empty(t, m.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_Coalesce(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"), WithCoalesce(4, 0))
+	defer m.Close() // nolint: errcheck
+
+	var results []textResult
+	for _, content := range []string{"a", "b", "<x>", "c", "d", "e", "f", "g", "</x>", "h"} {
+		for result := range m.Match(content) {
+			results = append(results, textResult{result.State(), slices.Clone(result.Raw())})
+		}
+	}
+	require.Equal(t, []textResult{
+		{STATE_NONE, []byte("ab")},
+		{STATE_HEAD, []byte("<x>")},
+		{STATE_BODY, []byte("cdef")},
+		{STATE_BODY, []byte("g")},
+		{STATE_TAIL, []byte("</x>")},
+	}, results)
+	require.ErrorIs(t, m.Close(), ErrBufferNotDrained)
+	require.Equal(t, "h", m.Drain())
+}
+
+func TestLos_Matcher_Go(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"))
+	defer m.Close() // nolint: errcheck
+
+	in := make(chan []byte)
+	go func() {
+		defer close(in)
+		for _, chunk := range []string{"a<", "x>b", "c</x", ">d<x>e</"} {
+			in <- []byte(chunk)
+		}
+	}()
+
+	out, errc := m.Go(in)
+	var results []textResult
+	for result := range out {
+		results = append(results, textResult{result.State(), result.Raw()})
+	}
+	require.Equal(t, []textResult{
+		{STATE_NONE, []byte("a")},
+		{STATE_HEAD, []byte("<x>")},
+		{STATE_BODY, []byte("b")},
+		{STATE_BODY, []byte("c")},
+		{STATE_TAIL, []byte("</x>")},
+		{STATE_NONE, []byte("d")},
+		{STATE_HEAD, []byte("<x>")},
+		{STATE_BODY, []byte("e")},
+	}, results)
+	require.ErrorIs(t, <-errc, ErrBufferNotDrained)
+	require.Equal(t, "</", m.Drain())
+}
+
+func TestLos_Pair_Shared(t *testing.T) {
+	pairs := []*Pair{
+		NewPair("<x>", "</x>"),
+		NewPair("<(a|b)>", "</(a|b)>", WithRegexHead(REGEX_MODE_PERL), WithRegexTail(REGEX_MODE_PERL)),
+		NewPair("<[a-z]+\\d>", "</[a-z]+[0-9]>", WithRegexHead(REGEX_MODE_PERL), WithRegexTail(REGEX_MODE_POSIX)),
+	}
+	inputs := []string{
+		"noise <x>body</x> tail",
+		"noise <a>body</b> tail",
+		"noise <ab1>body</cd2> tail",
+	}
+
+	var wg sync.WaitGroup
+	for i, pair := range pairs {
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 64 {
+					m := NewMatcher(pair)
+					var body string
+					for _, b := range []byte(inputs[i]) {
+						for result := range m.Match(string(b)) {
+							if result.State() == STATE_BODY {
+								body += result.String()
+							}
+						}
+					}
+					assert.Equal(t, "body", body)
+					assert.Empty(t, m.Drain())
+					assert.NoError(t, m.Close())
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestLos_Matcher_EmptyMatchPolicy(t *testing.T) {
+	type result = textResult
+	pairs := map[string]*Pair{
+		"kmp":   NewPair("", ""),
+		"regex": NewPair("x*", "y?", WithRegexHead(REGEX_MODE_PERL), WithRegexTail(REGEX_MODE_PERL)),
+	}
+	tests := []struct {
+		name     string
+		policy   emptyMatchPolicy
+		expected []result
+		err      error
+	}{
+		{
+			name:     "skip",
+			policy:   EMPTY_MATCH_SKIP,
+			expected: []result{{STATE_NONE, []byte("abc")}},
+		},
+		{
+			name:     "error",
+			policy:   EMPTY_MATCH_ERROR,
+			expected: nil,
+			err:      ErrEmptyMatch,
+		},
+		{
+			name:   "emit empty block",
+			policy: EMPTY_MATCH_EMIT_BLOCK,
+			expected: []result{
+				{STATE_HEAD, []byte("")}, {STATE_TAIL, []byte("")}, {STATE_NONE, []byte("a")},
+				{STATE_HEAD, []byte("")}, {STATE_TAIL, []byte("")}, {STATE_NONE, []byte("b")},
+				{STATE_HEAD, []byte("")}, {STATE_TAIL, []byte("")}, {STATE_NONE, []byte("c")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for name, pair := range pairs {
+			for _, chunks := range [][]string{{"abc"}, {"a", "b", "c"}, {"ab", "", "c"}} {
+				t.Run(tt.name+"/"+name, func(t *testing.T) {
+					m := NewMatcher(pair, WithEmptyMatchPolicy(tt.policy))
+					var got []result
+					for _, chunk := range chunks {
+						for r := range m.Match(chunk) {
+							// Merge the consecutive NONE split by chunks
+							if n := len(got); n > 0 && r.State() == STATE_NONE && got[n-1].state == STATE_NONE {
+								got[n-1].raw = append(got[n-1].raw, r.Raw()...)
+								continue
+							}
+							got = append(got, result{r.State(), slices.Clone(r.Raw())})
+						}
+					}
+					require.Equal(t, tt.expected, got)
+					require.ErrorIs(t, m.Err(), tt.err)
+					m.Drain()
+					require.NoError(t, m.Err())
+				})
+			}
+		}
+	}
+}
+
+func TestLos_Matcher_LookbackLimit(t *testing.T) {
+	pair := NewPair("<[a-z]*>", "</>", WithRegexHead(REGEX_MODE_PERL))
+	m := NewMatcher(pair, WithLookbackLimit(4))
+	defer m.Close() // nolint: errcheck
+
+	var none, body string
+	for _, chunk := range []string{"<", "aaaaaa", "aaaa", "<ab", ">x</>"} {
+		for result := range m.Match(chunk) {
+			switch result.State() {
+			case STATE_NONE:
+				none += result.String()
+			case STATE_BODY:
+				body += result.String()
+			}
+		}
+		require.LessOrEqual(t, m.(*matcher).buffer.Len(), 4)
+	}
+	require.Equal(t, "<aaaaaaaaaa", none)
+	require.Equal(t, "x", body)
+	require.Empty(t, m.Drain())
+
+	// The limit never cuts a bounded delimiter
+	m = NewMatcher(NewPair("<head>", "</head>"), WithLookbackLimit(2))
+	var states []State
+	for _, chunk := range []string{"<hea", "d>x"} {
+		for result := range m.Match(chunk) {
+			states = append(states, result.State())
+		}
+	}
+	require.Equal(t, []State{STATE_HEAD, STATE_BODY}, states)
+}
+
+func TestLos_Pair_MaxLen(t *testing.T) {
+	tests := []struct {
+		name string
+		pair *Pair
+		head int
+		tail int
+		ok   [2]bool
+	}{
+		{"literal", NewPair("<x>", "</x>"), 3, 4, [2]bool{true, true}},
+		{"fuzzy", NewPair("BEGIN", "END", WithMaxEditDistance(1)), 6, 4, [2]bool{true, true}},
+		{
+			"literal alternation",
+			NewPair("error|warn", "x", WithRegexHead(REGEX_MODE_PERL)),
+			5, 1, [2]bool{true, true},
+		},
+		{
+			"bounded regex",
+			NewPair("<[a-z]{1,3}\\d?>", "é.", WithRegexHead(REGEX_MODE_PERL), WithRegexTail(REGEX_MODE_PERL)),
+			6, 6, [2]bool{true, true},
+		},
+		{
+			"unbounded regex",
+			NewPair("<[a-z]+>", "</[a-z]*>", WithRegexHead(REGEX_MODE_PERL), WithRegexTail(REGEX_MODE_POSIX)),
+			0, 0, [2]bool{false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, ok := tt.pair.MaxHeadLen()
+			require.Equal(t, tt.ok[0], ok)
+			if ok {
+				require.Equal(t, tt.head, head)
+			}
+			tail, ok := tt.pair.MaxTailLen()
+			require.Equal(t, tt.ok[1], ok)
+			if ok {
+				require.Equal(t, tt.tail, tail)
+			}
+		})
+	}
+}
+
+func TestLos_Matcher_BodyHash(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"), WithBodyHash(sha256.New))
+	defer m.Close() // nolint: errcheck
+
+	var sums [][]byte
+	for _, chunk := range []string{"a<x>he", "llo</", "x>b<x></x>"} {
+		for result := range m.Match(chunk) {
+			block, ok := result.(Block)
+			require.True(t, ok)
+			if result.State() != STATE_TAIL {
+				require.Nil(t, block.Sum())
+				continue
+			}
+			sums = append(sums, block.Sum())
+		}
+	}
+	hello, empty := sha256.Sum256([]byte("hello")), sha256.Sum256(nil)
+	require.Equal(t, [][]byte{hello[:], empty[:]}, sums)
+}
+
+func TestLos_Matcher_Journal(t *testing.T) {
+	var journal bytes.Buffer
+	pairs := []*Pair{NewPair("<x>", "</x>"), NewPair("<y>", "</y>")}
+	m := NewMultiMatcher(pairs, WithJournal(&journal))
+	for _, chunk := range []string{"a<x>b", "</x>c<y", ">d</"} {
+		for range m.Match(chunk) {
+		}
+	}
+	require.Equal(t, "</", m.Drain())
+	require.Equal(t, []byte{
+		0, byte(STATE_NONE), 0, // "a" at 0
+		2, byte(STATE_HEAD), 0, // "<x>" at 1
+		6, byte(STATE_BODY), 0, // "b" at 4
+		2, byte(STATE_TAIL), 0, // "</x>" at 5
+		8, byte(STATE_NONE), 0, // "c" at 9
+		2, byte(STATE_HEAD), 1, // "<y>" at 10
+		6, byte(STATE_BODY), 1, // "d" at 13
+		2, byte(STATE_NONE), 0, // drained "</" at 14
+	}, journal.Bytes())
+}
+
+func TestLos_Replay(t *testing.T) {
+	var journal bytes.Buffer
+	pairs := []*Pair{NewPair("<x>", "</x>"), NewPair("<y>", "</y>")}
+	m := NewMultiMatcher(pairs, WithJournal(&journal))
+
+	chunks := []string{"a<x>b", "</x>c<y", ">d</"}
+	var expected []textResult
+	for _, chunk := range chunks {
+		for result := range m.Match(chunk) {
+			expected = append(expected, textResult{result.State(), slices.Clone(result.Raw())})
+		}
+	}
+	rest := m.Drain()
+	expected = append(expected, textResult{STATE_NONE, []byte(rest)})
+
+	var got []textResult
+	var indexes []int
+	source := strings.NewReader(strings.Join(chunks, ""))
+	for result := range Replay(&journal, source) {
+		got = append(got, textResult{result.State(), slices.Clone(result.Raw())})
+		indexes = append(indexes, result.(ReplayResult).PairIndex())
+	}
+	require.Equal(t, expected, got)
+	require.Equal(t, []int{0, 0, 0, 0, 0, 1, 1, 0}, indexes)
+}
+
+func TestLos_PairBuilder(t *testing.T) {
+	pair := NewPair("<x>", "</x>", WithPriority(2))
+	require.Equal(t, "<x>", pair.Head())
+	require.Equal(t, "</x>", pair.Tail())
+
+	derived := pair.Builder().Head("<[a-z]>", REGEX_MODE_PERL).Build()
+	head, tail := derived.Modes()
+	require.Equal(t, REGEX_MODE_PERL, head)
+	require.Equal(t, _REGEX_MODE_NONE, tail)
+	require.Equal(t, 2, derived.priority)
+
+	// The original pair is left untouched
+	head, _ = pair.Modes()
+	require.Equal(t, _REGEX_MODE_NONE, head)
+	require.Equal(t, "<x>", pair.Head())
+
+	m := NewMatcher(NewPairBuilder("{", "}").Tail("[})]", REGEX_MODE_PERL).Build())
+	var states []State
+	for result := range m.Match("a{b)c") {
+		states = append(states, result.State())
+	}
+	require.Equal(t, []State{STATE_NONE, STATE_HEAD, STATE_BODY, STATE_TAIL, STATE_NONE}, states)
+	require.Empty(t, m.Drain())
+}
+
+func TestLos_Matcher_Clone(t *testing.T) {
+	pair := NewPair("<[a-z]+>", "</>", WithRegexHead(REGEX_MODE_PERL))
+	tests := []struct {
+		name    string
+		matcher Matcher
+	}{
+		{"single pair", NewMatcher(pair, WithMaxBlocks(1))},
+		{"multi pair", NewMultiMatcher([]*Pair{pair, NewPair("{", "}")}, WithMaxBlocks(1))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range tt.matcher.Match("a<bc") {
+			}
+			clone := tt.matcher.Clone()
+
+			var states []State
+			for result := range clone.Match("<x>y</><z>") {
+				states = append(states, result.State())
+			}
+			// Options carried over, state started afresh
+			require.Equal(t, []State{STATE_HEAD, STATE_BODY, STATE_TAIL, STATE_NONE}, states)
+			require.Empty(t, clone.Drain())
+			require.Equal(t, "<bc", tt.matcher.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_Speculation(t *testing.T) {
+	frontMatter := NewPair("---\n", "\n---\n")
+	paragraph := NewPair("---\n", "\n\n")
+	tests := []struct {
+		name     string
+		contents []string
+		pair     *Pair
+		body     string
+	}{
+		{
+			name:     "front matter completes first",
+			contents: []string{"---", "\ntitle: x\n", "---\nrest"},
+			pair:     frontMatter,
+			body:     "title: x",
+		},
+		{
+			name:     "paragraph completes first",
+			contents: []string{"---\npara", "\n\nmore\n---\n"},
+			pair:     paragraph,
+			body:     "para",
+		},
+		{
+			name:     "budget exhausted",
+			contents: []string{"---\nno tail ", "in sight\n---\n"},
+			pair:     frontMatter,
+			body:     "no tail in sight",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMultiMatcher([]*Pair{frontMatter, paragraph}, WithSpeculation(8))
+			var body string
+			var pair *Pair
+			for _, content := range tt.contents {
+				for result := range m.Match(content) {
+					if result.State() == STATE_HEAD {
+						pair = result.(PairResult).Pair()
+					}
+					if result.State() == STATE_BODY {
+						body += result.String()
+					}
+				}
+			}
+			require.Same(t, tt.pair, pair)
+			require.Equal(t, tt.body, body)
+			m.Drain()
+		})
+	}
+
+	// A tail past the budget is not seen whatever the chunking, the
+	// pair ranked first wins
+	const input = "---\nlong paragraph\n\nrest"
+	for size := len(input); size > 0; size-- {
+		m := NewMultiMatcher([]*Pair{frontMatter, paragraph}, WithSpeculation(8))
+		var pair *Pair
+		for chunk := range slices.Chunk([]byte(input), size) {
+			for result := range m.Match(string(chunk)) {
+				if result.State() == STATE_HEAD {
+					pair = result.(PairResult).Pair()
+				}
+			}
+		}
+		require.Same(t, frontMatter, pair, size)
+		m.Drain()
+	}
+}
+
+func TestLos_DiffMatcher(t *testing.T) {
+	// The headers only open a block at the start of a line
+	preamble := "Subject: fix the @@ marker\nof diff --git a b\n\n"
+	diff := preamble +
+		"diff --git a/los.go b/los.go\n" +
+		"index 1a2b3c4..5d6e7f8 100644\n" +
+		"--- a/los.go\n" +
+		"+++ b/los.go\n" +
+		"@@ -1,2 +1,3 @@ package los\n" +
+		" a\n" +
+		"+b\n" +
+		"@@ -10 +11 @@\n" +
+		"-c @@ d\n" +
+		"diff --git a/go.mod b/go.mod\n" +
+		"@@ -1 +1 @@\n"
+
+	// The lines up to the next header land in the body, whatever the
+	// chunking, the last tail is settled by Flush
+	for size := 1; size <= len(diff); size += 7 {
+		m := NewDiffMatcher()
+		var blocks []string
+		var block, none string
+		collect := func(results Results) {
+			for result := range results {
+				switch result.State() {
+				case STATE_HEAD:
+					block = "hunk " + result.String()
+					if result.(PairResult).Pair() == DiffFilePair {
+						block = "file " + result.String()
+					}
+				case STATE_BODY:
+					block += result.String()
+				case STATE_TAIL:
+					require.Equal(t, "\n", result.String())
+					blocks, block = append(blocks, block), ""
+				case STATE_NONE:
+					none += result.String()
+				}
+			}
+		}
+		for chunk := range slices.Chunk([]byte(diff), size) {
+			collect(m.Match(string(chunk)))
+		}
+		collect(m.Flush())
+		require.Equal(t, []string{
+			"file diff --git a/los.go b/los.go\nindex 1a2b3c4..5d6e7f8 100644\n--- a/los.go\n+++ b/los.go",
+			"hunk @@ -1,2 +1,3 @@ package los\n a\n+b",
+			"hunk @@ -10 +11 @@\n-c @@ d",
+			"file diff --git a/go.mod b/go.mod",
+			"hunk @@ -1 +1 @@",
+		}, blocks, size)
+		require.Equal(t, preamble, none, size)
+		require.Empty(t, m.Drain(), size)
+		require.NoError(t, m.Close())
+	}
+}
+
+func TestLos_ChatMatcher(t *testing.T) {
+	transcript := "<|system|>be brief<|end|>\n<|user|>hi<|end|>\n<|assistant|>hello<|end|>"
+	tests := []struct {
+		name    string
+		matcher Matcher
+		input   string
+	}{
+		{"default markers", NewChatMatcher(), transcript},
+		{
+			"custom markers",
+			NewMultiMatcher(ChatPairs("<|eot|>", "system", "user", "assistant")),
+			strings.ReplaceAll(transcript, ChatEnd, "<|eot|>"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var turns []string
+			for chunk := range slices.Chunk([]byte(tt.input), 5) {
+				for result := range tt.matcher.Match(string(chunk)) {
+					switch result.State() {
+					case STATE_HEAD:
+						turns = append(turns, ChatRole(result)+":")
+					case STATE_BODY:
+						turns[len(turns)-1] += result.String()
+					case STATE_NONE:
+						require.Empty(t, ChatRole(result))
+					}
+				}
+			}
+			require.Equal(t, []string{"system:be brief", "user:hi", "assistant:hello"}, turns)
+			require.Empty(t, tt.matcher.Drain())
+		})
+	}
+}
+
+func TestLos_ToolCallAccumulator(t *testing.T) {
+	deltas := []ToolCallDelta{
+		{Index: 0, ID: "call_a", Name: "get_weather", Arguments: `{"city": "Par`},
+		{Index: 1, ID: "call_b", Name: "search", Arguments: ` {"q": "a } b \" {`},
+		{Index: 0, Arguments: `is", "days": [1, `},
+		{Index: 1, Arguments: `"}`},
+		{Index: 0, Arguments: `2]}`},
+		{Index: 2, ID: "call_c", Name: "broken", Arguments: `{"x": 1,}`},
+	}
+
+	acc := NewToolCallAccumulator()
+	var calls []ToolCall
+	var errs []error
+	for _, delta := range deltas {
+		done, err := acc.Add(delta)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		calls = append(calls, done...)
+	}
+	require.Equal(t, []ToolCall{
+		{ID: "call_b", Name: "search", Arguments: map[string]any{"q": `a } b " {`}},
+		{ID: "call_a", Name: "get_weather", Arguments: map[string]any{"city": "Paris", "days": []any{1.0, 2.0}}},
+	}, calls)
+	require.Len(t, errs, 1)
+	require.Zero(t, acc.Pending())
+
+	// A delta closing a call and carrying the next one
+	acc = NewToolCallAccumulator()
+	done, err := acc.Add(ToolCallDelta{Index: 0, ID: "call_a", Name: "get_weather"})
+	require.NoError(t, err)
+	require.Empty(t, done)
+	require.Equal(t, 1, acc.Pending())
+	done, err = acc.Add(ToolCallDelta{Index: 0, Arguments: `{"city": "Pa`})
+	require.NoError(t, err)
+	require.Empty(t, done)
+	done, err = acc.Add(ToolCallDelta{Index: 0, Arguments: `ris"} {"city": "Rome"}{"city": "Os`})
+	require.NoError(t, err)
+	require.Equal(t, []ToolCall{
+		{ID: "call_a", Name: "get_weather", Arguments: map[string]any{"city": "Paris"}},
+		{ID: "call_a", Name: "get_weather", Arguments: map[string]any{"city": "Rome"}},
+	}, done)
+	require.Equal(t, 1, acc.Pending())
+	done, err = acc.Add(ToolCallDelta{Index: 0, Arguments: `lo"}`})
+	require.NoError(t, err)
+	require.Equal(t, []ToolCall{{ID: "call_a", Name: "get_weather", Arguments: map[string]any{"city": "Oslo"}}}, done)
+	require.Zero(t, acc.Pending())
+
+	// The calls are keyed by their id, not by the index reused
+	done, err = acc.Add(ToolCallDelta{Index: 0, ID: "call_b", Name: "search", Arguments: `{"q": "x"`})
+	require.NoError(t, err)
+	require.Empty(t, done)
+	done, err = acc.Add(ToolCallDelta{Index: 1, ID: "call_a", Name: "get_weather", Arguments: `{"city": "Nice"}`})
+	require.NoError(t, err)
+	require.Equal(t, []ToolCall{{ID: "call_a", Name: "get_weather", Arguments: map[string]any{"city": "Nice"}}}, done)
+	done, err = acc.Add(ToolCallDelta{Index: 0, Arguments: `}`})
+	require.NoError(t, err)
+	require.Equal(t, []ToolCall{{ID: "call_b", Name: "search", Arguments: map[string]any{"q": "x"}}}, done)
+	require.Zero(t, acc.Pending())
+}
+
+func TestLos_Matcher_OnTransition(t *testing.T) {
+	type transition struct {
+		from, to State
+		offset   int64
+	}
+	var transitions []transition
+	m := NewMatcher(NewPair("<x>", "</x>"), WithOnTransition(func(from, to State, offset int64) {
+		transitions = append(transitions, transition{from, to, offset})
+	}))
+
+	for _, chunk := range []string{"ab<", "x>c", "d</x>e<x>f"} {
+		for range m.Match(chunk) {
+		}
+	}
+	require.Empty(t, m.Drain())
+	require.Equal(t, []transition{
+		{STATE_NONE, STATE_HEAD, 2},
+		{STATE_HEAD, STATE_BODY, 5},
+		{STATE_BODY, STATE_TAIL, 7},
+		{STATE_TAIL, STATE_NONE, 11},
+		{STATE_NONE, STATE_HEAD, 12},
+		{STATE_HEAD, STATE_BODY, 15},
+		{STATE_BODY, STATE_NONE, 16}, // drained
+	}, transitions)
+}
+
+func TestLos_Matcher_Clock(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	tests := []struct {
+		name string
+		opts []matcherOption
+	}{
+		{"streamed block", []matcherOption{WithClock(clock)}},
+		{"held block", []matcherOption{WithClock(clock), WithMaxBodyBytes(16)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMatcher(NewPair("<think>", "</think>"), tt.opts...)
+			var durations []time.Duration
+			for _, chunk := range []string{"<think>a", "b", "c</think>"} {
+				for result := range m.Match(chunk) {
+					durations = append(durations, result.(Block).Duration())
+				}
+			}
+			// Clock read at the head, then at the tail
+			require.Equal(t, time.Second, durations[len(durations)-1])
+			for _, d := range durations[:len(durations)-1] {
+				require.Zero(t, d)
+			}
+			require.Empty(t, m.Drain())
+		})
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestLos_Matcher_Route(t *testing.T) {
+	m := NewMatcher(NewPair("```", "```"))
+	var body, none bytes.Buffer
+	m.Route(STATE_BODY, &body)
+	m.Route(STATE_NONE, &none)
+
+	_, err := io.Copy(m, iotest.OneByteReader(strings.NewReader("a```go\nx\n```b```y")))
+	require.NoError(t, err)
+	require.Equal(t, "go\nx\ny", body.String())
+	require.Equal(t, "ab", none.String())
+	require.Empty(t, m.Drain())
+
+	// Unrouted states are yielded by Match
+	var states []State
+	for result := range m.Match("```z```") {
+		states = append(states, result.State())
+	}
+	require.Equal(t, []State{STATE_HEAD, STATE_TAIL}, states)
+
+	// A write error stops matching
+	errWrite := errors.New("write")
+	m.Route(STATE_BODY, failingWriter{errWrite})
+	_, err = m.Write([]byte("```z```c"))
+	require.ErrorIs(t, err, errWrite)
+	require.ErrorIs(t, m.Err(), errWrite)
+	require.Equal(t, "```c", m.Drain())
+}
+
+func TestLos_Chain(t *testing.T) {
+	fences := NewMatcher(NewPair("```\n", "```"))
+	items := NewMatcher(NewPair("- ", "\n", WithLineAnchoredHead()))
+	m := Chain(fences, items)
+	defer m.Close() // nolint: errcheck
+
+	type step struct {
+		depth int
+		state State
+		raw   string
+	}
+	var steps []step
+	input := "a\n- no\n```\n- x\n- y\n- z```b"
+	for chunk := range slices.Chunk([]byte(input), 3) {
+		for result := range m.Match(string(chunk)) {
+			depth := result.(ChainResult).Depth()
+			if n := len(steps) - 1; n >= 0 && steps[n].depth == depth && steps[n].state == result.State() {
+				steps[n].raw += result.String()
+				continue
+			}
+			steps = append(steps, step{depth, result.State(), result.String()})
+		}
+	}
+	require.Equal(t, []step{
+		{0, STATE_NONE, "a\n- no\n"},
+		{0, STATE_HEAD, "```\n"},
+		{1, STATE_HEAD, "- "},
+		{1, STATE_BODY, "x"},
+		{1, STATE_TAIL, "\n"},
+		{1, STATE_HEAD, "- "},
+		{1, STATE_BODY, "y"},
+		{1, STATE_TAIL, "\n"},
+		{1, STATE_HEAD, "- "},
+		{1, STATE_BODY, "z"}, // unterminated, cut by the outer tail
+		{0, STATE_TAIL, "```"},
+		{0, STATE_NONE, "b"},
+	}, steps)
+	require.Empty(t, m.Drain())
+
+	// Drain propagates to both stages
+	for range m.Match("```\n- a\n-``") {
+	}
+	require.Equal(t, "-``", m.Drain())
+	require.NoError(t, m.Close())
+}
+
+func TestLos_Tree(t *testing.T) {
+	sections := NewMultiMatcher([]*Pair{NewPair("<s>", "</s>", WithName("section"))})
+	fences := NewMatcher(NewPair("```\n", "```"))
+	lines := NewMatcher(NewPair("- ", "\n", WithLineAnchoredHead()))
+	m := Chain(sections, Chain(fences, lines))
+
+	input := "a<s>b```\n- x\n- y```c</s>d"
+	var tree Tree
+	for chunk := range slices.Chunk([]byte(input), 2) {
+		for result := range m.Match(string(chunk)) {
+			tree.Add(result)
+		}
+	}
+	require.Empty(t, m.Drain())
+
+	nodes := tree.Nodes()
+	require.Len(t, nodes, 3)
+	require.Equal(t, "a", nodes[0].Text)
+	require.Equal(t, "d", nodes[2].Text)
+
+	section := nodes[1]
+	require.Equal(t, "section", section.Pair.Name())
+	require.Equal(t, "</s>", section.Tail)
+	require.Len(t, section.Children, 3)
+	require.Equal(t, "b", section.Children[0].Text)
+	require.Equal(t, "c", section.Children[2].Text)
+
+	fence := section.Children[1]
+	require.True(t, fence.Block)
+	require.Len(t, fence.Children, 2)
+	for i, line := range []string{"x", "y"} {
+		require.Equal(t, "- ", fence.Children[i].Head)
+		require.Equal(t, line, fence.Children[i].Children[0].Text)
+	}
+
+	var b strings.Builder
+	for _, node := range nodes {
+		b.WriteString(node.String())
+	}
+	require.Equal(t, input, b.String())
+}
+
+func TestLos_Matcher_MaxStreamBytes(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"), WithMaxStreamBytes(8))
+
+	var got []string
+	for _, chunk := range []string{"a<x>", "bc</x>d", "e"} {
+		for result := range m.Match(chunk) {
+			got = append(got, result.String())
+		}
+	}
+	// "</" is held back as a partial tail when the limit is reached
+	require.Equal(t, []string{"a", "<x>", "bc"}, got)
+	require.ErrorIs(t, m.Err(), ErrStreamTooLong)
+	require.Equal(t, ErrStreamLimit{Limit: 8, Have: 11}, m.Err())
+	require.Equal(t, int64(12), m.Stats().Bytes)
+	require.Equal(t, "</x>de", m.Drain())
+
+	// Drain starts a new stream
+	require.NoError(t, m.Err())
+	for range m.Match("<x>") {
+	}
+	require.Equal(t, int64(3), m.Stats().Bytes)
+}
+
+func TestLos_Matcher_StrictPrefix(t *testing.T) {
+	collect := func(m Matcher, chunks ...string) []string {
+		var got []string
+		for _, chunk := range chunks {
+			for result := range m.Match(chunk) {
+				got = append(got, result.String())
+			}
+		}
+		return got
+	}
+
+	// The content between the blocks is left alone
+	m := NewMatcher(NewPair("<x>", "</x>"), WithStrictPrefix())
+	require.Equal(t, []string{"<x>", "a", "</x>", "b", "<x>"}, collect(m, "<x>a</x>b<x>"))
+	require.NoError(t, m.Err())
+
+	m = NewMatcher(NewPair("<x>", "</x>"), WithStrictPrefix())
+	require.Empty(t, collect(m, "ab<", "x>c"))
+	require.ErrorIs(t, m.Err(), ErrStrictPrefix)
+	require.EqualError(t, m.Err(), "content before the first head: 2 bytes at offset 0")
+
+	// Drain starts a new stream
+	require.Equal(t, "<x>c", m.Drain())
+	require.NoError(t, m.Err())
+	require.Equal(t, []string{"<x>", "c"}, collect(m, "<x>c"))
+
+	var reject strings.Builder
+	m = NewMatcher(NewPair("<x>", "</x>"), WithRejectWriter(&reject))
+	require.Equal(t, []string{"<x>", "a", "</x>", "b"}, collect(m, "junk<x>a</x>b"))
+	require.NoError(t, m.Err())
+	require.Equal(t, "junk", reject.String())
+
+	errWrite := errors.New("write")
+	m = NewMatcher(NewPair("<x>", "</x>"), WithRejectWriter(failingWriter{errWrite}))
+	require.Empty(t, collect(m, "junk<x>"))
+	require.ErrorIs(t, m.Err(), errWrite)
+}
+
+func TestLos_Matcher_InvariantChecks(t *testing.T) {
+	states := func(results Results) []State {
+		var got []State
+		for result := range results {
+			got = append(got, result.State())
+		}
+		return got
+	}
+
+	m := NewMatcher(NewPair("<x>", "</x>"), WithInvariantChecks(), WithRewind(16), WithCoalesce(2, 0))
+	require.Equal(t, []State{STATE_NONE, STATE_HEAD, STATE_BODY, STATE_TAIL, STATE_HEAD},
+		states(m.Match("ab<x>cd</x><x>")))
+	require.NoError(t, m.Rewind(len("cd</x><x>")))
+	require.Equal(t, []State{STATE_BODY, STATE_TAIL, STATE_HEAD}, states(m.Match("")))
+	require.NoError(t, m.Err())
+
+	// A regression of the state machine is caught before the Result
+	m = NewMatcher(NewPair("<x>", "</x>"), WithInvariantChecks())
+	m.(*matcher).state = STATE_BODY
+	require.Empty(t, states(m.Match("ab</x>")))
+	require.ErrorIs(t, m.Err(), ErrInvariant)
+	require.EqualError(t, m.Err(), "states out of order: BODY after NONE")
+
+	// The Result refused is not emitted, Drain starts a new stream
+	require.Equal(t, "</x>", m.Drain())
+	require.Equal(t, []State{STATE_NONE, STATE_HEAD}, states(m.Match("ab<x>")))
+	require.NoError(t, m.Err())
+}
+
+func TestLos_Matcher_RestartOnHead(t *testing.T) {
+	tests := []struct {
+		name     string
+		pair     *Pair
+		input    string
+		expected []Result
+	}{
+		{
+			name:  "restart at the inner head",
+			pair:  NewPair("<x>", "</x>"),
+			input: "a<x>b<x>c</x>d",
+			expected: []Result{
+				textResult{STATE_NONE, []byte("a")},
+				textResult{STATE_NONE, []byte("<x>b")},
+				textResult{STATE_HEAD, []byte("<x>")},
+				textResult{STATE_BODY, []byte("c")},
+				textResult{STATE_TAIL, []byte("</x>")},
+				textResult{STATE_NONE, []byte("d")},
+			},
+		},
+		{
+			name:  "restart at the last of many heads",
+			pair:  NewPair("<x>", "</x>"),
+			input: "<x><x>b<x></x>",
+			expected: []Result{
+				textResult{STATE_NONE, []byte("<x><x>b")},
+				textResult{STATE_HEAD, []byte("<x>")},
+				textResult{STATE_TAIL, []byte("</x>")},
+			},
+		},
+		{
+			name:  "regex head",
+			pair:  NewPair("<[a-z]>", "</>", WithRegexHead(REGEX_MODE_PERL)),
+			input: "<a>1<b>2</>",
+			expected: []Result{
+				textResult{STATE_NONE, []byte("<a>1")},
+				textResult{STATE_HEAD, []byte("<b>")},
+				textResult{STATE_BODY, []byte("2")},
+				textResult{STATE_TAIL, []byte("</>")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMatcher(tt.pair, WithRestartOnHead())
+			defer m.Close() // nolint: errcheck
+
+			var results []Result
+			for chunk := range slices.Chunk([]byte(tt.input), 2) {
+				for result := range m.Match(string(chunk)) {
+					results = append(results, textResult{result.State(), slices.Clone(result.Raw())})
+				}
+			}
+			require.Equal(t, tt.expected, results)
+			require.Empty(t, m.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_GreedyTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []matcherOption
+		chunks   []string
+		expected []Result
+		drained  string
+	}{
+		{
+			name:   "lazy tail",
+			opts:   []matcherOption{WithGreedyTail(), WithLazyTail()},
+			chunks: []string{"{a}b}", "c"},
+			expected: []Result{
+				textResult{STATE_HEAD, []byte("{")},
+				textResult{STATE_BODY, []byte("a")},
+				textResult{STATE_TAIL, []byte("}")},
+				textResult{STATE_NONE, []byte("b}")},
+				textResult{STATE_NONE, []byte("c")},
+			},
+		},
+		{
+			name:   "greedy tail settled by flush",
+			opts:   []matcherOption{WithGreedyTail()},
+			chunks: []string{"{a}b}", "c{d"},
+			expected: []Result{
+				textResult{STATE_HEAD, []byte("{")},
+				textResult{STATE_BODY, []byte("a}b")},
+				textResult{STATE_TAIL, []byte("}")},
+				textResult{STATE_NONE, []byte("c")},
+			},
+			drained: "{d",
+		},
+		{
+			name:   "greedy tail settled by max body",
+			opts:   []matcherOption{WithGreedyTail(), WithMaxBodyBytes(4)},
+			chunks: []string{"{a}b}", "cd{e}"},
+			expected: []Result{
+				textResult{STATE_HEAD, []byte("{")},
+				textResult{STATE_BODY, []byte("a}b")},
+				textResult{STATE_TAIL, []byte("}")},
+				textResult{STATE_NONE, []byte("cd")},
+				textResult{STATE_HEAD, []byte("{")},
+				textResult{STATE_BODY, []byte("e")},
+				textResult{STATE_TAIL, []byte("}")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMatcher(NewPair("{", "}"), tt.opts...)
+			var results []Result
+			for _, chunk := range tt.chunks {
+				for result := range m.Match(chunk) {
+					results = append(results, textResult{result.State(), slices.Clone(result.Raw())})
+				}
+			}
+			for result := range m.Flush() {
+				results = append(results, textResult{result.State(), slices.Clone(result.Raw())})
+			}
+			require.Equal(t, tt.expected, results)
+			require.Equal(t, tt.drained, m.Drain())
+		})
+	}
+}
+
+func TestLos_Matcher_Escape(t *testing.T) {
+	m := NewMatcher(NewPair(`"`, `"`, WithEscape('\\')))
+	defer m.Close() // nolint: errcheck
+
+	var bodies []string
+	input := `a \"b "c \"d\\" e "f\\\"g" h`
+	for chunk := range slices.Chunk([]byte(input), 3) {
+		for result := range m.Match(string(chunk)) {
+			if result.State() == STATE_HEAD {
+				bodies = append(bodies, "")
+			}
+			if result.State() == STATE_BODY {
+				bodies[len(bodies)-1] += result.String()
+			}
+		}
+	}
+	require.Equal(t, []string{`c \"d\\`, `f\\\"g`}, bodies)
+	require.Empty(t, m.Drain())
+}
+
+func TestLos_AnalyzePair(t *testing.T) {
+	codes := func(report Report) []warningCode {
+		var codes []warningCode
+		for _, w := range report.Warnings {
+			codes = append(codes, w.Code)
+		}
+		return codes
+	}
+
+	report := AnalyzePair(NewPair("<think>", "</think>"))
+	require.Empty(t, report.Warnings)
+	require.Zero(t, report.Score)
+	require.Equal(t, 7, report.Head.MaxLen)
+
+	report = AnalyzePair(NewPair("<a .*>", "(x+)*y", WithRegexHead(REGEX_MODE_PERL), WithRegexTail(REGEX_MODE_PERL)))
+	require.Equal(t, []warningCode{WARN_UNBOUNDED, WARN_UNBOUNDED, WARN_NESTED_QUANTIFIER}, codes(report))
+	require.True(t, report.Tail.Regex)
+	require.Positive(t, report.Tail.NumInst)
+	require.Equal(t, -1, report.Tail.MaxLen)
+	require.Equal(t, report.Head.Score+report.Tail.Score, report.Score)
+	require.Greater(t, report.Tail.Score, report.Tail.NumInst)
+
+	report = AnalyzePair(NewPair("", "x*", WithRegexTail(REGEX_MODE_PERL)))
+	require.Equal(t, []warningCode{WARN_EMPTY_MATCH, WARN_UNBOUNDED, WARN_EMPTY_MATCH}, codes(report))
+}
+
+func TestLos_MultiMatcher_StreamOrder(t *testing.T) {
+	type pairState struct {
+		state State
+		raw   string
+		pair  string
+	}
+
+	tests := []struct {
+		name  string
+		pairs []*Pair
+		input string
+	}{
+		{
+			name: "interleaved pairs",
+			pairs: []*Pair{
+				NewPair("<a>", "</a>", WithName("a")),
+				NewPair("<b>", "</b>", WithName("b")),
+				NewPair("[", "]", WithName("c")),
+			},
+			input: "x<b>1</b>[2]<a>3</a>y<a>[</a>[<b>]z",
+		},
+		{
+			name: "overlapping heads",
+			pairs: []*Pair{
+				NewPair("<ab", ">", WithName("a")),
+				NewPair("b<", ">", WithName("b"), WithPriority(1)),
+				NewPair("<", "<", WithName("c")),
+			},
+			input: "ab<ab<ab>b<<a<>",
+		},
+		{
+			name: "regex heads",
+			pairs: []*Pair{
+				NewPair("<h[1-6]>", "</h>", WithName("h"), WithRegexHead(REGEX_MODE_PERL)),
+				NewPair("<(p|div)>", "</>", WithName("p"), WithRegexHead(REGEX_MODE_PERL)),
+			},
+			input: "<p><h2>t</h><div>x</><h7>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expected []pairState
+			for size := 1; size <= len(tt.input); size++ {
+				m := NewMultiMatcher(tt.pairs)
+				var got []pairState
+				var stream strings.Builder
+				for chunk := range slices.Chunk([]byte(tt.input), size) {
+					for result := range m.Match(string(chunk)) {
+						stream.Write(result.Raw())
+						ps := pairState{result.State(), result.String(), ""}
+						if pr, ok := result.(PairResult); ok && pr.Pair() != nil {
+							ps.pair = pr.Pair().Name()
+						}
+						// Content is split by the chunks, merge it
+						if n := len(got) - 1; n >= 0 && got[n].state == ps.state &&
+							got[n].pair == ps.pair && ps.state&1 == 0 {
+							got[n].raw += ps.raw
+							continue
+						}
+						got = append(got, ps)
+					}
+				}
+				stream.WriteString(m.Drain())
+				require.Equal(t, tt.input, stream.String())
+				if expected == nil {
+					expected = got
+				}
+				require.Equal(t, expected, got, "chunk size %d", size)
+			}
+		})
+	}
+}
+
+func TestLos_Matcher_CloseAndDrain(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"))
+	for range m.Match("a<x>b</") {
+	}
+	rest, err := m.CloseAndDrain()
+	require.NoError(t, err)
+	require.Equal(t, "</", rest)
+
+	var final []Result
+	m = NewMatcher(NewPair("<x>", "</x>"), WithAutoDrainOnClose(func(result Result) {
+		final = append(final, result)
+	}))
+	for range m.Match("a<x>b</") {
+	}
+	require.NoError(t, m.Close())
+	require.Equal(t, []Result{textResult{STATE_NONE, []byte("</")}}, final)
+}
+
+func TestLos_Matcher_CloseTwice(t *testing.T) {
+	pair := NewPair("<x>", "</x\\s*>", WithRegexTail(REGEX_MODE_PERL))
+	m := NewMatcher(pair)
+	for range m.Match("<x>a</") {
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.Close()
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.ErrorIs(t, err, ErrBufferNotDrained)
+	}
+	m.Drain()
+	require.ErrorIs(t, m.Close(), ErrBufferNotDrained)
+
+	// The machine is put back into the pool only once
+	re := pair.tailProg.re
+	a, b := re.Get(), re.Get()
+	defer re.Put(a)
+	defer re.Put(b)
+	require.NotSame(t, a, b)
+}
+
+func TestLos_Matcher_OnHead(t *testing.T) {
+	pair := NewPair("<\\d+:", ">", WithRegexHead(REGEX_MODE_PERL))
+	n := 0
+	m := NewMatcher(pair, WithOnHead(func(r Result) any {
+		n++
+		return r.String() + string(rune('0'+n))
+	}))
+
+	type got struct {
+		state State
+		value any
+	}
+	gots := []got{}
+	for r := range m.Match("a<1:x><2:yz>b") {
+		gots = append(gots, got{r.State(), r.Value()})
+	}
+	require.Equal(t, []got{
+		{STATE_NONE, nil},
+		{STATE_HEAD, "<1:1"}, {STATE_BODY, "<1:1"}, {STATE_TAIL, "<1:1"},
+		{STATE_HEAD, "<2:2"}, {STATE_BODY, "<2:2"}, {STATE_TAIL, "<2:2"},
+		{STATE_NONE, nil},
+	}, gots)
+}
+
+func TestLos_CSVMatcher(t *testing.T) {
+	stream := "id,text\r\n" +
+		"1,\"a\nb\"\n" +
+		"\n" +
+		"2,\"say \"\"hi\"\"\r\n\"\n" +
+		"3\tc\td\n" +
+		"4,tail"
+
+	for size := 1; size <= len(stream); size++ {
+		m := NewCSVMatcher()
+		var records, tails []string
+		for chunk := range slices.Chunk([]byte(stream), size) {
+			for result := range m.Match(string(chunk)) {
+				switch result.State() {
+				case STATE_HEAD:
+					records = append(records, result.String())
+				case STATE_TAIL:
+					tails = append(tails, result.String())
+				case STATE_NONE:
+					require.Equal(t, "\n", result.String())
+				}
+			}
+		}
+		require.Equal(t, []string{
+			"id,text",
+			"1,\"a\nb\"",
+			"2,\"say \"\"hi\"\"\r\n\"",
+			"3\tc\td",
+		}, records, "chunk size %d", size)
+		require.Equal(t, []string{"\r\n", "\n", "\n", "\n"}, tails)
+		require.Equal(t, "4,tail", m.Drain())
+		require.NoError(t, m.Close())
+	}
+}
+
+type testTracer struct{ spans []string }
+
+type testSpan struct {
+	t    *testTracer
+	head string
+	at   int64
+}
+
+func (t *testTracer) Start(head Result, offset int64) Span {
+	return &testSpan{t, head.String(), offset}
+}
+
+func (s *testSpan) End(tail Result, offset int64, size int64) {
+	text := "<nil>"
+	if tail != nil {
+		text = tail.String()
+	}
+	s.t.spans = append(s.t.spans, fmt.Sprintf("%s@%d %s@%d %d", s.head, s.at, text, offset, size))
+}
+
+func TestLos_Matcher_Tracer(t *testing.T) {
+	tracer := &testTracer{}
+	m := NewMatcher(NewPair("<a>", "</a>"), WithTracer(tracer))
+	for _, chunk := range []string{"x<a>", "bo", "dy</a", ">y<a>z"} {
+		for range m.Match(chunk) {
+		}
+	}
+	require.Empty(t, m.Drain())
+	require.Equal(t, []string{"<a>@1 </a>@8 11", "<a>@13 <nil>@17 4"}, tracer.spans)
+}
+
+func TestLos_Matcher_Logger(t *testing.T) {
+	var sb strings.Builder
+	logger := slog.New(slog.NewTextHandler(&sb, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	m := NewMatcher(NewPair("<", ">"), WithMaxBodyBytes(2), WithLogger(logger))
+	for range m.Match("<abc>") {
+	}
+	m = NewMatcher(NewPair("x*", ">", WithRegexHead(REGEX_MODE_PERL)),
+		WithEmptyMatchPolicy(EMPTY_MATCH_ERROR), WithLogger(logger, slog.LevelInfo))
+	for range m.Match("ab") {
+	}
+	require.ErrorIs(t, m.Err(), ErrEmptyMatch)
+	require.Equal(t, ""+
+		"level=WARN msg=\"block rejected\" bytes=4 offset=0\n"+
+		"level=INFO msg=\"matching stopped\" err=\"delimiter matched empty\" offset=0\n",
+		sb.String())
+}
+
+func TestLos_State(t *testing.T) {
+	require.Equal(t, "HEAD", STATE_HEAD.String())
+	require.Equal(t, "State(7)", State(7).String())
+	require.Equal(t, "TAIL </x>", fmt.Sprint(STATE_TAIL, " </x>"))
+
+	for _, name := range []string{"body", "BODY", "state_body", "STATE_BODY"} {
+		state, err := ParseState(name)
+		require.NoError(t, err)
+		require.Equal(t, STATE_BODY, state)
+	}
+	_, err := ParseState("STATE_")
+	require.EqualError(t, err, `unknown state "STATE_"`)
+}
+
+func TestLos_KeyedMatcher(t *testing.T) {
+	collect := func(rs Results) []string {
+		var got []string
+		for result := range rs {
+			got = append(got, result.String())
+		}
+		return got
+	}
+
+	k := NewKeyedMatcher(NewPair("<x>", "</x>"), WithMaxKeys(2))
+	require.Equal(t, []string{"<x>", "a"}, collect(k.Match("a", "<x>a</")))
+	require.Equal(t, []string{"b"}, collect(k.Match("b", "b<")))
+	// The streams of the keys are independent
+	require.Equal(t, []string{"</x>"}, collect(k.Match("a", "x>")))
+	require.Equal(t, []string{"<x>"}, collect(k.Match("b", "x>")))
+	require.Equal(t, 2, k.Len())
+
+	// "a" is the least recently used, a new key evicts it
+	require.Equal(t, []string{"c"}, collect(k.Match("c", "c")))
+	require.Equal(t, 2, k.Len())
+	require.Equal(t, []string{"</x>"}, collect(k.Match("a", "</x>")))
+	require.Equal(t, []string{"d", "</x>"}, collect(k.Match("c", "<x>d</x>"))[1:])
+
+	require.Equal(t, "", k.Drain("b"))
+	require.Equal(t, "", k.Drain("unknown"))
+	require.Equal(t, 2, k.Len())
+	require.NoError(t, k.Err("a"))
+
+	// Sessions evicted while their Results are iterated over
+	for range k.Match("a", "<x>") {
+		require.Equal(t, []string{"e"}, collect(k.Match("e", "e")))
+		require.Equal(t, []string{"f"}, collect(k.Match("f", "f")))
+	}
+	require.Equal(t, 2, k.Len())
+
+	// Distinct keys are matched concurrently
+	k = NewKeyedMatcher(NewPair("<x>", "</x>"), WithSessionOptions(WithDiscardNone()))
+	var wg sync.WaitGroup
+	bodies := make([][]string, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprint(i)
+			for _, chunk := range []string{"-<x", ">" + key, "</x>-"} {
+				for result := range k.Match(key, chunk) {
+					if result.State() == STATE_BODY {
+						bodies[i] = append(bodies[i], result.String())
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i, body := range bodies {
+		require.Equal(t, []string{fmt.Sprint(i)}, body)
+	}
+	require.Equal(t, 8, k.Len())
+}
+
+func TestLos_KeyedMatcher_Evict(t *testing.T) {
+	var evicted []string
+	onEvict := func(key, drained string) {
+		evicted = append(evicted, key+" "+drained)
+	}
+	now := time.Unix(0, 0)
+	k := NewKeyedMatcher(NewPair("<x>", "</x>"), WithMaxKeys(2), WithSessionTTL(time.Minute), WithOnEvict(onEvict))
+	k.now = func() time.Time { return now }
+
+	for range k.Match("a", "<x>a") {
+	}
+	for range k.Match("b", "<") {
+	}
+	for range k.Match("c", "c<x") {
+	}
+	require.Equal(t, []string{"a "}, evicted)
+
+	// "b" idles beyond the TTL while "c" is matched again
+	now = now.Add(40 * time.Second)
+	for range k.Match("c", ">") {
+	}
+	now = now.Add(40 * time.Second)
+	k.Expire()
+	require.Equal(t, []string{"a ", "b <"}, evicted)
+	require.Equal(t, 1, k.Len())
+
+	// A Match evicts the idle sessions of the other keys
+	now = now.Add(2 * time.Minute)
+	for range k.Match("d", "d") {
+	}
+	require.Equal(t, []string{"a ", "b <", "c "}, evicted)
+
+	// Drain is not an eviction
+	require.Equal(t, "", k.Drain("d"))
+	require.Len(t, evicted, 3)
+
+	// A session evicted while its Results are iterated over is told
+	// once the iteration is done
+	evicted = nil
+	for range k.Match("e", "e<x>") {
+		for range k.Match("f", "f") {
+		}
+		for range k.Match("g", "<") {
+		}
+		require.Empty(t, evicted)
+	}
+	require.Equal(t, []string{"e "}, evicted)
+}
+
+func TestLos_Matcher_PooledResults(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"), WithPooledResults())
+	var got []string
+	for result := range m.Match("a<x>b</x>") {
+		require.Implements(t, (*PooledResult)(nil), result)
+		got = append(got, fmt.Sprint(result.State(), " ", result))
+		Release(result)
+	}
+	require.Equal(t, []string{"NONE a", "HEAD <x>", "BODY b", "TAIL </x>"}, got)
+
+	// Neither the sequence nor the Results allocate once the pool is
+	// warm, the race detector allocates on its own
+	if !raceEnabled {
+		allocs := testing.AllocsPerRun(100, func() {
+			m.Match("a<x>b</x>")(func(result Result) bool {
+				Release(result)
+				return true
+			})
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	// The options building Results of their own keep them pooled
+	opts := []matcherOption{WithCoalesce(4, 0), WithGraphemeSafety(), WithBodyHash(sha256.New)}
+	var want []string
+	for result := range NewMatcher(NewPair("<x>", "</x>"), opts...).Match("<x>ab\u00e9cd</x>") {
+		want = append(want, result.String())
+	}
+	m = NewMatcher(NewPair("<x>", "</x>"), append(opts, WithPooledResults())...)
+	got = got[:0]
+	for result := range m.Match("<x>ab\u00e9cd</x>") {
+		require.Implements(t, (*PooledResult)(nil), result)
+		got = append(got, result.String())
+		if result.State() == STATE_TAIL {
+			require.Len(t, result.(Block).Sum(), sha256.Size)
+		}
+		Release(result)
+	}
+	require.Equal(t, want, got)
+
+	// A detached Result is out of the pool
+	in := make(chan []byte, 1)
+	in <- []byte("a<x>")
+	close(in)
+	out, errc := NewMatcher(NewPair("<x>", "</x>"), WithPooledResults()).Go(in)
+	for result := range out {
+		_, isPooled := result.(PooledResult)
+		require.False(t, isPooled)
+	}
+	require.NoError(t, <-errc)
+
+	// Release leaves the other Results alone
+	Release(textResult{STATE_NONE, []byte("a")})
+}
+
+func TestLos_Matcher_Bodies(t *testing.T) {
+	in := strings.NewReader("a<x>" + strings.Repeat("b", 3*scanChunkSize) + "</x>c<x>skipped</x><x>d</x><x>open")
+	m := NewMatcher(NewPair("<x>", "</x>"))
+	var got []string
+	for body := range m.Bodies(iotest.HalfReader(in)) {
+		if len(got) == 1 {
+			got = append(got, "")
+			continue
+		}
+		b, err := io.ReadAll(body)
+		got = append(got, string(b))
+		if len(got) == 4 {
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+	require.Equal(t, []string{strings.Repeat("b", 3*scanChunkSize), "", "d", "open"}, got)
+	require.Equal(t, "", m.Drain())
+
+	// The error of reading is returned by the body it cuts
+	errRead := errors.New("read")
+	in2 := io.MultiReader(strings.NewReader("<x>a"), iotest.ErrReader(errRead))
+	for body := range NewMatcher(NewPair("<x>", "</x>")).Bodies(in2) {
+		b, err := io.ReadAll(body)
+		require.Equal(t, "a", string(b))
+		require.ErrorIs(t, err, errRead)
+	}
+
+	// Or else by a last reader
+	var errs []error
+	in3 := io.MultiReader(strings.NewReader("<x>1</x>"), iotest.ErrReader(errRead))
+	for body := range NewMatcher(NewPair("<x>", "</x>")).Bodies(in3) {
+		_, err := io.ReadAll(body)
+		errs = append(errs, err)
+	}
+	require.Equal(t, []error{nil, errRead}, errs)
+}
+
+// countingHash counts the bytes written to it.
+type countingHash struct {
+	hash.Hash
+	n int
+}
+
+func (h *countingHash) Write(p []byte) (int, error) {
+	h.n += len(p)
+	return h.Hash.Write(p)
+}
+
+func TestLos_Matcher_Bodies_Close(t *testing.T) {
+	body := strings.Repeat("b", 8*scanChunkSize)
+	h := &countingHash{Hash: sha256.New()}
+	m := NewMatcher(NewPair("<x>", "</x>"), WithBodyHash(func() hash.Hash { return h }))
+
+	var got []string
+	errAbandon := errors.New("abandon")
+	for r := range m.Bodies(strings.NewReader("<x>" + body + "</x><x>d</x>")) {
+		if len(got) > 0 {
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+			got = append(got, string(b))
+			continue
+		}
+		b := make([]byte, 2)
+		_, err := io.ReadFull(r, b)
+		require.NoError(t, err)
+		got = append(got, string(b))
+		require.NoError(t, r.(BodyReader).CloseWithError(errAbandon))
+		_, err = r.Read(b)
+		require.ErrorIs(t, err, errAbandon)
+	}
+	require.Equal(t, []string{"bb", "d"}, got)
+	// The body after the first chunk is skipped by the tail scan
+	require.Less(t, h.n, 2*scanChunkSize)
+
+	// The body of a chain is made of the Results of the inner matcher,
+	// which cannot skip it and reads it through
+	c := Chain(NewMatcher(NewPair("<x>", "</x>")), NewMatcher(NewPair("[", "]")))
+	got = got[:0]
+	for r := range c.Bodies(strings.NewReader("<x>a[b]</x><x>c[</x>")) {
+		if len(got) > 0 {
+			require.NoError(t, r.(BodyReader).Close())
+			_, err := r.Read(nil)
+			require.ErrorIs(t, err, io.ErrClosedPipe)
+			got = append(got, "closed")
+			continue
+		}
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		got = append(got, string(b))
+	}
+	require.Equal(t, []string{"a[b]", "closed"}, got)
+}
+
+func TestLos_Matcher_DiscardBody(t *testing.T) {
+	input := "a<x>" + strings.Repeat("b", 10000) + "</x>c<x></x><x>d</x"
+	for _, size := range []int{1, 3, 7, 4096} {
+		m := NewMatcher(NewPair("<x>", "</x>"), WithDiscardBody())
+		var got []string
+		var extents []Extent
+		last, maxBuffered := State(-1), 0
+		for chunk := range slices.Chunk([]byte(input), size) {
+			for result := range m.Match(string(chunk)) {
+				require.NotEqual(t, STATE_BODY, result.State())
+				if result.State() == last && last == STATE_NONE {
+					got[len(got)-1] += result.String()
+				} else {
+					got = append(got, result.String())
+				}
+				last = result.State()
+				if result.State() == STATE_TAIL {
+					extents = append(extents, result.(ExtentResult).Extent())
+				}
+			}
+			maxBuffered = max(maxBuffered, m.(*matcher).buffer.Cap())
+		}
+		require.Equal(t, []string{"a", "<x>", "</x>", "c", "<x>", "</x>", "<x>"}, got, size)
+		require.Equal(t, []Extent{
+			{Offset: 1, Size: 10007, BodyOffset: 4, BodySize: 10000},
+			{Offset: 10009, Size: 7, BodyOffset: 10012, BodySize: 0},
+		}, extents, size)
+		// The body is not buffered beyond the chunk it starts in
+		require.Less(t, maxBuffered, 2*size+64, size)
+		require.Equal(t, "</x", m.Drain())
+	}
+}
+
+func TestLos_Matcher_MatchIndex(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"))
+	var got []IndexSpan
+	for _, chunk := range []string{"a<x>b", "c</", "x>d"} {
+		got = slices.AppendSeq(got, m.MatchIndex(chunk))
+	}
+	require.Equal(t, []IndexSpan{
+		{State: STATE_NONE, Start: 0, End: 1}, {State: STATE_HEAD, Start: 1, End: 4}, {State: STATE_BODY, Start: 4, End: 5}, {State: STATE_BODY, Start: 5, End: 6},
+		{State: STATE_TAIL, Start: 6, End: 10}, {State: STATE_NONE, Start: 10, End: 11},
+	}, got)
+
+	// The offsets are counted across Drain and over the content left
+	// out by WithDiscardNone
+	m = NewMatcher(NewPair("<x>", "</x>"), WithDiscardNone())
+	for range m.MatchIndex("a<") {
+	}
+	require.Equal(t, "<", m.Drain())
+	require.Equal(t, []IndexSpan{{State: STATE_HEAD, Start: 4, End: 7}, {State: STATE_BODY, Start: 7, End: 8}},
+		slices.Collect(m.MatchIndex("bc<x>d")))
+
+	c := Chain(NewMatcher(NewPair("<x>", "</x>")), NewMatcher(NewPair("[", "]")))
+	for range c.Match("a") {
+	}
+	require.Equal(t, []IndexSpan{
+		{State: STATE_HEAD, Start: 1, End: 4}, {State: STATE_NONE, Start: 4, End: 5}, {State: STATE_HEAD, Start: 5, End: 6}, {State: STATE_BODY, Start: 6, End: 7}, {State: STATE_TAIL, Start: 7, End: 8},
+		{State: STATE_TAIL, Start: 8, End: 12},
+	}, slices.Collect(c.MatchIndex("<x>b[c]</x>")))
+	require.Equal(t, "", c.Drain())
+}
+
+func TestLos_TextOffsets(t *testing.T) {
+	const text = "é<x>😀b</x>ü"
+	for size := 1; size <= len(text); size++ {
+		m := NewMatcher(NewPair("<x>", "</x>"), WithTextOffsets())
+		runes := map[State][2]int64{}
+		units := map[State][2]int64{}
+		for chunk := range slices.Chunk([]byte(text), size) {
+			for result := range m.Match(string(chunk)) {
+				span := result.(SpanResult).Span()
+				r, u := runes[span.State], units[span.State]
+				if _, ok := runes[span.State]; !ok {
+					r[0], _ = span.Runes()
+					u[0], _ = span.UTF16()
+				}
+				_, r[1] = span.Runes()
+				_, u[1] = span.UTF16()
+				runes[span.State], units[span.State] = r, u
+			}
+		}
+		require.Equal(t, map[State][2]int64{
+			STATE_NONE: {0, 11}, STATE_HEAD: {1, 4}, STATE_BODY: {4, 6}, STATE_TAIL: {6, 10},
+		}, runes, size)
+		// The emoji takes two UTF-16 code units
+		require.Equal(t, map[State][2]int64{
+			STATE_NONE: {0, 12}, STATE_HEAD: {1, 4}, STATE_BODY: {4, 7}, STATE_TAIL: {7, 11},
+		}, units, size)
+	}
+
+	// The counts go on across Drain
+	m := NewMatcher(NewPair("<x>", "</x>"), WithTextOffsets())
+	for range m.Match("😀<") {
+	}
+	require.Equal(t, "<", m.Drain())
+	spans := slices.Collect(m.MatchIndex("é<x>"))
+	require.Len(t, spans, 2)
+	start, end := spans[1].UTF16()
+	require.Equal(t, [2]int64{4, 7}, [2]int64{start, end})
+	start, end = spans[1].Runes()
+	require.Equal(t, [2]int64{3, 6}, [2]int64{start, end})
+	require.Equal(t, int64(7), spans[1].Start)
+
+	// Without the option the text offsets are not counted
+	spans = slices.Collect(NewMatcher(NewPair("<x>", "</x>")).MatchIndex("a"))
+	start, end = spans[0].Runes()
+	require.Equal(t, [2]int64{-1, -1}, [2]int64{start, end})
+}
+
+func TestLos_Errors(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"))
+	for range m.Match("ab<x>c</") {
+	}
+	var unterminated ErrUnterminatedBlock
+	require.ErrorAs(t, m.Close(), &unterminated)
+	require.Equal(t, int64(2), unterminated.StartOffset)
+	require.ErrorIs(t, unterminated, ErrBufferNotDrained)
+
+	m = NewMatcher(NewPair("<x>", "</x>"))
+	for range m.Match("ab<") {
+	}
+	require.Equal(t, ErrBufferNotDrained, m.Close())
+
+	require.NoError(t, ValidatePair("<x>", "</x>"))
+	require.Error(t, ValidatePair("(", "</x>", WithRegexHead(REGEX_MODE_PERL)))
+	deep := strings.Repeat("(", 1001) + "x" + strings.Repeat(")", 1001)
+	err := ValidatePair("<x>", deep, WithRegexTail(REGEX_MODE_POSIX))
+	require.ErrorIs(t, err, ErrPatternTooComplex)
+	require.ErrorContains(t, err, "tail: ")
+}
+
+func TestLos_CompileLimits(t *testing.T) {
+	limits := WithCompileLimits(CompileLimits{MaxInst: 64, MaxRepeat: 100})
+	err := ValidatePair(`x{1000}`, "</x>", WithRegexHead(REGEX_MODE_PERL), limits)
+	require.ErrorIs(t, err, ErrPatternTooComplex)
+	require.ErrorContains(t, err, "head: ")
+	err = ValidatePair("<x>", `([a-z]{10}){8}`, WithRegexTail(REGEX_MODE_POSIX), limits)
+	require.ErrorIs(t, err, ErrPatternTooComplex)
+	require.Panics(t, func() { NewPair(`x{1000}`, "</x>", WithRegexHead(REGEX_MODE_PERL), limits) })
+
+	pair := NewPair(`<x\s*>`, "</x>", WithRegexHead(REGEX_MODE_PERL), limits)
+	m := NewMatcher(pair)
+	got := []string{}
+	for result := range m.Match("a<x >b</x>") {
+		got = append(got, result.String())
+	}
+	require.Equal(t, []string{"a", "<x >", "b", "</x>"}, got)
+	require.NoError(t, m.Close())
+}
+
+func TestLos_Results_Iter(t *testing.T) {
+	m := NewMatcher(NewPair("<", ">"))
+	bodies := slices.Collect(MapString(FilterState(m.Match("a<b>c<d>"), STATE_BODY, STATE_TAIL)))
+	require.Equal(t, []string{"b", ">", "d", ">"}, bodies)
+
+	a, b := Tee(m.Match("e<f>g"))
+	var got []string
+	for result := range a {
+		got = append(got, "a:"+result.String())
+		if result.State() == STATE_HEAD {
+			for result := range b {
+				got = append(got, "b:"+result.String())
+			}
+		}
+	}
+	require.Equal(t, []string{"a:e", "a:<", "b:e", "b:<", "b:f", "b:>", "b:g", "a:f", "a:>", "a:g"}, got)
+
+	// rs is stopped once both sequences are
+	stopped := false
+	rs := Results(func(yield func(Result) bool) {
+		defer func() { stopped = true }()
+		for range 3 {
+			if !yield(textResult{STATE_NONE, []byte("x")}) {
+				return
+			}
+		}
+	})
+	a, b = Tee(rs)
+	for range a {
+		break
+	}
+	require.False(t, stopped)
+	for range b {
+		break
+	}
+	require.True(t, stopped)
+}
+
+func TestLos_DecodeBlocks(t *testing.T) {
+	type call struct {
+		Name string `json:"name"`
+	}
+	decode := func(b []byte) (call, error) {
+		var c call
+		err := json.Unmarshal(b, &c)
+		return c, err
+	}
+	in := slices.Values([]string{`a<j>{"na`, `me":"x"}</`, `j>b<j>{</j><j>{"name":"y"}</j>`})
+
+	m := NewMatcher(NewPair("<j>", "</j>"))
+	var names []string
+	var errs int
+	for c, err := range DecodeBlocks(m, in, decode) {
+		if err != nil {
+			errs++
+			continue
+		}
+		names = append(names, c.Name)
+	}
+	require.Equal(t, []string{"x", "y"}, names)
+	require.Equal(t, 1, errs)
+	require.NoError(t, m.Close())
+}
+
+func TestLos_Scanner(t *testing.T) {
+	r := iotest.OneByteReader(strings.NewReader("a<x>b</x>c<x>d"))
+	s := NewScanner(r, NewMatcher(NewPair("<x>", "</x>")))
+	var got []string
+	for s.Scan() {
+		got = append(got, fmt.Sprint(int(s.Result().State()), s.Result()))
+	}
+	require.NoError(t, s.Err())
+	require.Equal(t, []string{"0 a", "1 <x>", "2 b", "3 </x>", "0 c", "1 <x>", "2 d"}, got)
+	require.Nil(t, s.Result())
+
+	r = iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("a<x>b</x>")))
+	s = NewScanner(r, NewMatcher(NewPair("<x>", "</x>")))
+	got = got[:0]
+	for s.Scan() {
+		got = append(got, s.Result().String())
+	}
+	require.ErrorIs(t, s.Err(), iotest.ErrTimeout)
+	require.Equal(t, []string{"a"}, got)
+}
+
+func TestLos_Matcher_MinScanSize(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x\\s*>", WithRegexTail(REGEX_MODE_PERL)), WithMinScanSize(4))
+	var got []string
+	for _, chunk := range []string{"a", "<", "x>", "b", "</", "x", ">", "c"} {
+		var results []string
+		for result := range m.Match(chunk) {
+			results = append(results, result.String())
+		}
+		got = append(got, strings.Join(results, "|"))
+	}
+	require.Equal(t, []string{"", "", "a|<x>", "", "", "b", "", ""}, got)
+	got = got[:0]
+	for result := range m.Flush() {
+		got = append(got, result.String())
+	}
+	require.Equal(t, []string{"</x>", "c"}, got)
+	require.Empty(t, m.Drain())
+	require.NoError(t, m.Close())
+}
+
+func TestLos_Matcher_LatencyModes(t *testing.T) {
+	input := strings.Repeat("ab<x>cd</x>", 100)
+	count := func(opts ...matcherOption) (int, string) {
+		m := NewMatcher(NewPair("<x>", "</x>"), opts...)
+		n, s := 0, ""
+		for chunk := range slices.Chunk([]byte(input), 3) {
+			for result := range m.Match(string(chunk)) {
+				n, s = n+1, s+result.String()
+			}
+		}
+		for result := range m.Flush() {
+			n, s = n+1, s+result.String()
+		}
+		return n, s + m.Drain()
+	}
+
+	low, lowOut := count(WithHighThroughput(), WithLowLatency())
+	high, highOut := count(WithHighThroughput())
+	require.Equal(t, input, lowOut)
+	require.Equal(t, input, highOut)
+	require.Less(t, high, low)
+	def, _ := count()
+	require.Equal(t, def, low)
+}
+
+func TestLos_Matcher_Recorder(t *testing.T) {
+	pair := NewPair("<x>", "</x>")
+	var recording bytes.Buffer
+	m := NewMatcher(pair, WithRecorder(&recording), WithGreedyTail())
+
+	var want []string
+	for _, chunk := range []string{"a<", "x>b</x>", "c</x>d"} {
+		for result := range m.Match(chunk) {
+			want = append(want, result.String())
+		}
+	}
+	for result := range m.Flush() {
+		want = append(want, result.String())
+	}
+	for result := range m.Match("<x") {
+		want = append(want, result.String())
+	}
+	want = append(want, m.Drain())
+	for result := range m.Match("<x>e</x>") {
+		want = append(want, result.String())
+	}
+	for result := range m.Flush() {
+		want = append(want, result.String())
+	}
+
+	var got []string
+	for result := range ReplayRecording(bytes.NewReader(recording.Bytes()), NewMatcher(pair, WithGreedyTail())) {
+		got = append(got, result.String())
+	}
+	require.Equal(t, want, got)
+	require.Equal(t, []string{"a", "<x>", "b</x>c", "</x>", "d", "<x", "<x>", "e", "</x>"}, want)
+}
+
+func TestLos_Matcher_Peek(t *testing.T) {
+	m := NewMatcher(NewPair("<think>", "</think>"))
+	for range m.Match("a<thi") {
+	}
+	require.Equal(t, "<thi", string(m.Peek()))
+	for range m.Match("nk>b</th") {
+	}
+	require.Equal(t, "</th", string(m.Peek()))
+	require.Equal(t, "</th", m.Drain())
+	require.Empty(t, m.Peek())
+
+	c := Chain(NewMatcher(NewPair("<a>", "</a>")), NewMatcher(NewPair("[[", "]]")))
+	for range c.Match("<a>x[</") {
+	}
+	require.Equal(t, "[</", string(c.Peek()))
+}
+
+func TestLos_Matcher_TailHoldBack(t *testing.T) {
+	// Only the longest suffix of the body which is a proper prefix of
+	// the tail is held back, the bytes before it are emitted at once.
+	held := func(body string, tails ...string) int {
+		n := 0
+		for _, tail := range tails {
+			for k := min(len(tail)-1, len(body)); k > n; k-- {
+				if strings.HasSuffix(body, tail[:k]) {
+					n = k
+				}
+			}
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		tail  string
+		mode  []regexMode
+		tails []string
+	}{
+		{"abab", nil, []string{"abab"}},
+		{"aab", nil, []string{"aab"}},
+		{"</think>", nil, []string{"</think>"}},
+		{"</a>|</bb>", []regexMode{REGEX_MODE_PERL}, []string{"</a>", "</bb>"}},
+	} {
+		m := NewMatcher(NewPair("<", tc.tail, WithRegexTail(tc.mode...)))
+		for range m.Match("<") {
+		}
+		body := ""
+		rng := rand.New(rand.NewPCG(1, 2))
+		for range 500 {
+			c := string("ab</thinkx>"[rng.IntN(11)])
+			body += c
+			for result := range m.Match(c) {
+				if result.State() == STATE_TAIL {
+					body = ""
+				}
+			}
+			if body == "" {
+				for range m.Match("<") {
+				}
+			}
+			require.Equal(t, held(body, tc.tails...), len(m.Peek()), "tail %q, body %q", tc.tail, body)
+		}
+	}
+}
+
+func TestLos_Matcher_RegexTailHoldBack(t *testing.T) {
+	// The bytes before the earliest start of the live threads of the
+	// tail are emitted at once, i.e. the longest suffix of the body
+	// that may still begin a tail is held back.
+	viable := regexp.MustCompile(`^(<|</[a-z]*)$`)
+	m := NewMatcher(NewPair("<", "</[a-z]+>", WithRegexTail(REGEX_MODE_PERL)))
+	for range m.Match("<") {
+	}
+	body := ""
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 2000 {
+		c := string("ab</>x"[rng.IntN(6)])
+		body += c
+		for result := range m.Match(c) {
+			if result.State() == STATE_TAIL {
+				body = ""
+			}
+		}
+		if body == "" {
+			for range m.Match("<") {
+			}
+		}
+		want := 0
+		for k := len(body); k > 0; k-- {
+			if viable.MatchString(body[len(body)-k:]) {
+				want = k
+				break
+			}
+		}
+		require.Equal(t, want, len(m.Peek()), "body %q", body)
+	}
+}
+
+func TestLos_MatchFile(t *testing.T) {
+	// Blocks straddle the windows the file is fed in
+	var content strings.Builder
+	for i := 0; content.Len() < 2*fileWindow+fileWindow/2; i++ {
+		fmt.Fprintf(&content, "line %d <x>body %d</x>\n", i, i)
+	}
+	content.WriteString("<x>unterminated")
+	path := filepath.Join(t.TempDir(), "huge.log")
+	require.NoError(t, os.WriteFile(path, []byte(content.String()), 0o644))
+
+	got := mergeRuns(MatchFile(path, NewPair("<x>", "</x>")))
+	s := NewScanner(strings.NewReader(content.String()), NewMatcher(NewPair("<x>", "</x>")))
+	want := mergeRuns(func(yield func(Result) bool) {
+		for s.Scan() && yield(s.Result()) {
+		}
+	})
+	require.NoError(t, s.Err())
+	require.Equal(t, len(want), len(got))
+	require.Equal(t, want, got)
+	require.Equal(t, []string{"<x>", "unterminated"}, got[len(got)-2:])
+
+	// Stopping early ends the sequence, a missing file ends it with
+	// an ErrorResult
+	n := 0
+	for range MatchFile(path, NewPair("<x>", "</x>")) {
+		if n++; n == 3 {
+			break
+		}
+	}
+	require.Equal(t, 3, n)
+	missing := slices.Collect(MatchFile(filepath.Join(t.TempDir(), "missing"), NewPair("<x>", "</x>")))
+	require.Len(t, missing, 1)
+	require.ErrorIs(t, missing[0].(ErrorResult).Err(), os.ErrNotExist)
+	require.Equal(t, STATE_NONE, missing[0].State())
+	require.Empty(t, missing[0].Raw())
+
+	empty := filepath.Join(t.TempDir(), "empty.log")
+	require.NoError(t, os.WriteFile(empty, nil, 0o644))
+	for range MatchFile(empty, NewPair("<x>", "</x>")) {
+		t.Fatal("an empty file has no Result")
+	}
+}
+
+// mergeRuns merges the Results of rs in the same state but HEAD and
+// TAIL, the runs do not depend on the chunking.
+func mergeRuns(rs iter.Seq[Result]) []string {
+	var runs []string
+	last := State(-1)
+	for result := range rs {
+		if result.State() == last && last != STATE_HEAD && last != STATE_TAIL {
+			runs[len(runs)-1] += result.String()
+			continue
+		}
+		runs, last = append(runs, result.String()), result.State()
+	}
+	return runs
+}
+
+func TestLos_MatchFileParallel(t *testing.T) {
+	// Long blocks make segments start within a block
+	var content strings.Builder
+	for i := 0; content.Len() < 5*minSegment; i++ {
+		fmt.Fprintf(&content, "line %d <x>body %d</x >\n", i, i)
+		if i%5000 == 0 {
+			fmt.Fprintf(&content, "<x>%s</x>", strings.Repeat("é", minSegment/3))
+		}
+	}
+	content.WriteString("<x>unterminated")
+	path := filepath.Join(t.TempDir(), "huge.log")
+	require.NoError(t, os.WriteFile(path, []byte(content.String()), 0o644))
+
+	for _, pair := range []*Pair{
+		NewPair("<x>", "</x>"),
+		NewPair("<x>", "</x ?>", WithRegexTail(REGEX_MODE_PERL)),
+		NewPair("<x>", "</x *>", WithRegexTail(REGEX_MODE_PERL)), // not split
+	} {
+		want := mergeRuns(MatchFile(path, pair))
+		got := mergeRuns(MatchFileParallel(path, pair, 4))
+		require.Equal(t, len(want), len(got), pair.Tail())
+		require.Equal(t, want, got, pair.Tail())
+	}
+
+	n := 0
+	for range MatchFileParallel(path, NewPair("<x>", "</x>"), 4) {
+		if n++; n == 3 {
+			break
+		}
+	}
+	require.Equal(t, 3, n)
+
+	missing := slices.Collect(MatchFileParallel(filepath.Join(t.TempDir(), "missing"), NewPair("<x>", "</x>"), 4))
+	require.Len(t, missing, 1)
+	require.ErrorIs(t, missing[0].(ErrorResult).Err(), os.ErrNotExist)
+}
+
+func TestLos_Splitter(t *testing.T) {
+	s, ok := newSplitter(NewPair("<x>", "</x ?>", WithRegexTail(REGEX_MODE_PERL)))
+	require.True(t, ok)
+	require.Equal(t, 5, s.maxLen)
+
+	data := []byte("ab<x>cd</x >é")
+	var safe []int
+	for at := range len(data) + 1 {
+		if s.safe(data, at) {
+			safe = append(safe, at)
+		}
+	}
+	require.Equal(t, []int{0, 1, 2, 5, 6, 7, 12, 14}, safe)
+	require.Equal(t, []int{5, 12, 14}, s.split(data, 4))
+
+	for _, pair := range []*Pair{
+		NewPair("<x>", "</x\\s*>", WithRegexTail(REGEX_MODE_PERL)),
+		NewPair("\\bx", "y", WithRegexHead(REGEX_MODE_PERL)),
+		NewPair("x", "y?", WithRegexTail(REGEX_MODE_PERL)),
+		NewPair("x", "y", WithEscape('\\')),
+		NewPair("x", "y", WithLineAnchoredHead()),
+		NewPair("xyz", "yz", WithMaxEditDistance(1)),
+		CSVPair,
+	} {
+		_, ok := newSplitter(pair)
+		require.False(t, ok, pair.Head()+" "+pair.Tail())
+	}
+}
+
+func TestLos_MatchFileFrom(t *testing.T) {
+	pair := NewPair("<x>", "</x>", WithEscape('\\'))
+	path := filepath.Join(t.TempDir(), "app.log")
+	content := "a<x>b\\</x>c</x>d<x>e</"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	// The partial tail at the end is left for the next run
+	var got []string
+	var offset int64
+	var state []byte
+	for result := range MatchFileFrom(path, 0, nil, pair) {
+		got = append(got, result.String())
+		offset, state = result.(CheckpointResult).Checkpoint()
+	}
+	require.Equal(t, []string{"a", "<x>", "b\\<", "/x>c", "</x>", "d", "<x>", "e"}, got)
+	require.Equal(t, int64(len(content)-2), offset)
+
+	// Once the file has grown, matching resumes within the block
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("x>f<x>\\")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	got = got[:0]
+	for result := range MatchFileFrom(path, offset, state, pair) {
+		got = append(got, fmt.Sprint(int(result.State()), result))
+		offset, state = result.(CheckpointResult).Checkpoint()
+	}
+	require.Equal(t, []string{"3 </x>", "0 f", "1 <x>", "2 \\"}, got)
+
+	// The escape before the checkpoint is not forgotten
+	require.NoError(t, os.WriteFile(path, []byte(content+"x>f<x>\\</x>g</x>"), 0o644))
+	got = got[:0]
+	for result := range MatchFileFrom(path, offset, state, pair) {
+		got = append(got, fmt.Sprint(int(result.State()), result))
+	}
+	require.Equal(t, []string{"2 <", "2 /x>g", "3 </x>"}, got)
+
+	for range MatchFileFrom(path, 3, []byte{0, 2}, pair) {
+		t.Fatal("a malformed state has no Result")
+	}
+}
+
+func TestLos_Walk(t *testing.T) {
+	fsys := fstest.MapFS{
+		"logs/a.log":     {Data: []byte("x<x>1</x>y<x>2</x>")},
+		"logs/b.log":     {Data: []byte("<x>3</x><x>open")},
+		"logs/c.txt":     {Data: []byte("<x>skipped</x>")},
+		"logs/d.log/e":   {Data: []byte("<x>nested</x>")},
+		"logs/empty.log": {Data: nil},
+	}
+	var mu sync.Mutex
+	got := map[string][]string{}
+	err := Walk(fsys, "logs/*.log", NewPair("<x>", "</x>"), func(path string, b Block) error {
+		require.Equal(t, STATE_BODY, b.State())
+		mu.Lock()
+		defer mu.Unlock()
+		got[path] = append(got[path], b.String())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"logs/a.log": {"<x>1</x>", "<x>2</x>"},
+		"logs/b.log": {"<x>3</x>"},
+	}, got)
+
+	// The first error of fn stops the walk
+	errStop := errors.New("stop")
+	calls := atomic.Int32{}
+	err = Walk(fsys, "logs/a.log", NewPair("<x>", "</x>"), func(string, Block) error {
+		calls.Add(1)
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, int32(1), calls.Load())
+
+	require.ErrorIs(t, Walk(fsys, "[", NewPair("<x>", "</x>"), nil), path.ErrBadPattern)
+}
+
+func TestLos_FindFirst(t *testing.T) {
+	pair := NewPair("```", "```")
+	r := strings.NewReader("intro ```go\nx := 1\n``` and ```more```")
+	b, err := FindFirst(iotest.OneByteReader(r), pair)
+	require.NoError(t, err)
+	require.Equal(t, STATE_BODY, b.State())
+	require.Equal(t, "```go\nx := 1\n```", b.String())
+	// The reading stops at the tail of the first block
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, " and ```more```", string(rest))
+
+	_, err = FindFirst(strings.NewReader("no ```block"), pair)
+	require.ErrorIs(t, err, ErrNoBlock)
+
+	errRead := errors.New("read")
+	_, err = FindFirst(iotest.ErrReader(errRead), pair)
+	require.ErrorIs(t, err, errRead)
+}
+
+func TestLos_Matcher_InvalidUTF8(t *testing.T) {
+	collect := func(m Matcher, chunks ...string) []string {
+		var got []string
+		for _, chunk := range chunks {
+			for result := range m.Match(chunk) {
+				got = append(got, fmt.Sprint(int(result.State()), result))
+			}
+		}
+		for result := range m.Flush() {
+			got = append(got, fmt.Sprint(int(result.State()), result))
+		}
+		return got
+	}
+
+	// RuneError is matched by the classes of a regex
+	pair := NewPair("<", "[^a]>", WithRegexTail(REGEX_MODE_PERL))
+	m := NewMatcher(pair)
+	require.Equal(t, []string{"1 <", "2 x", "3 \xff>"}, collect(m, "<x\xff>"))
+	require.NoError(t, m.Close())
+
+	// A rune split across chunks is not invalid
+	m = NewMatcher(pair, WithInvalidUTF8(INVALID_UTF8_SKIP))
+	require.Equal(t, []string{"1 <", "2 x", "3 é>"}, collect(m, "<x\xff\xc3", "\xa9>", "\xc3"))
+	require.Empty(t, m.Drain())
+	require.NoError(t, m.Close())
+
+	m = NewMatcher(pair, WithInvalidUTF8(INVALID_UTF8_ERROR))
+	require.Equal(t, []string{"1 <", "2 x"}, collect(m, "<x\xc3", "\xa9\xff>", "a>"))
+	require.ErrorIs(t, m.Err(), ErrInvalidUTF8)
+	require.EqualError(t, m.Err(), "invalid UTF-8: byte 0xff at offset 4")
+	require.Equal(t, "é\xff>a>", m.Drain())
+	require.NoError(t, m.Close())
+
+	m = NewMatcher(pair, WithInvalidUTF8(INVALID_UTF8_ERROR))
+	require.Equal(t, []string{"1 <", "2 x", "3 é>", "1 <"}, collect(m, "<xé>", "<x\xc3"))
+	require.EqualError(t, m.Err(), "invalid UTF-8: truncated rune at offset 7")
+	require.Equal(t, "x\xc3", m.Drain())
+	require.NoError(t, m.Close())
+
+	// The invalid bytes are matched as the runes of their value
+	pair = NewPair("<", `\xff+>`, WithRegexTail(REGEX_MODE_PERL))
+	m = NewMatcher(pair)
+	require.Equal(t, []string{"1 <", "2 x\xff>"}, collect(m, "<x\xff>"))
+	m.Drain()
+	require.NoError(t, m.Close())
+	m = NewMatcher(pair, WithInvalidUTF8(INVALID_UTF8_BYTE))
+	require.Equal(t, []string{"1 <", "2 x", "3 ÿ\xff>"}, collect(m, "<xÿ\xff>")) // both are 0xff
+	require.NoError(t, m.Close())
+}
+
+// utf16LE is a Decoder of UTF-16LE, in the manner of golang.org/x/text.
+type utf16LE struct{}
+
+var errShortSrc = errors.New("short source")
+
+func (utf16LE) Reset() {}
+
+func (utf16LE) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc+2 <= len(src) {
+		r, width := rune(src[nSrc])|rune(src[nSrc+1])<<8, 2
+		if utf16.IsSurrogate(r) {
+			if nSrc+4 > len(src) {
+				break
+			}
+			r, width = utf16.DecodeRune(r, rune(src[nSrc+2])|rune(src[nSrc+3])<<8), 4
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, errors.New("short destination")
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += width
+	}
+	if nSrc < len(src) {
+		if atEOF {
+			return nDst, nSrc, errors.New("truncated UTF-16")
+		}
+		return nDst, nSrc, errShortSrc
+	}
+	return nDst, nSrc, nil
+}
+
+func TestLos_Matcher_Encoding(t *testing.T) {
+	var encoded []byte
+	for _, u := range utf16.Encode([]rune("a<x>é😀</x>b<x>c")) {
+		encoded = append(encoded, byte(u), byte(u>>8))
+	}
+
+	// Units and surrogate pairs are split across chunks
+	m := NewMatcher(NewPair("<x>", "</x>"), WithEncoding(utf16LE{}))
+	var got []string
+	for i := range encoded {
+		for result := range m.Match(string(encoded[i : i+1])) {
+			got = append(got, fmt.Sprint(int(result.State()), result))
+		}
+	}
+	for result := range m.Flush() {
+		got = append(got, fmt.Sprint(int(result.State()), result))
+	}
+	require.NoError(t, m.Err())
+	require.Equal(t, []string{"0 a", "1 <x>", "2 é", "2 😀", "3 </x>", "0 b", "1 <x>", "2 c"}, got)
+	require.Empty(t, m.Drain())
+
+	// A unit left incomplete at the end is an error
+	for range m.Match(string(encoded[:3])) {
+	}
+	for range m.Flush() {
+	}
+	require.EqualError(t, m.Err(), "truncated UTF-16")
+	require.Empty(t, m.Drain()) // the incomplete unit is dropped
+	require.NoError(t, m.Close())
+}
+
+func TestLos_Matcher_GraphemeSafety(t *testing.T) {
+	clusters := []string{"a", "é", "👨‍👩‍👧", "🇫🇷", "🇩🇪", "👍🏽", "\r\n", "z"}
+	input := "<x>" + strings.Join(clusters, "") + "</x>"
+
+	m := NewMatcher(NewPair("<x>", "</x>"), WithGraphemeSafety())
+	var got []string
+	for i := range len(input) {
+		for result := range m.Match(input[i : i+1]) {
+			got = append(got, fmt.Sprint(int(result.State()), result))
+		}
+	}
+	want := []string{"1 <x>"}
+	for _, cluster := range clusters {
+		want = append(want, "2 "+cluster)
+	}
+	require.Equal(t, append(want, "3 </x>"), got)
+	require.Empty(t, m.Drain())
+
+	// The last cluster is held until Drain
+	got = got[:0]
+	for result := range m.Match("<x>ab́") {
+		got = append(got, result.String())
+	}
+	require.Equal(t, []string{"<x>", "a"}, got)
+	require.ErrorIs(t, m.Close(), ErrBufferNotDrained)
+	m = NewMatcher(NewPair("<x>", "</x>"), WithGraphemeSafety())
+	for range m.Match("<x>ab́") {
+	}
+	require.Equal(t, "b́", m.Drain())
+	require.NoError(t, m.Close())
+
+	require.Equal(t, 0, lastCluster([]byte("́́")))
+	require.Equal(t, 1, lastCluster([]byte("ab\xcc"))) // split rune
+	require.Equal(t, 8, lastCluster([]byte("🇫🇷🇩🇪")))
+	require.Equal(t, 16, lastCluster([]byte("🇫🇷🇩🇪🇮")))
+}
+
+func TestLos_Matcher_BodyHighlighter(t *testing.T) {
+	m := NewMatcher(NewPair("<x>", "</x>"), WithBodyHighlighter("TODO|FIXME"))
+	var got []string
+	for _, chunk := range []string{"a TODO <x>b TODO c FI", "XME d</x> TODO <x>TO", "DO</x>"} {
+		for result := range m.Match(chunk) {
+			got = append(got, fmt.Sprint(int(result.State()), " ", result, " ", result.Highlights()))
+		}
+	}
+	require.Equal(t, []string{
+		"0 a TODO  []",
+		"1 <x> []",
+		"2 b TODO c FI [[2 6]]",
+		"2 XME d [[-2 3]]",
+		"3 </x> []",
+		"0  TODO  []",
+		"1 <x> []",
+		"2 TO []",
+		"2 DO [[-2 2]]",
+		"3 </x> []",
+	}, got)
+	require.Empty(t, m.Drain())
+	require.NoError(t, m.Close())
+
+	// The empty matches are left out
+	m = NewMatcher(NewPair("<x>", "</x>"), WithBodyHighlighter(`\b`))
+	got = got[:0]
+	for result := range m.Match("<x>ab ba</x>") {
+		got = append(got, fmt.Sprint(result, " ", result.Highlights()))
+	}
+	require.Equal(t, []string{"<x> []", "ab ba []", "</x> []"}, got)
+	require.NoError(t, m.Close())
+}
+
+func TestLos_SandboxProfile(t *testing.T) {
+	sandbox := SandboxProfile()
+	require.Panics(t, func() {
+		NewPair(`(a{50}){50}`, "</x>", append([]pairOption{WithRegexHead(REGEX_MODE_PERL)}, sandbox.Pair...)...)
+	})
+
+	pair := NewPair(`<x\s*>`, "</x>", append([]pairOption{WithRegexHead(REGEX_MODE_PERL)}, sandbox.Pair...)...)
+	m := NewMatcher(pair, sandbox.Matcher...)
+	got := []string{}
+	for result := range m.Match("a<x >b</x>") {
+		got = append(got, result.String())
+	}
+	require.Equal(t, []string{"a", "<x >", "b", "</x>"}, got)
+	require.NoError(t, m.Err())
+
+	// The machines are not put back into the shared pool
+	retained := func() (n int64) {
+		for _, pool := range legex.PoolStats() {
+			n += pool.Retained
+		}
+		return n
+	}
+	before := retained()
+	require.NoError(t, m.Close())
+	require.Equal(t, before, retained())
+}
+
+func TestLos_MachinePool(t *testing.T) {
+	pool := NewMachinePool()
+	pair := NewPair(`<x\s*>`, "</x>", WithRegexHead(REGEX_MODE_PERL), WithMachinePool(pool))
+	m := NewMatcher(pair)
+	got := []string{}
+	for result := range m.Match("a<x >b</x>") {
+		got = append(got, result.String())
+	}
+	require.Equal(t, []string{"a", "<x >", "b", "</x>"}, got)
+
+	inUse := func() (n int64) {
+		for _, stat := range pool.Stats() {
+			n += stat.InUse
+		}
+		return n
+	}
+	require.Equal(t, int64(1), inUse())
+	require.NoError(t, m.Close())
+	require.Equal(t, int64(0), inUse())
+}
+
+func TestLos_Matcher_StepLimit(t *testing.T) {
+	pair := NewPair(`(a|aa)*b`, "</x>", WithRegexHead(REGEX_MODE_PERL))
+	m := NewMatcher(pair, WithStepLimit(1000))
+	input := strings.Repeat("a", 400)
+	for range 2 {
+		for range m.Match(input) {
+		}
+		require.NoError(t, m.Err())
+	}
+	for range m.Match(input) {
+	}
+	require.ErrorIs(t, m.Err(), ErrStepLimit)
+	for range m.Match("b") {
+	}
+	require.Equal(t, strings.Repeat(input, 3)+"b", m.Drain())
+
+	// Drain starts the count afresh
+	require.NoError(t, m.Err())
+	for range m.Match(input) {
+	}
+	require.NoError(t, m.Err())
+	require.Equal(t, input, m.Drain())
+}
+
+func TestLos_BuildPipeline(t *testing.T) {
+	spec := `{
+	  "stages": [
+	    {"pairs": [{"head": "<code>", "tail": "</code>"}]},
+	    {"pairs": [{"head": "TODO", "tail": "\n"}, {"name": "fix", "head": "FIX(ME|ES)", "tail": "\n", "head_regex": "perl"}],
+	     "transforms": [{"type": "discard_none"}]}
+	  ],
+	  "routes": {"body": "todos"}
+	}`
+	p, err := BuildPipeline([]byte(spec))
+	require.NoError(t, err)
+	var todos bytes.Buffer
+	m, err := p.NewMatcher(map[string]io.Writer{"todos": &todos})
+	require.NoError(t, err)
+	var got []string
+	for result := range m.Match("TODO out\n<code>a\nTODO: x\nFIXME: y\n</code>") {
+		got = append(got, result.String())
+	}
+	require.NoError(t, m.Err())
+	require.Equal(t, []string{"TODO out\n", "<code>", "TODO", "\n", "FIXME", "\n", "</code>"}, got)
+	require.Equal(t, ": x: y", todos.String())
+	require.NoError(t, m.Close())
+
+	_, err = p.NewMatcher(nil)
+	require.ErrorContains(t, err, `spec: routes.body: no sink "todos"`)
+
+	// The same spec in YAML
+	p, err = BuildPipeline([]byte(`
+stages:
+  - pairs: [{head: <code>, tail: </code>}]
+  - pairs:
+      - {head: TODO, tail: "\n"}
+      - {name: fix, head: FIX(ME|ES), tail: "\n", head_regex: perl}
+    transforms: [{type: discard_none}]
+routes: {body: todos}
+`))
+	require.NoError(t, err)
+	todos.Reset()
+	m, err = p.NewMatcher(map[string]io.Writer{"todos": &todos})
+	require.NoError(t, err)
+	for range m.Match("TODO out\n<code>a\nTODO: x\nFIXME: y\n</code>") {
+	}
+	require.NoError(t, m.Err())
+	require.Equal(t, ": x: y", todos.String())
+	require.NoError(t, m.Close())
+
+	for spec, path := range map[string]string{
+		`{"stages": []}`: "stages",
+		`{"stages": [{"pairs": [{"head": "(", "tail": "b", "head_regex": "perl"}]}]}`: "stages[0].pairs[0].head",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b", "tail_regex": "pcre"}]}]}`: "stages[0].pairs[0].tail_regex",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b"}]}, {"pairs": []}]}`:        "stages[1].pairs",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b", "escape": "\\"}],
+		  "transforms": [{"type": "coalesce", "every": "1 s"}]}]}`: "stages[0].transforms[0].every",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b"}], "transforms": [{"type": "upper"}]}]}`:               "stages[0].transforms[0].type",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b"}]}], "routes": {"blob": "x"}}`:                         "routes.blob",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b", "priority": "high"}]}]}`:                              "stages[0].pairs[0].priority",
+		`{"stages": [{"pairs": [{"head": "ab", "tail": "cd", "max_edit_distance": 5}]}]}`:                        "stages[0].pairs[0].max_edit_distance",
+		`{"stages": [{"pairs": [{"head": "ab", "tail": "cd", "max_edit_distance": -1}]}]}`:                       "stages[0].pairs[0].max_edit_distance",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b"}], "transforms": [{"type": "max_blocks", "n": -1}]}]}`: "stages[0].transforms[0].n",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b"}]}]} {"stages": []}`:                                   "",
+		`{"stages": [{"pairs": [{"head": "a", "tail": "b"}]}]}}`:                                                 "",
+		"stages:\n- pairs:\n  - {head: a, tail: b, max_edit_distance: 1}\n":                                      "stages[0].pairs[0].max_edit_distance",
+		"stages:\n- pairs: [{head: a, tail: b}]\n  transforms: [{type: upper}]\n":                                "stages[0].transforms[0].type",
+		"stages: [\n": "",
+	} {
+		_, err := BuildPipeline([]byte(spec))
+		var specErr ErrSpec
+		require.ErrorAs(t, err, &specErr, spec)
+		require.Equal(t, path, specErr.Path, spec)
+	}
+}
+
+func TestLos_Matcher_Template(t *testing.T) {
+	pair := NewPair(`<(\w+)>`, "</x>", WithRegexHead(REGEX_MODE_PERL))
+	m := NewMatcher(pair, WithTemplate("{{.Offsets}} {{.Head}}|{{.Body}}|{{.Tail}} {{len .Submatches}}\n"))
+	var got []string
+	for _, chunk := range []string{"ab<x>c", "d</x>e<y", ">f</x>"} {
+		for result := range m.Match(chunk) {
+			if text := result.(TemplateResult).Text(); text != "" {
+				require.Equal(t, STATE_TAIL, result.State())
+				got = append(got, text)
+			}
+		}
+	}
+	require.Equal(t, []string{"[2 11] <x>|cd|</x> 3\n", "[12 20] <y>|f|</x> 3\n"}, got)
+	require.NoError(t, m.Close())
+
+	// An error of the template stops matching
+	m = NewMatcher(NewPair("<x>", "</x>"), WithTemplate("{{.Head.Nope}}"))
+	for range m.Match("<x>a</x>b") {
+	}
+	require.ErrorContains(t, m.Err(), "Nope")
+	require.Equal(t, "b", m.Drain())
+	require.Panics(t, func() { WithTemplate("{{") })
+}
+
+func TestLos_Matcher_Submatches(t *testing.T) {
+	pair := NewPair(`<(?P<tag>\w+)(?: lang=(\w+))?>`, "</x>", WithRegexHead(REGEX_MODE_PERL))
+	literal := func(text string) []Submatch {
+		return []Submatch{{Text: text, End: len(text), StreamStart: -1, StreamEnd: -1}}
+	}
+	for _, opts := range [][]matcherOption{nil, {WithMaxBodyBytes(100)}} {
+		m := NewMatcher(pair, opts...)
+		var got [][]Submatch
+		for _, chunk := range []string{"a<code la", "ng=go>b</x><pre>c</x>"} {
+			for result := range m.Match(chunk) {
+				if result.State() != STATE_BODY {
+					got = append(got, result.Submatches())
+				}
+			}
+		}
+		require.Equal(t, [][]Submatch{
+			literal("a"),
+			{
+				{Text: "<code lang=go>", End: 14, StreamStart: 1, StreamEnd: 15},
+				{Index: 1, Name: "tag", Text: "code", Start: 1, End: 5, StreamStart: 2, StreamEnd: 6},
+				{Index: 2, Text: "go", Start: 11, End: 13, StreamStart: 12, StreamEnd: 14},
+			},
+			literal("</x>"),
+			{
+				{Text: "<pre>", End: 5, StreamStart: 20, StreamEnd: 25},
+				{Index: 1, Name: "tag", Text: "pre", Start: 1, End: 4, StreamStart: 21, StreamEnd: 24},
+				{Index: 2, Start: -1, End: -1, StreamStart: -1, StreamEnd: -1},
+			},
+			literal("</x>"),
+		}, got)
+
+		// The stream offsets go on across Drain
+		for range m.Match("d<x") {
+		}
+		require.Equal(t, "<x", m.Drain())
+		for result := range m.Match("<y>") {
+			require.Equal(t, int64(34), result.Submatches()[1].StreamStart)
+		}
+		m.Drain()
+		require.NoError(t, m.Close())
+	}
+}
@@ -0,0 +1,85 @@
+package los
+
+// WithTextOffsets counts the runes and the UTF-16 code units of the
+// stream along with its bytes, so that the Results tell where they
+// are in the coordinates of a text editor or of JavaScript, see
+// SpanResult. A rune is counted at its first byte, a Result cutting
+// a rune holds the part of it that follows. The counts start with
+// the matcher and go on across Drain.
+func WithTextOffsets() matcherOption {
+	return func(m *matcher) *matcher {
+		m.text = &textCount{}
+		return m
+	}
+}
+
+// SpanResult is implemented by the Results of a matcher given
+// WithTextOffsets.
+type SpanResult interface {
+	Result
+	// Span returns where the Result is in the stream.
+	Span() IndexSpan
+}
+
+var _ SpanResult = blockResult{}
+
+func (r blockResult) Span() IndexSpan {
+	return r.span
+}
+
+// Runes returns the offsets of the span in runes, or -1, -1 if they
+// are not counted, see WithTextOffsets.
+func (s IndexSpan) Runes() (start, end int64) {
+	if !s.counted {
+		return -1, -1
+	}
+	return s.runes[0], s.runes[1]
+}
+
+// UTF16 returns the offsets of the span in UTF-16 code units, e.g.
+// for the String of JavaScript, or -1, -1 if they are not counted,
+// see WithTextOffsets.
+func (s IndexSpan) UTF16() (start, end int64) {
+	if !s.counted {
+		return -1, -1
+	}
+	return s.units[0], s.units[1]
+}
+
+// textCount holds the runes and UTF-16 code units of the stream.
+type textCount struct {
+	runes, units int64
+}
+
+// add counts raw, it returns the span of raw ending at pos.
+func (c *textCount) add(state State, raw []byte, pos int64) IndexSpan {
+	span := IndexSpan{State: state, Start: pos - int64(len(raw)), End: pos, counted: true}
+	span.runes[0], span.units[0] = c.runes, c.units
+	runes, units := countText(raw)
+	c.runes, c.units = c.runes+runes, c.units+units
+	span.runes[1], span.units[1] = c.runes, c.units
+	return span
+}
+
+// sub takes back the counts of raw, e.g. rewound.
+func (c *textCount) sub(raw []byte) {
+	runes, units := countText(raw)
+	c.runes, c.units = c.runes-runes, c.units-units
+}
+
+// countText counts the first bytes of the runes of raw, and the
+// UTF-16 code units they take, two for the runes beyond the BMP,
+// which take four bytes in UTF-8.
+func countText(raw []byte) (runes, units int64) {
+	for _, b := range raw {
+		if b&0xc0 == 0x80 {
+			continue
+		}
+		runes++
+		units++
+		if b >= 0xf0 && b <= 0xf4 {
+			units++
+		}
+	}
+	return runes, units
+}
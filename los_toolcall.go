@@ -0,0 +1,154 @@
+package los
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ToolCallDelta is a fragment of a streamed function call, as found
+// in the "tool_calls" of OpenAI-style chat completion chunks. Only
+// the first fragment of a call usually carries ID and Name, the
+// following ones are told apart by Index.
+type ToolCallDelta struct {
+	Index     int
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// ToolCall is a function call whose arguments are complete.
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments map[string]any
+}
+
+// jsonObjectPair matches the JSON objects of a stream, the head is
+// the opening brace, the tail the brace balancing it and the body the
+// members in between.
+var jsonObjectPair = newJSONObjectPair()
+
+func newJSONObjectPair() *Pair {
+	pair := NewPair("{", "}", WithName("json"))
+	pair.newTail = func() pattern { return &jsonTailPattern{} }
+	return pair
+}
+
+// ToolCallAccumulator gathers the fragments of concurrent tool calls,
+// the arguments of every call id are matched by a KeyedMatcher, a
+// call is complete once its arguments form a whole JSON object, which
+// is told by the balance of braces out of strings.
+type ToolCallAccumulator struct {
+	matcher *KeyedMatcher
+	ids     map[int]string
+	calls   map[string]*toolCallState
+}
+
+type toolCallState struct {
+	name string
+	args []byte
+	open bool // within an object
+}
+
+func NewToolCallAccumulator() *ToolCallAccumulator {
+	return &ToolCallAccumulator{
+		matcher: NewKeyedMatcher(jsonObjectPair, WithSessionOptions(WithDiscardNone())),
+		ids:     map[int]string{},
+		calls:   map[string]*toolCallState{},
+	}
+}
+
+// Add feeds the accumulator with delta, it returns the calls whose
+// arguments are completed by delta, a delta may complete several
+// objects of the same call. The arguments which fail to parse are
+// reported as an error, those calls are dropped either way. The
+// bytes of a call out of its objects are ignored, a call is pending
+// from its first delta until an object of it is closed.
+func (a *ToolCallAccumulator) Add(delta ToolCallDelta) ([]ToolCall, error) {
+	if delta.ID != "" {
+		a.ids[delta.Index] = delta.ID
+	}
+	id := a.ids[delta.Index]
+	call, ok := a.calls[id]
+	if !ok {
+		call = &toolCallState{}
+		a.calls[id] = call
+	}
+	call.name += delta.Name
+
+	var done []ToolCall
+	var errs []error
+	for result := range a.matcher.Match(id, delta.Arguments) {
+		switch result.State() {
+		case STATE_HEAD:
+			call.open = true
+			call.args = append(call.args[:0], result.Raw()...)
+		case STATE_BODY:
+			call.args = append(call.args, result.Raw()...)
+		case STATE_TAIL:
+			call.open = false
+			call.args = append(call.args, result.Raw()...)
+			args := map[string]any{}
+			if err := json.Unmarshal(call.args, &args); err != nil {
+				errs = append(errs, fmt.Errorf("los: arguments of tool call %q: %w", id, err))
+				continue
+			}
+			done = append(done, ToolCall{ID: id, Name: call.name, Arguments: args})
+		}
+	}
+	if err := a.matcher.Err(id); err != nil {
+		errs = append(errs, fmt.Errorf("los: arguments of tool call %q: %w", id, err))
+	}
+	if !call.open && (len(done) > 0 || len(errs) > 0) {
+		delete(a.calls, id)
+		a.matcher.Drain(id)
+	}
+	return done, errors.Join(errs...)
+}
+
+// Pending returns the number of calls whose arguments are not
+// complete yet.
+func (a *ToolCallAccumulator) Pending() int {
+	return len(a.calls)
+}
+
+// jsonTailPattern matches the brace closing the object its head
+// opened, the braces and brackets within are balanced out of the
+// strings. A partial match is released as body, the nesting of the
+// bytes scanned is kept until the object is closed.
+type jsonTailPattern struct {
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+var _ pattern = (*jsonTailPattern)(nil)
+
+func (pat *jsonTailPattern) Match(index int, _ int, buffer []byte) (int, int, bool) {
+	for i := index; i < len(buffer); i++ {
+		c := buffer[i]
+		switch {
+		case pat.escaped:
+			pat.escaped = false
+		case pat.inString:
+			pat.escaped = c == '\\'
+			pat.inString = c != '"'
+		case c == '"':
+			pat.inString = true
+		case c == '{' || c == '[':
+			pat.depth++
+		case (c == '}' || c == ']') && pat.depth > 0:
+			pat.depth--
+		case c == '}':
+			return i, 1, true
+		}
+	}
+	return len(buffer), 0, false
+}
+
+func (pat *jsonTailPattern) Reset() {
+	*pat = jsonTailPattern{}
+}
+
+func (pat *jsonTailPattern) Clear() {}
@@ -0,0 +1,44 @@
+package los
+
+// Tracer starts a span for each block, see WithTracer. It takes a
+// few lines over an OpenTelemetry trace.Tracer, setting the offsets
+// and sizes as attributes, while los depends on no tracing library.
+type Tracer interface {
+	// Start is called with the HEAD Result of a block and the offset
+	// in the stream it starts at.
+	Start(head Result, offset int64) Span
+}
+
+// Span is the span of a block started by a Tracer.
+type Span interface {
+	// End is called with the TAIL Result of the block, the offset in
+	// the stream the tail starts at and the size of the block from
+	// its head to its tail. The tail is nil for a block left
+	// unfinished by Drain, the offset being where it was cut.
+	End(tail Result, offset int64, size int64)
+}
+
+// WithTracer starts a span at the head of each block and ends it at
+// its tail, so that the extraction of the blocks shows up in the
+// traces along with their timing.
+func WithTracer(t Tracer) matcherOption {
+	return func(m *matcher) *matcher {
+		m.tracer = t
+		return m
+	}
+}
+
+// trace starts or ends the span of the block of a Result just sent.
+func (m *matcher) trace(state State, result Result) {
+	n := int64(len(result.Raw()))
+	switch state {
+	case STATE_HEAD:
+		m.spanAt = m.pos - n
+		m.span = m.tracer.Start(result, m.spanAt)
+	case STATE_TAIL:
+		if m.span != nil {
+			m.span.End(result, m.pos-n, m.pos-m.spanAt)
+			m.span = nil
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package los
+
+// WithOnTransition calls fn synchronously whenever the state of the
+// emitted Results changes, with the offset in the stream the new
+// state starts at, e.g. to time how long a model is "thinking". The
+// transition to STATE_NONE made by Drain is told as well.
+func WithOnTransition(fn func(from, to State, offset int64)) matcherOption {
+	return func(m *matcher) *matcher {
+		m.onTrans = fn
+		return m
+	}
+}
+
+// advance moves the stream offset over n bytes emitted in state,
+// the transition is told and journaled if any.
+func (m *matcher) advance(state State, n int) {
+	if state != m.emitted {
+		if m.onTrans != nil {
+			m.onTrans(m.emitted, state, m.pos)
+		}
+		m.emitted = state
+	}
+	if m.journal != nil && n > 0 {
+		m.journalize(state)
+	}
+	m.pos += int64(n)
+}
@@ -0,0 +1,103 @@
+package los
+
+import "strings"
+
+// Node is a block along with what its body is made of, or a run of
+// text out of the blocks at its level. The body of a block is made
+// of the text and blocks of the next stage of a Chain, or of a
+// single text node if the block is not chained.
+type Node struct {
+	Block      bool
+	Pair       *Pair  // pair of the block, if told by PairResult
+	Head, Tail string // delimiters of the block, Tail is empty until closed
+	Text       string // content of a text node
+	Children   []*Node
+}
+
+// String returns the content covered by the node.
+func (n *Node) String() string {
+	if !n.Block {
+		return n.Text
+	}
+	var b strings.Builder
+	n.write(&b)
+	return b.String()
+}
+
+func (n *Node) write(b *strings.Builder) {
+	if !n.Block {
+		b.WriteString(n.Text)
+		return
+	}
+	b.WriteString(n.Head)
+	for _, child := range n.Children {
+		child.write(b)
+	}
+	b.WriteString(n.Tail)
+}
+
+// Tree assembles the Results of a matcher into nodes as they come,
+// the Results of a Chain are nested by their depth, e.g. sections
+// containing fences containing lines. A block cut by the tail of an
+// enclosing one is left unclosed. The zero Tree is ready to use.
+type Tree struct {
+	roots []*Node
+	open  []*Node // open blocks, by depth
+}
+
+// Add puts result into the tree, its content is copied.
+func (t *Tree) Add(result Result) {
+	depth := 0
+	if r, ok := result.(ChainResult); ok {
+		depth = r.Depth()
+		result = r.Unwrap()
+	}
+	// The blocks deeper than result are cut
+	t.open = t.open[:min(depth+int(result.State()>>1), len(t.open))]
+
+	raw := result.String()
+	switch result.State() {
+	case STATE_HEAD:
+		block := &Node{Block: true, Head: raw}
+		if r, ok := result.(PairResult); ok {
+			block.Pair = r.Pair()
+		}
+		t.append(block)
+		t.open = append(t.open, block)
+	case STATE_TAIL:
+		if n := len(t.open); n > 0 {
+			t.open[n-1].Tail += raw
+			t.open = t.open[:n-1]
+		}
+	default:
+		t.appendText(raw)
+	}
+}
+
+// Nodes returns the nodes of the outermost level.
+func (t *Tree) Nodes() []*Node {
+	return t.roots
+}
+
+// append adds n to the innermost open block.
+func (t *Tree) append(n *Node) {
+	if k := len(t.open); k > 0 {
+		t.open[k-1].Children = append(t.open[k-1].Children, n)
+	} else {
+		t.roots = append(t.roots, n)
+	}
+}
+
+// appendText adds text to the innermost open block, merged with the
+// text node it follows if any.
+func (t *Tree) appendText(text string) {
+	nodes := t.roots
+	if k := len(t.open); k > 0 {
+		nodes = t.open[k-1].Children
+	}
+	if k := len(nodes); k > 0 && !nodes[k-1].Block {
+		nodes[k-1].Text += text
+		return
+	}
+	t.append(&Node{Text: text})
+}
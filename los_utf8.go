@@ -0,0 +1,123 @@
+package los
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidUTF8 = errors.New("invalid UTF-8")
+
+type invalidUTF8Policy int
+
+const (
+	// INVALID_UTF8_REPLACE matches the invalid bytes as
+	// utf8.RuneError, which the classes of a regex delimiter like "."
+	// or "[^a]" match as well.
+	INVALID_UTF8_REPLACE invalidUTF8Policy = iota
+	// INVALID_UTF8_SKIP drops the invalid bytes from the stream, they
+	// are neither matched nor emitted.
+	INVALID_UTF8_SKIP
+	// INVALID_UTF8_ERROR stops matching at the first invalid byte,
+	// see Matcher.Err. The bytes from there on are left to Drain.
+	INVALID_UTF8_ERROR
+	// INVALID_UTF8_BYTE matches the invalid bytes as the runes of the
+	// same value, e.g. the regex "\xff+" matches the byte 0xff. Those
+	// are the runes U+0080 to U+00FF, so "ÿ" or "[À-ÿ]" match the
+	// bytes as well. It is up to the regex VM, a regex made of
+	// literals is matched as their UTF-8 encoding unless
+	// WithoutLiteralFastPath is given.
+	INVALID_UTF8_BYTE
+)
+
+// WithInvalidUTF8 decides how the bytes of the stream which are not
+// valid UTF-8 are matched. A rune split across chunks is not invalid,
+// with INVALID_UTF8_SKIP and INVALID_UTF8_ERROR its first bytes wait
+// for the next chunk, or for Flush to tell that they are invalid. It
+// defaults to INVALID_UTF8_REPLACE.
+func WithInvalidUTF8(policy invalidUTF8Policy) matcherOption {
+	return func(m *matcher) *matcher {
+		m.utf8 = &utf8Check{policy: policy}
+		m.tuneAll()
+		return m
+	}
+}
+
+type utf8Check struct {
+	policy  invalidUTF8Policy
+	pending string // first bytes of a rune split across chunks
+	at      int64  // offset of pending in the stream received
+}
+
+// checkUTF8 applies the policy of WithInvalidUTF8 to s. It returns
+// the part of s to be matched, and for INVALID_UTF8_ERROR the part
+// from the first invalid byte on along with the error.
+func (m *matcher) checkUTF8(s string) (string, string, error) {
+	c := m.utf8
+	if c == nil || (c.policy != INVALID_UTF8_SKIP && c.policy != INVALID_UTF8_ERROR) {
+		return s, "", nil
+	}
+	s, c.pending = c.pending+s, ""
+	var b strings.Builder
+	kept := 0 // bytes of s before i in b already, for INVALID_UTF8_SKIP
+	for i := 0; i < len(s); {
+		if s[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, width := utf8.DecodeRuneInString(s[i:])
+		if r != utf8.RuneError || width > 1 {
+			i += width
+			continue
+		}
+		if !utf8.FullRuneInString(s[i:]) {
+			c.pending = s[i:]
+			s = s[:i]
+			break
+		}
+		if c.policy == INVALID_UTF8_ERROR {
+			err := fmt.Errorf("%w: byte 0x%02x at offset %d", ErrInvalidUTF8, s[i], c.at+int64(i))
+			c.at += int64(len(s))
+			return s[:i], s[i:], err
+		}
+		b.WriteString(s[kept:i])
+		i++
+		kept = i
+	}
+	c.at += int64(len(s))
+	if kept == 0 {
+		return s, "", nil
+	}
+	b.WriteString(s[kept:])
+	return b.String(), "", nil
+}
+
+// endUTF8 tells the policy of WithInvalidUTF8 that the stream is
+// over, the first bytes of a rune left waiting are invalid.
+func (m *matcher) endUTF8() {
+	c := m.utf8
+	if c == nil || c.pending == "" {
+		return
+	}
+	if c.policy == INVALID_UTF8_ERROR {
+		if m.err == nil {
+			m.fail(fmt.Errorf("%w: truncated rune at offset %d", ErrInvalidUTF8, c.at))
+		}
+		m.buffer.WriteString(c.pending)
+	}
+	c.at += int64(len(c.pending))
+	c.pending = ""
+}
+
+// drainUTF8 returns the first bytes of a rune left waiting, and
+// starts the stream afresh.
+func (m *matcher) drainUTF8() string {
+	c := m.utf8
+	if c == nil {
+		return ""
+	}
+	pending := c.pending
+	c.pending, c.at = "", 0
+	return pending
+}
@@ -0,0 +1,12 @@
+package los
+
+// WithOnHead calls fn with every HEAD Result, the value returned is
+// attached to the block and told by Result.Value of its HEAD, BODY
+// and TAIL Results, e.g. a request ID or a parsed header, so that
+// the Results need no correlation map on the side.
+func WithOnHead(fn func(Result) any) matcherOption {
+	return func(m *matcher) *matcher {
+		m.onHead = fn
+		return m
+	}
+}
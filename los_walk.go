@@ -0,0 +1,159 @@
+package los
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// walkChunk is the size of the reads of Walk and FindFirst.
+const walkChunk = 32 << 10
+
+// ErrNoBlock is returned by FindFirst for a reader without a whole
+// block.
+var ErrNoBlock = errors.New("no block found")
+
+// Walk extracts the blocks of pair from the files of fsys matching
+// glob, see fs.Glob. The files are scanned on up to GOMAXPROCS
+// goroutines, fn is called with the blocks of a file in order, and
+// may be called concurrently for distinct files. A Block holds the
+// whole block, head and tail included, in STATE_BODY, a block left
+// open at the end of a file is not passed to fn. The first error of
+// fn or of reading a file stops the walk and is returned.
+func Walk(fsys fs.FS, glob string, pair *Pair, fn func(path string, b Block) error) error {
+	paths, err := fs.Glob(fsys, glob)
+	if err != nil {
+		return err
+	}
+
+	var (
+		next     atomic.Int64
+		stopped  atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	workers := min(runtime.GOMAXPROCS(0), len(paths))
+	wg.Add(workers)
+	for range workers {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, walkChunk)
+			for !stopped.Load() {
+				i := int(next.Add(1)) - 1
+				if i >= len(paths) {
+					return
+				}
+				if err := walkFile(fsys, paths[i], pair, buf, &stopped, fn); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					stopped.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// walkFile passes the blocks of the file at path to fn, it stops
+// early once stopped is set. Directories are skipped.
+func walkFile(fsys fs.FS, path string, pair *Pair, buf []byte, stopped *atomic.Bool,
+	fn func(path string, b Block) error) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.IsDir() {
+		return nil
+	}
+
+	m := NewMatcher(pair)
+	defer m.Close() // nolint: errcheck
+	var block []byte
+	for !stopped.Load() {
+		n, err := f.Read(buf)
+		for result := range m.Match(string(buf[:n])) {
+			if result.State() == STATE_NONE {
+				continue
+			}
+			if result.State() == STATE_HEAD {
+				block = block[:0]
+			}
+			block = append(block, result.Raw()...)
+			if result.State() == STATE_TAIL {
+				if err := fn(path, walkBlock{textResult{STATE_BODY, block}}); err != nil {
+					return err
+				}
+				block = nil // handed over to fn
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m.Drain()
+	return m.Err()
+}
+
+// FindFirst returns the first block of pair read from r, e.g. the
+// first code fence of a response, as Walk does it holds the whole
+// block in STATE_BODY. The reading stops as soon as the tail is
+// matched, the bytes of r after the block may be read already. A
+// reader over before a whole block is ErrNoBlock.
+func FindFirst(r io.Reader, pair *Pair) (Block, error) {
+	m := NewMatcher(pair)
+	defer m.Close() // nolint: errcheck
+	buf := make([]byte, walkChunk)
+	var block []byte
+	for {
+		n, err := r.Read(buf)
+		for result := range m.Match(string(buf[:n])) {
+			switch result.State() {
+			case STATE_NONE:
+				continue
+			case STATE_HEAD:
+				block = block[:0]
+			}
+			block = append(block, result.Raw()...)
+			if result.State() == STATE_TAIL {
+				return walkBlock{textResult{STATE_BODY, block}}, nil
+			}
+		}
+		if merr := m.Err(); merr != nil {
+			return nil, merr
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNoBlock
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// walkBlock is a whole block extracted by Walk or FindFirst.
+type walkBlock struct {
+	textResult
+}
+
+var _ Block = walkBlock{}
+
+// Sum returns nil, the body is not hashed by Walk.
+func (walkBlock) Sum() []byte {
+	return nil
+}
+
+// Duration returns 0, a block is read at once by Walk.
+func (walkBlock) Duration() time.Duration {
+	return 0
+}
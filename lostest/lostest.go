@@ -0,0 +1,169 @@
+// Package lostest provides helpers to test the pairs of los against
+// the regexp package of the standard library, and to hold matching
+// to an allocation budget.
+package lostest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/humbornjo/los"
+)
+
+// chunkings is the number of random chunkings tried per input, along
+// with the chunkings into pieces of 1 to 8 bytes.
+const chunkings = 32
+
+// Block is a block found in a stream, along with the STATE_NONE
+// content right before it.
+type Block struct {
+	None, Head, Body, Tail string
+}
+
+// Differential matches each input of corpus with pair under many
+// chunkings, randomized but reproducible, and compares the blocks
+// with the ones found by the regexp package over the whole input. It
+// returns an error telling the first chunking that differs.
+//
+// The pair is taken as its head, tail and regex modes, the options
+// changing how a delimiter is matched, e.g. los.WithEscape, are not
+// known to the regexp package, nor are the empty-width assertions of
+// a delimiter seeing the bytes before it. The content after the last block is
+// only checked to add up to the input along with Drain.
+func Differential(pair *los.Pair, corpus []string) error {
+	head, tail, err := compile(pair)
+	if err != nil {
+		return err
+	}
+	for i, input := range corpus {
+		want := Reference(head, tail, input)
+		rng := rand.New(rand.NewPCG(uint64(i), uint64(len(input))))
+		for n := range 8 + chunkings {
+			size := n + 1
+			if n >= 8 {
+				size = 0
+			}
+			chunks := chunk(input, size, rng)
+			got, err := Stream(pair, chunks)
+			if err != nil {
+				return fmt.Errorf("input %d, chunks %q: %w", i, chunks, err)
+			}
+			if !slices.Equal(got, want) {
+				return fmt.Errorf("input %d, chunks %q: got blocks %q, want %q", i, chunks, got, want)
+			}
+		}
+	}
+	return nil
+}
+
+// compile turns the delimiters of pair into the regexps matching
+// them.
+func compile(pair *los.Pair) (head, tail *regexp.Regexp, err error) {
+	headMode, tailMode := pair.Modes()
+	sources := [2]string{pair.Head(), pair.Tail()}
+	var res [2]*regexp.Regexp
+	for i, mode := range []any{headMode, tailMode} {
+		switch mode {
+		case los.REGEX_MODE_PERL:
+			res[i], err = regexp.Compile(sources[i])
+		case los.REGEX_MODE_POSIX:
+			res[i], err = regexp.CompilePOSIX(sources[i])
+		default:
+			res[i], err = regexp.Compile(regexp.QuoteMeta(sources[i]))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return res[0], res[1], nil
+}
+
+// Reference finds the blocks of input with the regexps of the head
+// and tail, a delimiter matching empty is stepped over by one byte
+// as with los.EMPTY_MATCH_SKIP.
+func Reference(head, tail *regexp.Regexp, input string) []Block {
+	var blocks []Block
+	var block Block
+	within := false
+	for pos := 0; pos < len(input); {
+		re, content := head, &block.None
+		if within {
+			re, content = tail, &block.Body
+		}
+		loc := re.FindStringIndex(input[pos:])
+		if loc == nil || pos+loc[0] == len(input) {
+			break
+		}
+		start, end := pos+loc[0], pos+loc[1]
+		if start == end {
+			*content += input[pos : start+1]
+			pos = start + 1
+			continue
+		}
+		*content += input[pos:start]
+		if within {
+			block.Tail = input[start:end]
+			blocks, block = append(blocks, block), Block{}
+		} else {
+			block.Head = input[start:end]
+		}
+		within, pos = !within, end
+	}
+	return blocks
+}
+
+// Stream matches the chunks with a new matcher of pair and flushes
+// it, it returns the blocks found and an error if the Results along with Drain do
+// not add up to the chunks.
+func Stream(pair *los.Pair, chunks []string) ([]Block, error) {
+	m := los.NewMatcher(pair)
+	defer m.Close() // nolint: errcheck
+
+	var blocks []Block
+	var block Block
+	var all strings.Builder
+	collect := func(results los.Results) {
+		for result := range results {
+			all.WriteString(result.String())
+			switch result.State() {
+			case los.STATE_NONE:
+				block.None += result.String()
+			case los.STATE_HEAD:
+				block.Head += result.String()
+			case los.STATE_BODY:
+				block.Body += result.String()
+			case los.STATE_TAIL:
+				block.Tail += result.String()
+				blocks, block = append(blocks, block), Block{}
+			}
+		}
+	}
+	for _, chunk := range chunks {
+		collect(m.Match(chunk))
+	}
+	// The matches held back for more input are settled at the end
+	collect(m.Flush())
+	all.WriteString(m.Drain())
+	if input := strings.Join(chunks, ""); all.String() != input {
+		return blocks, fmt.Errorf("content %q does not add up to the input %q", all.String(), input)
+	}
+	return blocks, m.Err()
+}
+
+// chunk cuts input into pieces of size bytes, or of random sizes up
+// to 16 bytes for a zero size.
+func chunk(input string, size int, rng *rand.Rand) []string {
+	var chunks []string
+	for len(input) > 0 {
+		n := size
+		if size == 0 {
+			n = 1 + rng.IntN(16)
+		}
+		n = min(n, len(input))
+		chunks, input = append(chunks, input[:n]), input[n:]
+	}
+	return chunks
+}
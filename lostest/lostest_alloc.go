@@ -0,0 +1,40 @@
+package lostest
+
+import (
+	"testing"
+
+	"github.com/humbornjo/los"
+)
+
+// allocRuns is the number of runs averaged by AssertMaxAllocs.
+const allocRuns = 100
+
+// AssertMaxAllocs fails t unless fn allocates at most n times per
+// call on average, as measured by testing.AllocsPerRun, so that the
+// allocation budget of a hot path is held by its tests. It reports
+// whether the budget is held.
+func AssertMaxAllocs(t testing.TB, fn func(), n float64) bool {
+	t.Helper()
+	if got := testing.AllocsPerRun(allocRuns, fn); got > n {
+		t.Errorf("%v allocations per call, budget %v", got, n)
+		return false
+	}
+	return true
+}
+
+// AssertMatchAllocs is AssertMaxAllocs for matching chunk with m and
+// iterating over its Results, chunk being matched once per run in the
+// same stream. The Results are released, see los.Release, and the
+// stream is left to the caller to Drain.
+func AssertMatchAllocs(t testing.TB, m los.Matcher, chunk string, n float64) bool {
+	t.Helper()
+	return AssertMaxAllocs(t, func() {
+		m.Match(chunk)(discard)
+	}, n)
+}
+
+// discard releases the Results without keeping them.
+func discard(result los.Result) bool {
+	los.Release(result)
+	return true
+}
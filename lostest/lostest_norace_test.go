@@ -0,0 +1,5 @@
+//go:build !race
+
+package lostest
+
+const raceEnabled = false
@@ -0,0 +1,127 @@
+package lostest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/humbornjo/los"
+)
+
+// Check matches the chunks with pair and returns an error if the
+// blocks differ from the ones of Reference, or if matching panics.
+func Check(pair *los.Pair, chunks []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	head, tail, err := compile(pair)
+	if err != nil {
+		return err
+	}
+	want := Reference(head, tail, strings.Join(chunks, ""))
+	got, err := Stream(pair, chunks)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("got blocks %q, want %q", got, want)
+	}
+	return nil
+}
+
+// Shrink reduces a case failing Check to a minimal one still failing
+// it, so that it makes a readable reproducer. It drops and merges
+// chunks, drops bytes of the input and of the delimiters, until none
+// of these steps keeps the case failing.
+func Shrink(pair *los.Pair, chunks []string) (*los.Pair, []string) {
+	if Check(pair, chunks) == nil {
+		return pair, chunks
+	}
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for _, step := range []func(*los.Pair, []string) (*los.Pair, []string, bool){
+			dropChunk, mergeChunks, dropByte, shortenDelimiter,
+		} {
+			if p, c, ok := step(pair, chunks); ok {
+				pair, chunks, shrunk = p, c, true
+			}
+		}
+	}
+	return pair, chunks
+}
+
+// dropChunk removes the first chunk whose removal keeps the case
+// failing.
+func dropChunk(pair *los.Pair, chunks []string) (*los.Pair, []string, bool) {
+	for i := range chunks {
+		c := slices.Delete(slices.Clone(chunks), i, i+1)
+		if Check(pair, c) != nil {
+			return pair, c, true
+		}
+	}
+	return pair, chunks, false
+}
+
+// mergeChunks joins the first two adjacent chunks whose boundary is
+// not needed to fail.
+func mergeChunks(pair *los.Pair, chunks []string) (*los.Pair, []string, bool) {
+	for i := 1; i < len(chunks); i++ {
+		c := slices.Clone(chunks)
+		c[i-1] += c[i]
+		c = slices.Delete(c, i, i+1)
+		if Check(pair, c) != nil {
+			return pair, c, true
+		}
+	}
+	return pair, chunks, false
+}
+
+// dropByte removes the first byte of the input not needed to fail,
+// a chunk left empty is removed.
+func dropByte(pair *los.Pair, chunks []string) (*los.Pair, []string, bool) {
+	for i, chunk := range chunks {
+		for j := range len(chunk) {
+			c := slices.Clone(chunks)
+			c[i] = chunk[:j] + chunk[j+1:]
+			if c[i] == "" {
+				c = slices.Delete(c, i, i+1)
+			}
+			if Check(pair, c) != nil {
+				return pair, c, true
+			}
+		}
+	}
+	return pair, chunks, false
+}
+
+// shortenDelimiter removes the first byte of the head or tail not
+// needed to fail, the delimiters are kept non-empty and valid for
+// both los and the regexp package.
+func shortenDelimiter(pair *los.Pair, chunks []string) (*los.Pair, []string, bool) {
+	headMode, tailMode := pair.Modes()
+	head, tail := pair.Head(), pair.Tail()
+	try := func(h, t string) (*los.Pair, bool) {
+		if h == "" || t == "" ||
+			los.ValidatePair(h, t, los.WithRegexHead(headMode), los.WithRegexTail(tailMode)) != nil {
+			return nil, false
+		}
+		p := pair.Builder().Head(h, headMode).Tail(t, tailMode).Build()
+		if _, _, err := compile(p); err != nil {
+			return nil, false
+		}
+		return p, Check(p, chunks) != nil
+	}
+	for j := range len(head) {
+		if p, ok := try(head[:j]+head[j+1:], tail); ok {
+			return p, chunks, true
+		}
+	}
+	for j := range len(tail) {
+		if p, ok := try(head, tail[:j]+tail[j+1:]); ok {
+			return p, chunks, true
+		}
+	}
+	return pair, chunks, false
+}
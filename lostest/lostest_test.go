@@ -0,0 +1,139 @@
+package lostest
+
+import (
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/humbornjo/los"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDifferential(t *testing.T) {
+	corpus := []string{
+		"",
+		"no block at all",
+		"a<think>b</think>c<think>d</think>",
+		"<think><think></think></think>",
+		"<thi<think>nk></thin</think>k>",
+		"a<think>unterminated",
+		strings.Repeat("x<think>yy</think>", 20),
+	}
+	for _, pair := range []*los.Pair{
+		los.NewPair("<think>", "</think>"),
+		los.NewPair("<t\\w*>", "</t\\w*>", los.WithRegexHead(los.REGEX_MODE_PERL), los.WithRegexTail(los.REGEX_MODE_PERL)),
+		los.NewPair("<(think|thin)>", "</think>", los.WithRegexHead(los.REGEX_MODE_POSIX)),
+		los.NewPair("\\w+>", "</", los.WithRegexHead(los.REGEX_MODE_PERL)),
+		los.NewPair("<(t|th|thi)", "(k|nk)>", los.WithRegexHead(los.REGEX_MODE_POSIX), los.WithRegexTail(los.REGEX_MODE_POSIX)),
+		los.NewPair("<t[a-z]*>", "</t[a-z]*>", los.WithRegexHead(los.REGEX_MODE_POSIX), los.WithRegexTail(los.REGEX_MODE_POSIX)),
+		los.NewPair("t", "nk|k+>", los.WithRegexTail(los.REGEX_MODE_POSIX)),
+	} {
+		require.NoError(t, Differential(pair, corpus), pair.Head())
+	}
+}
+
+func TestDifferential_Mismatch(t *testing.T) {
+	// The escape is unknown to the regexp package
+	pair := los.NewPair("\"", "\"", los.WithEscape('\\'))
+	err := Differential(pair, []string{`a"b\"c"d"`})
+	require.ErrorContains(t, err, "input 0, chunks")
+
+	// The empty-width assertions do not see the bytes before the
+	// position a match is tried from
+	for _, pair := range []*los.Pair{
+		los.NewPair("h", "\\Bb", los.WithRegexTail(los.REGEX_MODE_PERL)),
+		los.NewPair("(?m)^<", ">", los.WithRegexHead(los.REGEX_MODE_PERL)),
+	} {
+		require.Error(t, Differential(pair, []string{"hcbx", "a<b>\n<c>"}), pair.Head())
+	}
+}
+
+func TestCheck_Priority(t *testing.T) {
+	// The threads of higher priority win over a match reached first,
+	// e.g. "<kkk" over "<", however the input is cut into chunks
+	for head, input := range map[string]string{
+		"<k*":            "x<kkk>y</z",
+		"<(a|ab)(c|bcd)": "<abcd</",
+	} {
+		pair := los.NewPair(head, "</", los.WithRegexHead(los.REGEX_MODE_PERL))
+		require.NoError(t, Check(pair, []string{input}), head)
+		require.NoError(t, Differential(pair, []string{input, input + input}), head)
+	}
+	pair := los.NewPair("<k*", "</", los.WithRegexHead(los.REGEX_MODE_PERL))
+	require.NoError(t, Check(pair, []string{"x<k", "kk>y</z"}))
+	// A match is held up to the end of the stream
+	require.NoError(t, Check(pair, []string{"x<k", "k>y</z<k", "k"}))
+
+	// In POSIX mode a longer match may start after the one held, the
+	// bytes of the latter are not released meanwhile
+	pair = los.NewPair("h", "ab|b+", los.WithRegexTail(los.REGEX_MODE_POSIX))
+	require.NoError(t, Check(pair, []string{"habbbx"}))
+	require.NoError(t, Check(pair, []string{"h", "a", "b", "b", "b", "x"}))
+	require.NoError(t, Differential(pair, []string{"habbbx", "habbbxhbbabh"}))
+}
+
+func TestShrink(t *testing.T) {
+	// The escape makes the case fail Check, whatever the chunking
+	pair := los.NewPair("<<q>>", "<</q>>", los.WithEscape('\\'))
+	chunks := []string{"ab<<q", ">>x\\<</q>>y", "<</q>>", "cd"}
+	require.Error(t, Check(pair, chunks))
+
+	pair, chunks = Shrink(pair, chunks)
+	require.Error(t, Check(pair, chunks))
+	require.Equal(t, []string{">\\<"}, chunks)
+	require.Equal(t, ">", pair.Head())
+	require.Equal(t, "<", pair.Tail())
+}
+
+func FuzzDifferential(f *testing.F) {
+	f.Add("<think>", "</think>", "a<think>b</think>c", uint64(0))
+	f.Add("ab", "aab", "aaabaab", uint64(1))
+	f.Add("```", "```", "x```go\ny```z", uint64(2))
+	f.Fuzz(func(t *testing.T, head, tail, input string, seed uint64) {
+		// The regexp package rejects invalid UTF-8 in a pattern
+		if head == "" || tail == "" || !utf8.ValidString(head) || !utf8.ValidString(tail) {
+			t.Skip()
+		}
+		pair := los.NewPair(head, tail)
+		chunks := chunk(input, 0, rand.New(rand.NewPCG(seed, 0)))
+		if err := Check(pair, chunks); err != nil {
+			pair, chunks = Shrink(pair, chunks)
+			t.Fatalf("head %q, tail %q, chunks %q: %v", pair.Head(), pair.Tail(), chunks, Check(pair, chunks))
+		}
+	})
+}
+
+// budgetTB records the failures of an allocation budget.
+type budgetTB struct {
+	testing.TB
+	failed bool
+}
+
+func (t *budgetTB) Errorf(string, ...any) {
+	t.failed = true
+}
+
+func TestAssertMatchAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates on its own")
+	}
+	m := los.NewMatcher(los.NewPair("<x>", "</x>"))
+	defer m.Close() // nolint: errcheck
+
+	// The Results of a literal pair are allocated in slabs, only the
+	// sequence takes an allocation per Match
+	require.True(t, AssertMatchAllocs(t, m, "aaa<x>bbbb</x>cc", 1))
+	require.True(t, AssertMatchAllocs(t, m, "aaaaa", 1))
+
+	// The pooled ones take none
+	pooled := los.NewMatcher(los.NewPair("<x>", "</x>"), los.WithPooledResults())
+	defer pooled.Close() // nolint: errcheck
+	require.True(t, AssertMatchAllocs(t, pooled, "aaa<x>bbbb</x>cc", 0))
+
+	over := &budgetTB{TB: t}
+	require.False(t, AssertMatchAllocs(over, m, "aaaaa", 0))
+	require.True(t, over.failed)
+
+	require.True(t, AssertMaxAllocs(t, func() {}, 0))
+}
@@ -0,0 +1,170 @@
+// Package prom exposes the counters of los matchers and of the pools
+// of regex machines in the text format scraped by Prometheus. It
+// does not depend on the Prometheus client, a Collector is served as
+// is or its output forwarded to any registry.
+package prom
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/humbornjo/los"
+	"github.com/humbornjo/los/internal/legex"
+)
+
+var stateNames = [4]string{"none", "head", "body", "tail"}
+
+// Collector adds up the Results and Stats of the matchers it watches,
+// it is safe for concurrent use by the goroutines of the matchers and
+// of the scraper.
+type Collector struct {
+	namespace string
+
+	mu          sync.Mutex
+	results     [4]int64 // per state
+	bytes       [4]int64 // per state
+	steps       int64
+	allocs      int64
+	prefixSkips int64
+	buffered    map[los.Matcher]int
+}
+
+// NewCollector returns a Collector whose metrics are prefixed with
+// namespace, e.g. "los_results_total" for "los".
+func NewCollector(namespace string) *Collector {
+	return &Collector{namespace: namespace, buffered: map[los.Matcher]int{}}
+}
+
+// Match is m.Match counted by the collector, the Stats of m are taken
+// once the Results are iterated.
+func (c *Collector) Match(m los.Matcher, s string) los.Results {
+	return func(yield func(los.Result) bool) {
+		var results, bytes [4]int64
+		defer func() {
+			stats := m.Stats()
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for state := range results {
+				c.results[state] += results[state]
+				c.bytes[state] += bytes[state]
+			}
+			c.steps += int64(stats.Steps)
+			c.allocs += int64(stats.Allocs)
+			c.prefixSkips += int64(stats.PrefixSkips)
+			c.buffered[m] = stats.Buffered
+		}()
+		for result := range m.Match(s) {
+			results[result.State()]++
+			bytes[result.State()] += int64(len(result.Raw()))
+			if !yield(result) {
+				return
+			}
+		}
+	}
+}
+
+// Forget drops the bytes buffered by m from the gauge, it is to be
+// called as m is closed.
+func (c *Collector) Forget(m los.Matcher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.buffered, m)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	p := &printer{w: w, namespace: c.namespace}
+
+	c.mu.Lock()
+	results, bytes := c.results, c.bytes
+	steps, allocs, prefixSkips := c.steps, c.allocs, c.prefixSkips
+	buffered := 0
+	for _, n := range c.buffered {
+		buffered += n
+	}
+	c.mu.Unlock()
+
+	p.family("results_total", "counter", "Results emitted by state.")
+	for state, n := range results {
+		p.sample("results_total", `state="`+stateNames[state]+`"`, n)
+	}
+	p.family("result_bytes_total", "counter", "Bytes of the Results emitted by state.")
+	for state, n := range bytes {
+		p.sample("result_bytes_total", `state="`+stateNames[state]+`"`, n)
+	}
+	p.family("blocks_total", "counter", "Blocks matched.")
+	p.sample("blocks_total", "", results[los.STATE_TAIL])
+	p.family("buffered_bytes", "gauge", "Bytes held back by the matchers for a later Match.")
+	p.sample("buffered_bytes", "", int64(buffered))
+	p.family("regex_steps_total", "counter", "Runes stepped through by the regex threads.")
+	p.sample("regex_steps_total", "", steps)
+	p.family("regex_allocs_total", "counter", "Regex threads allocated.")
+	p.sample("regex_allocs_total", "", allocs)
+	p.family("regex_prefix_skip_bytes_total", "counter", "Bytes skipped by the literal prefix scan.")
+	p.sample("regex_prefix_skip_bytes_total", "", prefixSkips)
+
+	pools := legex.PoolStats()
+	p.family("machine_pool_hits_total", "counter", "Regex machines taken from the pool.")
+	for _, pool := range pools {
+		p.sample("machine_pool_hits_total", queueSize(pool), pool.Hits)
+	}
+	p.family("machine_pool_misses_total", "counter", "Regex machines allocated as the pool was empty.")
+	for _, pool := range pools {
+		p.sample("machine_pool_misses_total", queueSize(pool), pool.Misses)
+	}
+	p.family("machines_in_use", "gauge", "Regex machines taken and not put back.")
+	for _, pool := range pools {
+		p.sample("machines_in_use", queueSize(pool), pool.InUse)
+	}
+	p.family("machines_retained", "gauge", "Regex machines put back for reuse.")
+	for _, pool := range pools {
+		p.sample("machines_retained", queueSize(pool), pool.Retained)
+	}
+	p.family("machines_retained_bytes", "gauge", "Footprint of the regex machines retained.")
+	for _, pool := range pools {
+		p.sample("machines_retained_bytes", queueSize(pool), pool.RetainedBytes)
+	}
+	return p.n, p.err
+}
+
+// ServeHTTP serves the metrics to a scraper.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w) // nolint: errcheck
+}
+
+// queueSize labels the pool of pool, "0" being the pool of large
+// programs.
+func queueSize(pool legex.PoolStat) string {
+	return fmt.Sprintf(`queue_size="%d"`, pool.QueueSize)
+}
+
+// printer writes the lines of the text format, it stops at the first
+// error.
+type printer struct {
+	w         io.Writer
+	namespace string
+	n         int64
+	err       error
+}
+
+func (p *printer) family(name, kind, help string) {
+	p.printf("# HELP %s_%s %s\n# TYPE %s_%s %s\n", p.namespace, name, help, p.namespace, name, kind)
+}
+
+func (p *printer) sample(name, labels string, value int64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	p.printf("%s_%s%s %d\n", p.namespace, name, labels, value)
+}
+
+func (p *printer) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n, p.err = p.n+int64(n), err
+}
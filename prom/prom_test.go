@@ -0,0 +1,42 @@
+package prom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/humbornjo/los"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("los")
+	m := los.NewMatcher(los.NewPair("<", "</\\w+>", los.WithRegexTail(los.REGEX_MODE_PERL)))
+	for range c.Match(m, "a<b</x>c<d</") {
+	}
+
+	var sb strings.Builder
+	_, err := c.WriteTo(&sb)
+	require.NoError(t, err)
+	out := sb.String()
+	for _, line := range []string{
+		"# TYPE los_results_total counter",
+		`los_results_total{state="none"} 2`,
+		`los_results_total{state="head"} 2`,
+		`los_results_total{state="body"} 2`,
+		`los_results_total{state="tail"} 1`,
+		`los_result_bytes_total{state="tail"} 4`,
+		"los_blocks_total 1",
+		"los_buffered_bytes 2",
+		`los_machines_in_use{queue_size="128"} 1`,
+	} {
+		require.Contains(t, out, line+"\n")
+	}
+	require.Regexp(t, `los_regex_steps_total [1-9]`, out)
+	require.Regexp(t, `los_machine_pool_(hits|misses)_total\{queue_size="128"\} 1`, out)
+
+	require.Error(t, m.Close())
+	c.Forget(m)
+	sb.Reset()
+	c.WriteTo(&sb) // nolint: errcheck
+	require.Contains(t, sb.String(), "los_buffered_bytes 0\n")
+}
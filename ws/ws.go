@@ -0,0 +1,79 @@
+// Package ws runs a los.Matcher over the text messages of a
+// WebSocket, whose fragments rarely end where the delimiters do.
+// It is fed with the frames decoded by any WebSocket library.
+package ws
+
+import (
+	"errors"
+
+	"github.com/humbornjo/los"
+)
+
+var (
+	ErrUnexpectedContinuation = errors.New("continuation frame out of a message")
+	ErrUnfinishedMessage      = errors.New("data frame within a fragmented message")
+)
+
+// Opcode is the opcode of a frame, as defined by RFC 6455.
+type Opcode byte
+
+const (
+	OP_CONTINUATION Opcode = 0x0
+	OP_TEXT         Opcode = 0x1
+	OP_BINARY       Opcode = 0x2
+	OP_CLOSE        Opcode = 0x8
+	OP_PING         Opcode = 0x9
+	OP_PONG         Opcode = 0xA
+)
+
+// Frame is a decoded frame, Payload is unmasked already.
+type Frame struct {
+	Fin     bool
+	Opcode  Opcode
+	Payload []byte
+}
+
+// Reassembler feeds the fragments of the text messages to a matcher
+// as they come, so that a block may span fragments and messages
+// alike. Binary messages and control frames are skipped, the latter
+// may be interleaved with the fragments of a message.
+type Reassembler struct {
+	m los.Matcher
+
+	// within tells whether a fragmented message is pending, binary
+	// skips its continuations.
+	within bool
+	binary bool
+}
+
+func NewReassembler(m los.Matcher) *Reassembler {
+	return &Reassembler{m: m}
+}
+
+// Feed matches the payload of a frame, the Results are only valid
+// until the next Feed. It fails on a frame breaking the order of the
+// fragments, in which case nothing is matched.
+func (r *Reassembler) Feed(f Frame) (los.Results, error) {
+	switch {
+	case f.Opcode >= OP_CLOSE:
+		return none, nil
+	case f.Opcode == OP_CONTINUATION && !r.within:
+		return none, ErrUnexpectedContinuation
+	case f.Opcode != OP_CONTINUATION && r.within:
+		return none, ErrUnfinishedMessage
+	case f.Opcode != OP_CONTINUATION:
+		r.binary = f.Opcode != OP_TEXT
+	}
+	r.within = !f.Fin
+	if r.binary {
+		return none, nil
+	}
+	return r.m.Match(string(f.Payload)), nil
+}
+
+// Within reports whether the last message received is unfinished.
+func (r *Reassembler) Within() bool {
+	return r.within
+}
+
+func none(func(los.Result) bool) {}
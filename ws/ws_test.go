@@ -0,0 +1,47 @@
+package ws
+
+import (
+	"testing"
+
+	"github.com/humbornjo/los"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassembler(t *testing.T) {
+	m := los.NewMatcher(los.NewPair("<think>", "</think>"))
+	r := NewReassembler(m)
+
+	frames := []Frame{
+		{Opcode: OP_TEXT, Payload: []byte("a<thi")},
+		{Opcode: OP_PING, Fin: true, Payload: []byte("ping")},
+		{Opcode: OP_CONTINUATION, Payload: []byte("nk>b</th")},
+		{Opcode: OP_CONTINUATION, Fin: true, Payload: []byte("ink")},
+		{Opcode: OP_BINARY, Payload: []byte("<think>")},
+		{Opcode: OP_CONTINUATION, Fin: true, Payload: []byte("</think>")},
+		{Opcode: OP_TEXT, Fin: true, Payload: []byte(">c")},
+	}
+	var body, rest string
+	for _, f := range frames {
+		results, err := r.Feed(f)
+		require.NoError(t, err)
+		for result := range results {
+			switch result.State() {
+			case los.STATE_BODY:
+				body += result.String()
+			case los.STATE_NONE:
+				rest += result.String()
+			}
+		}
+	}
+	require.Equal(t, "b", body)
+	require.Equal(t, "ac", rest)
+	require.False(t, r.Within())
+
+	_, err := r.Feed(Frame{Opcode: OP_CONTINUATION, Fin: true})
+	require.ErrorIs(t, err, ErrUnexpectedContinuation)
+	_, err = r.Feed(Frame{Opcode: OP_TEXT, Payload: []byte("x")})
+	require.NoError(t, err)
+	_, err = r.Feed(Frame{Opcode: OP_TEXT, Fin: true})
+	require.ErrorIs(t, err, ErrUnfinishedMessage)
+	require.True(t, r.Within())
+}